@@ -1,18 +1,34 @@
 package main
 
 import (
+	"flag"
 	"log"
+	"os"
 
 	apiengine "github.com/newodahs/accessapi/internal/engine"
+	"github.com/newodahs/readerlambda/pkg/config"
 )
 
 func main() {
-	apiEng := apiengine.NewAPIEngine("", "", true)
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	localDynamo := flags.Bool(`localdb`, true, `Use the local dynamodb instance (-localdb=false for the configured/AWS one)`)
+	cfgFlags := config.AddFlags(flags)
+	flags.Parse(os.Args[1:])
+
+	cfg, cfgErr := cfgFlags.Load()
+	if cfgErr != nil {
+		log.Fatalf("bad configuration: %s", cfgErr)
+	}
+	if *localDynamo {
+		cfg.UseLocalDynamoDB()
+	}
+
+	apiEng := apiengine.NewAPIEngine(cfg)
 	if apiEng == nil {
 		log.Fatal("could not create api engine")
 	}
 
-	if err := apiEng.Run("0.0.0.0", 8080); err != nil {
+	if err := apiEng.Run(cfg.BindAddr); err != nil {
 		log.Fatalf("error while running api engine %s", err)
 	}
 }
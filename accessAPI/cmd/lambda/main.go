@@ -10,6 +10,7 @@ import (
 	ginadapter "github.com/awslabs/aws-lambda-go-api-proxy/gin"
 	"github.com/gin-gonic/gin"
 	apiengine "github.com/newodahs/accessapi/internal/engine"
+	"github.com/newodahs/readerlambda/pkg/config"
 )
 
 var (
@@ -26,7 +27,11 @@ var (
 func Handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	initSetup.Do(func() {
 		gin.SetMode(gin.ReleaseMode)
-		apiEng = apiengine.NewAPIEngine("", "", false)
+		cfg, cfgErr := config.FromEnv()
+		if cfgErr != nil {
+			log.Fatalf("bad configuration: %s", cfgErr)
+		}
+		apiEng = apiengine.NewAPIEngine(cfg)
 		if apiEng == nil {
 			log.Fatal("could not create api engine")
 		}
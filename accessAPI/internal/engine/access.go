@@ -0,0 +1,127 @@
+package apiengine
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/credstore"
+)
+
+// only the hashes are kept around; compared in constant time
+func hashTokens(tokens []string) [][sha256.Size]byte {
+	ret := make([][sha256.Size]byte, 0, len(tokens))
+	for _, token := range tokens {
+		ret = append(ret, sha256.Sum256([]byte(token)))
+	}
+	return ret
+}
+
+// a tenant token's hash and whose it is
+type tenantToken struct {
+	sum    [sha256.Size]byte
+	tenant string
+}
+
+// token => tenant, hashed the same way
+func hashTenantTokens(tokens map[string]string) []tenantToken {
+	ret := make([]tenantToken, 0, len(tokens))
+	for token, tenant := range tokens {
+		ret = append(ret, tenantToken{sum: sha256.Sum256([]byte(token)), tenant: tenant})
+	}
+	return ret
+}
+
+// the presented bearer token; empty if there isn't one
+func bearerToken(c *gin.Context) string {
+	token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !found {
+		return ""
+	}
+	return token
+}
+
+// whether the caller presented one of the admin tokens (Authorization: Bearer <token>)
+func (ae *APIEngine) isPrivileged(c *gin.Context) bool {
+	token := bearerToken(c)
+	if token == "" || len(ae.adminTokens) == 0 {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	match := 0
+	for _, admin := range ae.adminTokens { // no early out; every token is checked
+		match |= subtle.ConstantTimeCompare(sum[:], admin[:])
+	}
+	return match == 1
+}
+
+// the tenant whose token the caller presented; empty if it isn't a tenant token
+func (ae *APIEngine) callerTenant(c *gin.Context) string {
+	token := bearerToken(c)
+	if token == "" || len(ae.tenantTokens) == 0 {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	tenant := ""
+	for _, known := range ae.tenantTokens { // no early out here either
+		if subtle.ConstantTimeCompare(sum[:], known.sum[:]) == 1 {
+			tenant = known.tenant
+		}
+	}
+	return tenant
+}
+
+// gin middleware for routes tenants may use for themselves (admin callers act for any tenant)
+func (ae *APIEngine) requireTenant(c *gin.Context) {
+	if !ae.isPrivileged(c) && ae.callerTenant(c) == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "tenant or admin token required"})
+		return
+	}
+	c.Next()
+}
+
+// gin middleware for routes only admin callers may use
+func (ae *APIEngine) requireAdmin(c *gin.Context) {
+	if !ae.isPrivileged(c) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "admin token required"})
+		return
+	}
+	c.Next()
+}
+
+// gets creds ready to hand back: credentials stored under hashed keys get their identity back (for every
+// caller), encrypted passwords are decrypted for privileged callers and masked for everyone else (Encrypted
+// is set on those). returns how many couldn't be decrypted (they're masked too)
+func (ae *APIEngine) revealCredentials(c *gin.Context, creds []*credparser.CredentialInfo) int {
+	privileged := ae.isPrivileged(c)
+	if privileged && ae.Cipher == nil {
+		log.Printf("WARNING: privileged read but no key provider configured; encrypted passwords stay masked")
+	}
+
+	failed := 0
+	for _, cred := range creds {
+		if err := credstore.OpenIdentity(c.Request.Context(), ae.Cipher, cred); err != nil {
+			log.Printf("failed to decrypt credential identity [%s@%s]: %s", cred.User, cred.Domain, err)
+			failed++
+		}
+		if cred.Sealed == nil {
+			continue
+		}
+		if privileged && ae.Cipher != nil {
+			if err := credstore.OpenCredential(c.Request.Context(), ae.Cipher, cred); err == nil {
+				continue
+			} else {
+				log.Printf("failed to decrypt credential [%s]: %s", cred.Email, err)
+				failed++
+			}
+		}
+		cred.Redact()
+	}
+	return failed
+}
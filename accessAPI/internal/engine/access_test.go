@@ -0,0 +1,36 @@
+package apiengine
+
+import (
+	"net/http"
+	"testing"
+)
+
+// admin routes take only an admin token; the tenant watch routes take a tenant's token or an admin one
+func Test_Access_Gates(t *testing.T) {
+	ae, _ := newTestEngine(t)
+
+	testSet := []struct {
+		Name   string
+		Path   string
+		Token  string
+		Expect int
+	}{
+		{Name: "Admin No Token", Path: "/v1/admin/watchlist", Expect: http.StatusUnauthorized},
+		{Name: "Admin Unknown Token", Path: "/v1/admin/watchlist", Token: "nobody-0123456789abcdef", Expect: http.StatusUnauthorized},
+		{Name: "Admin Tenant Token", Path: "/v1/admin/watchlist", Token: testAcmeToken, Expect: http.StatusUnauthorized},
+		{Name: "Admin Admin Token", Path: "/v1/admin/watchlist", Token: testAdminToken, Expect: http.StatusOK},
+		{Name: "Admin Export Tenant Token", Path: "/v1/admin/credentials/someone@acme.com", Token: testAcmeToken, Expect: http.StatusUnauthorized},
+		{Name: "Tenant No Token", Path: "/v1/watchlist", Expect: http.StatusUnauthorized},
+		{Name: "Tenant Unknown Token", Path: "/v1/watchlist", Token: "nobody-0123456789abcdef", Expect: http.StatusUnauthorized},
+		{Name: "Tenant Tenant Token", Path: "/v1/watchlist", Token: testAcmeToken, Expect: http.StatusOK},
+		{Name: "Tenant Admin Token", Path: "/v1/watchlist", Token: testAdminToken, Expect: http.StatusOK},
+	}
+
+	for _, test := range testSet {
+		t.Run(test.Name, func(t *testing.T) {
+			if code := ae.serve(t, http.MethodGet, test.Path, test.Token, nil, nil); code != test.Expect {
+				t.Errorf("expected %d, got %d", test.Expect, code)
+			}
+		})
+	}
+}
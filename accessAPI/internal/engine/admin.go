@@ -0,0 +1,117 @@
+package apiengine
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/credstore"
+	"github.com/newodahs/readerlambda/pkg/jobs"
+	"github.com/newodahs/readerlambda/pkg/sources"
+)
+
+// right-to-erasure: removes everything stored about the address (its credential, source links, watches on it
+// and its canary record) and records a tombstone so ingests don't store it again; optional ?reference= (e.g. a
+// ticket number) is kept on the tombstone. erasing an address we don't have still records the tombstone. the
+// rejects files in S3 are out of reach here; `credreader erase` scrubs those. without a lookup key there's no
+// tombstone (the rest is still erased), so a later ingest can store the address again
+func (ae *APIEngine) EraseCredential(c *gin.Context) {
+	if !ae.checkEngine(c, "EraseCredential") {
+		return
+	}
+
+	email := c.Param("email")
+	if _, _, err := credstore.SplitAddress(email); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid request; must pass an email address"})
+		return
+	}
+
+	tables := credstore.ErasureTables{
+		Credentials:       ae.Tables.Credentials,
+		SourceCredentials: ae.Tables.SourceCredentials,
+		Tombstones:        ae.Tables.Tombstones,
+		Watchlist:         ae.Tables.Watchlist,
+		Canaries:          ae.Tables.Canaries,
+	}
+	erasure, err := credstore.Erase(c.Request.Context(), ae.DynDBCli, tables, ae.Keys, email, c.Query("reference"))
+	if err != nil {
+		log.Printf("failed to erase credential in EraseCredential: %s", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "failed to erase credential; it's safe to retry"})
+		return
+	}
+	// the address itself isn't logged; that would rather defeat the point
+	tombstone := "no tombstone"
+	if erasure.Tombstone != nil {
+		tombstone = "tombstone " + erasure.Tombstone.Key
+	}
+	log.Printf("erased credential (%s, reference [%s]): found %t, %d passwords, %d source links, %d watches, canary %t",
+		tombstone, c.Query("reference"), erasure.Found, erasure.Passwords, erasure.SourceLinks, erasure.Watches, erasure.Canary)
+
+	c.JSON(http.StatusOK, erasure)
+}
+
+// subject access: everything stored about one address; its credential (passwords decrypted), the sources
+// and ingest jobs it came from, and its tombstone if it has been erased
+func (ae *APIEngine) ExportCredential(c *gin.Context) {
+	if !ae.checkEngine(c, "ExportCredential") {
+		return
+	}
+
+	email := c.Param("email")
+	domain, user, splitErr := credstore.SplitAddress(email)
+	if splitErr != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid request; must pass an email address"})
+		return
+	}
+	ctx := c.Request.Context()
+
+	tombstone, err := credstore.GetTombstone(ctx, ae.DynDBCli, ae.Tables.Tombstones, ae.Keys, email)
+	if err != nil {
+		log.Printf("failed to get tombstone in ExportCredential: %s", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "failed to look up erasure"})
+		return
+	}
+
+	key := ae.Keys.Key(domain, user)
+	cred, err := credstore.GetCredential(ctx, ae.DynDBCli, ae.Tables.Credentials, key.Domain, key.User)
+	if err != nil {
+		log.Printf("failed to get credential in ExportCredential: %s", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "failed to get credential"})
+		return
+	}
+
+	errCount := 0
+	srcList := []*sources.Source{}
+	jobList := []*jobs.Job{}
+	if cred != nil {
+		errCount += ae.revealCredentials(c, []*credparser.CredentialInfo{cred})
+
+		for _, sourceID := range credstore.SourceIDs(cred) {
+			src, srcErr := sources.Get(ctx, ae.DynDBCli, ae.Tables.Sources, sourceID)
+			if srcErr != nil {
+				log.Printf("failed to get source [%s] in ExportCredential: %s", sourceID, srcErr)
+				errCount++
+			} else if src != nil {
+				srcList = append(srcList, src)
+			}
+		}
+
+		seen := map[string]bool{}
+		for _, prov := range cred.Provenance {
+			if prov.JobID == "" || seen[prov.JobID] {
+				continue
+			}
+			seen[prov.JobID] = true
+			job, jobErr := jobs.Get(ctx, ae.DynDBCli, ae.Tables.Jobs, prov.JobID)
+			if jobErr != nil {
+				log.Printf("failed to get job [%s] in ExportCredential: %s", prov.JobID, jobErr)
+				errCount++
+			} else if job != nil {
+				jobList = append(jobList, job)
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"email": email, "errorCount": errCount, "credential": cred, "sources": srcList, "jobs": jobList, "erased": tombstone})
+}
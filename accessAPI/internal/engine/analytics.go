@@ -0,0 +1,40 @@
+package apiengine
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/newodahs/readerlambda/pkg/analytics"
+	"github.com/newodahs/readerlambda/pkg/credstore"
+)
+
+// reports what a domain's leaked passwords have in common (reuse, base words, patterns, keyboard walks,
+// lengths, the company name; ?company= if it isn't the domain's). passwords are decrypted to work it out, but
+// none of them is in the report
+func (ae *APIEngine) GetPasswordAnalytics(c *gin.Context) {
+	if !ae.checkEngine(c, "GetPasswordAnalytics") {
+		return
+	}
+
+	domain := strings.TrimSpace(c.Param("domain"))
+	if domain == "" || strings.Contains(domain, "@") {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid request; must pass a domain"})
+		return
+	}
+
+	report, err := analytics.Analyze(c.Request.Context(), ae.DynDBCli, ae.Tables.Credentials, ae.Cipher, ae.Keys, domain, c.Query("company"))
+	if errors.Is(err, credstore.ErrNoCipher) {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "stored passwords are encrypted and no keys are configured"})
+		return
+	}
+	if err != nil {
+		log.Printf("failed to analyze [%s] in GetPasswordAnalytics: %s", domain, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "failed to analyze domain"})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
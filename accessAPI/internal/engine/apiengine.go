@@ -2,18 +2,20 @@ package apiengine
 
 import (
 	"context"
+	"crypto/sha256"
 	"errors"
-	"fmt"
 	"log"
+	"net"
 	"net/http"
-	"net/url"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	transport "github.com/aws/smithy-go/endpoints"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/newodahs/readerlambda/pkg/config"
+	"github.com/newodahs/readerlambda/pkg/credstore"
+	"github.com/newodahs/readerlambda/pkg/envelope"
+	"github.com/newodahs/readerlambda/pkg/tenants"
+	"github.com/newodahs/readerlambda/pkg/util"
+	"github.com/newodahs/readerlambda/pkg/webhook"
 )
 
 // wrap up some common items that our routes may need
@@ -21,33 +23,44 @@ type APIEngine struct {
 	Server      *gin.Engine
 	SSLCertFile string
 	SSLKeyFile  string
-	DynDBCli    *dynamodb.Client
+	DynDBCli    util.DynamoDBAPI
+	Tables      config.Tables
+	Cipher      *envelope.Cipher     // opens encrypted passwords for privileged reads; nil if none are encrypted
+	Keys        *credstore.KeyHasher // hashes lookups when credentials are stored under hashed keys; nil if they aren't
+	Webhooks    *webhook.Sender      // for redelivering failed webhooks; nil if webhooks aren't configured
+	Tenants     *tenants.Directory   // who owns which domains; nil if no tenants are configured
+
+	adminTokens  [][sha256.Size]byte // hashes of the tokens that make a request privileged (see isPrivileged)
+	tenantTokens []tenantToken       // hashes of the tokens tenants manage their own watches with (see callerTenant)
 }
 
 // Really only useful for our local test harness runs; the lambda uses a Proxy call and not this...
-func (ae APIEngine) Run(bindAddr string, bindPort uint16) error {
+//
+// bindAddr is host:port; a missing port defaults to 443 with TLS and 80 without
+func (ae APIEngine) Run(bindAddr string) error {
 	if bindAddr == "" {
 		bindAddr = "0.0.0.0"
 	}
-
-	if ae.SSLCertFile != "" && ae.SSLKeyFile != "" { // we determine our run mode by if we have an SSL cert/key or not; WARNING: Not Fully Implemented/Tested
-		if bindPort == 0 {
-			bindPort = 443
+	if _, _, splitErr := net.SplitHostPort(bindAddr); splitErr != nil {
+		port := "80"
+		if ae.SSLCertFile != "" && ae.SSLKeyFile != "" {
+			port = "443"
 		}
-		return ae.Server.RunTLS(fmt.Sprintf("%s:%d", bindAddr, bindPort), ae.SSLCertFile, ae.SSLKeyFile)
+		bindAddr = net.JoinHostPort(bindAddr, port)
 	}
 
-	log.Printf("WARNING: No SSL Cert and Key file were provided, running in HTTP (non-SSL) mode!")
-	if bindPort == 0 {
-		bindPort = 80
+	if ae.SSLCertFile != "" && ae.SSLKeyFile != "" { // we determine our run mode by if we have an SSL cert/key or not; WARNING: Not Fully Implemented/Tested
+		return ae.Server.RunTLS(bindAddr, ae.SSLCertFile, ae.SSLKeyFile)
 	}
 
-	return ae.Server.Run(fmt.Sprintf("%s:%d", bindAddr, bindPort))
+	log.Printf("WARNING: No SSL Cert and Key file were provided, running in HTTP (non-SSL) mode!")
+	return ae.Server.Run(bindAddr)
 }
 
-// leave localResolver nil if not going to a local dynamodb localResolver dynamodb.EndpointResolverV2
-func NewAPIEngine(sslCertFile, sslKeyFile string, useLocalDynamoDB bool) *APIEngine {
-	ret := &APIEngine{SSLCertFile: sslCertFile, SSLKeyFile: sslKeyFile}
+// everything (dynamodb endpoint/credentials, tables, TLS files, CORS origins) comes from cfg; see the
+// readerlambda config package
+func NewAPIEngine(cfg *config.Config) *APIEngine {
+	ret := &APIEngine{SSLCertFile: cfg.TLSCertFile, SSLKeyFile: cfg.TLSKeyFile, Tables: cfg.Tables, adminTokens: hashTokens(cfg.AdminTokens)}
 	ret.Server = gin.Default()
 	if trustErr := ret.Server.SetTrustedProxies(nil); trustErr != nil {
 		log.Printf("failed to set trusted proxies to off (will continue): %s", trustErr)
@@ -55,7 +68,7 @@ func NewAPIEngine(sslCertFile, sslKeyFile string, useLocalDynamoDB bool) *APIEng
 
 	//no going crazy here, this is just a demo
 	corsConfig := cors.DefaultConfig()
-	corsConfig.AllowOrigins = []string{"*"}
+	corsConfig.AllowOrigins = cfg.CORSOrigins
 	corsConfig.AllowMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
 	corsConfig.AllowHeaders = []string{"Origin", "Content-Length", "Content-Role", "Authorization"}
 	ret.Server.Use(cors.New(corsConfig))
@@ -67,7 +80,13 @@ func NewAPIEngine(sslCertFile, sslKeyFile string, useLocalDynamoDB bool) *APIEng
 	}
 
 	//TODO: better error handling...
-	if err := ret.setupDynamoDB(useLocalDynamoDB); err != nil {
+	if err := ret.setupTenants(cfg); err != nil {
+		log.Fatalf("failed to setup tenants: %s", err)
+		return nil
+	}
+
+	//TODO: better error handling...
+	if err := ret.setupDynamoDB(cfg); err != nil {
 		log.Fatalf("failed to setup dynamodb: %s", err)
 		return nil
 	}
@@ -75,50 +94,65 @@ func NewAPIEngine(sslCertFile, sslKeyFile string, useLocalDynamoDB bool) *APIEng
 	return ret
 }
 
-// Resolver is used for local dynamodb instances only
-type Resolver struct {
-	URL *url.URL
-}
+func (ae *APIEngine) setupTenants(cfg *config.Config) error {
+	if ae == nil {
+		return errors.New("nil gin-engine passed to setupTenants")
+	}
+
+	var err error
+	if ae.Tenants, err = cfg.TenantDirectory(); err != nil {
+		return err
+	}
+	tokens, err := cfg.TenantTokenMap()
+	if err != nil {
+		return err
+	}
+	ae.tenantTokens = hashTenantTokens(tokens)
 
-func (r *Resolver) ResolveEndpoint(_ context.Context, params dynamodb.EndpointParameters) (transport.Endpoint, error) {
-	u := *r.URL
-	return transport.Endpoint{URI: u}, nil
+	return nil
 }
 
-func (ae *APIEngine) setupDynamoDB(useLocalDynamoDB bool) error {
+func (ae *APIEngine) setupDynamoDB(cfg *config.Config) error {
 	if ae == nil {
 		return errors.New("nil gin-engine passed to setupDynamoDB")
 	}
 
-	// HACK: if we're in our test harness, force our dynamodb client to look locally
-	if useLocalDynamoDB {
-		dynamoURL, parseErr := url.Parse("http://localhost:8000")
-		if parseErr != nil {
-			return fmt.Errorf("failed to parse dynamodb local url: %s", parseErr)
-		}
-
-		ae.DynDBCli = dynamodb.New(dynamodb.Options{
-			EndpointResolverV2: &Resolver{URL: dynamoURL},
-			Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
-				return aws.Credentials{
-					AccessKeyID:     `fakeMyKeyId`,
-					SecretAccessKey: `fakeSecretAccessKey`,
-				}, nil
-			}),
-			Region: `fakeRegion`,
-		})
-	} else { //normal path in AWS deployment
-		sdkConfig, err := config.LoadDefaultConfig(context.TODO())
-		if err != nil {
-			return fmt.Errorf("failed to load default config: %s", err)
-		}
+	// the config decides whether this is dynamodb-local (our test harness) or the real thing
+	sdkConfig, err := cfg.AWSConfig(context.TODO())
+	if err != nil {
+		return err
+	}
+	ae.DynDBCli = cfg.DynamoDBClient(sdkConfig)
 
-		ae.DynDBCli = dynamodb.NewFromConfig(sdkConfig)
+	// and whatever encrypted the passwords in it
+	if ae.Cipher, err = cfg.NewCipher(context.TODO()); err != nil {
+		return err
+	}
+	if ae.Keys, err = cfg.NewKeyHasher(); err != nil {
+		return err
 	}
+	ae.Webhooks = cfg.NewWebhookSender(ae.DynDBCli)
 
 	return nil
 }
 
+// common sanity check for our route handlers; aborts the request and returns false if the engine isn't usable
+func (ae *APIEngine) checkEngine(c *gin.Context, caller string) bool {
+	if ae == nil {
+		log.Printf("nil engine called for %s", caller)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "engine setup failure"})
+		return false
+	}
+
+	if ae.DynDBCli == nil {
+		log.Printf("nil dynamodb engine in %s, cannot proceed", caller)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "engine setup failure: no dynamodb client"})
+		return false
+	}
+
+	return true
+}
+
 // route setup
 func (ae *APIEngine) setupRoutes() error {
 	if ae == nil {
@@ -130,6 +164,43 @@ func (ae *APIEngine) setupRoutes() error {
 	{
 		versionGrp.GET("/compromised", ae.GetCompromised) // actual call to look up compromised creds
 
+		versionGrp.GET("/sources", ae.GetSources)                           // breach/source catalog
+		versionGrp.GET("/sources/:id", ae.GetSource)                        // single source
+		versionGrp.GET("/sources/:id/credentials", ae.GetSourceCredentials) // creds that appeared in a source
+
+		versionGrp.GET("/jobs", ae.GetJobs)    // ingest job history
+		versionGrp.GET("/jobs/:id", ae.GetJob) // single ingest job
+
+		adminGrp := versionGrp.Group("/admin", ae.requireAdmin) // admin token only
+		{
+			adminGrp.GET("/credentials/:email", ae.ExportCredential)   // subject access: everything stored about an address
+			adminGrp.DELETE("/credentials/:email", ae.EraseCredential) // right to erasure
+
+			adminGrp.PUT("/credentials/:email/remediation", ae.SetRemediation) // help desk progress on an exposed credential
+
+			adminGrp.GET("/watchlist", ae.GetWatchlist)           // watched domains/addresses
+			adminGrp.POST("/watchlist", ae.AddWatch)              // watch a domain/address for new credentials
+			adminGrp.DELETE("/watchlist/:target", ae.DeleteWatch) // stop watching
+
+			adminGrp.GET("/canaries", ae.GetCanaries)            // planted canary credentials and their sightings
+			adminGrp.GET("/canaries/:email", ae.GetCanary)       // one canary
+			adminGrp.POST("/canaries", ae.AddCanary)             // plant a canary
+			adminGrp.DELETE("/canaries/:email", ae.DeleteCanary) // retire one
+
+			adminGrp.POST("/reconcile", ae.ReconcileDirectory)          // match an HR/directory export against exposed credentials
+			adminGrp.GET("/analytics/:domain", ae.GetPasswordAnalytics) // password reuse and patterns for a domain
+
+			adminGrp.GET("/webhooks/deliveries", ae.GetDeliveries)                   // failed (or ?status=) webhook deliveries
+			adminGrp.POST("/webhooks/deliveries/:id/redeliver", ae.RedeliverWebhook) // send one again now
+		}
+
+		watchGrp := versionGrp.Group("/watchlist", ae.requireTenant) // tenant token (the tenant's own watches) or admin token
+		{
+			watchGrp.GET("", ae.GetWatchlist)
+			watchGrp.POST("", ae.AddWatch)
+			watchGrp.DELETE("/:target", ae.DeleteWatch)
+		}
+
 		versionGrp.GET("/ping", func(ctx *gin.Context) { // for debug purposes (make sure it's basically working)
 			ctx.JSON(http.StatusOK, gin.H{"message": "pong"})
 		})
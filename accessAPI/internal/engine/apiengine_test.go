@@ -0,0 +1,73 @@
+package apiengine
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/newodahs/readerlambda/pkg/awsfake"
+	"github.com/newodahs/readerlambda/pkg/config"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/util"
+	"github.com/newodahs/readerlambda/pkg/watchlist"
+)
+
+const (
+	testAdminToken  = "admin-0123456789abcdef"
+	testAcmeToken   = "acme-0123456789abcdef"
+	testGlobexToken = "globex-0123456789abcdef"
+)
+
+// an engine with our routes over an in-memory dynamodb; two tenants (acme, globex) with a token each, plus
+// an admin token
+func newTestEngine(t *testing.T) (*APIEngine, *awsfake.DynamoDB) {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+	cfg := config.Default()
+	cfg.AdminTokens = []string{testAdminToken}
+	cfg.Tenants = "acme=acme.com,globex=globex.com"
+	cfg.TenantTokens = []string{"acme=" + testAcmeToken, "globex=" + testGlobexToken}
+
+	cli := awsfake.NewDynamoDB()
+	for table, schema := range map[string]util.DymamoSchema{cfg.Tables.Credentials: credparser.CredentialInfo{}, cfg.Tables.Watchlist: watchlist.Entry{}} {
+		if err := util.EnsureDynamoDBTable(context.Background(), cli, table, schema, nil); err != nil {
+			t.Fatalf("failed to create table [%s]: %s", table, err)
+		}
+	}
+
+	ae := &APIEngine{Server: gin.New(), DynDBCli: cli, Tables: cfg.Tables, adminTokens: hashTokens(cfg.AdminTokens)}
+	if err := ae.setupRoutes(); err != nil {
+		t.Fatalf("failed to setup routes: %s", err)
+	}
+	if err := ae.setupTenants(cfg); err != nil {
+		t.Fatalf("failed to setup tenants: %s", err)
+	}
+	return ae, cli
+}
+
+// sends a request (with token as the bearer token, if any) and decodes the JSON response into out (if not nil)
+func (ae *APIEngine) serve(t *testing.T, method, path, token string, body io.Reader, out any) int {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, body)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rec := httptest.NewRecorder()
+	ae.Server.ServeHTTP(rec, req)
+
+	if out != nil && rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("failed to decode response to %s %s: %s", method, path, err)
+		}
+	}
+	return rec.Code
+}
@@ -0,0 +1,103 @@
+package apiengine
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/newodahs/readerlambda/pkg/canary"
+)
+
+// body of a new canary; the password is only ever kept hashed
+type canaryRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	Label    string `json:"label"`
+}
+
+// every registered canary with where each has been seen
+func (ae *APIEngine) GetCanaries(c *gin.Context) {
+	if !ae.checkEngine(c, "GetCanaries") {
+		return
+	}
+
+	canaries, err := canary.List(c.Request.Context(), ae.DynDBCli, ae.Tables.Canaries)
+	if err != nil {
+		log.Printf("failed to list canaries in GetCanaries: %s", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "failed to list canaries"})
+		return
+	}
+	if canaries == nil {
+		canaries = []*canary.Canary{}
+	}
+	c.JSON(http.StatusOK, gin.H{"canaries": canaries})
+}
+
+// a single canary and its sightings
+func (ae *APIEngine) GetCanary(c *gin.Context) {
+	if !ae.checkEngine(c, "GetCanary") {
+		return
+	}
+
+	found, err := canary.Get(c.Request.Context(), ae.DynDBCli, ae.Tables.Canaries, c.Param("email"))
+	if err != nil {
+		log.Printf("failed to get canary in GetCanary: %s", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "failed to get canary"})
+		return
+	}
+	if found == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "no such canary"})
+		return
+	}
+	c.JSON(http.StatusOK, found)
+}
+
+// registers a canary; ingests containing it are flagged and alerted on from then on. 409 if the address
+// is already one
+func (ae *APIEngine) AddCanary(c *gin.Context) {
+	if !ae.checkEngine(c, "AddCanary") {
+		return
+	}
+
+	var req canaryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid request; body must be a canary (email, password, label)"})
+		return
+	}
+	newCanary, err := canary.New(req.Email, req.Password, req.Label)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	if err := canary.Save(c.Request.Context(), ae.DynDBCli, ae.Tables.Canaries, newCanary); err != nil {
+		if errors.Is(err, canary.ErrExists) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": "that address is already a canary"})
+			return
+		}
+		log.Printf("failed to save canary in AddCanary: %s", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "failed to save canary"})
+		return
+	}
+	c.JSON(http.StatusOK, newCanary)
+}
+
+// retires a canary, sightings and all
+func (ae *APIEngine) DeleteCanary(c *gin.Context) {
+	if !ae.checkEngine(c, "DeleteCanary") {
+		return
+	}
+
+	found, err := canary.Delete(c.Request.Context(), ae.DynDBCli, ae.Tables.Canaries, c.Param("email"))
+	if err != nil {
+		log.Printf("failed to delete canary in DeleteCanary: %s", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "failed to delete canary"})
+		return
+	}
+	if !found {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "no such canary"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "deleted"})
+}
@@ -4,20 +4,20 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/gin-gonic/gin"
 	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/credstore"
 )
 
-const DYNDB_TABLE_EXPLOITCRED = `exploitedCredentials`
-
 // main function for finding compromised accounts via a filter on email or domain
-// will fail if no filter is passed
+// will fail if no filter is passed; an optional status (e.g. status=new) narrows it to credentials at that
+// point in remediation, which makes a domain filter a work queue; sort=severity puts the most severe first
+// and limit=n only returns the first n (after sorting; total says how many there were)
 //
 // returns a list of the compromised credentials found
 func (ae *APIEngine) GetCompromised(c *gin.Context) {
@@ -40,59 +40,56 @@ func (ae *APIEngine) GetCompromised(c *gin.Context) {
 		return
 	}
 
-	var exprErr error
-	var expr expression.Expression
-
-	//simple check to see if the filter is for email or domain
-	idx := strings.Index(rawFilter, `@`)
-	if idx < 0 { // treat this as a domain
-		keyEx := expression.Key("domainname").Equal(expression.Value(rawFilter))
-		expr, exprErr = expression.NewBuilder().WithKeyCondition(keyEx).Build()
-		if exprErr != nil {
-			log.Printf("failed to build query expression for dynamodb: %s", exprErr)
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "failed to build dynamodb query expression"})
+	var status credparser.RemediationStatus
+	if rawStatus := c.Query("status"); rawStatus != "" {
+		var statusErr error
+		if status, statusErr = credparser.ParseRemediationStatus(rawStatus); statusErr != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": statusErr.Error()})
 			return
 		}
-	} else { // it's an email (we hope)
-		username := rawFilter[:idx]
-		domain := rawFilter[idx+1:]
-
-		keyEx := expression.Key("domainname").Equal(expression.Value(domain)).And(expression.Key("username").Equal(expression.Value(username)))
-		expr, exprErr = expression.NewBuilder().WithKeyCondition(keyEx).Build()
-		if exprErr != nil {
-			log.Printf("failed to build query expression for dynamodb in GetCompromised: %s", exprErr)
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "failed to build dynamodb query expression"})
+	}
+
+	sortBy := c.Query("sort")
+	if sortBy != "" && sortBy != "severity" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid request; sort must be severity"})
+		return
+	}
+
+	limit := 0
+	if rawLimit := c.Query("limit"); rawLimit != "" {
+		var convErr error
+		if limit, convErr = strconv.Atoi(rawLimit); convErr != nil || limit <= 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid request; limit must be a positive number"})
 			return
 		}
 	}
 
-	// query dynamodb and get back the data
-	res, getErr := ae.DynDBCli.Query(c.Request.Context(), &dynamodb.QueryInput{
-		TableName:                 aws.String(DYNDB_TABLE_EXPLOITCRED),
-		ExpressionAttributeNames:  expr.Names(),
-		ExpressionAttributeValues: expr.Values(),
-		KeyConditionExpression:    expr.KeyCondition(),
-	})
+	//simple check to see if the filter is for email or domain
+	domain, user := rawFilter, ""
+	if idx := strings.Index(rawFilter, `@`); idx >= 0 { // it's an email (we hope)
+		domain, user = rawFilter[idx+1:], rawFilter[:idx]
+	}
+
+	// every page of it, hashed the same way it was stored (if it was) and narrowed to status by dynamodb
+	output, errCount, getErr := credstore.QueryCompromised(c.Request.Context(), ae.DynDBCli, ae.Tables.Credentials, ae.Keys, domain, user, status)
 	if getErr != nil {
 		log.Printf("failed during Query call on dynamodb in GetCompromised: %s", getErr)
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "failed during Query call on dynamodb"})
 		return
 	}
-
-	// process the dynamodb data; rip over it and generate an (IMHO) easier-to-use structure that we can return to our client
-	errCount := 0
-	var output []*credparser.CredentialInfo
-	for _, item := range res.Items {
-		cred := &credparser.CredentialInfo{}
-		unmarshErr := attributevalue.UnmarshalMap(item, cred)
-		if unmarshErr != nil {
-			log.Printf("failed to unmarshal credential [%+v] in GetCompromised: %s", item, unmarshErr)
-			errCount++
-		}
-		output = append(output, cred)
+	if errCount > 0 {
+		log.Printf("failed to unmarshal %d credentials in GetCompromised", errCount)
+	}
+	if sortBy == "severity" {
+		sortBySeverity(output)
 	}
+	total := len(output)
+	if limit > 0 && limit < total {
+		output = output[:limit] // only what's handed back needs decrypting
+	}
+	errCount += ae.revealCredentials(c, output)
 
-	c.JSON(http.StatusOK, gin.H{"errorCount": errCount, "credlist": output})
+	c.JSON(http.StatusOK, gin.H{"errorCount": errCount, "total": total, "credlist": output})
 }
 
 // another route implementation I made for just pulling all credentials; not currently exposed but maybe useful
@@ -111,7 +108,7 @@ func (ae *APIEngine) GetAllCompromised(c *gin.Context) {
 
 	// just pull in everything...
 	res, err := ae.DynDBCli.Scan(c.Request.Context(), &dynamodb.ScanInput{
-		TableName: aws.String(DYNDB_TABLE_EXPLOITCRED),
+		TableName: aws.String(ae.Tables.Credentials),
 	})
 	if err != nil {
 		log.Printf("failed while attempting to get all compromised account results: %s", err)
@@ -123,14 +120,15 @@ func (ae *APIEngine) GetAllCompromised(c *gin.Context) {
 	errCount := 0
 	var output []*credparser.CredentialInfo
 	for _, item := range res.Items {
-		cred := &credparser.CredentialInfo{}
-		unmarshErr := attributevalue.UnmarshalMap(item, cred)
-		if unmarshErr != nil {
-			log.Printf("failed to unmarshal credential [%+v]: %s", item, unmarshErr)
+		cred, decodeErr := credstore.DecodeCredential(item) // upgrades items stored at older schema versions
+		if decodeErr != nil {
+			log.Printf("failed to unmarshal credential [%+v]: %s", item, decodeErr)
 			errCount++
+			continue
 		}
 		output = append(output, cred)
 	}
+	errCount += ae.revealCredentials(c, output)
 
 	c.JSON(http.StatusOK, gin.H{"errorCount": errCount, "credlist": output})
 }
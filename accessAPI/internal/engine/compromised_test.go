@@ -0,0 +1,130 @@
+package apiengine
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/credstore"
+)
+
+type compromisedResponse struct {
+	ErrorCount int                          `json:"errorCount"`
+	Total      int                          `json:"total"`
+	Credlist   []*credparser.CredentialInfo `json:"credlist"`
+}
+
+func (resp compromisedResponse) emails() []string {
+	var ret []string
+	for _, cred := range resp.Credlist {
+		ret = append(ret, cred.Email)
+	}
+	return ret
+}
+
+// ?status= narrows a domain to credentials at that point in remediation; ones stored before remediation
+// existed count as new
+func Test_Compromised_StatusFilter(t *testing.T) {
+	ae, cli := newTestEngine(t)
+	ctx := context.Background()
+
+	for _, user := range []string{"alice", "bob", "carol"} {
+		cred := &credparser.CredentialInfo{Domain: "acme.com", User: user, Email: user + "@acme.com"}
+		cred.AddPassword("pw-"+user, &credparser.Provenance{SourceID: "breach-1"})
+		if _, err := credstore.StoreCredential(ctx, cli, ae.Tables.Credentials, nil, nil, cred); err != nil {
+			t.Fatalf("failed to store: %s", err)
+		}
+	}
+	if _, err := credstore.SetRemediation(ctx, cli, ae.Tables.Credentials, nil, "bob@acme.com", credstore.RemediationUpdate{Status: credparser.REMEDIATION_PASSWORD_RESET, By: "helpdesk"}); err != nil {
+		t.Fatalf("failed to set remediation: %s", err)
+	}
+	legacy := map[string]types.AttributeValue{
+		"domainname": &types.AttributeValueMemberS{Value: "acme.com"},
+		"username":   &types.AttributeValueMemberS{Value: "dave"},
+		"password":   &types.AttributeValueMemberS{Value: "old"},
+	}
+	if _, err := cli.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(ae.Tables.Credentials), Item: legacy}); err != nil {
+		t.Fatalf("failed to put legacy item: %s", err)
+	}
+
+	testSet := []struct {
+		Name   string
+		Query  string
+		Expect []string
+		Code   int
+	}{
+		{Name: "No Status", Query: "filter=acme.com", Expect: []string{"alice@acme.com", "bob@acme.com", "carol@acme.com", "dave@acme.com"}, Code: http.StatusOK},
+		{Name: "New", Query: "filter=acme.com&status=new", Expect: []string{"alice@acme.com", "carol@acme.com", "dave@acme.com"}, Code: http.StatusOK},
+		{Name: "Reset", Query: "filter=acme.com&status=password-reset", Expect: []string{"bob@acme.com"}, Code: http.StatusOK},
+		{Name: "Address", Query: "filter=bob@acme.com&status=new", Code: http.StatusOK},
+		{Name: "Bad Status", Query: "filter=acme.com&status=fixed", Code: http.StatusBadRequest},
+	}
+	for _, test := range testSet {
+		t.Run(test.Name, func(t *testing.T) {
+			var resp compromisedResponse
+			if code := ae.serve(t, http.MethodGet, "/v1/compromised?"+test.Query, "", nil, &resp); code != test.Code {
+				t.Fatalf("expected %d, got %d", test.Code, code)
+			}
+			emails := resp.emails()
+			slices.Sort(emails)
+			if !slices.Equal(emails, test.Expect) || resp.Total != len(test.Expect) {
+				t.Errorf("expected %v, got %v (total %d)", test.Expect, emails, resp.Total)
+			}
+		})
+	}
+}
+
+// limit applies after sorting, so it's the most severe n of the whole domain (unscored last), with total
+// counting everything that matched
+func Test_Compromised_SortThenLimit(t *testing.T) {
+	ae, cli := newTestEngine(t)
+	ctx := context.Background()
+
+	// stored in an order that isn't the severity order; scores set directly rather than worked out
+	for user, score := range map[string]int{"alice": 10, "bob": 80, "carol": -1, "dave": 90, "erin": 50} {
+		cred := &credparser.CredentialInfo{Domain: "acme.com", User: user, Email: user + "@acme.com"}
+		cred.AddPassword("pw-"+user, &credparser.Provenance{SourceID: "breach-1"})
+		if score >= 0 {
+			cred.Severity = &credparser.Severity{Score: score}
+		}
+		item, err := credstore.EncodeCredential(ctx, nil, nil, cred)
+		if err != nil {
+			t.Fatalf("failed to encode: %s", err)
+		}
+		if _, err := cli.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(ae.Tables.Credentials), Item: item}); err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+	}
+
+	testSet := []struct {
+		Name   string
+		Query  string
+		Expect []string
+		Code   int
+	}{
+		{Name: "Sorted", Query: "filter=acme.com&sort=severity", Expect: []string{"dave@acme.com", "bob@acme.com", "erin@acme.com", "alice@acme.com", "carol@acme.com"}, Code: http.StatusOK},
+		{Name: "Top Two", Query: "filter=acme.com&sort=severity&limit=2", Expect: []string{"dave@acme.com", "bob@acme.com"}, Code: http.StatusOK},
+		{Name: "Limit Past The End", Query: "filter=acme.com&sort=severity&limit=10", Expect: []string{"dave@acme.com", "bob@acme.com", "erin@acme.com", "alice@acme.com", "carol@acme.com"}, Code: http.StatusOK},
+		{Name: "Bad Limit", Query: "filter=acme.com&sort=severity&limit=0", Code: http.StatusBadRequest},
+		{Name: "Bad Sort", Query: "filter=acme.com&sort=name", Code: http.StatusBadRequest},
+	}
+	for _, test := range testSet {
+		t.Run(test.Name, func(t *testing.T) {
+			var resp compromisedResponse
+			if code := ae.serve(t, http.MethodGet, "/v1/compromised?"+test.Query, "", nil, &resp); code != test.Code {
+				t.Fatalf("expected %d, got %d", test.Code, code)
+			}
+			if test.Code != http.StatusOK {
+				return
+			}
+			if !slices.Equal(resp.emails(), test.Expect) || resp.Total != 5 {
+				t.Errorf("expected %v of 5, got %v of %d", test.Expect, resp.emails(), resp.Total)
+			}
+		})
+	}
+}
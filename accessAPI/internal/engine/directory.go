@@ -0,0 +1,68 @@
+package apiengine
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/newodahs/readerlambda/pkg/directory"
+)
+
+// largest directory export accepted; a few hundred thousand employees fits comfortably
+const MAX_DIRECTORY_SIZE = 64 << 20
+
+// matches an uploaded HR/directory export (the request body; CSV with a header row, or LDIF per ?format=
+// or a Content-Type mentioning ldif) against the stored credentials and returns the report; nothing is kept
+func (ae *APIEngine) ReconcileDirectory(c *gin.Context) {
+	if !ae.checkEngine(c, "ReconcileDirectory") {
+		return
+	}
+
+	format := directory.FORMAT_CSV
+	if raw := c.Query("format"); raw != "" {
+		var err error
+		if format, err = directory.ParseFormat(raw); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid request; format must be csv or ldif"})
+			return
+		}
+	} else if strings.Contains(strings.ToLower(c.ContentType()), "ldif") {
+		format = directory.FORMAT_LDIF
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, MAX_DIRECTORY_SIZE))
+	var tooBig *http.MaxBytesError
+	if errors.As(err, &tooBig) {
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"message": "directory export is too large"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "failed to read directory export"})
+		return
+	}
+
+	dir, err := directory.Parse(bytes.NewReader(body), format)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid directory export: " + err.Error()})
+		return
+	}
+	if len(dir.Employees) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid request; the directory export has no employees with an email address"})
+		return
+	}
+
+	tables := directory.Tables{Credentials: ae.Tables.Credentials, Sources: ae.Tables.Sources}
+	report, err := directory.Reconcile(c.Request.Context(), ae.DynDBCli, tables, ae.Keys, dir)
+	if err != nil {
+		log.Printf("failed to reconcile in ReconcileDirectory: %s", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "failed to reconcile directory"})
+		return
+	}
+	log.Printf("reconciled directory (report %s): %d employees, %d active exposed, %d leaked since their last change, %d remediated",
+		report.ID, report.Employees, report.ExposedActive, report.LeakAfterChange, report.Remediated)
+
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,55 @@
+package apiengine
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/newodahs/readerlambda/pkg/jobs"
+)
+
+// lists ingest jobs, newest first; optional ?status= and ?limit= (defaults to 50)
+func (ae *APIEngine) GetJobs(c *gin.Context) {
+	if !ae.checkEngine(c, "GetJobs") {
+		return
+	}
+
+	limit := 50
+	if rawLimit := c.Query("limit"); rawLimit != "" {
+		var convErr error
+		if limit, convErr = strconv.Atoi(rawLimit); convErr != nil || limit < 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid request; limit must be a non-negative number"})
+			return
+		}
+	}
+
+	jobList, err := jobs.List(c.Request.Context(), ae.DynDBCli, ae.Tables.Jobs, jobs.Status(c.Query("status")), limit)
+	if err != nil {
+		log.Printf("failed to list jobs in GetJobs: %s", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "failed to list jobs"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"jobs": jobList})
+}
+
+// returns a single ingest job by id
+func (ae *APIEngine) GetJob(c *gin.Context) {
+	if !ae.checkEngine(c, "GetJob") {
+		return
+	}
+
+	job, err := jobs.Get(c.Request.Context(), ae.DynDBCli, ae.Tables.Jobs, c.Param("id"))
+	if err != nil {
+		log.Printf("failed to get job in GetJob: %s", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "failed to get job"})
+		return
+	}
+	if job == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "job not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+}
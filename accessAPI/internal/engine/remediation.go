@@ -0,0 +1,68 @@
+package apiengine
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/credstore"
+)
+
+// body of a remediation update; passwords are indexes into the credential's password list as returned by
+// /v1/compromised, leave it out to update all of them
+type remediationRequest struct {
+	Status    string `json:"status"`
+	By        string `json:"by"`
+	Notes     string `json:"notes"`
+	Passwords []int  `json:"passwords"`
+}
+
+// records where the help desk has got with an exposed credential (new, acknowledged, password-reset or
+// false-positive) along with who did it and any notes; returns the credential's status and provenance
+// (passwords aren't handed back here)
+func (ae *APIEngine) SetRemediation(c *gin.Context) {
+	if !ae.checkEngine(c, "SetRemediation") {
+		return
+	}
+
+	email := c.Param("email")
+	if _, _, err := credstore.SplitAddress(email); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid request; must pass an email address"})
+		return
+	}
+
+	var req remediationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid request; body must be a remediation update"})
+		return
+	}
+	status, err := credparser.ParseRemediationStatus(req.Status)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if req.By == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid request; must say who made the update (by)"})
+		return
+	}
+
+	update := credstore.RemediationUpdate{Status: status, By: req.By, Notes: req.Notes, Passwords: req.Passwords}
+	cred, err := credstore.SetRemediation(c.Request.Context(), ae.DynDBCli, ae.Tables.Credentials, ae.Keys, email, update)
+	if errors.Is(err, credstore.ErrNoSuchPassword) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("failed to set remediation in SetRemediation: %s", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "failed to record remediation; it's safe to retry"})
+		return
+	}
+	if cred == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "no credential stored for that address"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"email": email, "status": cred.Status, "provenance": cred.Provenance})
+}
@@ -0,0 +1,24 @@
+package apiengine
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/newodahs/readerlambda/pkg/credparser"
+)
+
+// most severe first; credentials not scored yet go last, and ties by address so pages are stable
+func sortBySeverity(creds []*credparser.CredentialInfo) {
+	slices.SortStableFunc(creds, func(a, b *credparser.CredentialInfo) int {
+		switch {
+		case a.Severity == nil && b.Severity == nil:
+		case a.Severity == nil:
+			return 1
+		case b.Severity == nil:
+			return -1
+		case a.Severity.Score != b.Severity.Score:
+			return b.Severity.Score - a.Severity.Score
+		}
+		return strings.Compare(a.Email, b.Email)
+	})
+}
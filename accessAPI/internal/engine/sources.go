@@ -0,0 +1,75 @@
+package apiengine
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/newodahs/readerlambda/pkg/credstore"
+	"github.com/newodahs/readerlambda/pkg/sources"
+)
+
+// lists every breach/source we know about
+func (ae *APIEngine) GetSources(c *gin.Context) {
+	if !ae.checkEngine(c, "GetSources") {
+		return
+	}
+
+	srcList, err := sources.List(c.Request.Context(), ae.DynDBCli, ae.Tables.Sources)
+	if err != nil {
+		log.Printf("failed to list sources in GetSources: %s", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "failed to list sources"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sources": srcList})
+}
+
+// returns a single source by id
+func (ae *APIEngine) GetSource(c *gin.Context) {
+	if !ae.checkEngine(c, "GetSource") {
+		return
+	}
+
+	src, err := sources.Get(c.Request.Context(), ae.DynDBCli, ae.Tables.Sources, c.Param("id"))
+	if err != nil {
+		log.Printf("failed to get source in GetSource: %s", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "failed to get source"})
+		return
+	}
+	if src == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "source not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, src)
+}
+
+// returns the credentials that appeared in a given source; same output shape as GetCompromised
+func (ae *APIEngine) GetSourceCredentials(c *gin.Context) {
+	if !ae.checkEngine(c, "GetSourceCredentials") {
+		return
+	}
+
+	links, err := sources.ListLinks(c.Request.Context(), ae.DynDBCli, ae.Tables.SourceCredentials, c.Param("id"))
+	if err != nil {
+		log.Printf("failed to list source links in GetSourceCredentials: %s", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "failed to look up credentials for source"})
+		return
+	}
+
+	keys := make([]credstore.CredentialKey, 0, len(links))
+	for _, link := range links {
+		keys = append(keys, credstore.CredentialKey{Domain: link.Domain, User: link.User})
+	}
+
+	output, errCount, err := credstore.BatchGetCredentials(c.Request.Context(), ae.DynDBCli, ae.Tables.Credentials, keys)
+	if err != nil {
+		log.Printf("failed to get credentials in GetSourceCredentials: %s", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "failed to get credentials for source"})
+		return
+	}
+	errCount += ae.revealCredentials(c, output)
+
+	c.JSON(http.StatusOK, gin.H{"errorCount": errCount, "credlist": output})
+}
@@ -0,0 +1,140 @@
+package apiengine
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/newodahs/readerlambda/pkg/watchlist"
+)
+
+// body of a new watch; target is a domain or an email address
+type watchRequest struct {
+	Target string `json:"target"`
+	Owner  string `json:"owner"`
+	Label  string `json:"label"`
+}
+
+// the tenant a watch route is limited to: the caller's own for a tenant token, empty for an admin one (who
+// can act for any owner)
+func (ae *APIEngine) watchTenant(c *gin.Context) string {
+	if ae.isPrivileged(c) {
+		return ""
+	}
+	return ae.callerTenant(c)
+}
+
+// who a watch is for: a tenant caller can only name itself (or nobody), an admin caller anyone; aborts the
+// request and returns false if owner isn't allowed
+func (ae *APIEngine) watchOwner(c *gin.Context, owner string) (string, bool) {
+	owner = strings.TrimSpace(owner)
+	if tenant := ae.watchTenant(c); tenant != "" {
+		if owner != "" && owner != tenant {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "tenant tokens can only manage the tenant's own watches"})
+			return "", false
+		}
+		return tenant, true
+	}
+	return owner, true
+}
+
+// every watched domain and address; optional ?owner= narrows it to one tenant's. tenant callers only ever
+// see their own
+func (ae *APIEngine) GetWatchlist(c *gin.Context) {
+	if !ae.checkEngine(c, "GetWatchlist") {
+		return
+	}
+	owner, ok := ae.watchOwner(c, c.Query("owner"))
+	if !ok {
+		return
+	}
+
+	entries, err := watchlist.List(c.Request.Context(), ae.DynDBCli, ae.Tables.Watchlist)
+	if err != nil {
+		log.Printf("failed to list watchlist in GetWatchlist: %s", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "failed to list watchlist"})
+		return
+	}
+
+	output := []*watchlist.Entry{}
+	for _, entry := range entries {
+		if owner == "" || entry.Owner == owner {
+			output = append(output, entry)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"watchlist": output})
+}
+
+// registers a watch; new credentials ingested for the target alert its owner from then on. a tenant caller
+// owns the watch and can only watch its own domains (and addresses in them); with tenants configured, an admin
+// caller has to give one of them as the owner
+func (ae *APIEngine) AddWatch(c *gin.Context) {
+	if !ae.checkEngine(c, "AddWatch") {
+		return
+	}
+
+	var req watchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid request; body must be a watch (target, owner)"})
+		return
+	}
+	owner, ok := ae.watchOwner(c, req.Owner)
+	if !ok {
+		return
+	}
+	entry, err := watchlist.NewEntry(req.Target, owner, req.Label)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if tenant := ae.watchTenant(c); tenant != "" {
+		domain := entry.Target
+		if _, addrDomain, found := strings.Cut(domain, "@"); found {
+			domain = addrDomain
+		}
+		if ae.Tenants.Of(domain) != tenant {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": fmt.Sprintf("[%s] is not one of the tenant's domains", domain)})
+			return
+		}
+	} else if ae.Tenants != nil && !ae.Tenants.Has(entry.Owner) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("invalid request; [%s] is not a configured tenant", entry.Owner)})
+		return
+	}
+
+	if err := watchlist.Save(c.Request.Context(), ae.DynDBCli, ae.Tables.Watchlist, entry); err != nil {
+		log.Printf("failed to save watch in AddWatch: %s", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "failed to save watch"})
+		return
+	}
+	c.JSON(http.StatusOK, entry)
+}
+
+// removes owner's (?owner=, required for admin callers) watch on a target; tenant callers remove their own
+func (ae *APIEngine) DeleteWatch(c *gin.Context) {
+	if !ae.checkEngine(c, "DeleteWatch") {
+		return
+	}
+
+	owner, ok := ae.watchOwner(c, c.Query("owner"))
+	if !ok {
+		return
+	}
+	if owner == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid request; must pass the watch's owner"})
+		return
+	}
+
+	found, err := watchlist.Delete(c.Request.Context(), ae.DynDBCli, ae.Tables.Watchlist, c.Param("target"), owner)
+	if err != nil {
+		log.Printf("failed to delete watch in DeleteWatch: %s", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "failed to delete watch"})
+		return
+	}
+	if !found {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "no such watch"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "deleted"})
+}
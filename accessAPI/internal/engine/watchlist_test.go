@@ -0,0 +1,93 @@
+package apiengine
+
+import (
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/newodahs/readerlambda/pkg/watchlist"
+)
+
+type watchlistResponse struct {
+	Watchlist []*watchlist.Entry `json:"watchlist"`
+}
+
+func (resp watchlistResponse) targets() []string {
+	var ret []string
+	for _, entry := range resp.Watchlist {
+		ret = append(ret, entry.Owner+":"+entry.Target)
+	}
+	slices.Sort(ret)
+	return ret
+}
+
+// a tenant only ever sees and changes its own watches, whatever it asks for
+func Test_Watchlist_TenantIsolation(t *testing.T) {
+	ae, _ := newTestEngine(t)
+
+	for _, body := range []string{
+		`{"target": "acme.com", "owner": "acme"}`,
+		`{"target": "globex.com", "owner": "globex"}`,
+		`{"target": "ceo@globex.com", "owner": "globex"}`,
+	} {
+		if code := ae.serve(t, http.MethodPost, "/v1/admin/watchlist", testAdminToken, strings.NewReader(body), nil); code != http.StatusOK {
+			t.Fatalf("failed to add watch %s: %d", body, code)
+		}
+	}
+	if code := ae.serve(t, http.MethodPost, "/v1/watchlist", testAcmeToken, strings.NewReader(`{"target": "ceo@acme.com"}`), nil); code != http.StatusOK {
+		t.Fatalf("failed to add the tenant's own watch: %d", code)
+	}
+
+	var resp watchlistResponse
+	if code := ae.serve(t, http.MethodGet, "/v1/watchlist", testAcmeToken, nil, &resp); code != http.StatusOK {
+		t.Fatalf("failed to list watches: %d", code)
+	}
+	if expect := []string{"acme:acme.com", "acme:ceo@acme.com"}; !slices.Equal(resp.targets(), expect) {
+		t.Errorf("expected acme to see %v, got %v", expect, resp.targets())
+	}
+	resp = watchlistResponse{}
+	if code := ae.serve(t, http.MethodGet, "/v1/watchlist", testGlobexToken, nil, &resp); code != http.StatusOK {
+		t.Fatalf("failed to list watches: %d", code)
+	}
+	if expect := []string{"globex:ceo@globex.com", "globex:globex.com"}; !slices.Equal(resp.targets(), expect) {
+		t.Errorf("expected globex to see %v, got %v", expect, resp.targets())
+	}
+
+	// asking for, adding or removing another tenant's watches doesn't get anywhere
+	testSet := []struct {
+		Name   string
+		Method string
+		Path   string
+		Body   string
+		Expect int
+	}{
+		{Name: "List Other Owner", Method: http.MethodGet, Path: "/v1/watchlist?owner=globex", Expect: http.StatusForbidden},
+		{Name: "Add For Other Owner", Method: http.MethodPost, Path: "/v1/watchlist", Body: `{"target": "acme.com", "owner": "globex"}`, Expect: http.StatusForbidden},
+		{Name: "Add Other Domain", Method: http.MethodPost, Path: "/v1/watchlist", Body: `{"target": "globex.com"}`, Expect: http.StatusForbidden},
+		{Name: "Add Other Address", Method: http.MethodPost, Path: "/v1/watchlist", Body: `{"target": "cfo@globex.com"}`, Expect: http.StatusForbidden},
+		{Name: "Delete Other Owner", Method: http.MethodDelete, Path: "/v1/watchlist/globex.com?owner=globex", Expect: http.StatusForbidden},
+		{Name: "Delete Other Target", Method: http.MethodDelete, Path: "/v1/watchlist/globex.com", Expect: http.StatusNotFound},
+	}
+	for _, test := range testSet {
+		t.Run(test.Name, func(t *testing.T) {
+			var body io.Reader
+			if test.Body != "" {
+				body = strings.NewReader(test.Body)
+			}
+			if code := ae.serve(t, test.Method, test.Path, testAcmeToken, body, nil); code != test.Expect {
+				t.Errorf("expected %d, got %d", test.Expect, code)
+			}
+		})
+	}
+
+	// and an admin still sees everyone's, untouched
+	resp = watchlistResponse{}
+	if code := ae.serve(t, http.MethodGet, "/v1/admin/watchlist", testAdminToken, nil, &resp); code != http.StatusOK {
+		t.Fatalf("failed to list watches: %d", code)
+	}
+	if expect := []string{"acme:acme.com", "acme:ceo@acme.com", "globex:ceo@globex.com", "globex:globex.com"}; !slices.Equal(resp.targets(), expect) {
+		t.Errorf("expected every watch to be left, got %v", resp.targets())
+	}
+}
@@ -0,0 +1,68 @@
+package apiengine
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/newodahs/readerlambda/pkg/webhook"
+)
+
+// webhooks need configuring (a URL and secret) before there's anything to look at or redeliver
+func (ae *APIEngine) checkWebhooks(c *gin.Context) bool {
+	if ae.Webhooks == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"message": "webhooks are not configured"})
+		return false
+	}
+	return true
+}
+
+// webhook deliveries with a status (?status=, failed by default; pending or delivered also work), newest first
+func (ae *APIEngine) GetDeliveries(c *gin.Context) {
+	if !ae.checkEngine(c, "GetDeliveries") || !ae.checkWebhooks(c) {
+		return
+	}
+
+	status := webhook.Status(c.DefaultQuery("status", string(webhook.STATUS_FAILED)))
+	switch status {
+	case webhook.STATUS_FAILED, webhook.STATUS_PENDING, webhook.STATUS_DELIVERED:
+	default:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "invalid request; status must be failed, pending or delivered"})
+		return
+	}
+
+	deliveries, err := webhook.List(c.Request.Context(), ae.DynDBCli, ae.Webhooks.Table, status)
+	if err != nil {
+		log.Printf("failed to list deliveries in GetDeliveries: %s", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "failed to list webhook deliveries"})
+		return
+	}
+	if deliveries == nil {
+		deliveries = []*webhook.Delivery{}
+	}
+	c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+}
+
+// sends a delivery again straight away (same id and body, so receivers can dedupe); 502 if the receiver
+// still doesn't take it, in which case it stays failed
+func (ae *APIEngine) RedeliverWebhook(c *gin.Context) {
+	if !ae.checkEngine(c, "RedeliverWebhook") || !ae.checkWebhooks(c) {
+		return
+	}
+
+	d, err := ae.Webhooks.Redeliver(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		log.Printf("failed to redeliver in RedeliverWebhook: %s", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "failed to redeliver webhook"})
+		return
+	}
+	if d == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "no such delivery"})
+		return
+	}
+	if d.Status != webhook.STATUS_DELIVERED {
+		c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"message": "receiver did not accept the webhook", "delivery": d})
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
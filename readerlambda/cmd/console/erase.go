@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/newodahs/readerlambda/pkg/config"
+	"github.com/newodahs/readerlambda/pkg/credstore"
+	"github.com/newodahs/readerlambda/pkg/postprocess"
+)
+
+// erase [-reference R] [-bucket B [-prefix P]] [-dir D] [-localdb=false] [config flags] <email>
+//
+// the API's erase plus what it can't reach: the rejects files (in -bucket under -prefix, and/or the ones the
+// watch leaves under -dir) have every line mentioning the address removed. run once per bucket if rejects
+// go to a quarantine bucket too
+func runErase(args []string) {
+	flags := flag.NewFlagSet("erase", flag.ExitOnError)
+	reference := flags.String(`reference`, ``, `Kept on the tombstone, e.g. a ticket number`)
+	bucket := flags.String(`bucket`, ``, `Scrub the rejects files in this bucket`)
+	prefix := flags.String(`prefix`, ``, `Only scrub rejects files under this prefix of -bucket`)
+	rejectsDir := flags.String(`dir`, ``, `Scrub the rejects files under this directory (where watch put them)`)
+	localDynamo := flags.Bool(`localdb`, true, `Erase from the local dynamodb instance (-localdb=false for the configured/AWS one)`)
+	cfgFlags := config.AddFlags(flags)
+	flags.Parse(args)
+	cfg := loadConfig(cfgFlags, *localDynamo)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	email := flags.Arg(0)
+	if _, _, err := credstore.SplitAddress(email); err != nil {
+		log.Fatalf("%s", err)
+	}
+	keys := newKeyHasher(cfg)
+	if keys == nil {
+		log.Printf("no lookup key configured (-lookup-key); erasing without a tombstone, so a later ingest may store the address again")
+	}
+
+	ctx := context.TODO()
+	tables := credstore.ErasureTables{
+		Credentials:       cfg.Tables.Credentials,
+		SourceCredentials: cfg.Tables.SourceCredentials,
+		Tombstones:        cfg.Tables.Tombstones,
+		Watchlist:         cfg.Tables.Watchlist,
+		Canaries:          cfg.Tables.Canaries,
+	}
+	erasure, eraseErr := credstore.Erase(ctx, newDynamoDBClient(cfg), tables, keys, email, *reference)
+	if erasure != nil {
+		tombstone := "no tombstone"
+		if erasure.Tombstone != nil {
+			tombstone = "tombstone " + erasure.Tombstone.Key
+		}
+		fmt.Printf("%s: found %t, %d passwords, %d source links, %d watches, canary %t\n",
+			tombstone, erasure.Found, erasure.Passwords, erasure.SourceLinks, erasure.Watches, erasure.Canary)
+	}
+	if eraseErr != nil {
+		log.Fatalf("erase failed (it's safe to run again): %s", eraseErr)
+	}
+
+	failed := false
+	if *bucket != "" {
+		sdkConfig, err := cfg.AWSConfig(ctx)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		stats, scrubErr := postprocess.ScrubRejects(ctx, cfg.S3Client(sdkConfig), *bucket, *prefix, email)
+		fmt.Printf("%s/%s: %d rejects files, %d rewritten, %d lines removed\n", *bucket, *prefix, stats.Files, stats.Rewritten, stats.Lines)
+		if scrubErr != nil {
+			log.Printf("failed to scrub rejects files: %s", scrubErr)
+			failed = true
+		}
+	}
+	if *rejectsDir != "" {
+		files, rewritten, lines, scrubErr := scrubRejectsDir(*rejectsDir, email)
+		fmt.Printf("%s: %d rejects files, %d rewritten, %d lines removed\n", *rejectsDir, files, rewritten, lines)
+		if scrubErr != nil {
+			log.Printf("failed to scrub rejects files: %s", scrubErr)
+			failed = true
+		}
+	}
+	if failed {
+		log.Fatalf("some rejects files still mention the address; it's safe to run again")
+	}
+}
+
+// the on-disk version of postprocess.ScrubRejects
+func scrubRejectsDir(dir, email string) (files, rewritten, lines int, err error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	var errs []error
+	walkErr := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, postprocess.REJECTS_SUFFIX) {
+			return nil
+		}
+		files++
+
+		fh, err := os.Open(path)
+		if err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		kept, removed, err := postprocess.ScrubRejectLines(fh, email)
+		fh.Close()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to read %s: %s", path, err))
+			return nil
+		}
+		switch {
+		case removed == 0:
+		case len(kept) == 0:
+			err = os.Remove(path)
+		default:
+			err = os.WriteFile(path, kept, 0o600)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		if removed > 0 {
+			rewritten++
+			lines += removed
+		}
+		return nil
+	})
+	return files, rewritten, lines, errors.Join(append(errs, walkErr)...)
+}
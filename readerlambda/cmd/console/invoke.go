@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/newodahs/readerlambda/internal/handler"
+	"github.com/newodahs/readerlambda/pkg/awsfake"
+	"github.com/newodahs/readerlambda/pkg/config"
+	"github.com/newodahs/readerlambda/pkg/jobs"
+	"github.com/newodahs/readerlambda/pkg/util"
+)
+
+// invoke -event <file> [-seed <file>] [-localdb] [-s3-endpoint <url>] [config flags]
+//
+// runs the real lambda handler on a synthetic event (see test/events); S3 and dynamodb are in-memory
+// fakes unless pointed at local stand-ins (minio/localstack for S3, dynamodb-local for dynamodb)
+func runInvoke(args []string) {
+	flags := flag.NewFlagSet("invoke", flag.ExitOnError)
+	eventFile := flags.String(`event`, ``, `JSON event to hand the lambda handler (S3, SQS, EventBridge or continuation)`)
+	seedFile := flags.String(`seed`, `./test/challenge_creds.txt`, `File uploaded to every object the event refers to when using the in-memory S3 (empty to not seed)`)
+	localDynamo := flags.Bool(`localdb`, false, `If set, use the local dynamodb instance instead of an in-memory one`)
+	cfgFlags := config.AddFlags(flags) // -s3-endpoint to use an S3-compatible endpoint instead of an in-memory S3
+	flags.Parse(args)
+	cfg := loadConfig(cfgFlags, *localDynamo)
+
+	if *eventFile == "" {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	raw, readErr := os.ReadFile(*eventFile)
+	if readErr != nil {
+		log.Fatalf("failed to read event: %s", readErr)
+	}
+
+	var dynDB util.DynamoDBAPI
+	fakeDynDB := awsfake.NewDynamoDB()
+	if *localDynamo {
+		dynDB = newDynamoDBClient(cfg)
+	} else {
+		dynDB = fakeDynDB
+	}
+
+	var s3Cli handler.S3API
+	fakeS3 := awsfake.NewS3()
+	if cfg.S3Endpoint != "" {
+		sdkConfig, sdkErr := cfg.AWSConfig(context.TODO())
+		if sdkErr != nil {
+			log.Fatalf("%s", sdkErr)
+		}
+		s3Cli = cfg.S3Client(sdkConfig)
+	} else {
+		s3Cli = fakeS3
+		if *seedFile != "" {
+			seedObjects(fakeS3, raw, *seedFile)
+		}
+	}
+
+	// no SQS here; continuations fall back to returning an error (as they would without a queue configured)
+	h, hErr := handler.NewFromEnv(cfg, s3Cli, dynDB, nil)
+	if hErr != nil {
+		log.Fatalf("failed to setup handler: %s", hErr)
+	}
+
+	resp, runErr := h.HandleRequest(context.Background(), raw)
+	if resp != nil {
+		out, _ := json.MarshalIndent(resp, "", "  ")
+		fmt.Printf("response:\n%s\n", out)
+	}
+	if runErr != nil {
+		fmt.Printf("handler returned error: %s\n", runErr)
+	}
+
+	// what the run left behind
+	jobList, jobErr := jobs.List(context.TODO(), dynDB, cfg.Tables.Jobs, "", 10)
+	if jobErr != nil {
+		log.Printf("WARNING: failed to list jobs: %s", jobErr)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nJOB\tSTATUS\tOBJECT\tLINES\tACCEPTED\tREJECTED\tWRITE FAILURES")
+	for _, job := range jobList {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\t%d\n", job.ID, job.Status, job.Object(), job.LinesRead, job.Accepted, job.TotalRejected(), job.WriteFailures)
+	}
+	tw.Flush()
+
+	if !*localDynamo {
+		fmt.Println("\ntables:")
+		for _, table := range fakeDynDB.Tables() {
+			fmt.Printf("  %s: %d items\n", table, len(fakeDynDB.Items(table)))
+		}
+	}
+	if cfg.S3Endpoint == "" {
+		objs, _ := handler.EventObjects(raw)
+		seen := map[string]bool{}
+		for _, obj := range objs {
+			bucket, _, _ := strings.Cut(obj, "/")
+			if seen[bucket] {
+				continue
+			}
+			seen[bucket] = true
+			fmt.Printf("\nbucket %s now holds:\n", bucket)
+			for _, key := range fakeS3.Keys(bucket) {
+				fmt.Printf("  %s\n", key)
+			}
+		}
+	}
+
+	if runErr != nil {
+		os.Exit(1)
+	}
+}
+
+// puts the contents of seedFile at every object the event mentions
+func seedObjects(fakeS3 *awsfake.S3, raw []byte, seedFile string) {
+	body, readErr := os.ReadFile(seedFile)
+	if readErr != nil {
+		log.Fatalf("failed to read seed file: %s", readErr)
+	}
+
+	objs, objErr := handler.EventObjects(raw)
+	if objErr != nil {
+		log.Fatalf("failed to find objects in event: %s", objErr)
+	}
+	for _, obj := range objs {
+		bucket, key, _ := strings.Cut(obj, "/")
+		fakeS3.Put(bucket, key, body, nil)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/newodahs/readerlambda/pkg/config"
+	"github.com/newodahs/readerlambda/pkg/jobs"
+)
+
+// jobs list [-status <status>] [-limit N] [-localdb=false] [config flags]
+// jobs get [-localdb=false] [config flags] <jobId>
+func runJobs(args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "usage:\n  %[1]s jobs list [-status running|succeeded|partial|failed] [-limit N]\n  %[1]s jobs get <jobId>\n", os.Args[0])
+		os.Exit(1)
+	}
+	if len(args) < 1 {
+		usage()
+	}
+
+	flags := flag.NewFlagSet("jobs "+args[0], flag.ExitOnError)
+	status := flags.String(`status`, ``, `Only list jobs in this status (list only)`)
+	limit := flags.Int(`limit`, 25, `Maximum number of jobs to list (0 for all; list only)`)
+	localDynamo := flags.Bool(`localdb`, true, `Read from the local dynamodb instance (-localdb=false for the configured/AWS one)`)
+	cfgFlags := config.AddFlags(flags)
+	flags.Parse(args[1:])
+	cfg := loadConfig(cfgFlags, *localDynamo)
+	cli := newDynamoDBClient(cfg)
+
+	switch args[0] {
+	case "list":
+		jobList, err := jobs.List(context.TODO(), cli, cfg.Tables.Jobs, jobs.Status(*status), *limit)
+		if err != nil {
+			log.Fatalf("failed to list jobs: %s", err)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tSTARTED\tSTATUS\tOBJECT\tLINES\tACCEPTED\tREJECTED\tWRITE FAILURES")
+		for _, job := range jobList {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\n", job.ID, job.Started.Format("2006-01-02 15:04:05"), job.Status, job.Object(), job.LinesRead, job.Accepted, job.TotalRejected(), job.WriteFailures)
+		}
+		tw.Flush()
+
+	case "get":
+		if flags.NArg() < 1 {
+			usage()
+		}
+
+		job, err := jobs.Get(context.TODO(), cli, cfg.Tables.Jobs, flags.Arg(0))
+		if err != nil {
+			log.Fatalf("failed to get job: %s", err)
+		}
+		if job == nil {
+			log.Fatalf("job [%s] not found", flags.Arg(0))
+		}
+
+		out, _ := json.MarshalIndent(job, "", "  ")
+		fmt.Println(string(out))
+
+	default:
+		usage()
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/newodahs/readerlambda/pkg/config"
+	"github.com/newodahs/readerlambda/pkg/credstore"
+	"github.com/newodahs/readerlambda/pkg/envelope"
+)
+
+const (
+	DEFAULT_REKEY_STATE_FILE    = "rekey-state.json"
+	DEFAULT_HASHKEYS_STATE_FILE = "hashkeys-state.json"
+)
+
+// keys -file <key file> | -lookup
+//
+// creates a local key file, or adds a new master key to an existing one and makes it current; run rekey
+// afterwards to move stored passwords onto it (old keys stay in the file so they can still be opened).
+// -lookup prints a new random lookup key (for hashed keys) instead
+func runKeys(args []string) {
+	flags := flag.NewFlagSet("keys", flag.ExitOnError)
+	keyFile := flags.String(`file`, ``, `Local key file to create or rotate`)
+	lookup := flags.Bool(`lookup`, false, `Print a new lookup key (base64) for storing credentials under hashed keys`)
+	flags.Parse(args)
+
+	if *lookup {
+		secret := make([]byte, credstore.MIN_LOOKUP_KEY_SIZE)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatalf("failed to generate lookup key: %s", err)
+		}
+		fmt.Println(base64.StdEncoding.EncodeToString(secret))
+		return
+	}
+
+	if *keyFile == "" {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	var keys *envelope.LocalKeys
+	if _, statErr := os.Stat(*keyFile); statErr == nil {
+		var loadErr error
+		if keys, loadErr = envelope.LoadKeyFile(*keyFile); loadErr != nil {
+			log.Fatalf("%s", loadErr)
+		}
+	} else if !errors.Is(statErr, os.ErrNotExist) {
+		log.Fatalf("failed to check key file: %s", statErr)
+	}
+
+	keys, keyID, err := keys.Rotate()
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	if err := keys.Save(*keyFile); err != nil {
+		log.Fatalf("%s", err)
+	}
+	fmt.Printf("%s: current master key is now [%s] (%d keys in the file)\n", *keyFile, keyID, len(keys.KeyIDs()))
+}
+
+// rekey [-state <file>] [-segments N] [-page N] [-dry-run] [-localdb=false] [config flags]
+//
+// re-wraps every stored password's data key with the key provider's current master key (sealing any that
+// are still plaintext); resumable the same way migrate is
+func runRekey(args []string) {
+	flags := flag.NewFlagSet("rekey", flag.ExitOnError)
+	stateFile := flags.String(`state`, DEFAULT_REKEY_STATE_FILE, `File the re-key's progress is kept in; resumed from if it exists`)
+	segments := flags.Int(`segments`, credstore.DEFAULT_MIGRATE_SEGMENTS, `Number of parallel scan segments (new runs only)`)
+	pageSize := flags.Int(`page`, credstore.DEFAULT_MIGRATE_PAGE_SIZE, `Items evaluated per scan request`)
+	dryRun := flags.Bool(`dry-run`, false, `Count what would be re-keyed without writing anything (the state file isn't touched)`)
+	localDynamo := flags.Bool(`localdb`, true, `Re-key the local dynamodb instance (-localdb=false for the configured/AWS one)`)
+	cfgFlags := config.AddFlags(flags)
+	flags.Parse(args)
+	cfg := loadConfig(cfgFlags, *localDynamo)
+
+	cipher := newCipher(cfg)
+	if cipher == nil {
+		log.Fatalf("no key provider configured (-key-provider)")
+	}
+
+	state, err := loadMigrationState(*stateFile)
+	switch {
+	case err != nil:
+		log.Fatalf("%s", err)
+	case *dryRun || state == nil:
+		state = credstore.NewRekeyState(cfg.Tables.Credentials, *segments, cipher.CurrentKeyID())
+	case !state.IsRekey():
+		log.Fatalf("state file [%s] isn't for a re-key; use another -state", *stateFile)
+	case state.Table != cfg.Tables.Credentials:
+		log.Fatalf("state file [%s] is for table [%s], not [%s]; use another -state", *stateFile, state.Table, cfg.Tables.Credentials)
+	case state.Done() && state.TargetKeyID == cipher.CurrentKeyID():
+		log.Printf("re-key in [%s] already finished; remove it to start again", *stateFile)
+		printMigrationTotals(state)
+		return
+	case state.TargetKeyID != cipher.CurrentKeyID():
+		log.Printf("master key changed since [%s] was started; starting over for [%s]", *stateFile, cipher.CurrentKeyID())
+		state = credstore.NewRekeyState(cfg.Tables.Credentials, *segments, cipher.CurrentKeyID())
+	default:
+		log.Printf("resuming re-key from [%s]", *stateFile)
+	}
+
+	mig := credstore.NewMigrator(newDynamoDBClient(cfg))
+	mig.Cipher = cipher
+	mig.PageSize = *pageSize
+	mig.DryRun = *dryRun
+	if !*dryRun {
+		mig.OnProgress = func(state *credstore.MigrationState) error { return saveMigrationState(*stateFile, state) }
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	runErr := mig.Run(ctx, state)
+	printMigrationTotals(state)
+	if errors.Is(runErr, context.Canceled) {
+		log.Printf("interrupted; run again to carry on from [%s]", *stateFile)
+		os.Exit(1)
+	}
+	if runErr != nil {
+		log.Fatalf("re-key failed: %s", runErr)
+	}
+}
+
+// hashkeys [-state <file>] [-segments N] [-page N] [-dry-run] [-localdb=false] [config flags]
+//
+// moves every credential still stored under its plain domain/user (from before the lookup key was turned on)
+// to its hashed key, source links and all; resumable the same way migrate is. without a lookup key it moves
+// plain items stored under a differently cased key (from before those were canonicalised) instead
+func runHashKeys(args []string) {
+	flags := flag.NewFlagSet("hashkeys", flag.ExitOnError)
+	stateFile := flags.String(`state`, DEFAULT_HASHKEYS_STATE_FILE, `File the move's progress is kept in; resumed from if it exists`)
+	segments := flags.Int(`segments`, credstore.DEFAULT_MIGRATE_SEGMENTS, `Number of parallel scan segments (new runs only)`)
+	pageSize := flags.Int(`page`, credstore.DEFAULT_MIGRATE_PAGE_SIZE, `Items evaluated per scan request`)
+	dryRun := flags.Bool(`dry-run`, false, `Count what would be moved without writing anything (the state file isn't touched)`)
+	localDynamo := flags.Bool(`localdb`, true, `Move credentials in the local dynamodb instance (-localdb=false for the configured/AWS one)`)
+	cfgFlags := config.AddFlags(flags)
+	flags.Parse(args)
+	cfg := loadConfig(cfgFlags, *localDynamo)
+
+	keys := newKeyHasher(cfg)
+	cipher := newCipher(cfg)
+	if keys != nil && cipher == nil {
+		log.Fatalf("no key provider configured (-key-provider)")
+	}
+	if keys == nil {
+		log.Printf("no lookup key configured (-lookup-key); only moving plain keys to their lowercased form")
+	}
+
+	state, err := loadMigrationState(*stateFile)
+	switch {
+	case err != nil:
+		log.Fatalf("%s", err)
+	case *dryRun || state == nil:
+		state = credstore.NewHashKeysState(cfg.Tables.Credentials, *segments)
+	case !state.IsHashKeys():
+		log.Fatalf("state file [%s] isn't for moving to hashed keys; use another -state", *stateFile)
+	case state.Table != cfg.Tables.Credentials:
+		log.Fatalf("state file [%s] is for table [%s], not [%s]; use another -state", *stateFile, state.Table, cfg.Tables.Credentials)
+	case state.Done():
+		log.Printf("move in [%s] already finished; remove it to start again", *stateFile)
+		printMigrationTotals(state)
+		return
+	default:
+		log.Printf("resuming move to hashed keys from [%s]", *stateFile)
+	}
+
+	mig := credstore.NewMigrator(newDynamoDBClient(cfg))
+	mig.Cipher = cipher
+	mig.Keys = keys
+	mig.LinkTable = cfg.Tables.SourceCredentials
+	mig.PageSize = *pageSize
+	mig.DryRun = *dryRun
+	if !*dryRun {
+		mig.OnProgress = func(state *credstore.MigrationState) error { return saveMigrationState(*stateFile, state) }
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	runErr := mig.Run(ctx, state)
+	printMigrationTotals(state)
+	if errors.Is(runErr, context.Canceled) {
+		log.Printf("interrupted; run again to carry on from [%s]", *stateFile)
+		os.Exit(1)
+	}
+	if runErr != nil {
+		log.Fatalf("move to hashed keys failed: %s", runErr)
+	}
+}
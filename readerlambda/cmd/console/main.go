@@ -5,84 +5,306 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
-	"net/url"
 	"os"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	transport "github.com/aws/smithy-go/endpoints"
+	"github.com/newodahs/readerlambda/pkg/alerts"
+	"github.com/newodahs/readerlambda/pkg/config"
 	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/credstore"
+	"github.com/newodahs/readerlambda/pkg/envelope"
+	"github.com/newodahs/readerlambda/pkg/ingest"
+	"github.com/newodahs/readerlambda/pkg/jobs"
+	"github.com/newodahs/readerlambda/pkg/sources"
 	"github.com/newodahs/readerlambda/pkg/util"
+	"github.com/newodahs/readerlambda/pkg/webhook"
 )
 
-type Resolver struct {
-	URL *url.URL
+// sub-commands; anything else (or nothing) falls through to the original ingest-a-file behavior
+var commands = map[string]func(args []string){
+	"jobs":      runJobs,
+	"invoke":    runInvoke,
+	"watch":     runWatch,
+	"migrate":   runMigrate,
+	"keys":      runKeys,
+	"rekey":     runRekey,
+	"hashkeys":  runHashKeys,
+	"purge":     runPurge,
+	"reconcile": runReconcile,
+	"ntlm":      runNTLM,
+	"rescore":   runRescore,
+	"erase":     runErase,
 }
 
-func (r *Resolver) ResolveEndpoint(_ context.Context, params dynamodb.EndpointParameters) (transport.Endpoint, error) {
-	u := *r.URL
-	return transport.Endpoint{URI: u}, nil
+func main() {
+	if len(os.Args) > 1 {
+		if cmd, found := commands[os.Args[1]]; found {
+			cmd(os.Args[2:])
+			return
+		}
+	}
+
+	runIngest(os.Args[1:])
 }
 
-func main() {
-	credFile := flag.String(`credfile`, `./test/challenge_creds.txt`, `Pass the name of the file where the credentials to be read are stored`)
-	localDynamo := flag.Bool(`localdb`, false, `If set, will attempt to write to a local dynamodb instance`)
-	flag.Parse()
+// loads the shared config for a sub-command's (parsed) flags; localDynamo (-localdb) points us at dynamodb-local
+func loadConfig(cfgFlags *config.Flags, localDynamo bool) *config.Config {
+	cfg, err := cfgFlags.Load()
+	if err != nil {
+		log.Fatalf("bad configuration: %s", err)
+	}
+	if localDynamo {
+		cfg.UseLocalDynamoDB()
+	}
+	return cfg
+}
+
+func newDynamoDBClient(cfg *config.Config) *dynamodb.Client {
+	sdkConfig, err := cfg.AWSConfig(context.TODO())
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	return cfg.DynamoDBClient(sdkConfig)
+}
+
+// nil if passwords aren't encrypted
+func newCipher(cfg *config.Config) *envelope.Cipher {
+	cipher, err := cfg.NewCipher(context.TODO())
+	if err != nil {
+		log.Fatalf("bad key provider configuration: %s", err)
+	}
+	return cipher
+}
 
-	if credFile == nil {
-		flag.Usage()
-		os.Exit(1)
+// nil unless credentials are stored under hashed keys
+func newKeyHasher(cfg *config.Config) *credstore.KeyHasher {
+	keys, err := cfg.NewKeyHasher()
+	if err != nil {
+		log.Fatalf("bad lookup key: %s", err)
 	}
+	return keys
+}
 
-	//parse the credentials file
-	credList, err := credparser.GetCredentialInfoFile(*credFile)
+// nil unless some alert destination (webhooks included) is configured
+func newAlertNotifier(cfg *config.Config, webhooks *webhook.Sender) alerts.Notifier {
+	notifier, err := cfg.NewNotifier(context.TODO(), webhooks)
 	if err != nil {
-		var wrapErr error
-		for ; wrapErr != nil; wrapErr = errors.Unwrap(err) {
-			log.Printf("%s", wrapErr)
+		log.Fatalf("bad alert configuration: %s", err)
+	}
+	return notifier
+}
+
+func runIngest(args []string) {
+	// exit only once ingest has returned, so the rejects file (and output) it opened get closed
+	err := ingestCmd(args, os.Stdout, os.Stderr)
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		log.Fatalf("%s", err)
+	}
+}
+
+// the original ingest-a-file behavior; parsed credentials go to stdout, the summary (if asked for) to stderr
+func ingestCmd(args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	credFile := flags.String(`credfile`, `./test/challenge_creds.txt`, `Pass the name of the file where the credentials to be read are stored`)
+	localDynamo := flags.Bool(`localdb`, false, `If set, will attempt to write to a local dynamodb instance`)
+	manifestFile := flags.String(`manifest`, ``, `Optional source manifest (JSON) describing the breach the credential file came from`)
+	dryRun := flags.Bool(`dry-run`, false, `Parse and print only; nothing is written to dynamodb even with -localdb`)
+	format := flags.String(`format`, FORMAT_TEXT, fmt.Sprintf(`Output format for parsed credentials; one of %v`, outputFormats))
+	rejectsOut := flags.String(`rejects`, ``, `Write rejected lines (JSON, one per line) to this file instead of logging them`)
+	summary := flags.Bool(`summary`, false, `Print counts (including rejects by reason) to stderr when done`)
+	cfgFlags := config.AddFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *credFile == "" {
+		flags.Usage()
+		return errors.New("no credentials file given (-credfile)")
+	}
+
+	cfg, cfgErr := cfgFlags.Load()
+	if cfgErr != nil {
+		return fmt.Errorf("bad configuration: %s", cfgErr)
+	}
+	if *localDynamo && !*dryRun {
+		cfg.UseLocalDynamoDB()
+	}
+
+	out, fmtErr := newRecordWriter(*format, stdout)
+	if fmtErr != nil {
+		return fmtErr
+	}
+
+	var src *sources.Source
+	if *manifestFile != "" {
+		var mfErr error
+		if src, mfErr = loadManifest(*manifestFile); mfErr != nil {
+			return mfErr
 		}
-		log.Printf("%s", err)
 	}
 
 	//if set, ensure the local dynamodb instance is accessable
-	var cli *dynamodb.Client
-	if *localDynamo {
-		log.Printf("Writing credential data to local dynamodb...")
+	var cli util.DynamoDBAPI // left as a nil interface (not a nil *dynamodb.Client) so the ingester knows to only parse
+	if *localDynamo && *dryRun {
+		log.Printf("Dry run; not writing to local dynamodb")
+	} else if *localDynamo {
+		log.Printf("Writing credential data to local dynamodb (%s)...", cfg.DynamoDBEndpoint)
+		sdkConfig, sdkErr := cfg.AWSConfig(context.TODO())
+		if sdkErr != nil {
+			return sdkErr
+		}
+		cli = cfg.DynamoDBClient(sdkConfig)
+	}
 
-		dynamoDBURL, parseErr := url.Parse("http://localhost:8000")
-		if parseErr != nil {
-			log.Fatalf("failed to parse local dynamodb url: %s", parseErr)
+	ing := cfg.NewIngester(cli)
+	if cli != nil {
+		var err error
+		if ing.Cipher, err = cfg.NewCipher(context.TODO()); err != nil {
+			return fmt.Errorf("bad key provider configuration: %s", err)
+		}
+		if ing.Keys, err = cfg.NewKeyHasher(); err != nil {
+			return fmt.Errorf("bad lookup key: %s", err)
+		}
+		ing.Webhooks = cfg.NewWebhookSender(cli)
+		if ing.Notifier, err = cfg.NewNotifier(context.TODO(), ing.Webhooks); err != nil {
+			return fmt.Errorf("bad alert configuration: %s", err)
+		}
+	}
+	ing.OnReject = func(pe *credparser.ParseError) { log.Printf("%s", pe) }
+	if *rejectsOut != "" {
+		rejFh, rejErr := createRejectsFile(*rejectsOut)
+		if rejErr != nil {
+			return rejErr
 		}
+		defer rejFh.Close()
 
-		cli = dynamodb.New(dynamodb.Options{
-			EndpointResolverV2: &Resolver{URL: dynamoDBURL},
-			Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
-				return aws.Credentials{
-					AccessKeyID:     `fakeMyKeyId`,
-					SecretAccessKey: `fakeSecretAccessKey`,
-				}, nil
-			}),
-			Region: `fakeRegion`,
-		})
-
-		if setupErr := util.EnsureDynamoDBTable(context.TODO(), cli, `exploitedCredentials`, credparser.CredentialInfo{}); setupErr != nil {
-			log.Printf("failed to setup exploitedCredentials table in local dynamodb: %s", setupErr)
+		ing.OnReject = func(pe *credparser.ParseError) {
+			if err := rejFh.Write(pe); err != nil {
+				log.Printf("WARNING: failed to write reject: %s", err)
+			}
 		}
 	}
 
-	for _, cred := range credList {
-		// for our own sanity (in test), print out what we parsed
-		fmt.Printf("User: %s; Domain: %s; Email: %s; Password: %s\n", cred.User, cred.Domain, cred.Email, cred.Password)
+	// if we can't write the output there's no point carrying on; stop after the batch we're in
+	credCnt := 0
+	var outErr error
+	ing.OnCredential = func(cred *credparser.CredentialInfo, stored bool) {
+		credCnt++
+		if outErr == nil {
+			outErr = out.Write(cred)
+		}
+	}
+	ing.OnCheckpoint = func(pos ingest.Position) bool { return outErr == nil }
 
-		// if set, dump the parse cred to the local dynamodb instance
-		if *localDynamo && cli != nil {
-			if _, putErr := cli.PutItem(context.TODO(), &dynamodb.PutItemInput{
-				Item:      cred.GetKey(),
-				TableName: aws.String(`exploitedCredentials`),
-			}); putErr != nil {
-				log.Printf("failed to store exploited credential [%s] to dynamodb: %s", cred, putErr)
-			}
+	if cli != nil {
+		if setupErr := ing.EnsureTables(context.TODO()); setupErr != nil {
+			log.Printf("failed to setup tables in local dynamodb: %s", setupErr)
 		}
+		saveSource(context.TODO(), cli, cfg.Tables.Sources, cfg.TableOptions, src)
+	}
+
+	job, _, runErr := ingestFile(context.TODO(), ing, *credFile, src)
+	if closeErr := out.Close(); closeErr != nil && outErr == nil {
+		outErr = closeErr
+	}
+	if job == nil {
+		return runErr
+	}
+	if outErr != nil {
+		// the run stopped for us rather than finishing; don't leave the job running
+		ing.Fail(context.TODO(), job, fmt.Errorf("failed to write output: %s", outErr))
+	}
+
+	if *summary {
+		printSummary(stderr, job, credCnt, cli != nil, *dryRun)
+	} else {
+		log.Printf("job [%s] %s: %d lines, %d accepted, %d rejected, %d write failures", job.ID, job.Status, job.LinesRead, job.Accepted, job.TotalRejected(), job.WriteFailures)
+	}
+
+	if outErr != nil {
+		return fmt.Errorf("failed to write output: %s", outErr)
+	}
+	if runErr != nil {
+		return fmt.Errorf("failed while ingesting [%s]: %s", *credFile, runErr)
+	}
+	return nil
+}
+
+func loadManifest(filename string) (*sources.Source, error) {
+	mf, openErr := os.Open(filename)
+	if openErr != nil {
+		return nil, fmt.Errorf("failed to open source manifest: %s", openErr)
+	}
+	defer mf.Close()
+
+	src, parseErr := sources.ParseManifest(mf)
+	if parseErr != nil {
+		return nil, fmt.Errorf("failed to parse source manifest: %s", parseErr)
+	}
+	return src, nil
+}
+
+// records src (if there is one) in the local dynamodb; failures are only logged
+func saveSource(ctx context.Context, cli util.DynamoDBAPI, tableName string, tableOpts *util.TableOptions, src *sources.Source) {
+	if src == nil {
+		return
+	}
+	if setupErr := util.EnsureDynamoDBTable(ctx, cli, tableName, sources.Source{}, tableOpts); setupErr != nil {
+		log.Printf("failed to setup %s table in local dynamodb: %s", tableName, setupErr)
+	}
+	if _, saveErr := sources.Save(ctx, cli, tableName, src); saveErr != nil {
+		log.Printf("failed to store source [%s]: %s", src.ID, saveErr)
+	}
+}
+
+// runs filename through ing as a new job; returns the job (nil if the file couldn't be opened) and the
+// rejected lines, along with any hook ing already had
+func ingestFile(ctx context.Context, ing *ingest.Ingester, filename string, src *sources.Source) (*jobs.Job, []*credparser.ParseError, error) {
+	credFh, openErr := os.Open(filename)
+	if openErr != nil {
+		return nil, nil, fmt.Errorf("failed to open credentials file: %s", openErr)
+	}
+	defer credFh.Close()
+
+	job := jobs.New()
+	job.Filename = filename
+	if src != nil {
+		job.SourceID = src.ID
+		job.BreachDate = src.BreachDate
+	}
+	if info, statErr := credFh.Stat(); statErr == nil {
+		job.Size = info.Size()
+	}
+
+	var rejects []*credparser.ParseError
+	prevOnReject := ing.OnReject
+	ing.OnReject = func(pe *credparser.ParseError) {
+		rejects = append(rejects, pe)
+		if prevOnReject != nil {
+			prevOnReject(pe)
+		}
+	}
+	defer func() { ing.OnReject = prevOnReject }()
+
+	runErr := ing.Run(ctx, credFh, job)
+	sendWebhooks(ctx, ing.Webhooks)
+	return job, rejects, runErr
+}
+
+// sends the webhooks the ingest queued (and any others that are due); there's no schedule here to pick
+// them up, unlike the lambda. ones that fail stay queued for the next run
+func sendWebhooks(ctx context.Context, sender *webhook.Sender) {
+	if sender == nil {
+		return
+	}
+	stats, err := sender.Retry(ctx)
+	if err != nil {
+		log.Printf("WARNING: failed to send webhooks: %s", err)
+	}
+	if stats.Due > 0 {
+		log.Printf("webhooks: %d due, %d delivered, %d still pending, %d failed, %d skipped",
+			stats.Due, stats.Delivered, stats.Pending, stats.Failed, stats.Skipped)
 	}
 }
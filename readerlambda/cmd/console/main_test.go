@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fails every write, like a closed pipe
+type brokenWriter struct{}
+
+func (brokenWriter) Write(p []byte) (int, error) { return 0, errors.New("broken pipe") }
+
+func Test_Console_Ingest(t *testing.T) {
+	dir := t.TempDir()
+	credFile := filepath.Join(dir, "dump.txt")
+	if err := os.WriteFile(credFile, []byte("one@a.com:pw1\ngarbage\ntwo@b.com:pw2\none@a.com:pw1\n"), 0o600); err != nil {
+		t.Fatalf("failed to write dump: %s", err)
+	}
+
+	testSet := []struct {
+		Name          string
+		Args          []string
+		BrokenOut     bool
+		ExpectErr     string // substring; empty for no error
+		ExpectSummary string // substring of stderr; empty for no summary
+		ExpectOut     int    // credentials written to stdout
+	}{
+		{Name: "Parse Only", Args: []string{"-summary"}, ExpectSummary: "summary (parse only; nothing stored without -localdb)", ExpectOut: 2},
+		{Name: "Dry Run", Args: []string{"-summary", "-dry-run"}, ExpectSummary: "summary (dry run; nothing stored)", ExpectOut: 2},
+		{Name: "Dry Run With Local DB", Args: []string{"-summary", "-dry-run", "-localdb"}, ExpectSummary: "summary (dry run; nothing stored)", ExpectOut: 2},
+		{Name: "No Summary", Args: nil, ExpectOut: 2},
+		{Name: "Broken Output", Args: []string{"-summary"}, BrokenOut: true, ExpectErr: "failed to write output", ExpectSummary: "summary ("},
+		{Name: "Missing File", Args: []string{"-credfile", filepath.Join(dir, "missing.txt")}, ExpectErr: "failed to open credentials file"},
+		{Name: "Bad Format", Args: []string{"-format", "xml"}, ExpectErr: "unknown format"},
+	}
+
+	for _, test := range testSet {
+		t.Run(test.Name, func(t *testing.T) {
+			rejectsFile := filepath.Join(t.TempDir(), "rejects.jsonl")
+			args := append([]string{"-credfile", credFile, "-rejects", rejectsFile}, test.Args...)
+
+			stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+			var out io.Writer = stdout
+			if test.BrokenOut {
+				out = brokenWriter{}
+			}
+
+			err := ingestCmd(args, out, stderr)
+			if test.ExpectErr == "" && err != nil {
+				t.Fatalf("ingest failed: %s", err)
+			}
+			if test.ExpectErr != "" && (err == nil || !strings.Contains(err.Error(), test.ExpectErr)) {
+				t.Fatalf("expected an error containing [%s], got %v", test.ExpectErr, err)
+			}
+
+			if got := stderr.String(); (test.ExpectSummary == "") != (got == "") || !strings.Contains(got, test.ExpectSummary) {
+				t.Errorf("expected summary containing [%s], got [%s]", test.ExpectSummary, got)
+			}
+			if got := strings.Count(stdout.String(), "\n"); got != test.ExpectOut {
+				t.Errorf("expected %d credentials written, got %d: %s", test.ExpectOut, got, stdout)
+			}
+
+			// the rejects file is closed (and complete) whether or not the run worked out
+			if test.ExpectErr != "" && test.ExpectSummary == "" {
+				return // never got as far as reading the dump
+			}
+			rejects, readErr := os.ReadFile(rejectsFile)
+			if readErr != nil {
+				t.Fatalf("failed to read rejects file: %s", readErr)
+			}
+			lines := 0
+			for scanner := bufio.NewScanner(bytes.NewReader(rejects)); scanner.Scan(); {
+				lines++
+			}
+			if lines != 2 {
+				t.Errorf("expected the garbage line and the duplicate in the rejects file, got [%s]", rejects)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/newodahs/readerlambda/pkg/config"
+	"github.com/newodahs/readerlambda/pkg/credstore"
+)
+
+const DEFAULT_MIGRATE_STATE_FILE = "migrate-state.json"
+
+// migrate [-state <file>] [-segments N] [-page N] [-dry-run] [-localdb=false] [config flags]
+//
+// rewrites credentials stored at an older schema version at the current one; progress is saved to the
+// state file after every page, so running it again after an interruption (ctrl-c included) carries on
+func runMigrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	stateFile := flags.String(`state`, DEFAULT_MIGRATE_STATE_FILE, `File the migration's progress is kept in; resumed from if it exists`)
+	segments := flags.Int(`segments`, credstore.DEFAULT_MIGRATE_SEGMENTS, `Number of parallel scan segments (new migrations only)`)
+	pageSize := flags.Int(`page`, credstore.DEFAULT_MIGRATE_PAGE_SIZE, `Items evaluated per scan request`)
+	dryRun := flags.Bool(`dry-run`, false, `Count what would be migrated without writing anything (the state file isn't touched)`)
+	localDynamo := flags.Bool(`localdb`, true, `Migrate the local dynamodb instance (-localdb=false for the configured/AWS one)`)
+	cfgFlags := config.AddFlags(flags)
+	flags.Parse(args)
+	cfg := loadConfig(cfgFlags, *localDynamo)
+
+	state, err := loadMigrationState(*stateFile)
+	switch {
+	case err != nil:
+		log.Fatalf("%s", err)
+	case *dryRun || state == nil:
+		state = credstore.NewMigrationState(cfg.Tables.Credentials, *segments)
+	case state.IsRekey() || state.IsHashKeys():
+		log.Fatalf("state file [%s] is for %s, not a migration; use another -state", *stateFile, state.Kind)
+	case state.Table != cfg.Tables.Credentials:
+		log.Fatalf("state file [%s] is for table [%s], not [%s]; use another -state", *stateFile, state.Table, cfg.Tables.Credentials)
+	case state.Done():
+		log.Printf("migration in [%s] already finished; remove it to start again", *stateFile)
+		printMigrationTotals(state)
+		return
+	default:
+		log.Printf("resuming migration from [%s]", *stateFile)
+	}
+
+	mig := credstore.NewMigrator(newDynamoDBClient(cfg))
+	mig.Cipher = newCipher(cfg) // passwords get sealed as they're rewritten, if encryption is configured
+	mig.PageSize = *pageSize
+	mig.DryRun = *dryRun
+	if !*dryRun {
+		mig.OnProgress = func(state *credstore.MigrationState) error { return saveMigrationState(*stateFile, state) }
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	runErr := mig.Run(ctx, state)
+	printMigrationTotals(state)
+	if errors.Is(runErr, context.Canceled) {
+		log.Printf("interrupted; run again to carry on from [%s]", *stateFile)
+		os.Exit(1)
+	}
+	if runErr != nil {
+		log.Fatalf("migration failed: %s", runErr)
+	}
+}
+
+// nil (and no error) if there's no state file yet
+func loadMigrationState(filename string) (*credstore.MigrationState, error) {
+	raw, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migration state: %s", err)
+	}
+
+	state := &credstore.MigrationState{}
+	if err := json.Unmarshal(raw, state); err != nil {
+		return nil, fmt.Errorf("failed to parse migration state [%s]: %s", filename, err)
+	}
+	return state, nil
+}
+
+// written to a temporary file and renamed over the old one, so a crash mid-write can't lose our place
+func saveMigrationState(filename string, state *credstore.MigrationState) error {
+	raw, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+func printMigrationTotals(state *credstore.MigrationState) {
+	totals := state.Totals()
+	status := "incomplete"
+	if totals.Done {
+		status = "complete"
+	}
+	target := fmt.Sprintf("schema version %d", state.TargetVersion)
+	switch {
+	case state.IsRekey():
+		target = fmt.Sprintf("master key %s", state.TargetKeyID)
+	case state.IsHashKeys():
+		target = "hashed keys"
+	}
+	fmt.Printf("%s (%s, %s): %d items scanned, %d migrated, %d skipped, %d failed\n",
+		state.Table, target, status, totals.Scanned, totals.Migrated, totals.Skipped, totals.Failed)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/newodahs/readerlambda/pkg/config"
+	"github.com/newodahs/readerlambda/pkg/ntlm"
+)
+
+// ntlm -hashes FILE -domains example.com[,...] [-out FILE] [-localdb=false] [config flags]
+//
+// compares an offline export of directory NT hashes (user:hash or pwdump format) with the NTLM hashes of
+// every password stored for the domains and reports the accounts whose current password has leaked. the
+// export is only read into memory; nothing from it is written to the store
+func runNTLM(args []string) {
+	flags := flag.NewFlagSet("ntlm", flag.ExitOnError)
+	hashFile := flags.String(`hashes`, ``, `The directory hash export (user:NTHASH per line, or pwdump/secretsdump format)`)
+	domainList := flags.String(`domains`, ``, `Comma separated domains whose stored passwords are compared`)
+	outFile := flags.String(`out`, ``, `Write the full report (JSON) to this file`)
+	localDynamo := flags.Bool(`localdb`, true, `Compare against the local dynamodb instance (-localdb=false for the configured/AWS one)`)
+	cfgFlags := config.AddFlags(flags)
+	flags.Parse(args)
+	cfg := loadConfig(cfgFlags, *localDynamo)
+
+	domains := strings.FieldsFunc(*domainList, func(r rune) bool { return r == ',' || r == ' ' })
+	if *hashFile == "" || len(domains) == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	fh, err := os.Open(*hashFile)
+	if err != nil {
+		log.Fatalf("failed to open hash export: %s", err)
+	}
+	accounts, skipped, err := ntlm.ParseDump(fh)
+	fh.Close()
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	report, err := ntlm.Compare(context.TODO(), newDynamoDBClient(cfg), cfg.Tables.Credentials, newCipher(cfg), newKeyHasher(cfg), domains, accounts)
+	if err != nil {
+		log.Fatalf("compare failed: %s", err)
+	}
+
+	fmt.Printf("%d accounts (%d machine accounts skipped) against %d leaked passwords for %s\n",
+		report.Accounts, skipped, report.Passwords, strings.Join(report.Domains, ", "))
+	fmt.Printf("MATCHED: %d accounts are using a leaked password\n", report.Matched)
+	for _, match := range report.Matches {
+		whose := "someone else's leaked password"
+		if match.Own {
+			whose = "THEIR OWN leaked password"
+		}
+		disabled := ""
+		if match.Disabled {
+			disabled = " (disabled)"
+		}
+		fmt.Printf("  %-30s %s%s; leaked for %d address(es), e.g. %s\n", match.User, whose, disabled, match.Leaks, match.Addresses[0])
+	}
+	if report.Unreadable > 0 {
+		log.Printf("WARNING: %d stored credentials couldn't be read and were left out", report.Unreadable)
+	}
+
+	if *outFile != "" {
+		raw, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			log.Fatalf("failed to marshal report: %s", err)
+		}
+		if err := os.WriteFile(*outFile, raw, 0o600); err != nil {
+			log.Fatalf("failed to write report: %s", err)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/jobs"
+)
+
+// output formats for parsed credentials (-format)
+const (
+	FORMAT_TEXT  = "text" // the original "User: ...; Password: ..." lines
+	FORMAT_JSON  = "json"
+	FORMAT_JSONL = "jsonl"
+	FORMAT_CSV   = "csv"
+	FORMAT_TABLE = "table"
+)
+
+var outputFormats = []string{FORMAT_TEXT, FORMAT_JSON, FORMAT_JSONL, FORMAT_CSV, FORMAT_TABLE}
+
+// writes parsed credentials out as they come off the ingester; Close flushes anything buffered
+type recordWriter interface {
+	Write(cred *credparser.CredentialInfo) error
+	Close() error
+}
+
+func newRecordWriter(format string, out io.Writer) (recordWriter, error) {
+	switch format {
+	case FORMAT_TEXT:
+		return &textWriter{out: out}, nil
+	case FORMAT_JSON:
+		return &jsonWriter{out: out, creds: []*credparser.CredentialInfo{}}, nil
+	case FORMAT_JSONL:
+		return &jsonlWriter{enc: json.NewEncoder(out)}, nil
+	case FORMAT_CSV:
+		cw := csv.NewWriter(out)
+		return &rowWriter{rows: cw, flush: func() error { cw.Flush(); return cw.Error() }}, nil
+	case FORMAT_TABLE:
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		return &rowWriter{rows: tabRows{tw}, flush: tw.Flush}, nil
+	}
+	return nil, fmt.Errorf("unknown format [%s] (want one of %v)", format, outputFormats)
+}
+
+type textWriter struct {
+	out io.Writer
+}
+
+func (w *textWriter) Write(cred *credparser.CredentialInfo) error {
+	_, err := fmt.Fprintf(w.out, "User: %s; Domain: %s; Email: %s; Password: %s\n", cred.User, cred.Domain, cred.Email, cred.Password)
+	return err
+}
+
+func (w *textWriter) Close() error { return nil }
+
+// a single array, so everything is held until Close
+type jsonWriter struct {
+	out   io.Writer
+	creds []*credparser.CredentialInfo
+}
+
+func (w *jsonWriter) Write(cred *credparser.CredentialInfo) error {
+	w.creds = append(w.creds, cred)
+	return nil
+}
+
+func (w *jsonWriter) Close() error {
+	out, err := json.MarshalIndent(w.creds, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w.out, "%s\n", out)
+	return err
+}
+
+type jsonlWriter struct {
+	enc *json.Encoder
+}
+
+func (w *jsonlWriter) Write(cred *credparser.CredentialInfo) error { return w.enc.Encode(cred) }
+
+func (w *jsonlWriter) Close() error { return nil }
+
+type rowSink interface {
+	Write(record []string) error
+}
+
+// tabwriter as a rowSink
+type tabRows struct {
+	tw *tabwriter.Writer
+}
+
+func (t tabRows) Write(record []string) error {
+	for i, field := range record {
+		sep := "\t"
+		if i == len(record)-1 {
+			sep = "\n"
+		}
+		if _, err := fmt.Fprint(t.tw, field, sep); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// csv and table; one row per password (with the line it came from), header first
+type rowWriter struct {
+	rows    rowSink
+	flush   func() error
+	started bool
+}
+
+func (w *rowWriter) Write(cred *credparser.CredentialInfo) error {
+	if !w.started {
+		w.started = true
+		if err := w.rows.Write([]string{"email", "user", "domain", "password", "line"}); err != nil {
+			return err
+		}
+	}
+
+	for i, passwd := range cred.Password {
+		line := ""
+		if i < len(cred.Provenance) && cred.Provenance[i] != nil && cred.Provenance[i].Line > 0 {
+			line = strconv.Itoa(cred.Provenance[i].Line)
+		}
+		if err := w.rows.Write([]string{cred.Email, cred.User, cred.Domain, passwd, line}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *rowWriter) Close() error { return w.flush() }
+
+// rejected lines as JSON, one per line (same as the lambda's rejects files)
+type rejectsFile struct {
+	fh  *os.File
+	enc *json.Encoder
+}
+
+func createRejectsFile(filename string) (*rejectsFile, error) {
+	fh, err := os.Create(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create rejects file: %s", err)
+	}
+	return &rejectsFile{fh: fh, enc: json.NewEncoder(fh)}, nil
+}
+
+func (r *rejectsFile) Write(pe *credparser.ParseError) error { return r.enc.Encode(pe) }
+
+func (r *rejectsFile) Close() error { return r.fh.Close() }
+
+// the counts for a run; to stderr so it doesn't get mixed into piped output. stored is whether we were
+// writing to dynamodb at all, dryRun whether that was because of -dry-run
+func printSummary(out io.Writer, job *jobs.Job, credCnt int, stored, dryRun bool) {
+	mode := "stored"
+	switch {
+	case dryRun:
+		mode = "dry run; nothing stored"
+	case !stored:
+		mode = "parse only; nothing stored without -localdb"
+	}
+
+	fmt.Fprintf(out, "summary (%s):\n", mode)
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "  lines read\t%d\n", job.LinesRead)
+	fmt.Fprintf(tw, "  accepted\t%d\n", job.Accepted)
+	fmt.Fprintf(tw, "  credentials\t%d\n", credCnt)
+	if stored {
+		fmt.Fprintf(tw, "  new passwords\t%d\n", job.NewPasswords)
+		fmt.Fprintf(tw, "  write failures\t%d\n", job.WriteFailures)
+		fmt.Fprintf(tw, "  erased (skipped)\t%d\n", job.Suppressed)
+		fmt.Fprintf(tw, "  alerts sent\t%d\n", job.Alerts)
+		if job.AlertFailures > 0 {
+			fmt.Fprintf(tw, "  alerts failed\t%d\n", job.AlertFailures)
+		}
+		if job.Canaries > 0 {
+			fmt.Fprintf(tw, "  CANARIES FOUND\t%d\n", job.Canaries)
+		}
+	}
+	fmt.Fprintf(tw, "  rejected\t%d\n", job.TotalRejected())
+	for _, reason := range []credparser.RejectReason{credparser.REJECT_DUPLICATE, credparser.REJECT_UNPARSEABLE, credparser.REJECT_NO_EMAIL} {
+		fmt.Fprintf(tw, "    %s\t%d\n", reason, job.Rejected[reason])
+	}
+	tw.Flush()
+}
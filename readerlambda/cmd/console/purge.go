@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/newodahs/readerlambda/pkg/config"
+	"github.com/newodahs/readerlambda/pkg/credstore"
+)
+
+// purge [-page N] [-dry-run] [-localdb=false] [config flags]
+//
+// removes credentials (and passwords) whose retention has run out; the same thing the reader lambda does
+// on a schedule. an interrupted purge is simply run again
+func runPurge(args []string) {
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	pageSize := flags.Int(`page`, credstore.DEFAULT_PURGE_PAGE_SIZE, `Items evaluated per scan request`)
+	dryRun := flags.Bool(`dry-run`, false, `Count what would be removed without changing anything`)
+	localDynamo := flags.Bool(`localdb`, true, `Purge the local dynamodb instance (-localdb=false for the configured/AWS one)`)
+	cfgFlags := config.AddFlags(flags)
+	flags.Parse(args)
+	cfg := loadConfig(cfgFlags, *localDynamo)
+
+	purger := credstore.NewPurger(newDynamoDBClient(cfg), cfg.Tables.Credentials, cfg.Tables.SourceCredentials)
+	purger.PageSize = *pageSize
+	purger.DryRun = *dryRun
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	stats, runErr := purger.Run(ctx)
+	verb := "removed"
+	if *dryRun {
+		verb = "would be removed"
+	}
+	fmt.Printf("%s: %d items with expired passwords; %d deleted, %d trimmed (%d passwords %s), %d skipped, %d failed\n",
+		cfg.Tables.Credentials, stats.Scanned, stats.Deleted, stats.Trimmed, stats.Passwords, verb, stats.Skipped, stats.Failed)
+	if errors.Is(runErr, context.Canceled) {
+		log.Printf("interrupted; run again to finish")
+		os.Exit(1)
+	}
+	if runErr != nil {
+		log.Fatalf("purge failed: %s", runErr)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/newodahs/readerlambda/pkg/config"
+	"github.com/newodahs/readerlambda/pkg/directory"
+)
+
+// reconcile -directory FILE [-format csv|ldif] [-out FILE] [-localdb=false] [config flags]
+//
+// matches an HR/directory export against the stored credentials and reports which active employees are
+// exposed; prints a summary, and the full report (JSON) to -out when given
+func runReconcile(args []string) {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	dirFile := flags.String(`directory`, ``, `The directory export (CSV with a header row, or LDIF)`)
+	format := flags.String(`format`, ``, `csv or ldif; guessed from the file name if not set`)
+	outFile := flags.String(`out`, ``, `Write the full report (JSON) to this file`)
+	localDynamo := flags.Bool(`localdb`, true, `Reconcile against the local dynamodb instance (-localdb=false for the configured/AWS one)`)
+	cfgFlags := config.AddFlags(flags)
+	flags.Parse(args)
+	cfg := loadConfig(cfgFlags, *localDynamo)
+
+	if *dirFile == "" {
+		flags.Usage()
+		os.Exit(1)
+	}
+	dirFormat := directory.FormatFromName(*dirFile)
+	if *format != "" {
+		var err error
+		if dirFormat, err = directory.ParseFormat(*format); err != nil {
+			log.Fatalf("%s", err)
+		}
+	}
+
+	fh, err := os.Open(*dirFile)
+	if err != nil {
+		log.Fatalf("failed to open directory export: %s", err)
+	}
+	dir, err := directory.Parse(fh, dirFormat)
+	fh.Close()
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	tables := directory.Tables{Credentials: cfg.Tables.Credentials, Sources: cfg.Tables.Sources}
+	report, err := directory.Reconcile(context.TODO(), newDynamoDBClient(cfg), tables, newKeyHasher(cfg), dir)
+	if err != nil {
+		log.Fatalf("reconcile failed: %s", err)
+	}
+
+	fmt.Printf("%d employees (%d active, %d entries without an address skipped)\n", report.Employees, report.Active, report.Skipped)
+	fmt.Printf("EXPOSED: %d active, %d inactive; %d leaked since their last password change, %d with no change date, %d already remediated\n",
+		report.ExposedActive, report.ExposedInactive, report.LeakAfterChange, report.UnknownChange, report.Remediated)
+	for _, finding := range report.Findings {
+		fmt.Printf("  %-40s %-14s %-15s %d password(s), latest leak %s\n", finding.Employee.Email, finding.Timing, finding.Status,
+			finding.Passwords, finding.LatestLeak.Format("2006-01-02"))
+	}
+	if report.FailedDecode > 0 {
+		log.Printf("WARNING: %d stored credentials couldn't be read and were left out", report.FailedDecode)
+	}
+
+	if *outFile != "" {
+		raw, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			log.Fatalf("failed to marshal report: %s", err)
+		}
+		if err := os.WriteFile(*outFile, raw, 0o600); err != nil {
+			log.Fatalf("failed to write report: %s", err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/newodahs/readerlambda/pkg/config"
+	"github.com/newodahs/readerlambda/pkg/credstore"
+)
+
+// rescore -domains example.com[,...] [-localdb=false] [config flags]
+//
+// recomputes the severity of every credential stored for the domains; run it after an import (to pick up
+// password reuse across the domain) or after a source's breach date is set
+func runRescore(args []string) {
+	flags := flag.NewFlagSet("rescore", flag.ExitOnError)
+	domainList := flags.String(`domains`, ``, `Comma separated domains to rescore`)
+	localDynamo := flags.Bool(`localdb`, true, `Rescore in the local dynamodb instance (-localdb=false for the configured/AWS one)`)
+	cfgFlags := config.AddFlags(flags)
+	flags.Parse(args)
+	cfg := loadConfig(cfgFlags, *localDynamo)
+
+	domains := strings.FieldsFunc(*domainList, func(r rune) bool { return r == ',' || r == ' ' })
+	if len(domains) == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	cli := newDynamoDBClient(cfg)
+	tables := credstore.RescoreTables{Credentials: cfg.Tables.Credentials, Sources: cfg.Tables.Sources}
+	cipher, keys := newCipher(cfg), newKeyHasher(cfg)
+	for _, domain := range domains {
+		stats, err := credstore.Rescore(context.TODO(), cli, tables, cipher, keys, domain)
+		if err != nil {
+			log.Fatalf("rescore of [%s] failed: %s", domain, err)
+		}
+		fmt.Printf("%s: %d credentials, %d rescored, %d skipped, %d unreadable, %d failed\n",
+			domain, stats.Credentials, stats.Updated, stats.Skipped, stats.Unreadable, stats.Failed)
+	}
+}
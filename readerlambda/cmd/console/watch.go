@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/newodahs/readerlambda/pkg/config"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/ingest"
+	"github.com/newodahs/readerlambda/pkg/jobs"
+	"github.com/newodahs/readerlambda/pkg/postprocess"
+	"github.com/newodahs/readerlambda/pkg/sources"
+	"github.com/newodahs/readerlambda/pkg/util"
+)
+
+const (
+	DEFAULT_WATCH_POLL      = 2 * time.Second
+	DEFAULT_WATCH_POLL_SLOW = 30 * time.Second // with native notifications polling is only a safety net
+)
+
+// watch -dir <dir> [-localdb] [-processed <subdir>] [-failed <subdir>] [-poll <duration>] [-once]
+//
+// a self-hosted stand-in for the S3 trigger: every file that lands in dir is ingested, then moved into the
+// processed (or failed) subdirectory with its rejects written next to it
+func runWatch(args []string) {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	dir := flags.String(`dir`, ``, `Directory to watch for credential files`)
+	localDynamo := flags.Bool(`localdb`, false, `If set, will attempt to write to a local dynamodb instance`)
+	processedDir := flags.String(`processed`, `processed`, `Subdirectory (of -dir) files are moved to once ingested`)
+	failedDir := flags.String(`failed`, `failed`, `Subdirectory (of -dir) files are moved to if their ingest fails`)
+	poll := flags.Duration(`poll`, 0, fmt.Sprintf(`How often to scan the directory (default %s, or %s when native notifications are available)`, DEFAULT_WATCH_POLL, DEFAULT_WATCH_POLL_SLOW))
+	once := flags.Bool(`once`, false, `Ingest whatever is in the directory now and exit instead of watching`)
+	cfgFlags := config.AddFlags(flags)
+	flags.Parse(args)
+	cfg := loadConfig(cfgFlags, *localDynamo)
+
+	if *dir == "" {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	w := &watcher{
+		dir:       *dir,
+		processed: filepath.Join(*dir, *processedDir),
+		failed:    filepath.Join(*dir, *failedDir),
+		seen:      map[string]fileState{},
+	}
+	for _, sub := range []string{w.processed, w.failed} {
+		if err := os.MkdirAll(sub, 0o755); err != nil {
+			log.Fatalf("failed to create [%s]: %s", sub, err)
+		}
+	}
+
+	var cli util.DynamoDBAPI // nil interface means parse only (see runIngest)
+	if *localDynamo {
+		cli = newDynamoDBClient(cfg)
+	}
+	w.cli = cli
+	w.sourceTable = cfg.Tables.Sources
+	w.tableOpts = cfg.TableOptions
+	w.ing = cfg.NewIngester(cli)
+	if cli != nil {
+		w.ing.Cipher = newCipher(cfg)
+		w.ing.Keys = newKeyHasher(cfg)
+		w.ing.Webhooks = cfg.NewWebhookSender(cli)
+		w.ing.Notifier = newAlertNotifier(cfg, w.ing.Webhooks)
+		if setupErr := w.ing.EnsureTables(context.TODO()); setupErr != nil {
+			log.Printf("failed to setup tables in local dynamodb: %s", setupErr)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// whatever is already there was (presumably) written before we started
+	for _, name := range w.scan() {
+		w.process(ctx, name)
+	}
+	if *once {
+		w.printTotals()
+		return
+	}
+
+	landed, notifyErr := newNotifier(ctx, *dir)
+	if notifyErr != nil {
+		log.Printf("native file notifications unavailable, polling instead: %s", notifyErr)
+	}
+	interval := *poll
+	if interval <= 0 {
+		interval = DEFAULT_WATCH_POLL
+		if landed != nil {
+			interval = DEFAULT_WATCH_POLL_SLOW
+		}
+	}
+
+	log.Printf("watching [%s] (scanning every %s)", *dir, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			w.printTotals()
+			return
+
+		case name, ok := <-landed:
+			if !ok {
+				landed = nil // notifier died; carry on polling
+				continue
+			}
+			if w.candidate(name) {
+				w.process(ctx, name)
+			}
+
+		case <-ticker.C:
+			for _, name := range w.stable() {
+				w.process(ctx, name)
+			}
+		}
+	}
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+type watcher struct {
+	dir         string
+	processed   string
+	failed      string
+	cli         util.DynamoDBAPI
+	sourceTable string
+	tableOpts   *util.TableOptions
+	ing         *ingest.Ingester
+
+	seen map[string]fileState // size/mtime as of the last scan, for spotting files still being written
+
+	files, failures, lines, accepted, rejected int
+}
+
+// files in the directory we'd ingest: regular, not hidden (editors, partial uploads), not sidecar manifests
+func (w *watcher) candidate(name string) bool {
+	if name == "" || strings.HasPrefix(name, ".") || sources.IsManifestKey(name) {
+		return false
+	}
+	info, err := os.Lstat(filepath.Join(w.dir, name))
+	return err == nil && info.Mode().IsRegular()
+}
+
+func (w *watcher) scan() []string {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		log.Printf("WARNING: failed to read [%s]: %s", w.dir, err)
+		return nil
+	}
+
+	var ret []string
+	for _, entry := range entries {
+		if w.candidate(entry.Name()) {
+			ret = append(ret, entry.Name())
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// files that haven't changed since the last scan; anything still growing waits for the next one
+func (w *watcher) stable() []string {
+	var ready []string
+	current := map[string]fileState{}
+	for _, name := range w.scan() {
+		info, err := os.Stat(filepath.Join(w.dir, name))
+		if err != nil {
+			continue
+		}
+		state := fileState{size: info.Size(), modTime: info.ModTime()}
+		current[name] = state
+		if prev, found := w.seen[name]; found && prev == state {
+			ready = append(ready, name)
+			delete(current, name)
+		}
+	}
+	w.seen = current
+	return ready
+}
+
+// ingests one file, moves it (and its manifest, if any) out of the way and prints a summary
+func (w *watcher) process(ctx context.Context, name string) {
+	path := filepath.Join(w.dir, name)
+	if _, err := os.Stat(path); err != nil {
+		return // already handled (notification and scan both saw it)
+	}
+	delete(w.seen, name)
+
+	// a sidecar manifest (<file>.source.json) describes the breach, same as in S3
+	var src *sources.Source
+	manifestPath := filepath.Join(w.dir, sources.ManifestKey(name))
+	if _, statErr := os.Stat(manifestPath); statErr == nil {
+		var mfErr error
+		if src, mfErr = loadManifest(manifestPath); mfErr != nil {
+			log.Printf("WARNING: %s (continuing without a source)", mfErr)
+		} else if w.cli != nil {
+			saveSource(ctx, w.cli, w.sourceTable, w.tableOpts, src)
+		}
+	} else {
+		manifestPath = ""
+	}
+
+	job, rejects, runErr := ingestFile(ctx, w.ing, path, src)
+
+	destDir := w.processed
+	if runErr != nil || job == nil || job.Status == jobs.STATUS_FAILED {
+		destDir = w.failed
+		w.failures++
+	}
+	dest, moveErr := moveInto(path, destDir)
+	if moveErr != nil {
+		log.Printf("WARNING: %s", moveErr)
+	}
+	if manifestPath != "" {
+		if _, mfMoveErr := moveInto(manifestPath, destDir); mfMoveErr != nil {
+			log.Printf("WARNING: %s", mfMoveErr)
+		}
+	}
+	if len(rejects) > 0 && dest != "" {
+		if rejErr := writeRejects(dest+postprocess.REJECTS_SUFFIX, rejects); rejErr != nil {
+			log.Printf("WARNING: %s", rejErr)
+		}
+	}
+
+	w.files++
+	if job == nil {
+		fmt.Printf("%s: failed: %s\n", name, runErr)
+		return
+	}
+	w.lines += job.LinesRead
+	w.accepted += job.Accepted
+	w.rejected += job.TotalRejected()
+
+	summary := fmt.Sprintf("%s: %s; %d lines, %d accepted, %d rejected", name, job.Status, job.LinesRead, job.Accepted, job.TotalRejected())
+	if reasons := rejectReasons(job.Rejected); reasons != "" {
+		summary += " (" + reasons + ")"
+	}
+	if job.WriteFailures > 0 {
+		summary += fmt.Sprintf(", %d write failures", job.WriteFailures)
+	}
+	if job.Suppressed > 0 {
+		summary += fmt.Sprintf(", %d erased addresses skipped", job.Suppressed)
+	}
+	if job.Canaries > 0 {
+		summary += fmt.Sprintf(", %d CANARIES FOUND", job.Canaries)
+	}
+	if job.Alerts+job.AlertFailures > 0 {
+		summary += fmt.Sprintf(", %d alerts (%d failed)", job.Alerts+job.AlertFailures, job.AlertFailures)
+	}
+	if runErr != nil {
+		summary += fmt.Sprintf("; error: %s", runErr)
+	}
+	if dest != "" {
+		summary += " -> " + dest
+	}
+	fmt.Println(summary)
+}
+
+func (w *watcher) printTotals() {
+	fmt.Printf("%d files (%d failed): %d lines, %d accepted, %d rejected\n", w.files, w.failures, w.lines, w.accepted, w.rejected)
+}
+
+// "duplicate: 2, no-email: 1"
+func rejectReasons(rejected map[credparser.RejectReason]int) string {
+	var parts []string
+	for reason, cnt := range rejected {
+		if cnt > 0 {
+			parts = append(parts, fmt.Sprintf("%s: %d", reason, cnt))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+// renames path into dir, adding a timestamp if something by that name is already there; returns the new path
+func moveInto(path, dir string) (string, error) {
+	dest := filepath.Join(dir, filepath.Base(path))
+	if _, err := os.Stat(dest); err == nil {
+		dest = fmt.Sprintf("%s.%s", dest, time.Now().UTC().Format("20060102T150405.000000000"))
+	}
+	if err := os.Rename(path, dest); err != nil {
+		return "", fmt.Errorf("failed to move [%s] to [%s]: %s", path, dir, err)
+	}
+	return dest, nil
+}
+
+// one JSON object per line, same as the rejects files the lambda writes
+func writeRejects(filename string, rejects []*credparser.ParseError) error {
+	rejFh, err := createRejectsFile(filename)
+	if err != nil {
+		return err
+	}
+
+	var writeErr error
+	for _, pe := range rejects {
+		if writeErr = rejFh.Write(pe); writeErr != nil {
+			break
+		}
+	}
+	return errors.Join(writeErr, rejFh.Close())
+}
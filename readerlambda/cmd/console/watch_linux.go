@@ -0,0 +1,66 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"syscall"
+	"unsafe"
+)
+
+// reports the names of files written (closed after writing) or moved into dir, via inotify; the channel
+// is closed if the notifier gives up
+func newNotifier(ctx context.Context, dir string) (<-chan string, error) {
+	fd, initErr := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if initErr != nil {
+		return nil, fmt.Errorf("inotify init failed: %s", initErr)
+	}
+	if _, watchErr := syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO); watchErr != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to watch [%s]: %s", dir, watchErr)
+	}
+
+	landed := make(chan string)
+	go func() {
+		defer close(landed)
+		defer syscall.Close(fd)
+
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, readErr := syscall.Read(fd, buf)
+			if readErr != nil {
+				if readErr == syscall.EINTR {
+					continue
+				}
+				log.Printf("WARNING: inotify read failed: %s", readErr)
+				return
+			}
+
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				nameStart := offset + syscall.SizeofInotifyEvent
+				name := string(bytes.TrimRight(buf[nameStart:nameStart+int(event.Len)], "\x00"))
+				offset = nameStart + int(event.Len)
+
+				if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+					log.Printf("WARNING: inotify queue overflowed; relying on the next scan")
+					continue
+				}
+				if event.Mask&syscall.IN_ISDIR != 0 || name == "" {
+					continue
+				}
+
+				select {
+				case landed <- name:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return landed, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// no native notifications outside linux (yet); watch falls back to polling
+func newNotifier(ctx context.Context, dir string) (<-chan string, error) {
+	return nil, errors.New("not supported on this platform")
+}
@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// how close to the lambda deadline we're willing to get before checkpointing and handing off
+const DEFAULT_CHECKPOINT_MARGIN = 30 * time.Second
+
+// what we send ourselves when we run out of time part way through an object; the checkpoint itself
+// lives in the processed-object ledger, the offset/line here are informational
+type continuationEvent struct {
+	Continuation *continuation `json:"continuation"`
+}
+
+type continuation struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	ETag   string `json:"etag"`
+	JobID  string `json:"jobId"`
+	Offset int64  `json:"offset"`
+	Line   int    `json:"line"`
+}
+
+func (c continuation) objectRef() objectRef {
+	return objectRef{Bucket: c.Bucket, Key: c.Key, ETag: c.ETag}
+}
+
+func checkpointMargin() time.Duration {
+	if raw := os.Getenv("CHECKPOINT_MARGIN"); raw != "" {
+		if margin, err := time.ParseDuration(raw); err == nil && margin > 0 {
+			return margin
+		}
+		log.Printf("WARNING: ignoring bad CHECKPOINT_MARGIN [%s]", raw)
+	}
+	return DEFAULT_CHECKPOINT_MARGIN
+}
+
+// true while there's comfortably enough time left in this invocation to keep going
+func (h *Handler) haveTimeLeft(ctx context.Context) bool {
+	deadline, ok := ctx.Deadline()
+	return !ok || time.Until(deadline) > h.CheckpointMargin
+}
+
+// queues up the rest of an object for another invocation by sending ourselves a message on
+// CONTINUATION_QUEUE_URL (normally the same queue that triggers us); without one we return an error, so
+// lambda's own retry may get a little further from the checkpoint, but the caller has failed the job
+func (h *Handler) emitContinuation(ctx context.Context, cont continuation) error {
+	if h.ContinuationQueue == "" || h.SQS == nil {
+		return fmt.Errorf("stopped %s/%s at line %d and no continuation queue is configured (%s)", cont.Bucket, cont.Key, cont.Line, ENV_CONTINUATION_QUEUE_URL)
+	}
+
+	body, marshErr := json.Marshal(continuationEvent{Continuation: &cont})
+	if marshErr != nil {
+		return fmt.Errorf("failed to marshal continuation: %s", marshErr)
+	}
+
+	// the current context is nearly out of time; don't let that kill the hand-off
+	sendCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := h.SQS.SendMessage(sendCtx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(h.ContinuationQueue),
+		MessageBody: aws.String(string(body)),
+	}); err != nil {
+		return errors.Join(fmt.Errorf("failed to send continuation for %s/%s", cont.Bucket, cont.Key), err)
+	}
+
+	log.Printf("queued continuation for %s/%s from line %d (offset %d)", cont.Bucket, cont.Key, cont.Line, cont.Offset)
+	return nil
+}
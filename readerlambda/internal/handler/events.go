@@ -0,0 +1,188 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// the bits of an S3 object we need, regardless of which kind of event told us about it
+type objectRef struct {
+	Bucket string
+	Key    string // already url-decoded
+	ETag   string // empty if the event didn't say; the handler looks it up
+	Size   int64
+}
+
+func (o objectRef) String() string {
+	return o.Bucket + "/" + o.Key
+}
+
+type eventKind int
+
+const (
+	EVENT_UNKNOWN eventKind = iota
+	EVENT_S3
+	EVENT_SQS
+	EVENT_EVENTBRIDGE
+	EVENT_S3_TEST      // sent once when a bucket notification is configured; nothing to do
+	EVENT_CONTINUATION // we ran out of time on an object and queued the rest for ourselves
+	EVENT_SCHEDULED    // an EventBridge schedule; time to purge expired credentials and retry webhooks
+)
+
+var errUnknownEvent = errors.New("unrecognized event payload")
+
+// just enough of every payload we accept to tell them apart
+type eventProbe struct {
+	Records []struct {
+		EventSource string `json:"eventSource"`
+	} `json:"Records"`
+	DetailType   string          `json:"detail-type"`
+	Source       string          `json:"source"`
+	Event        string          `json:"Event"`
+	Continuation json.RawMessage `json:"continuation"`
+}
+
+func classifyEvent(raw []byte) eventKind {
+	var probe eventProbe
+	if err := json.Unmarshal(raw, &probe); err != nil {
+		return EVENT_UNKNOWN
+	}
+
+	switch {
+	case len(probe.Continuation) > 0:
+		return EVENT_CONTINUATION
+	case probe.Event == "s3:TestEvent":
+		return EVENT_S3_TEST
+	case probe.Source == "aws.s3" && probe.DetailType == "Object Created":
+		return EVENT_EVENTBRIDGE
+	case probe.Source == "aws.events" && probe.DetailType == "Scheduled Event":
+		return EVENT_SCHEDULED
+	case len(probe.Records) > 0 && probe.Records[0].EventSource == "aws:sqs":
+		return EVENT_SQS
+	case len(probe.Records) > 0 && probe.Records[0].EventSource == "aws:s3":
+		return EVENT_S3
+	}
+	return EVENT_UNKNOWN
+}
+
+func objectsFromS3Event(evt events.S3Event) []objectRef {
+	var ret []objectRef
+	for _, record := range evt.Records {
+		if !strings.HasPrefix(record.EventName, "ObjectCreated:") {
+			continue // deletes from our own cleanup, restores, records we can't tell anything about, etc.
+		}
+
+		ret = append(ret, objectRef{
+			Bucket: record.S3.Bucket.Name,
+			Key:    record.S3.Object.URLDecodedKey,
+			ETag:   record.S3.Object.ETag,
+			Size:   record.S3.Object.Size,
+		})
+	}
+	return ret
+}
+
+// detail of an EventBridge "Object Created" event from S3; unlike bucket notifications the key isn't url-encoded
+type s3EventBridgeDetail struct {
+	Bucket struct {
+		Name string `json:"name"`
+	} `json:"bucket"`
+	Object struct {
+		Key  string `json:"key"`
+		Size int64  `json:"size"`
+		ETag string `json:"etag"`
+	} `json:"object"`
+}
+
+func objectsFromEventBridge(evt events.EventBridgeEvent) ([]objectRef, error) {
+	var detail s3EventBridgeDetail
+	if err := json.Unmarshal(evt.Detail, &detail); err != nil {
+		return nil, fmt.Errorf("failed to decode eventbridge detail: %w", err)
+	}
+	if detail.Bucket.Name == "" || detail.Object.Key == "" {
+		return nil, fmt.Errorf("eventbridge event [%s] has no bucket/key", evt.ID)
+	}
+
+	return []objectRef{{
+		Bucket: detail.Bucket.Name,
+		Key:    detail.Object.Key,
+		ETag:   detail.Object.ETag,
+		Size:   detail.Object.Size,
+	}}, nil
+}
+
+func objectsFromContinuation(raw []byte) ([]objectRef, error) {
+	var evt continuationEvent
+	if err := json.Unmarshal(raw, &evt); err != nil {
+		return nil, fmt.Errorf("failed to decode continuation: %w", err)
+	}
+	if evt.Continuation == nil || evt.Continuation.Key == "" {
+		return nil, errors.New("continuation has no object")
+	}
+	return []objectRef{evt.Continuation.objectRef()}, nil
+}
+
+// an SQS message body carries either an S3 bucket notification, an EventBridge event (when a rule
+// targets the queue) or one of our own continuations
+func objectsFromMessageBody(body string) ([]objectRef, error) {
+	switch classifyEvent([]byte(body)) {
+	case EVENT_S3:
+		var evt events.S3Event
+		if err := json.Unmarshal([]byte(body), &evt); err != nil {
+			return nil, fmt.Errorf("failed to decode s3 notification: %w", err)
+		}
+		return objectsFromS3Event(evt), nil
+
+	case EVENT_EVENTBRIDGE:
+		var evt events.EventBridgeEvent
+		if err := json.Unmarshal([]byte(body), &evt); err != nil {
+			return nil, fmt.Errorf("failed to decode eventbridge event: %w", err)
+		}
+		return objectsFromEventBridge(evt)
+
+	case EVENT_CONTINUATION:
+		return objectsFromContinuation([]byte(body))
+
+	case EVENT_S3_TEST:
+		return nil, nil
+	}
+
+	return nil, errUnknownEvent
+}
+
+// every object (as bucket/key) an event refers to, in the order the handler would process them; SQS
+// messages we can't make sense of are skipped. used by the console harness to seed a local S3 stand-in
+func EventObjects(raw json.RawMessage) ([]string, error) {
+	var objs []objectRef
+	switch classifyEvent(raw) {
+	case EVENT_SQS:
+		var sqsEvent events.SQSEvent
+		if err := json.Unmarshal(raw, &sqsEvent); err != nil {
+			return nil, fmt.Errorf("failed to decode sqs event: %s", err)
+		}
+		for _, msg := range sqsEvent.Records {
+			if msgObjs, err := objectsFromMessageBody(msg.Body); err == nil {
+				objs = append(objs, msgObjs...)
+			}
+		}
+
+	case EVENT_S3_TEST, EVENT_SCHEDULED:
+		return nil, nil
+
+	default:
+		var err error
+		if objs, err = objectsFromMessageBody(string(raw)); err != nil {
+			return nil, err
+		}
+	}
+
+	ret := make([]string, 0, len(objs))
+	for _, obj := range objs {
+		ret = append(ret, obj.String())
+	}
+	return ret, nil
+}
@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+// an S3 bucket notification with one record per (eventName, key) pair
+func s3Notification(t *testing.T, records ...[2]string) string {
+	t.Helper()
+
+	type record struct {
+		EventSource string `json:"eventSource"`
+		EventName   string `json:"eventName,omitempty"`
+		S3          struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key  string `json:"key"`
+				ETag string `json:"eTag"`
+			} `json:"object"`
+		} `json:"s3"`
+	}
+
+	var evt struct {
+		Records []record `json:"Records"`
+	}
+	for _, rec := range records {
+		cur := record{EventSource: "aws:s3", EventName: rec[0]}
+		cur.S3.Bucket.Name = testBucket
+		cur.S3.Object.Key = rec[1]
+		cur.S3.Object.ETag = "0123abcd"
+		evt.Records = append(evt.Records, cur)
+	}
+
+	raw, err := json.Marshal(evt)
+	if err != nil {
+		t.Fatalf("failed to marshal notification: %s", err)
+	}
+	return string(raw)
+}
+
+func Test_Events_Classify(t *testing.T) {
+	testSet := []struct {
+		Name   string
+		Raw    string
+		Expect eventKind
+	}{
+		{Name: "S3 Put", Raw: string(loadEvent(t, "s3-put.json")), Expect: EVENT_S3},
+		{Name: "S3 Delete", Raw: string(loadEvent(t, "s3-delete.json")), Expect: EVENT_S3},
+		{Name: "S3 Test", Raw: string(loadEvent(t, "s3-test-event.json")), Expect: EVENT_S3_TEST},
+		{Name: "SQS", Raw: string(loadEvent(t, "sqs-batch.json")), Expect: EVENT_SQS},
+		{Name: "EventBridge", Raw: string(loadEvent(t, "eventbridge-created.json")), Expect: EVENT_EVENTBRIDGE},
+		{Name: "Scheduled", Raw: string(loadEvent(t, "scheduled.json")), Expect: EVENT_SCHEDULED},
+		{Name: "Continuation", Raw: `{"continuation": {"bucket": "b", "key": "k", "etag": "e"}}`, Expect: EVENT_CONTINUATION},
+		{Name: "EventBridge Other Detail", Raw: `{"source": "aws.s3", "detail-type": "Object Deleted", "detail": {}}`, Expect: EVENT_UNKNOWN},
+		{Name: "Other Record Source", Raw: `{"Records": [{"eventSource": "aws:sns"}]}`, Expect: EVENT_UNKNOWN},
+		{Name: "No Records", Raw: `{"Records": []}`, Expect: EVENT_UNKNOWN},
+		{Name: "Not JSON", Raw: `not an event`, Expect: EVENT_UNKNOWN},
+	}
+
+	for _, test := range testSet {
+		t.Run(test.Name, func(t *testing.T) {
+			if got := classifyEvent([]byte(test.Raw)); got != test.Expect {
+				t.Errorf("expected kind %d, got %d", test.Expect, got)
+			}
+		})
+	}
+}
+
+// only object-created records are ingested, whichever way they arrive
+func Test_Events_MessageBody(t *testing.T) {
+	testSet := []struct {
+		Name      string
+		Body      string
+		Expect    []string // bucket/key of each object
+		ExpectErr bool
+	}{
+		{Name: "S3 Put", Body: string(loadEvent(t, "s3-put.json")), Expect: []string{testBucket + "/" + testKey}},
+		{Name: "S3 Delete", Body: string(loadEvent(t, "s3-delete.json"))},
+		{
+			Name: "Mixed Records",
+			Body: s3Notification(t,
+				[2]string{"ObjectCreated:Put", "a.txt"},
+				[2]string{"ObjectRemoved:Delete", "b.txt"},
+				[2]string{"ObjectCreated:CompleteMultipartUpload", "c+d.txt"},
+				[2]string{"ObjectRestore:Completed", "e.txt"},
+			),
+			Expect: []string{testBucket + "/a.txt", testBucket + "/c d.txt"},
+		},
+		{Name: "No Event Name", Body: s3Notification(t, [2]string{"", "a.txt"})},
+		{Name: "Not Quite Created", Body: s3Notification(t, [2]string{"ObjectCreatedSoon", "a.txt"})},
+		{Name: "EventBridge", Body: string(loadEvent(t, "eventbridge-created.json")), Expect: []string{testBucket + "/" + testKey}},
+		{Name: "EventBridge Without Key", Body: `{"source": "aws.s3", "detail-type": "Object Created", "detail": {"bucket": {"name": "b"}}}`, ExpectErr: true},
+		{Name: "Continuation", Body: `{"continuation": {"bucket": "b", "key": "k", "etag": "e", "line": 10}}`, Expect: []string{"b/k"}},
+		{Name: "Continuation Without Key", Body: `{"continuation": {"bucket": "b"}}`, ExpectErr: true},
+		{Name: "S3 Test", Body: string(loadEvent(t, "s3-test-event.json"))},
+		{Name: "Scheduled", Body: string(loadEvent(t, "scheduled.json")), ExpectErr: true},
+		{Name: "Garbage", Body: "not an event", ExpectErr: true},
+	}
+
+	for _, test := range testSet {
+		t.Run(test.Name, func(t *testing.T) {
+			objs, err := objectsFromMessageBody(test.Body)
+			if (err != nil) != test.ExpectErr {
+				t.Fatalf("unexpected error state: %v", err)
+			}
+
+			var got []string
+			for _, obj := range objs {
+				got = append(got, obj.String())
+			}
+			if !slices.Equal(got, test.Expect) {
+				t.Errorf("expected objects %v, got %v", test.Expect, got)
+			}
+		})
+	}
+}
+
+func Test_Events_EventObjects(t *testing.T) {
+	testSet := []struct {
+		Name      string
+		Event     string
+		Expect    []string
+		ExpectErr bool
+	}{
+		{Name: "SQS Skips Garbage", Event: "sqs-batch.json", Expect: []string{testBucket + "/" + testKey}},
+		{Name: "S3 Put", Event: "s3-put.json", Expect: []string{testBucket + "/" + testKey}},
+		{Name: "S3 Delete", Event: "s3-delete.json", Expect: []string{}},
+		{Name: "Scheduled", Event: "scheduled.json"},
+		{Name: "S3 Test", Event: "s3-test-event.json"},
+	}
+
+	for _, test := range testSet {
+		t.Run(test.Name, func(t *testing.T) {
+			got, err := EventObjects(loadEvent(t, test.Event))
+			if (err != nil) != test.ExpectErr {
+				t.Fatalf("unexpected error state: %v", err)
+			}
+			if !slices.Equal(got, test.Expect) {
+				t.Errorf("expected objects %v, got %v", test.Expect, got)
+			}
+		})
+	}
+}
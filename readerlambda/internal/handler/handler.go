@@ -0,0 +1,537 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/smithy-go"
+	"github.com/newodahs/readerlambda/pkg/alerts"
+	"github.com/newodahs/readerlambda/pkg/config"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/credstore"
+	"github.com/newodahs/readerlambda/pkg/envelope"
+	"github.com/newodahs/readerlambda/pkg/ingest"
+	"github.com/newodahs/readerlambda/pkg/jobs"
+	"github.com/newodahs/readerlambda/pkg/ledger"
+	"github.com/newodahs/readerlambda/pkg/postprocess"
+	"github.com/newodahs/readerlambda/pkg/retention"
+	"github.com/newodahs/readerlambda/pkg/sources"
+	"github.com/newodahs/readerlambda/pkg/util"
+	"github.com/newodahs/readerlambda/pkg/webhook"
+)
+
+// environment variable naming the queue continuations are sent to
+const ENV_CONTINUATION_QUEUE_URL = "CONTINUATION_QUEUE_URL"
+
+// the S3 calls the handler makes; satisfied by *s3.Client and awsfake.S3
+type S3API interface {
+	postprocess.S3API
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+}
+
+// the SQS calls the handler makes (just sending continuations)
+type SQSAPI interface {
+	SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+}
+
+// the reader lambda's logic with its clients injected, so the same code runs in lambda, against local
+// endpoints from the console and against the in-memory fakes in tests
+type Handler struct {
+	Tables       config.Tables
+	TableOptions *util.TableOptions   // how missing tables are created; nil for the defaults
+	Cipher       *envelope.Cipher     // if set passwords are stored encrypted
+	Keys         *credstore.KeyHasher // if set credentials are stored under hashed keys
+	Retention    *retention.Policy    // if set passwords expire per the policy
+	Notifier     alerts.Notifier      // if set new credentials are matched against the watchlist and alerted on
+	Webhooks     *webhook.Sender      // if set finished jobs are queued as webhooks, and scheduled runs send them
+	S3           S3API
+	DynDBCli     util.DynamoDBAPI
+	SQS          SQSAPI // optional; only needed to send continuations
+	PostProc     *postprocess.Processor
+
+	CheckpointMargin  time.Duration // how close to the deadline we get before handing off the rest of an object
+	ContinuationQueue string        // where continuations go; empty means rely on lambda's retry
+
+	tablesMu    sync.Mutex
+	tablesReady bool // the tables have been ensured by an earlier event on this instance
+}
+
+// builds a handler using cfg's tables, configured the way the lambda is (POSTPROCESS_MODE and friends,
+// CHECKPOINT_MARGIN, CONTINUATION_QUEUE_URL)
+func NewFromEnv(cfg *config.Config, s3Cli S3API, dynDBCli util.DynamoDBAPI, sqsCli SQSAPI) (*Handler, error) {
+	if s3Cli == nil || dynDBCli == nil {
+		return nil, fmt.Errorf("s3 client (%v) or dynamodb client (%v) was nil", s3Cli, dynDBCli)
+	}
+
+	ppOpts, ppErr := postprocess.OptionsFromEnv()
+	if ppErr != nil {
+		return nil, fmt.Errorf("bad post-processing configuration: %s", ppErr)
+	}
+
+	cipher, cipherErr := cfg.NewCipher(context.TODO())
+	if cipherErr != nil {
+		return nil, fmt.Errorf("bad key provider configuration: %s", cipherErr)
+	}
+	keys, keysErr := cfg.NewKeyHasher()
+	if keysErr != nil {
+		return nil, fmt.Errorf("bad lookup key: %s", keysErr)
+	}
+	policy, policyErr := cfg.RetentionPolicy()
+	if policyErr != nil {
+		return nil, fmt.Errorf("bad retention policy: %s", policyErr)
+	}
+	webhooks := cfg.NewWebhookSender(dynDBCli)
+	notifier, notifierErr := cfg.NewNotifier(context.TODO(), webhooks)
+	if notifierErr != nil {
+		return nil, fmt.Errorf("bad alert configuration: %s", notifierErr)
+	}
+
+	return &Handler{
+		Tables:            cfg.Tables,
+		TableOptions:      cfg.TableOptions,
+		Cipher:            cipher,
+		Keys:              keys,
+		Retention:         policy,
+		Notifier:          notifier,
+		Webhooks:          webhooks,
+		S3:                s3Cli,
+		DynDBCli:          dynDBCli,
+		SQS:               sqsCli,
+		PostProc:          postprocess.New(s3Cli, ppOpts),
+		CheckpointMargin:  checkpointMargin(),
+		ContinuationQueue: os.Getenv(ENV_CONTINUATION_QUEUE_URL),
+	}, nil
+}
+
+// we take S3 notifications directly, SQS batches wrapping them (or EventBridge events), and EventBridge
+// "Object Created" events; SQS batches get a partial batch response so only failed messages are retried
+// (the event source mapping needs ReportBatchItemFailures turned on). EventBridge scheduled events purge
+// expired credentials and retry failed webhooks instead
+func (h *Handler) HandleRequest(ctx context.Context, raw json.RawMessage) (any, error) {
+	// make sure our dynamodb is basically setup
+	if setupErr := h.ensureTablesOnce(ctx); setupErr != nil {
+		return nil, setupErr
+	}
+
+	switch classifyEvent(raw) {
+	case EVENT_S3:
+		var s3Event events.S3Event
+		if err := json.Unmarshal(raw, &s3Event); err != nil {
+			return nil, fmt.Errorf("failed to decode s3 event: %s", err)
+		}
+		return nil, h.processObjects(ctx, objectsFromS3Event(s3Event))
+
+	case EVENT_EVENTBRIDGE:
+		var ebEvent events.EventBridgeEvent
+		if err := json.Unmarshal(raw, &ebEvent); err != nil {
+			return nil, fmt.Errorf("failed to decode eventbridge event: %s", err)
+		}
+		objs, objErr := objectsFromEventBridge(ebEvent)
+		if objErr != nil {
+			return nil, objErr
+		}
+		return nil, h.processObjects(ctx, objs)
+
+	case EVENT_SQS:
+		var sqsEvent events.SQSEvent
+		if err := json.Unmarshal(raw, &sqsEvent); err != nil {
+			return nil, fmt.Errorf("failed to decode sqs event: %s", err)
+		}
+
+		resp := events.SQSEventResponse{BatchItemFailures: []events.SQSBatchItemFailure{}}
+		for _, msg := range sqsEvent.Records {
+			objs, objErr := objectsFromMessageBody(msg.Body)
+			if objErr == nil {
+				objErr = h.processObjects(ctx, objs)
+			}
+			if objErr != nil {
+				log.Printf("sqs message [%s] failed: %s", msg.MessageId, objErr)
+				resp.BatchItemFailures = append(resp.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: msg.MessageId})
+			}
+		}
+		return resp, nil
+
+	case EVENT_CONTINUATION:
+		objs, objErr := objectsFromContinuation(raw)
+		if objErr != nil {
+			return nil, objErr
+		}
+		return nil, h.processObjects(ctx, objs)
+
+	case EVENT_SCHEDULED:
+		return h.scheduled(ctx)
+
+	case EVENT_S3_TEST:
+		log.Printf("ignoring s3 test event")
+		return nil, nil
+	}
+
+	return nil, errUnknownEvent
+}
+
+// processes each object independently; one bad object doesn't stop the rest
+//
+// returns the failures (if any) joined together
+func (h *Handler) processObjects(ctx context.Context, objs []objectRef) error {
+	var runningErr error
+	for _, obj := range objs {
+		if err := h.processObject(ctx, obj); err != nil {
+			runningErr = errors.Join(runningErr, fmt.Errorf("%s: %w", obj, err))
+		}
+	}
+	return runningErr
+}
+
+// ingests a single object; an error means it should be retried
+func (h *Handler) processObject(ctx context.Context, obj objectRef) error {
+	bucket := obj.Bucket
+	key := obj.Key
+
+	// sidecar manifests describe a dump, they aren't dumps themselves
+	if sources.IsManifestKey(key) {
+		log.Printf("skipping source manifest %s/%s", bucket, key)
+		return nil
+	}
+
+	// nor are the objects/rejects files we moved or wrote ourselves
+	if h.PostProc.Skip(key) {
+		log.Printf("skipping post-processed object %s/%s", bucket, key)
+		return nil
+	}
+
+	ing := h.newIngester()
+
+	job := jobs.New()
+	job.Bucket = bucket
+	job.Key = key
+	job.ETag = obj.ETag
+	job.Size = obj.Size
+
+	// the etag is what the claim and every read are pinned to; events about objects normally carry it
+	if job.ETag == "" {
+		head, headErr := h.S3.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &bucket, Key: &key})
+		if objectGone(headErr) {
+			log.Printf("skipping %s/%s; it's gone", bucket, key)
+			return nil
+		}
+		if headErr != nil {
+			return fmt.Errorf("failed to get the etag of %s/%s: %s", bucket, key, headErr)
+		}
+		job.ETag = strings.Trim(aws.ToString(head.ETag), `"`)
+	}
+
+	// S3 can deliver the same event more than once and lambda retries on error; only one invocation
+	// gets to ingest a given object version
+	claim, claimErr := ledger.Claim(ctx, h.DynDBCli, h.Tables.Processed, bucket, key, job.ETag, job.ID, leaseFor(ctx))
+	switch {
+	case errors.Is(claimErr, ledger.ErrAlreadyProcessed):
+		log.Printf("skipping %s/%s (etag %s); already processed", bucket, key, job.ETag)
+		return h.finishCleanup(ctx, bucket, key, job.ETag, claim)
+	case errors.Is(claimErr, ledger.ErrInProgress):
+		// the holder may yet fail or time out; an error keeps this event around (sqs redelivers it, lambda
+		// retries it) so the object is picked up again once its lease runs out
+		return fmt.Errorf("%s/%s (etag %s) is being processed by another invocation: %w", bucket, key, job.ETag, claimErr)
+	case claimErr != nil:
+		return claimErr
+	}
+	start := ingest.Position{Offset: claim.Offset, Line: claim.Line}
+	if claim.Resumed {
+		log.Printf("resuming %s/%s (etag %s); attempt %d from line %d (offset %d)", bucket, key, job.ETag, claim.Attempts, start.Line, start.Offset)
+
+		// keep the job that started this object; if there's a checkpoint keep adding to its counts too
+		job.ID = claim.JobID
+		if start.Line > 0 {
+			if prevJob, jobErr := jobs.Get(ctx, h.DynDBCli, ing.JobTable, claim.JobID); jobErr != nil {
+				log.Printf("WARNING: could not load job [%s] to resume (starting its counts over): %s", claim.JobID, jobErr)
+			} else if prevJob != nil {
+				prevJob.Status = jobs.STATUS_RUNNING
+				prevJob.Error = ""
+				job = prevJob
+			}
+		}
+	}
+
+	// get the object (from the checkpoint on, if we have one; and only if it's still the version we claimed)
+	getInput := &s3.GetObjectInput{
+		Bucket:  &bucket,
+		Key:     &key,
+		IfMatch: aws.String(claim.ETag),
+	}
+	if start.Offset > 0 {
+		getInput.Range = aws.String(fmt.Sprintf("bytes=%d-", start.Offset))
+
+		// earlier parts were read by earlier invocations; read them again (just the lines, nothing is
+		// stored) so a line repeated across parts is still caught as a duplicate
+		before, beforeErr := h.S3.GetObject(ctx, &s3.GetObjectInput{
+			Bucket:  &bucket,
+			Key:     &key,
+			IfMatch: aws.String(claim.ETag),
+			Range:   aws.String(fmt.Sprintf("bytes=0-%d", start.Offset-1)),
+		})
+		if beforeErr != nil {
+			return h.getFailed(ctx, ing, job, claim, beforeErr)
+		}
+		defer before.Body.Close()
+		ing.Before = before.Body
+	}
+	output, getErr := h.S3.GetObject(ctx, getInput)
+	if getErr != nil {
+		return h.getFailed(ctx, ing, job, claim, getErr)
+	}
+	defer output.Body.Close()
+
+	if output.ETag != nil {
+		job.ETag = strings.Trim(*output.ETag, `"`)
+	}
+	if output.ContentLength != nil && start.Offset == 0 {
+		job.Size = *output.ContentLength
+	}
+
+	// figure out which breach this dump belongs to (if anyone told us)
+	if src, srcErr := h.resolveSource(ctx, bucket, key, output.Metadata); srcErr != nil {
+		log.Printf("WARNING: could not resolve source for %s/%s (continuing without one): %s", bucket, key, srcErr)
+	} else if src != nil {
+		job.SourceID = src.ID
+		job.BreachDate = src.BreachDate
+	}
+
+	// rejects are just warnings as far as the ingest goes; the job keeps the counts and they end up in the rejects file
+	var rejects []*credparser.ParseError
+	ing.OnReject = func(pe *credparser.ParseError) {
+		log.Printf("%s", pe)
+		rejects = append(rejects, pe)
+	}
+
+	// persist our progress after every batch; once we're close to the deadline stop and hand the rest off
+	ing.OnCheckpoint = func(pos ingest.Position) bool {
+		if cpErr := ledger.Checkpoint(ctx, h.DynDBCli, h.Tables.Processed, claim, pos.Offset, pos.Line); cpErr != nil {
+			log.Printf("WARNING: %s", cpErr) // a retry would just redo a little more work
+		}
+		return h.haveTimeLeft(ctx)
+	}
+
+	// parse and store (merging with anything we already have for the same account)
+	pos, runErr := ing.RunFrom(ctx, output.Body, job, start)
+	if errors.Is(runErr, ingest.ErrStopped) || errors.Is(runErr, ingest.ErrInterrupted) {
+		if errors.Is(runErr, ingest.ErrStopped) {
+			log.Printf("ingest job [%s] for %s/%s stopped at line %d (offset %d) to avoid timing out", job.ID, bucket, key, pos.Line, pos.Offset)
+		} else {
+			log.Printf("ingest job [%s] for %s/%s interrupted; continuing from line %d (offset %d): %s", job.ID, bucket, key, pos.Line, pos.Offset, runErr)
+		}
+
+		// lines past the position get read (and rejected) again by the continuation; ctx may be done by now
+		rejects = slices.DeleteFunc(rejects, func(pe *credparser.ParseError) bool { return pe.Line > pos.Line })
+		if rejErr := h.PostProc.WriteRejects(context.WithoutCancel(ctx), bucket, h.PostProc.Opts.ProcessedPrefix, partName(key, start), rejects); rejErr != nil {
+			log.Printf("WARNING: %s", rejErr)
+		}
+		h.releaseClaim(claim)
+
+		// if we got nowhere a continuation would just do the same again; fail and let the retry (and eventually
+		// the dead letter queue) have it
+		if errors.Is(runErr, ingest.ErrInterrupted) && pos == start {
+			return runErr
+		}
+
+		// without a queue all we'd have is lambda's retry, which gives up after a couple of attempts and
+		// would quietly leave the rest of the object unread; fail the job so it's obvious
+		if h.ContinuationQueue == "" || h.SQS == nil {
+			job.Finish(fmt.Errorf("stopped at line %d; objects this big need a continuation queue (%s)", pos.Line, ENV_CONTINUATION_QUEUE_URL))
+			if saveErr := jobs.Save(context.WithoutCancel(ctx), h.DynDBCli, ing.JobTable, job); saveErr != nil {
+				log.Printf("WARNING: %s", saveErr)
+			}
+		}
+		return h.emitContinuation(ctx, continuation{Bucket: bucket, Key: key, ETag: claim.ETag, JobID: job.ID, Offset: pos.Offset, Line: pos.Line})
+	}
+	if runErr != nil {
+		log.Printf("ingest job [%s] for %s/%s failed: %s", job.ID, bucket, key, runErr)
+		h.releaseClaim(claim)
+
+		// the object itself is bad (reading it again won't help, see RunFrom); quarantine it. if that works the
+		// failure is handled (the job has the details) and a retry would find nothing to do
+		if qErr := h.PostProc.Failed(ctx, bucket, key, rejects); qErr != nil {
+			log.Printf("failed to quarantine %s/%s: %s", bucket, key, qErr)
+			return runErr
+		}
+		return nil
+	}
+	log.Printf("ingest job [%s] for %s/%s finished (%s): %d lines, %d accepted, %d rejected, %d write failures, %d alerts (%d failed), %d canaries",
+		job.ID, bucket, key, job.Status, job.LinesRead, job.Accepted, job.TotalRejected(), job.WriteFailures, job.Alerts, job.AlertFailures, job.Canaries)
+
+	// earlier parts of a resumed object wrote their own rejects files; keep this part's separate too
+	if start.Line > 0 {
+		if rejErr := h.PostProc.WriteRejects(ctx, bucket, h.PostProc.Opts.ProcessedPrefix, partName(key, start), rejects); rejErr != nil {
+			log.Printf("WARNING: %s", rejErr)
+		}
+		rejects = nil
+	}
+
+	if completeErr := ledger.Complete(ctx, h.DynDBCli, h.Tables.Processed, claim); completeErr != nil {
+		log.Printf("WARNING: %s", completeErr) // worst case a duplicate delivery re-ingests; merges make that harmless
+	}
+
+	// cleanup the bucket (move/delete/tag the object we just processed, per POSTPROCESS_MODE)
+	return h.PostProc.Succeeded(ctx, bucket, key, job.ID, rejects)
+}
+
+// we couldn't read the object we claimed; the job records why. if the version we claimed is gone (deleted,
+// or overwritten, so the etag no longer matches) there's nothing to retry; the newer version has its own event
+func (h *Handler) getFailed(ctx context.Context, ing *ingest.Ingester, job *jobs.Job, claim *ledger.Entry, getErr error) error {
+	log.Printf("error getting object %s/%s: %s", job.Bucket, job.Key, getErr)
+	job.Finish(getErr)
+	if saveErr := jobs.Save(ctx, h.DynDBCli, ing.JobTable, job); saveErr != nil {
+		log.Printf("WARNING: %s", saveErr)
+	}
+	h.releaseClaim(claim)
+
+	if objectGone(getErr) {
+		return nil
+	}
+	return getErr
+}
+
+// true if err says the object (or the version of it we asked for) doesn't exist
+func objectGone(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "NoSuchKey", "NotFound", "PreconditionFailed":
+		return true
+	}
+	return false
+}
+
+// an object the ledger says was fully ingested is normally gone (moved or deleted) by the time its event is
+// redelivered; if it's still there, and still the version we ingested, the post-processing failed after
+// the ingest was marked complete, so do it again
+func (h *Handler) finishCleanup(ctx context.Context, bucket, key, etag string, entry *ledger.Entry) error {
+	if h.PostProc.Opts.Mode == postprocess.MODE_TAG {
+		return nil // tagged objects are meant to stay put
+	}
+
+	head, headErr := h.S3.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &bucket, Key: &key})
+	if objectGone(headErr) {
+		return nil
+	}
+	if headErr != nil {
+		return fmt.Errorf("failed to check whether %s/%s was cleaned up: %s", bucket, key, headErr)
+	}
+	if head.ETag == nil || strings.Trim(*head.ETag, `"`) != etag {
+		return nil // overwritten since; that version has its own event
+	}
+
+	jobID := ""
+	if entry != nil {
+		jobID = entry.JobID
+	}
+	log.Printf("%s/%s (etag %s) was ingested but never cleaned up; post-processing it again", bucket, key, etag)
+	return h.PostProc.Succeeded(ctx, bucket, key, jobID, nil)
+}
+
+func (h *Handler) newIngester() *ingest.Ingester {
+	ing := ingest.NewWithTables(h.DynDBCli, h.Tables.Ingest(), h.TableOptions)
+	ing.Cipher = h.Cipher
+	ing.Keys = h.Keys
+	ing.Retention = h.Retention
+	ing.Notifier = h.Notifier
+	ing.Webhooks = h.Webhooks
+	return ing
+}
+
+// ensures the tables on the first event of a cold start rather than describing every table on every
+// event; a failure isn't remembered, so the next event tries again instead of the instance staying broken
+func (h *Handler) ensureTablesOnce(ctx context.Context) error {
+	h.tablesMu.Lock()
+	defer h.tablesMu.Unlock()
+
+	if h.tablesReady {
+		return nil
+	}
+	if err := h.ensureTables(ctx); err != nil {
+		return err
+	}
+	h.tablesReady = true
+	return nil
+}
+
+func (h *Handler) ensureTables(ctx context.Context) error {
+	if err := h.newIngester().EnsureTables(ctx); err != nil {
+		return err
+	}
+	if err := util.EnsureDynamoDBTable(ctx, h.DynDBCli, h.Tables.Processed, ledger.Entry{}, h.TableOptions); err != nil {
+		return err
+	}
+	return util.EnsureDynamoDBTable(ctx, h.DynDBCli, h.Tables.Sources, sources.Source{}, h.TableOptions)
+}
+
+// claims last as long as this invocation can (plus a little slack), so a crashed/timed out attempt
+// can be picked up by the retry
+func leaseFor(ctx context.Context) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		return time.Until(deadline) + time.Minute
+	}
+	return ledger.DEFAULT_LEASE
+}
+
+// name for the rejects file of one part of an object processed across several invocations
+func partName(key string, start ingest.Position) string {
+	return fmt.Sprintf("%s.from-line-%d", key, start.Line+1)
+}
+
+// on failure we hand the object back so lambda's retry doesn't have to wait out our lease; uses a fresh
+// context as ours may be the reason we failed
+func (h *Handler) releaseClaim(claim *ledger.Entry) {
+	if err := ledger.Release(context.Background(), h.DynDBCli, h.Tables.Processed, claim); err != nil {
+		log.Printf("WARNING: %s", err)
+	}
+}
+
+// source info comes from the object's own metadata first, then from a sidecar manifest (<key>.source.json)
+//
+// returns nil (no error) if the dump has no source information at all
+func (h *Handler) resolveSource(ctx context.Context, bucket, key string, meta map[string]string) (*sources.Source, error) {
+	src, metaErr := sources.FromMetadata(meta)
+	if metaErr != nil && !errors.Is(metaErr, sources.ErrNoSource) {
+		return nil, metaErr
+	}
+
+	if src == nil {
+		manifest, getErr := h.S3.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(sources.ManifestKey(key)),
+		})
+		if getErr != nil {
+			var noKey *s3types.NoSuchKey
+			if errors.As(getErr, &noKey) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("failed to get source manifest: %s", getErr)
+		}
+		defer manifest.Body.Close()
+
+		var parseErr error
+		if src, parseErr = sources.ParseManifest(manifest.Body); parseErr != nil {
+			if errors.Is(parseErr, sources.ErrNoSource) {
+				return nil, nil
+			}
+			return nil, parseErr
+		}
+	}
+
+	return sources.Save(ctx, h.DynDBCli, h.Tables.Sources, src)
+}
@@ -0,0 +1,565 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/newodahs/readerlambda/pkg/awsfake"
+	"github.com/newodahs/readerlambda/pkg/config"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/credstore"
+	"github.com/newodahs/readerlambda/pkg/ingest"
+	"github.com/newodahs/readerlambda/pkg/jobs"
+	"github.com/newodahs/readerlambda/pkg/ledger"
+	"github.com/newodahs/readerlambda/pkg/postprocess"
+	"github.com/newodahs/readerlambda/pkg/retention"
+	"github.com/newodahs/readerlambda/pkg/sources"
+)
+
+// end-to-end runs of the real handler against the in-memory S3/dynamodb fakes, driven by the synthetic
+// events in test/events
+
+const (
+	testBucket = "credential-dumps"
+	testKey    = "dumps/challenge creds.txt" // what the url-encoded key in the events decodes to
+)
+
+type fakeSQS struct {
+	sent []string
+}
+
+func (f *fakeSQS) SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	f.sent = append(f.sent, *params.MessageBody)
+	return &sqs.SendMessageOutput{}, nil
+}
+
+type testEnv struct {
+	h     *Handler
+	s3    *awsfake.S3
+	dyn   *awsfake.DynamoDB
+	sqs   *fakeSQS
+	creds []byte
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+
+	creds, readErr := os.ReadFile(filepath.Join("..", "..", "test", "challenge_creds.txt"))
+	if readErr != nil {
+		t.Fatalf("failed to read test credentials: %s", readErr)
+	}
+
+	env := &testEnv{s3: awsfake.NewS3(), dyn: awsfake.NewDynamoDB(), sqs: &fakeSQS{}, creds: creds}
+	env.s3.Put(testBucket, testKey, creds, nil)
+	env.h = &Handler{
+		Tables:            config.Default().Tables,
+		S3:                env.s3,
+		DynDBCli:          env.dyn,
+		SQS:               env.sqs,
+		PostProc:          postprocess.New(env.s3, postprocess.DefaultOptions()),
+		CheckpointMargin:  DEFAULT_CHECKPOINT_MARGIN,
+		ContinuationQueue: "https://sqs.us-east-1.amazonaws.com/123456789012/credential-dumps",
+	}
+	return env
+}
+
+func loadEvent(t *testing.T, name string) json.RawMessage {
+	t.Helper()
+
+	raw, err := os.ReadFile(filepath.Join("..", "..", "test", "events", name))
+	if err != nil {
+		t.Fatalf("failed to read event %s: %s", name, err)
+	}
+	return raw
+}
+
+// what the parser makes of the test file on its own; the tables should end up holding exactly this
+func expectedCreds(t *testing.T, body []byte) map[string]*credparser.CredentialInfo {
+	t.Helper()
+
+	parsed, _ := credparser.GetCredentialInfo(bufio.NewScanner(bytes.NewReader(body)))
+	ret := map[string]*credparser.CredentialInfo{}
+	for _, cred := range parsed {
+		ret[cred.Email] = cred
+	}
+	return ret
+}
+
+func (env *testEnv) storedCreds(t *testing.T) map[string]*credparser.CredentialInfo {
+	t.Helper()
+
+	var stored []*credparser.CredentialInfo
+	if err := attributevalue.UnmarshalListOfMaps(env.dyn.Items(credstore.DYNDB_TABLE_EXPLOITCRED), &stored); err != nil {
+		t.Fatalf("failed to unmarshal stored credentials: %s", err)
+	}
+	ret := map[string]*credparser.CredentialInfo{}
+	for _, cred := range stored {
+		ret[cred.Email] = cred
+	}
+	return ret
+}
+
+func (env *testEnv) jobs(t *testing.T) []*jobs.Job {
+	t.Helper()
+
+	list, err := jobs.List(context.TODO(), env.dyn, jobs.DYNDB_TABLE_JOBS, "", 0)
+	if err != nil {
+		t.Fatalf("failed to list jobs: %s", err)
+	}
+	return list
+}
+
+func Test_Handler_S3Put(t *testing.T) {
+	env := newTestEnv(t)
+	etag := env.s3.Object(testBucket, testKey).ETag
+
+	if _, err := env.h.HandleRequest(context.TODO(), loadEvent(t, "s3-put.json")); err != nil {
+		t.Fatalf("handler failed: %s", err)
+	}
+
+	for _, table := range []string{credstore.DYNDB_TABLE_EXPLOITCRED, jobs.DYNDB_TABLE_JOBS, ledger.DYNDB_TABLE_PROCESSED, sources.DYNDB_TABLE_SOURCES, sources.DYNDB_TABLE_SOURCECREDS} {
+		if !slices.Contains(env.dyn.Tables(), table) {
+			t.Errorf("table [%s] was not created (have %v)", table, env.dyn.Tables())
+		}
+	}
+
+	expect := expectedCreds(t, env.creds)
+	stored := env.storedCreds(t)
+	if len(expect) == 0 || len(stored) != len(expect) {
+		t.Fatalf("expected %d stored credentials, got %d", len(expect), len(stored))
+	}
+	for email, want := range expect {
+		got := stored[email]
+		if got == nil {
+			t.Errorf("credential [%s] was not stored", email)
+			continue
+		}
+		if !slices.Equal(got.Password, want.Password) {
+			t.Errorf("credential [%s] stored passwords %v, expected %v", email, got.Password, want.Password)
+		}
+		if len(got.Provenance) != len(got.Password) || got.Provenance[0].Bucket != testBucket || got.Provenance[0].Key != testKey {
+			t.Errorf("credential [%s] has bad provenance: %+v", email, got.Provenance)
+		}
+	}
+
+	jobList := env.jobs(t)
+	if len(jobList) != 1 {
+		t.Fatalf("expected 1 job, got %d", len(jobList))
+	}
+	job := jobList[0]
+	if job.Status != jobs.STATUS_SUCCEEDED || job.Bucket != testBucket || job.Key != testKey || job.ETag != etag || job.Accepted != len(expect) {
+		t.Errorf("unexpected job: %+v", job)
+	}
+
+	entry, ledgerErr := ledger.Get(context.TODO(), env.dyn, ledger.DYNDB_TABLE_PROCESSED, ledger.ObjectID(testBucket, testKey, etag))
+	if ledgerErr != nil || entry == nil || entry.State != ledger.STATE_COMPLETE || entry.JobID != job.ID {
+		t.Errorf("expected a complete ledger entry for job [%s]: %+v (%v)", job.ID, entry, ledgerErr)
+	}
+
+	// the object is moved out of the way, with any rejects next to it
+	expectKeys := []string{postprocess.DEFAULT_PROCESSED_PREFIX + testKey}
+	if job.TotalRejected() > 0 {
+		expectKeys = append(expectKeys, postprocess.DEFAULT_PROCESSED_PREFIX+testKey+postprocess.REJECTS_SUFFIX)
+	}
+	if keys := env.s3.Keys(testBucket); !slices.Equal(keys, expectKeys) {
+		t.Errorf("expected bucket to hold %v afterwards, got %v", expectKeys, keys)
+	}
+
+	// S3 delivers at least once; the same event again mustn't ingest (or fail) a second time
+	if _, err := env.h.HandleRequest(context.TODO(), loadEvent(t, "s3-put.json")); err != nil {
+		t.Errorf("redelivered event failed: %s", err)
+	}
+	if jobCnt := len(env.jobs(t)); jobCnt != 1 {
+		t.Errorf("redelivered event created another job (%d jobs)", jobCnt)
+	}
+
+	// if the move never happened (say the delete kept failing after the ledger said complete) a redelivery
+	// finishes it, without ingesting again
+	env.s3.Put(testBucket, testKey, env.creds, nil)
+	if _, err := env.h.HandleRequest(context.TODO(), loadEvent(t, "s3-put.json")); err != nil {
+		t.Errorf("redelivered event for a leftover object failed: %s", err)
+	}
+	if env.s3.Object(testBucket, testKey) != nil {
+		t.Errorf("leftover object wasn't cleaned up: %v", env.s3.Keys(testBucket))
+	}
+	if jobCnt := len(env.jobs(t)); jobCnt != 1 {
+		t.Errorf("cleaning up a leftover object created another job (%d jobs)", jobCnt)
+	}
+
+	// a different version under the same key is left for its own event
+	env.s3.Put(testBucket, testKey, []byte("someone@else.com:pw\n"), nil)
+	if _, err := env.h.HandleRequest(context.TODO(), loadEvent(t, "s3-put.json")); err != nil {
+		t.Errorf("redelivered event for an overwritten object failed: %s", err)
+	}
+	if env.s3.Object(testBucket, testKey) == nil {
+		t.Errorf("a newer version of the object was moved without being ingested")
+	}
+}
+
+// a message for an object another invocation holds is reported as failed so sqs redelivers it, rather
+// than being deleted while the holder may still fail
+func Test_Handler_InProgress(t *testing.T) {
+	env := newTestEnv(t)
+	etag := env.s3.Object(testBucket, testKey).ETag
+	if err := env.h.ensureTables(context.TODO()); err != nil {
+		t.Fatalf("failed to create tables: %s", err)
+	}
+
+	holder, claimErr := ledger.Claim(context.TODO(), env.dyn, ledger.DYNDB_TABLE_PROCESSED, testBucket, testKey, etag, "someone-else", time.Hour)
+	if claimErr != nil {
+		t.Fatalf("failed to claim: %s", claimErr)
+	}
+
+	resp, err := env.h.HandleRequest(context.TODO(), loadEvent(t, "sqs-batch.json"))
+	if err != nil {
+		t.Fatalf("handler failed: %s", err)
+	}
+	sqsResp, _ := resp.(events.SQSEventResponse)
+	if len(sqsResp.BatchItemFailures) != 2 || sqsResp.BatchItemFailures[0].ItemIdentifier != "059f36b4-87a3-44ab-83d2-661975830a7d" {
+		t.Errorf("expected the held object's message to be retried, got %+v", sqsResp.BatchItemFailures)
+	}
+	if env.s3.Object(testBucket, testKey) == nil || len(env.storedCreds(t)) != 0 {
+		t.Errorf("object was ingested while another invocation held it")
+	}
+
+	// once the holder lets go the redelivered message goes through
+	if relErr := ledger.Release(context.TODO(), env.dyn, ledger.DYNDB_TABLE_PROCESSED, holder); relErr != nil {
+		t.Fatalf("failed to release: %s", relErr)
+	}
+	resp, _ = env.h.HandleRequest(context.TODO(), loadEvent(t, "sqs-batch.json"))
+	if sqsResp, _ = resp.(events.SQSEventResponse); len(sqsResp.BatchItemFailures) != 1 {
+		t.Errorf("expected only the bad message to fail after release, got %+v", sqsResp.BatchItemFailures)
+	}
+	if env.s3.Object(testBucket, testKey) != nil || len(env.storedCreds(t)) == 0 {
+		t.Errorf("object wasn't ingested after the claim was released")
+	}
+}
+
+func Test_Handler_EventKinds(t *testing.T) {
+	testSet := []struct {
+		Name         string
+		Event        string
+		ExpectErr    bool
+		ExpectFailed []string // sqs message ids reported back as failures
+		ExpectIngest bool
+	}{
+		{Name: "EventBridge", Event: "eventbridge-created.json", ExpectIngest: true},
+		{Name: "SQSBatch", Event: "sqs-batch.json", ExpectFailed: []string{"2e1424d4-f796-459a-8184-9c92662be6da"}, ExpectIngest: true},
+		{Name: "S3TestEvent", Event: "s3-test-event.json"},
+		{Name: "S3Delete", Event: "s3-delete.json"},
+		{Name: "Scheduled", Event: "scheduled.json"},
+	}
+
+	for _, test := range testSet {
+		t.Run(test.Name, func(t *testing.T) {
+			env := newTestEnv(t)
+
+			resp, err := env.h.HandleRequest(context.TODO(), loadEvent(t, test.Event))
+			if (err != nil) != test.ExpectErr {
+				t.Fatalf("unexpected error state: %v", err)
+			}
+
+			if test.ExpectFailed != nil {
+				sqsResp, ok := resp.(events.SQSEventResponse)
+				if !ok {
+					t.Fatalf("expected an sqs batch response, got %T", resp)
+				}
+				var failed []string
+				for _, f := range sqsResp.BatchItemFailures {
+					failed = append(failed, f.ItemIdentifier)
+				}
+				if !slices.Equal(failed, test.ExpectFailed) {
+					t.Errorf("expected failed messages %v, got %v", test.ExpectFailed, failed)
+				}
+			}
+
+			ingested := env.s3.Object(testBucket, testKey) == nil
+			if ingested != test.ExpectIngest {
+				t.Errorf("expected ingested: %t; bucket holds %v", test.ExpectIngest, env.s3.Keys(testBucket))
+			}
+			if test.ExpectIngest && len(env.storedCreds(t)) == 0 {
+				t.Errorf("nothing was stored")
+			}
+		})
+	}
+}
+
+// an object too big for one invocation is checkpointed, handed off via a continuation and finished by
+// the next invocation(s) under the same job
+func Test_Handler_Continuation(t *testing.T) {
+	env := newTestEnv(t)
+
+	const lineCnt = 1234
+	var dump bytes.Buffer
+	for i := range lineCnt {
+		fmt.Fprintf(&dump, "user%d@continue.com:pw%d\n", i, i)
+	}
+	dump.WriteString("user0@continue.com:pw0\n") // a duplicate of a line in the first part
+	bigKey := "dumps/big.txt"
+	etag := env.s3.Put(testBucket, bigKey, dump.Bytes(), nil)
+
+	// with the margin longer than the time we have, every invocation stops after its first batch
+	env.h.CheckpointMargin = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	raw, _ := json.Marshal(events.S3Event{Records: []events.S3EventRecord{{
+		EventSource: "aws:s3",
+		EventName:   "ObjectCreated:Put",
+		S3: events.S3Entity{
+			Bucket: events.S3Bucket{Name: testBucket},
+			Object: events.S3Object{Key: bigKey, ETag: etag, Size: int64(dump.Len())},
+		},
+	}}})
+
+	invocations := 0
+	for ; invocations < 10; invocations++ {
+		sentBefore := len(env.sqs.sent)
+		if _, err := env.h.HandleRequest(ctx, raw); err != nil {
+			t.Fatalf("invocation %d failed: %s", invocations, err)
+		}
+		if len(env.sqs.sent) == sentBefore {
+			break // finished
+		}
+		raw = json.RawMessage(env.sqs.sent[len(env.sqs.sent)-1])
+	}
+
+	if invocations < 2 {
+		t.Errorf("expected the object to take several invocations, took %d", invocations+1)
+	}
+
+	jobList := env.jobs(t)
+	if len(jobList) != 1 {
+		t.Fatalf("expected a single job across invocations, got %d", len(jobList))
+	}
+	if job := jobList[0]; job.Status != jobs.STATUS_SUCCEEDED || job.LinesRead != lineCnt+1 || job.Accepted != lineCnt || job.Rejected[credparser.REJECT_DUPLICATE] != 1 {
+		t.Errorf("unexpected job after continuation: %+v", job)
+	}
+	if stored := len(env.storedCreds(t)); stored != lineCnt {
+		t.Errorf("expected %d stored credentials, got %d", lineCnt, stored)
+	}
+	if env.s3.Object(testBucket, bigKey) != nil || env.s3.Object(testBucket, postprocess.DEFAULT_PROCESSED_PREFIX+bigKey) == nil {
+		t.Errorf("object wasn't moved once finished: %v", env.s3.Keys(testBucket))
+	}
+}
+
+// cuts the first read of an object off after failAfter bytes, like a connection dropping mid-download
+type droppingS3 struct {
+	*awsfake.S3
+	failAfter int64
+}
+
+func (d *droppingS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	out, err := d.S3.GetObject(ctx, params, optFns...)
+	if err == nil && d.failAfter > 0 {
+		out.Body = io.NopCloser(io.MultiReader(io.LimitReader(out.Body, d.failAfter), iotest.ErrReader(errors.New("connection reset"))))
+		d.failAfter = 0
+	}
+	return out, err
+}
+
+// an object whose read fails part way isn't quarantined; the rest goes through a continuation
+func Test_Handler_Interrupted(t *testing.T) {
+	env := newTestEnv(t)
+
+	const lineCnt = 1234
+	var dump bytes.Buffer
+	for i := range lineCnt {
+		fmt.Fprintf(&dump, "user%d@interrupted.com:pw%d\n", i, i)
+	}
+	bigKey := "dumps/big.txt"
+	etag := env.s3.Put(testBucket, bigKey, dump.Bytes(), nil)
+	env.h.S3 = &droppingS3{S3: env.s3, failAfter: int64(dump.Len() * 2 / 3)} // past the first batch
+
+	raw, _ := json.Marshal(events.S3Event{Records: []events.S3EventRecord{{
+		EventSource: "aws:s3",
+		EventName:   "ObjectCreated:Put",
+		S3: events.S3Entity{
+			Bucket: events.S3Bucket{Name: testBucket},
+			Object: events.S3Object{Key: bigKey, ETag: etag, Size: int64(dump.Len())},
+		},
+	}}})
+	if _, err := env.h.HandleRequest(context.TODO(), raw); err != nil {
+		t.Fatalf("interrupted invocation failed: %s", err)
+	}
+	if len(env.sqs.sent) != 1 {
+		t.Fatalf("expected a continuation, sent %d messages", len(env.sqs.sent))
+	}
+	if keys := env.s3.Keys(testBucket); slices.Contains(keys, postprocess.DEFAULT_FAILED_PREFIX+bigKey) || !slices.Contains(keys, bigKey) {
+		t.Fatalf("interrupted object was moved: %v", keys)
+	}
+
+	if _, err := env.h.HandleRequest(context.TODO(), json.RawMessage(env.sqs.sent[0])); err != nil {
+		t.Fatalf("continuation failed: %s", err)
+	}
+	jobList := env.jobs(t)
+	if len(jobList) != 1 {
+		t.Fatalf("expected a single job, got %d", len(jobList))
+	}
+	if job := jobList[0]; job.Status != jobs.STATUS_SUCCEEDED || job.LinesRead != lineCnt || job.Accepted != lineCnt {
+		t.Errorf("unexpected job after continuing: %+v", job)
+	}
+	if stored := len(env.storedCreds(t)); stored != lineCnt {
+		t.Errorf("expected %d stored credentials, got %d", lineCnt, stored)
+	}
+	if env.s3.Object(testBucket, postprocess.DEFAULT_PROCESSED_PREFIX+bigKey) == nil {
+		t.Errorf("object wasn't moved once finished: %v", env.s3.Keys(testBucket))
+	}
+}
+
+// without a queue an object that needs a continuation fails its job rather than relying on lambda's retry
+// to get through it; an event without an etag is pinned to the one S3 has
+func Test_Handler_NoQueue(t *testing.T) {
+	env := newTestEnv(t)
+	env.h.ContinuationQueue = ""
+	env.h.CheckpointMargin = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	var dump bytes.Buffer
+	for i := range 600 {
+		fmt.Fprintf(&dump, "user%d@noqueue.com:pw%d\n", i, i)
+	}
+	bigKey := "dumps/big.txt"
+	etag := env.s3.Put(testBucket, bigKey, dump.Bytes(), nil)
+
+	raw, _ := json.Marshal(events.S3Event{Records: []events.S3EventRecord{{
+		EventSource: "aws:s3",
+		EventName:   "ObjectCreated:Put",
+		S3: events.S3Entity{
+			Bucket: events.S3Bucket{Name: testBucket},
+			Object: events.S3Object{Key: bigKey, Sequencer: "0A1B2C3D4E5F678901"},
+		},
+	}}})
+	if _, err := env.h.HandleRequest(ctx, raw); err == nil || !strings.Contains(err.Error(), ENV_CONTINUATION_QUEUE_URL) {
+		t.Fatalf("expected an error about the missing queue, got %v", err)
+	}
+
+	jobList := env.jobs(t)
+	if len(jobList) != 1 || jobList[0].Status != jobs.STATUS_FAILED || !strings.Contains(jobList[0].Error, ENV_CONTINUATION_QUEUE_URL) {
+		t.Errorf("expected a failed job naming the missing queue: %+v", jobList)
+	}
+	entry, _ := ledger.Get(context.TODO(), env.dyn, ledger.DYNDB_TABLE_PROCESSED, ledger.ObjectID(testBucket, bigKey, etag))
+	if entry == nil || entry.Line != ingest.DEFAULT_BATCH_SIZE {
+		t.Errorf("expected a checkpoint under the object's etag: %+v", entry)
+	}
+
+	// the retry picks up from the checkpoint (reading the earlier part with the same etag)
+	env.h.CheckpointMargin = DEFAULT_CHECKPOINT_MARGIN
+	if _, err := env.h.HandleRequest(ctx, raw); err != nil {
+		t.Fatalf("retry failed: %s", err)
+	}
+	if jobList = env.jobs(t); len(jobList) != 1 || jobList[0].Status != jobs.STATUS_SUCCEEDED || jobList[0].LinesRead != 600 {
+		t.Errorf("expected the retry to finish the job: %+v", jobList)
+	}
+}
+
+// an event for a version of an object that's since been overwritten is dropped, not retried
+func Test_Handler_Overwritten(t *testing.T) {
+	env := newTestEnv(t)
+	env.s3.Put(testBucket, testKey, []byte("someone@else.com:pw\n"), nil)
+
+	if _, err := env.h.HandleRequest(context.TODO(), loadEvent(t, "s3-put.json")); err != nil {
+		t.Fatalf("expected the stale event to be dropped, got %s", err)
+	}
+	if len(env.storedCreds(t)) != 0 || env.s3.Object(testBucket, testKey) == nil {
+		t.Errorf("the newer version was ingested (or moved) by the old version's event: %v", env.s3.Keys(testBucket))
+	}
+}
+
+// credentials from an old breach expire per the retention policy and the scheduled purge removes them
+func Test_Handler_Retention(t *testing.T) {
+	env := newTestEnv(t)
+	env.s3.Put(testBucket, sources.ManifestKey(testKey), []byte(`{"name":"Old Breach","breachDate":"2020-01-01"}`), nil)
+	env.h.Retention, _ = retention.New("365d", nil, nil, nil)
+
+	if _, err := env.h.HandleRequest(context.TODO(), loadEvent(t, "s3-put.json")); err != nil {
+		t.Fatalf("handler failed: %s", err)
+	}
+	if ttlAttr, _, _ := env.dyn.TableSettings(credstore.DYNDB_TABLE_EXPLOITCRED); ttlAttr != credstore.ATTR_EXPIRES_AT {
+		t.Errorf("expected TTL on [%s], got [%s]", credstore.ATTR_EXPIRES_AT, ttlAttr)
+	}
+
+	stored := env.storedCreds(t)
+	expires := time.Date(2020, 12, 31, 0, 0, 0, 0, time.UTC) // 365 days from the breach (a leap year)
+	for email, cred := range stored {
+		if cred.ExpiresAt == nil || !cred.ExpiresAt.Equal(expires) || !cred.Provenance[0].ExpiresAt.Equal(expires) {
+			t.Errorf("credential [%s] expires at %v, expected %s", email, cred.ExpiresAt, expires)
+		}
+	}
+
+	resp, err := env.h.HandleRequest(context.TODO(), loadEvent(t, "scheduled.json"))
+	if err != nil {
+		t.Fatalf("scheduled purge failed: %s", err)
+	}
+	if res, ok := resp.(ScheduledResult); !ok || res.Purge.Deleted != len(stored) {
+		t.Errorf("expected %d credentials deleted, got %+v", len(stored), resp)
+	}
+	if left := len(env.dyn.Items(credstore.DYNDB_TABLE_EXPLOITCRED)); left != 0 {
+		t.Errorf("expected the purge to empty the table, %d left", left)
+	}
+	if left := len(env.dyn.Items(sources.DYNDB_TABLE_SOURCECREDS)); left != 0 {
+		t.Errorf("expected the purge to remove the source links, %d left", left)
+	}
+}
+
+// counts table descriptions, failing the first few as if dynamodb were throttling us
+type describeCountingDynamoDB struct {
+	*awsfake.DynamoDB
+	failFor   int
+	describes int
+}
+
+func (f *describeCountingDynamoDB) DescribeTable(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
+	f.describes++
+	if f.failFor > 0 {
+		f.failFor--
+		return nil, errors.New("throttled")
+	}
+	return f.DynamoDB.DescribeTable(ctx, params, optFns...)
+}
+
+// the tables are ensured on the first event that gets through, not on every event; a failed attempt is
+// tried again by the next event
+func Test_Handler_EnsureTablesOnce(t *testing.T) {
+	env := newTestEnv(t)
+	dyn := &describeCountingDynamoDB{DynamoDB: env.dyn, failFor: 1}
+	env.h.DynDBCli = dyn
+
+	if _, err := env.h.HandleRequest(context.TODO(), loadEvent(t, "s3-test-event.json")); err == nil || !strings.Contains(err.Error(), "throttled") {
+		t.Fatalf("expected the first event to fail ensuring tables, got %v", err)
+	}
+	if _, err := env.h.HandleRequest(context.TODO(), loadEvent(t, "s3-test-event.json")); err != nil {
+		t.Fatalf("handler failed: %s", err)
+	}
+	if !slices.Contains(env.dyn.Tables(), credstore.DYNDB_TABLE_EXPLOITCRED) {
+		t.Fatalf("tables weren't created after the failed attempt (have %v)", env.dyn.Tables())
+	}
+
+	ensured := dyn.describes
+	for i := 0; i < 3; i++ {
+		if _, err := env.h.HandleRequest(context.TODO(), loadEvent(t, "s3-test-event.json")); err != nil {
+			t.Fatalf("handler failed: %s", err)
+		}
+	}
+	if dyn.describes != ensured {
+		t.Errorf("expected no more table descriptions after the tables were ensured, got %d more", dyn.describes-ensured)
+	}
+}
@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/newodahs/readerlambda/pkg/credstore"
+	"github.com/newodahs/readerlambda/pkg/webhook"
+)
+
+// what a scheduled run did
+type ScheduledResult struct {
+	Purge    credstore.PurgeStats `json:"purge"`
+	Webhooks *webhook.RetryStats  `json:"webhooks,omitempty"` // nil without webhooks
+}
+
+// the housekeeping done on a schedule: purging expired credentials then retrying webhooks that are due,
+// both stopping CheckpointMargin short of the deadline; whatever's left is picked up by the next run
+func (h *Handler) scheduled(ctx context.Context) (any, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline.Add(-h.CheckpointMargin))
+		defer cancel()
+	}
+
+	var ret ScheduledResult
+	var err error
+	ret.Purge, err = h.purge(ctx)
+	if err != nil {
+		return ret, err
+	}
+	if h.Webhooks != nil {
+		stats, retryErr := h.Webhooks.Retry(ctx)
+		log.Printf("webhooks: %d due, %d delivered, %d still pending, %d failed, %d skipped",
+			stats.Due, stats.Delivered, stats.Pending, stats.Failed, stats.Skipped)
+		ret.Webhooks = &stats
+		if errors.Is(retryErr, context.DeadlineExceeded) {
+			log.Printf("webhook retries stopped to avoid timing out; the next run carries on")
+			retryErr = nil
+		}
+		err = retryErr
+	}
+	return ret, err
+}
+
+// removes expired credentials/passwords (see credstore.Purger); returns the purge's counts. running out
+// of time isn't an error, the next run carries on
+func (h *Handler) purge(ctx context.Context) (credstore.PurgeStats, error) {
+	stats, err := credstore.NewPurger(h.DynDBCli, h.Tables.Credentials, h.Tables.SourceCredentials).Run(ctx)
+	log.Printf("purge: %d expired, %d deleted, %d trimmed (%d passwords removed), %d skipped, %d failed",
+		stats.Scanned, stats.Deleted, stats.Trimmed, stats.Passwords, stats.Skipped, stats.Failed)
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("purge stopped to avoid timing out; the next run carries on")
+		return stats, nil
+	}
+	return stats, err
+}
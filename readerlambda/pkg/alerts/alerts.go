@@ -0,0 +1,251 @@
+package alerts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/newodahs/readerlambda/pkg/util"
+)
+
+// what raised an alert
+type Kind string
+
+const (
+	ALERT_KIND_WATCHLIST Kind = "watchlist"
+	ALERT_KIND_CANARY    Kind = "canary" // one of our canary credentials turned up in a dump
+)
+
+// how urgently an alert wants looking at; passed along so destinations can route on it
+type Priority string
+
+const (
+	PRIORITY_NORMAL Priority = "normal"
+	PRIORITY_HIGH   Priority = "high"
+)
+
+// something someone asked to hear about turned up in an ingest; only ever carries masked details (see
+// MaskEmail), never passwords, as it leaves the system
+type Alert struct {
+	ID        string   `json:"id"`
+	Kind      Kind     `json:"kind"`
+	Priority  Priority `json:"priority"`
+	Label     string   `json:"label,omitempty"`   // canary alerts: where the canary was planted
+	Owner     string   `json:"owner,omitempty"`   // who registered the watch (tenant/team)
+	Watched   string   `json:"watched,omitempty"` // what matched: a domain, or a (masked) address
+	Email     string   `json:"email"`             // masked
+	Domain    string   `json:"domain"`
+	Passwords int      `json:"passwords"` // passwords for the address that were new to us (canaries: in the dump)
+
+	PasswordMatched bool `json:"passwordMatched,omitempty"` // canary alerts: the canary's password was there too, not just its address
+
+	SourceID   string    `json:"sourceId,omitempty"`
+	JobID      string    `json:"jobId,omitempty"`
+	Bucket     string    `json:"bucket,omitempty"`
+	Key        string    `json:"key,omitempty"`
+	Filename   string    `json:"filename,omitempty"`
+	Line       int       `json:"line,omitempty"` // canary alerts: where in the file it was
+	DetectedAt time.Time `json:"detectedAt"`
+}
+
+// canary alerts are high priority, everything else normal
+func New(kind Kind) *Alert {
+	priority := PRIORITY_NORMAL
+	if kind == ALERT_KIND_CANARY {
+		priority = PRIORITY_HIGH
+	}
+	return &Alert{ID: util.NewID(), Kind: kind, Priority: priority, DetectedAt: time.Now().UTC()}
+}
+
+// keeps the first and last character of the user part: jsmith@example.com => j****h@example.com
+// (anything of two characters or fewer is masked entirely)
+func MaskEmail(email string) string {
+	user, domain, found := strings.Cut(email, "@")
+	runes := []rune(user)
+	masked := strings.Repeat("*", len(runes))
+	if len(runes) > 2 {
+		masked = string(runes[0]) + strings.Repeat("*", len(runes)-2) + string(runes[len(runes)-1])
+	}
+	if !found {
+		return masked
+	}
+	return masked + "@" + domain
+}
+
+// delivers alerts somewhere
+type Notifier interface {
+	Notify(ctx context.Context, alert *Alert) error
+}
+
+// sends every alert to each of its notifiers; one failing doesn't stop the rest
+type Notifiers []Notifier
+
+func (ns Notifiers) Notify(ctx context.Context, alert *Alert) error {
+	var errs []error
+	for _, n := range ns {
+		if err := n.Notify(ctx, alert); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// how many alerts a Queue sends at once by default
+const DEFAULT_QUEUE_WORKERS = 4
+
+// sends alerts in the background, so whoever raises one (an ingest, part way through a batch) isn't held up
+// by a slow destination. Wait before counting on them having gone; a Queue is done with once it's Closed
+//
+// alerts are sent with ctx's values but not its cancellation: what they're about has already been stored, so
+// an ingest running out of time mustn't lose them
+type Queue struct {
+	notifier Notifier
+	ctx      context.Context
+	pending  chan *Alert
+	inflight sync.WaitGroup
+	workers  sync.WaitGroup
+
+	mu     sync.Mutex
+	sent   int
+	failed int
+}
+
+func NewQueue(ctx context.Context, notifier Notifier, workers int) *Queue {
+	if workers <= 0 {
+		workers = DEFAULT_QUEUE_WORKERS
+	}
+	q := &Queue{notifier: notifier, ctx: context.WithoutCancel(ctx), pending: make(chan *Alert, workers*16)}
+	for range workers {
+		q.workers.Add(1)
+		go q.work()
+	}
+	return q
+}
+
+func (q *Queue) work() {
+	defer q.workers.Done()
+	for alert := range q.pending {
+		err := q.notifier.Notify(q.ctx, alert)
+		if err != nil {
+			log.Printf("WARNING: failed to send %s alert [%s]: %s", alert.Kind, alert.ID, err)
+		}
+
+		q.mu.Lock()
+		if err != nil {
+			q.failed++
+		} else {
+			q.sent++
+		}
+		q.mu.Unlock()
+		q.inflight.Done()
+	}
+}
+
+// queues alert for sending; only waits if the destination is so far behind that the queue is full
+func (q *Queue) Enqueue(alert *Alert) {
+	q.inflight.Add(1)
+	q.pending <- alert
+}
+
+// waits for everything queued so far; returns how many were sent and how many failed since the last Wait
+func (q *Queue) Wait() (sent, failed int) {
+	q.inflight.Wait()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	sent, failed = q.sent, q.failed
+	q.sent, q.failed = 0, 0
+	return sent, failed
+}
+
+// Wait, then stops the workers
+func (q *Queue) Close() (sent, failed int) {
+	sent, failed = q.Wait()
+	close(q.pending)
+	q.workers.Wait()
+	return sent, failed
+}
+
+// the SNS calls we make; satisfied by *sns.Client
+type SNSAPI interface {
+	Publish(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error)
+}
+
+// publishes each alert as JSON to a topic, with its kind and priority as message attributes for
+// subscription filters
+type SNSNotifier struct {
+	SNS      SNSAPI
+	TopicARN string
+}
+
+func (sn *SNSNotifier) Notify(ctx context.Context, alert *Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return fmt.Errorf("failed to marshal alert: %s", err)
+	}
+	if _, err := sn.SNS.Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(sn.TopicARN),
+		Subject:  aws.String("exposed credential alert"),
+		Message:  aws.String(string(body)),
+		MessageAttributes: map[string]snstypes.MessageAttributeValue{
+			"kind":     {DataType: aws.String("String"), StringValue: aws.String(string(alert.Kind))},
+			"priority": {DataType: aws.String("String"), StringValue: aws.String(string(alert.Priority))},
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to publish alert [%s]: %s", alert.ID, err)
+	}
+	return nil
+}
+
+// appends each alert to a file as a line of JSON; for tests and local runs
+type FileNotifier struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (fn *FileNotifier) Notify(ctx context.Context, alert *Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return fmt.Errorf("failed to marshal alert: %s", err)
+	}
+
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+	fh, err := os.OpenFile(fn.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open alert file: %s", err)
+	}
+	defer fh.Close()
+	if _, err := fh.Write(append(body, '\n')); err != nil {
+		return fmt.Errorf("failed to write alert [%s]: %s", alert.ID, err)
+	}
+	return nil
+}
+
+// every alert in a file written by FileNotifier
+func ReadFile(path string) ([]*Alert, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ret []*Alert
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	for dec.More() {
+		alert := &Alert{}
+		if err := dec.Decode(alert); err != nil {
+			return ret, fmt.Errorf("failed to read alert file: %s", err)
+		}
+		ret = append(ret, alert)
+	}
+	return ret, nil
+}
@@ -0,0 +1,126 @@
+package alerts
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+)
+
+func Test_MaskEmail(t *testing.T) {
+	for raw, expect := range map[string]string{
+		"jsmith@example.com": "j****h@example.com",
+		"ab@example.com":     "**@example.com",
+		"josé@example.com":   "j**é@example.com",
+		"nodomain":           "n******n",
+	} {
+		if got := MaskEmail(raw); got != expect {
+			t.Errorf("expected [%s] for [%s], got [%s]", expect, raw, got)
+		}
+	}
+}
+
+type fakeSNS struct {
+	published []*sns.PublishInput
+	err       error
+}
+
+func (f *fakeSNS) Publish(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error) {
+	f.published = append(f.published, params)
+	return &sns.PublishOutput{}, f.err
+}
+
+func Test_Notifiers(t *testing.T) {
+	ctx := context.Background()
+
+	topic := &fakeSNS{}
+	alertFile := filepath.Join(t.TempDir(), "alerts.jsonl")
+	all := Notifiers{&SNSNotifier{SNS: topic, TopicARN: "arn:aws:sns:us-east-1:123456789012:alerts"}, &FileNotifier{Path: alertFile}}
+
+	alert := New(ALERT_KIND_WATCHLIST)
+	alert.Email = MaskEmail("jsmith@example.com")
+	for range 2 {
+		if err := all.Notify(ctx, alert); err != nil {
+			t.Fatalf("failed to notify: %s", err)
+		}
+	}
+
+	if len(topic.published) != 2 || aws.ToString(topic.published[0].TopicArn) != "arn:aws:sns:us-east-1:123456789012:alerts" ||
+		aws.ToString(topic.published[0].MessageAttributes["kind"].StringValue) != string(ALERT_KIND_WATCHLIST) ||
+		aws.ToString(topic.published[0].MessageAttributes["priority"].StringValue) != string(PRIORITY_NORMAL) {
+		t.Errorf("unexpected sns publishes %+v", topic.published)
+	}
+	if written, err := ReadFile(alertFile); err != nil || len(written) != 2 || written[1].ID != alert.ID || written[1].Email != "j****h@example.com" {
+		t.Errorf("unexpected alert file %+v (%v)", written, err)
+	}
+
+	// one failing doesn't stop the others, and every failure is reported
+	topic.err = errors.New("throttled")
+	unwritable := &FileNotifier{Path: filepath.Join(t.TempDir(), "missing", "alerts.jsonl")}
+	err := Notifiers{unwritable, &SNSNotifier{SNS: topic}, &FileNotifier{Path: alertFile}}.Notify(ctx, alert)
+	if err == nil || !strings.Contains(err.Error(), "alert file") || !strings.Contains(err.Error(), "throttled") {
+		t.Errorf("expected both failures reported, got %v", err)
+	}
+	if written, _ := ReadFile(alertFile); len(written) != 3 {
+		t.Errorf("expected the file notifier to still get the alert, got %d", len(written))
+	}
+}
+
+func Test_New(t *testing.T) {
+	for kind, expect := range map[Kind]Priority{ALERT_KIND_WATCHLIST: PRIORITY_NORMAL, ALERT_KIND_CANARY: PRIORITY_HIGH} {
+		if alert := New(kind); alert.Priority != expect || alert.ID == "" {
+			t.Errorf("unexpected %s alert %+v", kind, alert)
+		}
+	}
+}
+
+type funcNotifier func(ctx context.Context, alert *Alert) error
+
+func (fn funcNotifier) Notify(ctx context.Context, alert *Alert) error { return fn(ctx, alert) }
+
+// queued alerts go out in the background, even once the ctx they were raised under is done; Wait counts them
+func Test_Queue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var got []string
+	q := NewQueue(ctx, funcNotifier(func(ctx context.Context, alert *Alert) error {
+		<-release
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if alert.Owner == "broken" {
+			return errors.New("no such topic")
+		}
+		mu.Lock()
+		got = append(got, alert.Owner)
+		mu.Unlock()
+		return nil
+	}), 2)
+
+	for _, owner := range []string{"acme", "broken", "globex"} {
+		alert := New(ALERT_KIND_WATCHLIST)
+		alert.Owner = owner
+		q.Enqueue(alert) // doesn't wait on the (blocked) notifier
+	}
+	cancel()
+	close(release)
+
+	if sent, failed := q.Wait(); sent != 2 || failed != 1 {
+		t.Errorf("expected 2 sent and 1 failed, got %d and %d", sent, failed)
+	}
+	if slices.Sort(got); !slices.Equal(got, []string{"acme", "globex"}) {
+		t.Errorf("unexpected alerts sent %v", got)
+	}
+
+	q.Enqueue(New(ALERT_KIND_CANARY))
+	if sent, failed := q.Close(); sent != 1 || failed != 0 {
+		t.Errorf("expected only what was queued since the last wait counted, got %d and %d", sent, failed)
+	}
+}
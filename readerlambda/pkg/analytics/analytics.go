@@ -0,0 +1,306 @@
+package analytics
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/credstore"
+	"github.com/newodahs/readerlambda/pkg/envelope"
+	"github.com/newodahs/readerlambda/pkg/severity"
+	"github.com/newodahs/readerlambda/pkg/util"
+)
+
+const (
+	MAX_TOP_ENTRIES   = 10 // longest list of base words, patterns or reuse groups reported
+	MIN_BASE_ACCOUNTS = 3  // a base word is only reported once this many accounts use it; fewer says too much about them
+	MIN_WALK_LENGTH   = 4  // shortest run of neighbouring keys counted as a keyboard walk
+)
+
+// how many accounts share one password (which password isn't said)
+type ReuseGroup struct {
+	Accounts int `json:"accounts"`
+}
+
+// a base word or suffix pattern and how many accounts use it
+type Count struct {
+	Value    string `json:"value"`
+	Accounts int    `json:"accounts"`
+}
+
+// how many passwords are a given length
+type LengthCount struct {
+	Length    int `json:"length"`
+	Passwords int `json:"passwords"`
+}
+
+// what a domain's leaked passwords have in common; made from the plaintext, but none of it is in here
+type Report struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"createdAt"`
+	Domain     string    `json:"domain"`
+	Company    string    `json:"company"` // the name looked for in passwords
+	Accounts   int       `json:"accounts"`
+	Passwords  int       `json:"passwords"`  // distinct plaintext passwords per account, all counted below
+	Hashed     int       `json:"hashed"`     // passwords that leaked as hashes; left out, there's nothing to see in them
+	Unreadable int       `json:"unreadable"` // stored credentials that couldn't be read or decrypted
+
+	SharedPasswords int          `json:"sharedPasswords"` // passwords more than one account has
+	SharedAccounts  int          `json:"sharedAccounts"`  // accounts with a password another account has too
+	ReuseGroups     []ReuseGroup `json:"reuseGroups"`     // the biggest sharing groups
+
+	BaseWords       []Count       `json:"baseWords"`       // the word under the decoration, e.g. "summer" for Summer2024!; the company name shows as {company}
+	Patterns        []Count       `json:"patterns"`        // the shape, e.g. Word{year}{symbol} for Company2024!
+	KeyboardWalks   int           `json:"keyboardWalks"`   // passwords with a run of neighbouring keys (qwerty, 1qaz ...)
+	ContainsCompany int           `json:"containsCompany"` // passwords containing the company name, leetspeak and all
+	Lengths         []LengthCount `json:"lengths"`
+}
+
+// the rows and columns of a us keyboard; a walk runs along one either way
+var keyboardLines = []string{
+	"`1234567890-=", "qwertyuiop[]\\", "asdfghjkl;'", "zxcvbnm,./",
+	"1qaz", "2wsx", "3edc", "4rfv", "5tgb", "6yhn", "7ujm", "8ik,", "9ol.", "0p;/",
+}
+
+// whether password has a run of at least MIN_WALK_LENGTH neighbouring keys
+func hasKeyboardWalk(password string) bool {
+	password = strings.ToLower(password)
+	for _, line := range keyboardLines {
+		reversed := []rune(line)
+		slices.Reverse(reversed)
+		for _, walk := range []string{line, string(reversed)} {
+			for start := 0; start+MIN_WALK_LENGTH <= len(walk); start++ {
+				if strings.Contains(password, walk[start:start+MIN_WALK_LENGTH]) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+var leet = strings.NewReplacer("@", "a", "4", "a", "0", "o", "1", "i", "!", "i", "3", "e", "$", "s", "5", "s", "7", "t", "|", "l")
+
+// password lowercased with its leetspeak undone, for looking for words in
+func normalize(password string) string {
+	return leet.Replace(strings.ToLower(password))
+}
+
+// the company name guessed from a domain: its first label, past a mail. or corp. host part (acme for acme.com,
+// acme.co.uk and mail.acme.com); pass the name explicitly when the domain isn't it
+func CompanyName(domain string) string {
+	labels := strings.Split(strings.ToLower(domain), ".")
+	if len(labels) > 2 && slices.Contains([]string{"mail", "corp", "ad", "internal"}, labels[0]) {
+		labels = labels[1:]
+	}
+	return labels[0]
+}
+
+// splits password into what's in front of its letters, the letters (with leetspeak between them), and what's
+// after: "!!Summ3r2024!" => "!!", "Summ3r", "2024!". no letters at all => "", "", password
+func split(password string) (string, string, string) {
+	runes := []rune(password)
+	first := slices.IndexFunc(runes, unicode.IsLetter)
+	if first < 0 {
+		return "", "", password
+	}
+	last := len(runes) - 1
+	for !unicode.IsLetter(runes[last]) {
+		last--
+	}
+	return string(runes[:first]), string(runes[first : last+1]), string(runes[last+1:])
+}
+
+// the word a password is built on, or "" if it has none worth the name. a password that's nothing but the
+// word has no base word either: reporting it would be reporting the password
+func baseWord(password, company string) string {
+	normalized := normalize(password)
+	if company != "" && strings.Contains(normalized, company) {
+		return "{company}"
+	}
+	_, word, _ := split(password)
+	word = normalize(word)
+	if len(word) < 3 || strings.IndexFunc(word, func(r rune) bool { return !unicode.IsLetter(r) }) >= 0 {
+		return "" // too short to be a word, or more than one (a phrase or noise)
+	}
+	if word == normalized {
+		return ""
+	}
+	return word
+}
+
+// describes the shape of a run of digits and symbols around the base word
+func affixShape(affix string) string {
+	var shape strings.Builder
+	for affix != "" {
+		digits := strings.IndexFunc(affix, func(r rune) bool { return !unicode.IsDigit(r) })
+		if digits < 0 {
+			digits = len(affix)
+		}
+		switch {
+		case digits == 0: // a symbol (or anything else that isn't a digit)
+			_, size := utf8.DecodeRuneInString(affix)
+			shape.WriteString("{symbol}")
+			affix = affix[size:]
+			continue
+		case digits == 4 && isYear(affix[:4]):
+			shape.WriteString("{year}")
+		case digits <= 2:
+			shape.WriteString(strings.Repeat("{digit}", digits))
+		default:
+			shape.WriteString("{digits}")
+		}
+		affix = affix[digits:]
+	}
+	return shape.String()
+}
+
+func isYear(digits string) bool {
+	year, err := strconv.Atoi(digits)
+	return err == nil && year >= 1950 && year <= time.Now().Year()+1
+}
+
+// the shape of password: how its word is capitalized and what's around it, e.g. Word{year}{symbol}
+func pattern(password string) string {
+	prefix, word, suffix := split(password)
+	if word == "" {
+		return affixShape(suffix)
+	}
+
+	var wordShape string
+	letters := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) {
+			return r
+		}
+		return -1
+	}, word)
+	switch {
+	case strings.ToLower(letters) == letters:
+		wordShape = "word"
+	case strings.ToUpper(letters) == letters:
+		wordShape = "WORD"
+	case unicode.IsUpper([]rune(letters)[0]) && strings.ToLower(string([]rune(letters)[1:])) == string([]rune(letters)[1:]):
+		wordShape = "Word"
+	default:
+		wordShape = "wOrD"
+	}
+	return affixShape(prefix) + wordShape + affixShape(suffix)
+}
+
+// the most used first (ties by value), dropping those used by fewer than minAccounts, at most MAX_TOP_ENTRIES
+func top(counts map[string]int, minAccounts int) []Count {
+	ret := []Count{}
+	for value, accounts := range counts {
+		if accounts >= minAccounts {
+			ret = append(ret, Count{Value: value, Accounts: accounts})
+		}
+	}
+	slices.SortFunc(ret, func(a, b Count) int {
+		return cmp.Or(b.Accounts-a.Accounts, strings.Compare(a.Value, b.Value))
+	})
+	return ret[:min(len(ret), MAX_TOP_ENTRIES)]
+}
+
+// reads every password stored for domain and reports what they have in common. company is the name to look
+// for in them (CompanyName of the domain if empty). cipher and keys must match how credentials are stored
+func Analyze(ctx context.Context, cli util.DynamoDBAPI, tableName string, cipher *envelope.Cipher, keys *credstore.KeyHasher, domain, company string) (*Report, error) {
+	if cli == nil {
+		return nil, errors.New("passed dynamodb client was nil")
+	}
+	domain, _ = credstore.CanonicalIdentity(domain, "")
+	if domain == "" {
+		return nil, errors.New("no domain to analyze")
+	}
+	company = normalize(strings.TrimSpace(company))
+	if company == "" {
+		company = normalize(CompanyName(domain))
+	}
+
+	report := &Report{ID: util.NewID(), CreatedAt: time.Now().UTC(), Domain: domain, Company: company}
+	holders := map[string]int{} // password => accounts that have it
+	baseWords, patterns, lengths := map[string]int{}, map[string]int{}, map[int]int{}
+	var accountPasswords [][]string
+
+	failed, err := credstore.QueryDomain(ctx, cli, tableName, keys, domain, func(cred *credparser.CredentialInfo) error {
+		if err := credstore.OpenCredential(ctx, cipher, cred); err != nil {
+			if errors.Is(err, credstore.ErrNoCipher) {
+				return err
+			}
+			report.Unreadable++
+			return nil
+		}
+		report.Accounts++
+
+		var passwords []string
+		accountWords, accountPatterns := map[string]bool{}, map[string]bool{}
+		for _, password := range slices.Compact(slices.Sorted(slices.Values(cred.Password))) {
+			switch {
+			case password == "" || password == credparser.REDACTED_PASSWORD:
+				continue
+			case severity.Classify(password) != credparser.STORAGE_PLAINTEXT:
+				report.Hashed++
+				continue
+			}
+			report.Passwords++
+			passwords = append(passwords, password)
+			holders[password]++
+			lengths[len([]rune(password))]++
+			if hasKeyboardWalk(password) {
+				report.KeyboardWalks++
+			}
+			if company != "" && strings.Contains(normalize(password), company) {
+				report.ContainsCompany++
+			}
+			// words and patterns count accounts, so someone with summer1 and summer2 doesn't make summer common
+			if word := baseWord(password, company); word != "" {
+				accountWords[word] = true
+			}
+			if shape := pattern(password); shape != "" {
+				accountPatterns[shape] = true
+			}
+		}
+		for word := range accountWords {
+			baseWords[word]++
+		}
+		for shape := range accountPatterns {
+			patterns[shape]++
+		}
+		accountPasswords = append(accountPasswords, passwords)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.Unreadable += failed
+
+	report.ReuseGroups = []ReuseGroup{}
+	for _, accounts := range holders {
+		if accounts > 1 {
+			report.SharedPasswords++
+			report.ReuseGroups = append(report.ReuseGroups, ReuseGroup{Accounts: accounts})
+		}
+	}
+	slices.SortFunc(report.ReuseGroups, func(a, b ReuseGroup) int { return b.Accounts - a.Accounts })
+	report.ReuseGroups = report.ReuseGroups[:min(len(report.ReuseGroups), MAX_TOP_ENTRIES)]
+	for _, passwords := range accountPasswords {
+		if slices.ContainsFunc(passwords, func(password string) bool { return holders[password] > 1 }) {
+			report.SharedAccounts++
+		}
+	}
+
+	report.BaseWords = top(baseWords, MIN_BASE_ACCOUNTS)
+	report.Patterns = top(patterns, 1)
+	report.Lengths = []LengthCount{}
+	for length, cnt := range lengths {
+		report.Lengths = append(report.Lengths, LengthCount{Length: length, Passwords: cnt})
+	}
+	slices.SortFunc(report.Lengths, func(a, b LengthCount) int { return a.Length - b.Length })
+	return report, nil
+}
@@ -0,0 +1,134 @@
+package analytics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/newodahs/readerlambda/pkg/awsfake"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/credstore"
+	"github.com/newodahs/readerlambda/pkg/envelope"
+	"github.com/newodahs/readerlambda/pkg/util"
+)
+
+func Test_Patterns(t *testing.T) {
+	testSet := []struct {
+		Password    string
+		ExpectBase  string
+		ExpectShape string
+		ExpectWalk  bool
+	}{
+		{Password: "Acme2024!", ExpectBase: "{company}", ExpectShape: "Word{year}{symbol}"},
+		{Password: "@cm3rocks", ExpectBase: "{company}", ExpectShape: "{symbol}word"},
+		{Password: "Summ3r2024", ExpectBase: "summer", ExpectShape: "Word{year}"},
+		{Password: "!!WINTER12", ExpectBase: "winter", ExpectShape: "{symbol}{symbol}WORD{digit}{digit}"},
+		{Password: "p@ssw0rd123", ExpectBase: "password", ExpectShape: "word{digits}"},
+		{Password: "qwerty", ExpectShape: "word", ExpectWalk: true}, // the whole password; not a base word
+		{Password: "P@ssword", ExpectShape: "Word"},
+		{Password: "1qaz2wsx", ExpectShape: "{digit}word", ExpectWalk: true},
+		{Password: "lkjh!", ExpectBase: "lkjh", ExpectShape: "word{symbol}", ExpectWalk: true},
+		{Password: "135324", ExpectShape: "{digits}"},
+		{Password: "Go", ExpectShape: "Word"},
+		{Password: "hello world", ExpectShape: "word"},
+	}
+
+	for _, test := range testSet {
+		if got := baseWord(test.Password, "acme"); got != test.ExpectBase {
+			t.Errorf("[%s]: expected base [%s], got [%s]", test.Password, test.ExpectBase, got)
+		}
+		if got := pattern(test.Password); got != test.ExpectShape {
+			t.Errorf("[%s]: expected pattern [%s], got [%s]", test.Password, test.ExpectShape, got)
+		}
+		if got := hasKeyboardWalk(test.Password); got != test.ExpectWalk {
+			t.Errorf("[%s]: expected keyboard walk %t, got %t", test.Password, test.ExpectWalk, got)
+		}
+	}
+
+	for domain, expect := range map[string]string{"acme.com": "acme", "acme.co.uk": "acme", "mail.acme.com": "acme", "ACME.io": "acme"} {
+		if got := CompanyName(domain); got != expect {
+			t.Errorf("[%s]: expected company %s, got %s", domain, expect, got)
+		}
+	}
+}
+
+func Test_Analyze(t *testing.T) {
+	const tableName = "credsTest"
+	ctx := context.Background()
+	cli := awsfake.NewDynamoDB()
+	if err := util.EnsureDynamoDBTable(ctx, cli, tableName, credparser.CredentialInfo{}, nil); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	localKeys, _, err := (*envelope.LocalKeys)(nil).Rotate()
+	if err != nil {
+		t.Fatalf("failed to make keys: %s", err)
+	}
+	cipher := envelope.NewCipher(localKeys)
+
+	store := func(email string, passwords ...string) {
+		user, domain, _ := strings.Cut(email, "@")
+		cred := &credparser.CredentialInfo{User: user, Domain: domain, Email: email}
+		for _, password := range passwords {
+			cred.AddPassword(password, nil)
+		}
+		if _, err := credstore.StoreCredential(ctx, cli, tableName, cipher, nil, cred); err != nil {
+			t.Fatalf("failed to store: %s", err)
+		}
+	}
+	store("jdoe@acme.com", "Acme2024!", "Summer2023")
+	store("asmith@acme.com", "Acme2024!")
+	store("bob@acme.com", "Acme2024!", "summer99")
+	store("carol@acme.com", "Summer2024", "5f4dcc3b5aa765d61d8327deb882cf99")
+	store("dave@acme.com", "qwerty123")
+	store("erin@other.com", "Acme2024!")
+
+	report, err := Analyze(ctx, cli, tableName, cipher, nil, "ACME.com", "")
+	if err != nil {
+		t.Fatalf("failed to analyze: %s", err)
+	}
+	if report.Domain != "acme.com" || report.Company != "acme" || report.Accounts != 5 || report.Passwords != 7 || report.Hashed != 1 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if report.SharedPasswords != 1 || report.SharedAccounts != 3 || !slices.Equal(report.ReuseGroups, []ReuseGroup{{Accounts: 3}}) {
+		t.Errorf("expected Acme2024! shared by three accounts, got %d/%d %v", report.SharedPasswords, report.SharedAccounts, report.ReuseGroups)
+	}
+	if report.ContainsCompany != 3 || report.KeyboardWalks != 1 {
+		t.Errorf("expected 3 passwords with the company name and 1 walk, got %d and %d", report.ContainsCompany, report.KeyboardWalks)
+	}
+	// summer is used by three accounts, so it's common enough to name; qwerty (one account) isn't
+	if !slices.Equal(report.BaseWords, []Count{{Value: "summer", Accounts: 3}, {Value: "{company}", Accounts: 3}}) {
+		t.Errorf("unexpected base words %v", report.BaseWords)
+	}
+	if report.Patterns[0] != (Count{Value: "Word{year}{symbol}", Accounts: 3}) {
+		t.Errorf("expected Word{year}{symbol} to be the most common pattern, got %v", report.Patterns)
+	}
+	if !slices.Equal(report.Lengths, []LengthCount{{Length: 8, Passwords: 1}, {Length: 9, Passwords: 4}, {Length: 10, Passwords: 2}}) {
+		t.Errorf("unexpected lengths %v", report.Lengths)
+	}
+
+	raw, _ := json.Marshal(report)
+	for _, secret := range []string{"Acme2024", "Summer2023", "summer99", "qwerty123", "5f4dcc3b"} {
+		if strings.Contains(string(raw), secret) {
+			t.Errorf("report gives away [%s]: %s", secret, raw)
+		}
+	}
+
+	// a word that's the whole password isn't a base word, however many accounts use it
+	store("frank@initech.com", "letmein")
+	store("grace@initech.com", "Letmein")
+	store("heidi@initech.com", "l3tm3in")
+	undecorated, err := Analyze(ctx, cli, tableName, cipher, nil, "initech.com", "")
+	if err != nil {
+		t.Fatalf("failed to analyze: %s", err)
+	}
+	if raw, _ := json.Marshal(undecorated); len(undecorated.BaseWords) != 0 || strings.Contains(strings.ToLower(string(raw)), "letmein") {
+		t.Errorf("report gives away a whole password: %s", raw)
+	}
+
+	if _, err := Analyze(ctx, cli, tableName, nil, nil, "acme.com", ""); !errors.Is(err, credstore.ErrNoCipher) {
+		t.Errorf("expected encrypted passwords without a cipher to fail, got %v", err)
+	}
+}
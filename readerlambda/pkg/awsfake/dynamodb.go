@@ -0,0 +1,597 @@
+package awsfake
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+)
+
+// an in-memory stand-in for the bits of dynamodb we use (satisfies util.DynamoDBAPI); tables, conditional
+// puts and deletes, queries (including on GSIs), scans and batch gets, enough to run the reader lambda end-to-end
+// without dynamodb-local
+type DynamoDB struct {
+	mu     sync.Mutex
+	tables map[string]*fakeTable
+
+	// how many DescribeTable calls a newly created table reports CREATING for before going ACTIVE; for
+	// exercising the code that waits on it
+	CreatingFor int
+
+	// when set, Query and Scan evaluate at most this many items a page whatever the Limit; stands in for
+	// dynamodb's 1MB pages, for exercising the code that has to follow LastEvaluatedKey
+	MaxPageItems int
+}
+
+type keyDef struct {
+	hash  string
+	rng   string // empty for hash-only keys
+	index string // empty for the table itself
+}
+
+type fakeTable struct {
+	desc  types.TableDescription
+	key   keyDef
+	gsis  map[string]keyDef
+	items map[string]item
+
+	creating int // describes left before ACTIVE
+	ttlAttr  string
+	pitr     bool
+	tags     []types.Tag
+}
+
+func NewDynamoDB() *DynamoDB {
+	return &DynamoDB{tables: map[string]*fakeTable{}}
+}
+
+func keyDefFrom(schema []types.KeySchemaElement) keyDef {
+	var kd keyDef
+	for _, elem := range schema {
+		if elem.KeyType == types.KeyTypeHash {
+			kd.hash = aws.ToString(elem.AttributeName)
+		} else {
+			kd.rng = aws.ToString(elem.AttributeName)
+		}
+	}
+	return kd
+}
+
+// a string uniquely identifying the item's key under kd; ok is false if the item is missing a key attribute
+func (kd keyDef) id(it item) (string, bool) {
+	hash, found := it[kd.hash]
+	if !found {
+		return "", false
+	}
+	id := avString(hash)
+	if kd.rng != "" {
+		rng, found := it[kd.rng]
+		if !found {
+			return "", false
+		}
+		id += "\x00" + avString(rng)
+	}
+	return id, true
+}
+
+func (kd keyDef) keyOf(it item) item {
+	ret := item{kd.hash: it[kd.hash]}
+	if kd.rng != "" {
+		ret[kd.rng] = it[kd.rng]
+	}
+	return ret
+}
+
+func avString(av types.AttributeValue) string {
+	switch v := av.(type) {
+	case *types.AttributeValueMemberS:
+		return "S:" + v.Value
+	case *types.AttributeValueMemberN:
+		return "N:" + v.Value
+	case *types.AttributeValueMemberB:
+		return fmt.Sprintf("B:%x", v.Value)
+	}
+	return fmt.Sprintf("%T:%v", av, av)
+}
+
+func copyItem(it item) item {
+	if it == nil {
+		return nil
+	}
+	cp := make(item, len(it))
+	for k, v := range it {
+		cp[k] = v
+	}
+	return cp
+}
+
+func notFound(tableName string) error {
+	return &types.ResourceNotFoundException{Message: aws.String(fmt.Sprintf("table [%s] not found", tableName))}
+}
+
+func (f *DynamoDB) table(tableName *string) (*fakeTable, error) {
+	tbl, found := f.tables[aws.ToString(tableName)]
+	if !found {
+		return nil, notFound(aws.ToString(tableName))
+	}
+	return tbl, nil
+}
+
+func (f *DynamoDB) CreateTable(ctx context.Context, params *dynamodb.CreateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name := aws.ToString(params.TableName)
+	if _, found := f.tables[name]; found {
+		return nil, &types.ResourceInUseException{Message: aws.String(fmt.Sprintf("table [%s] already exists", name))}
+	}
+
+	tbl := &fakeTable{
+		desc: types.TableDescription{
+			TableName:            aws.String(name),
+			TableStatus:          types.TableStatusActive,
+			KeySchema:            params.KeySchema,
+			AttributeDefinitions: params.AttributeDefinitions,
+			CreationDateTime:     aws.Time(time.Now().UTC()),
+		},
+		key:      keyDefFrom(params.KeySchema),
+		gsis:     map[string]keyDef{},
+		items:    map[string]item{},
+		creating: f.CreatingFor,
+		tags:     params.Tags,
+	}
+	if tbl.creating > 0 {
+		tbl.desc.TableStatus = types.TableStatusCreating
+	}
+	if params.BillingMode != "" {
+		tbl.desc.BillingModeSummary = &types.BillingModeSummary{BillingMode: params.BillingMode}
+	}
+	for _, gsi := range params.GlobalSecondaryIndexes {
+		kd := keyDefFrom(gsi.KeySchema)
+		kd.index = aws.ToString(gsi.IndexName)
+		tbl.gsis[kd.index] = kd
+		tbl.desc.GlobalSecondaryIndexes = append(tbl.desc.GlobalSecondaryIndexes, types.GlobalSecondaryIndexDescription{
+			IndexName:   gsi.IndexName,
+			KeySchema:   gsi.KeySchema,
+			Projection:  gsi.Projection,
+			IndexStatus: types.IndexStatusActive,
+		})
+	}
+	if params.ProvisionedThroughput != nil {
+		tbl.desc.ProvisionedThroughput = &types.ProvisionedThroughputDescription{
+			ReadCapacityUnits:  params.ProvisionedThroughput.ReadCapacityUnits,
+			WriteCapacityUnits: params.ProvisionedThroughput.WriteCapacityUnits,
+		}
+	}
+	if sse := params.SSESpecification; sse != nil && aws.ToBool(sse.Enabled) {
+		tbl.desc.SSEDescription = &types.SSEDescription{
+			Status:          types.SSEStatusEnabled,
+			SSEType:         sse.SSEType,
+			KMSMasterKeyArn: sse.KMSMasterKeyId,
+		}
+	}
+	f.tables[name] = tbl
+
+	desc := tbl.desc
+	return &dynamodb.CreateTableOutput{TableDescription: &desc}, nil
+}
+
+func (f *DynamoDB) DescribeTable(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tbl, err := f.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	desc := tbl.desc
+	desc.ItemCount = aws.Int64(int64(len(tbl.items)))
+	if tbl.creating > 0 {
+		if tbl.creating--; tbl.creating == 0 {
+			tbl.desc.TableStatus = types.TableStatusActive
+		}
+	}
+	return &dynamodb.DescribeTableOutput{Table: &desc}, nil
+}
+
+// only adds global secondary indexes (which are ACTIVE straight away; there's nothing to backfill)
+func (f *DynamoDB) UpdateTable(ctx context.Context, params *dynamodb.UpdateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTableOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tbl, err := f.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	for _, update := range params.GlobalSecondaryIndexUpdates {
+		gsi := update.Create
+		if gsi == nil {
+			return nil, &smithy.GenericAPIError{Code: "ValidationException", Message: "only creating indexes is supported"}
+		}
+		name := aws.ToString(gsi.IndexName)
+		if _, found := tbl.gsis[name]; found {
+			return nil, &smithy.GenericAPIError{Code: "ValidationException", Message: fmt.Sprintf("index [%s] already exists", name)}
+		}
+		kd := keyDefFrom(gsi.KeySchema)
+		kd.index = name
+		tbl.gsis[name] = kd
+		tbl.desc.GlobalSecondaryIndexes = append(tbl.desc.GlobalSecondaryIndexes, types.GlobalSecondaryIndexDescription{
+			IndexName:   gsi.IndexName,
+			KeySchema:   gsi.KeySchema,
+			Projection:  gsi.Projection,
+			IndexStatus: types.IndexStatusActive,
+		})
+	}
+	desc := tbl.desc
+	return &dynamodb.UpdateTableOutput{TableDescription: &desc}, nil
+}
+
+func (f *DynamoDB) UpdateTimeToLive(ctx context.Context, params *dynamodb.UpdateTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTimeToLiveOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tbl, err := f.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	spec := params.TimeToLiveSpecification
+	if spec == nil || aws.ToString(spec.AttributeName) == "" {
+		return nil, &smithy.GenericAPIError{Code: "ValidationException", Message: "TimeToLiveSpecification needs an attribute name"}
+	}
+	if aws.ToBool(spec.Enabled) {
+		if tbl.ttlAttr != "" {
+			// dynamodb won't enable it twice, even on the same attribute
+			return nil, &smithy.GenericAPIError{Code: "ValidationException", Message: "TimeToLive is already enabled"}
+		}
+		tbl.ttlAttr = aws.ToString(spec.AttributeName)
+	} else {
+		tbl.ttlAttr = ""
+	}
+	return &dynamodb.UpdateTimeToLiveOutput{TimeToLiveSpecification: spec}, nil
+}
+
+func (f *DynamoDB) DescribeTimeToLive(ctx context.Context, params *dynamodb.DescribeTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTimeToLiveOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tbl, err := f.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	desc := &types.TimeToLiveDescription{TimeToLiveStatus: types.TimeToLiveStatusDisabled}
+	if tbl.ttlAttr != "" {
+		desc = &types.TimeToLiveDescription{TimeToLiveStatus: types.TimeToLiveStatusEnabled, AttributeName: aws.String(tbl.ttlAttr)}
+	}
+	return &dynamodb.DescribeTimeToLiveOutput{TimeToLiveDescription: desc}, nil
+}
+
+func (f *DynamoDB) DescribeContinuousBackups(ctx context.Context, params *dynamodb.DescribeContinuousBackupsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeContinuousBackupsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tbl, err := f.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	status := types.PointInTimeRecoveryStatusDisabled
+	if tbl.pitr {
+		status = types.PointInTimeRecoveryStatusEnabled
+	}
+	return &dynamodb.DescribeContinuousBackupsOutput{ContinuousBackupsDescription: &types.ContinuousBackupsDescription{
+		ContinuousBackupsStatus:        types.ContinuousBackupsStatusEnabled,
+		PointInTimeRecoveryDescription: &types.PointInTimeRecoveryDescription{PointInTimeRecoveryStatus: status},
+	}}, nil
+}
+
+func (f *DynamoDB) UpdateContinuousBackups(ctx context.Context, params *dynamodb.UpdateContinuousBackupsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateContinuousBackupsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tbl, err := f.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if params.PointInTimeRecoverySpecification != nil {
+		tbl.pitr = aws.ToBool(params.PointInTimeRecoverySpecification.PointInTimeRecoveryEnabled)
+	}
+	return &dynamodb.UpdateContinuousBackupsOutput{}, nil
+}
+
+func (f *DynamoDB) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tbl, err := f.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	id, ok := tbl.key.id(params.Key)
+	if !ok {
+		return nil, fmt.Errorf("key for table [%s] is missing a key attribute", aws.ToString(params.TableName))
+	}
+	return &dynamodb.GetItemOutput{Item: copyItem(tbl.items[id])}, nil
+}
+
+func (f *DynamoDB) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tbl, err := f.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	id, ok := tbl.key.id(params.Item)
+	if !ok {
+		return nil, fmt.Errorf("item for table [%s] is missing a key attribute", aws.ToString(params.TableName))
+	}
+
+	cond, condErr := compileCondition(params.ConditionExpression, params.ExpressionAttributeNames, params.ExpressionAttributeValues)
+	if condErr != nil {
+		return nil, condErr
+	}
+	existing := tbl.items[id]
+	if !cond(existing) {
+		return nil, &types.ConditionalCheckFailedException{Message: aws.String("the conditional request failed")}
+	}
+
+	tbl.items[id] = copyItem(params.Item)
+
+	out := &dynamodb.PutItemOutput{}
+	if params.ReturnValues == types.ReturnValueAllOld {
+		out.Attributes = existing
+	}
+	return out, nil
+}
+
+func (f *DynamoDB) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tbl, err := f.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	id, ok := tbl.key.id(params.Key)
+	if !ok {
+		return nil, fmt.Errorf("key for table [%s] is missing a key attribute", aws.ToString(params.TableName))
+	}
+
+	cond, condErr := compileCondition(params.ConditionExpression, params.ExpressionAttributeNames, params.ExpressionAttributeValues)
+	if condErr != nil {
+		return nil, condErr
+	}
+	existing := tbl.items[id]
+	if !cond(existing) {
+		return nil, &types.ConditionalCheckFailedException{Message: aws.String("the conditional request failed")}
+	}
+
+	delete(tbl.items, id)
+
+	out := &dynamodb.DeleteItemOutput{}
+	if params.ReturnValues == types.ReturnValueAllOld {
+		out.Attributes = existing
+	}
+	return out, nil
+}
+
+func (f *DynamoDB) BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out := &dynamodb.BatchGetItemOutput{Responses: map[string][]map[string]types.AttributeValue{}}
+	for tableName, keysAndAttrs := range params.RequestItems {
+		tbl, err := f.table(aws.String(tableName))
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keysAndAttrs.Keys {
+			if id, ok := tbl.key.id(key); ok {
+				if it, found := tbl.items[id]; found {
+					out.Responses[tableName] = append(out.Responses[tableName], copyItem(it))
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+func (f *DynamoDB) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tbl, err := f.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	kd := tbl.key
+	if params.IndexName != nil {
+		var found bool
+		if kd, found = tbl.gsis[*params.IndexName]; !found {
+			return nil, fmt.Errorf("table [%s] has no index [%s]", *params.TableName, *params.IndexName)
+		}
+	}
+
+	keyCond, keyErr := compileCondition(params.KeyConditionExpression, params.ExpressionAttributeNames, params.ExpressionAttributeValues)
+	if keyErr != nil {
+		return nil, keyErr
+	}
+
+	var matched []item
+	for _, it := range tbl.items {
+		if _, hasKey := kd.id(it); hasKey && keyCond(it) {
+			matched = append(matched, it)
+		}
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		if params.ScanIndexForward != nil && !*params.ScanIndexForward {
+			return tbl.lessFor(kd, matched[j], matched[i])
+		}
+		return tbl.lessFor(kd, matched[i], matched[j])
+	})
+
+	items, last, pageErr := tbl.page(matched, kd, params.ExclusiveStartKey, f.pageLimit(params.Limit), params.FilterExpression, params.ExpressionAttributeNames, params.ExpressionAttributeValues)
+	if pageErr != nil {
+		return nil, pageErr
+	}
+	return &dynamodb.QueryOutput{Items: items, Count: int32(len(items)), LastEvaluatedKey: last}, nil
+}
+
+func (f *DynamoDB) Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tbl, err := f.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	// scans come back in key order; not what dynamodb does, but stable paging is all anyone should rely on
+	all := tbl.sorted()
+	if total := aws.ToInt32(params.TotalSegments); total > 0 {
+		// parallel scans: each item lives in exactly one segment
+		segment := aws.ToInt32(params.Segment)
+		if segment < 0 || segment >= total {
+			return nil, &smithy.GenericAPIError{Code: "ValidationException", Message: fmt.Sprintf("segment %d is out of range for %d segments", segment, total)}
+		}
+		var inSegment []item
+		for _, it := range all {
+			id, _ := tbl.key.id(it)
+			hash := fnv.New32a()
+			hash.Write([]byte(id))
+			if int32(hash.Sum32()%uint32(total)) == segment {
+				inSegment = append(inSegment, it)
+			}
+		}
+		all = inSegment
+	}
+	items, last, pageErr := tbl.page(all, tbl.key, params.ExclusiveStartKey, f.pageLimit(params.Limit), params.FilterExpression, params.ExpressionAttributeNames, params.ExpressionAttributeValues)
+	if pageErr != nil {
+		return nil, pageErr
+	}
+	return &dynamodb.ScanOutput{Items: items, Count: int32(len(items)), LastEvaluatedKey: last}, nil
+}
+
+// orders by the range key of kd (then the table key so ties are stable)
+func (tbl *fakeTable) lessFor(kd keyDef, a, b item) bool {
+	if kd.rng != "" {
+		if cmp, ok := compareScalars(a[kd.rng], b[kd.rng]); ok && cmp != 0 {
+			return cmp < 0
+		}
+	}
+	aID, _ := tbl.key.id(a)
+	bID, _ := tbl.key.id(b)
+	return aID < bID
+}
+
+func (tbl *fakeTable) sorted() []item {
+	ids := make([]string, 0, len(tbl.items))
+	for id := range tbl.items {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	ret := make([]item, 0, len(ids))
+	for _, id := range ids {
+		ret = append(ret, tbl.items[id])
+	}
+	return ret
+}
+
+func (f *DynamoDB) pageLimit(limit *int32) *int32 {
+	if f.MaxPageItems > 0 && (limit == nil || *limit > int32(f.MaxPageItems)) {
+		return aws.Int32(int32(f.MaxPageItems))
+	}
+	return limit
+}
+
+// applies paging then the filter (dynamodb's limit counts items evaluated, not returned)
+func (tbl *fakeTable) page(candidates []item, kd keyDef, startKey item, limit *int32, filter *string, names map[string]string, values map[string]types.AttributeValue) ([]item, item, error) {
+	filterCond, filterErr := compileCondition(filter, names, values)
+	if filterErr != nil {
+		return nil, nil, filterErr
+	}
+
+	if startKey != nil {
+		startID, _ := tbl.key.id(startKey)
+		for i, it := range candidates {
+			if id, _ := tbl.key.id(it); id == startID {
+				candidates = candidates[i+1:]
+				break
+			}
+		}
+	}
+
+	var last item
+	if limit != nil && *limit > 0 && int(*limit) < len(candidates) {
+		candidates = candidates[:*limit]
+		last = tbl.key.keyOf(candidates[len(candidates)-1])
+		if kd.index != "" { // index pages carry the index key too
+			for k, v := range kd.keyOf(candidates[len(candidates)-1]) {
+				last[k] = v
+			}
+		}
+	}
+
+	ret := []item{}
+	for _, it := range candidates {
+		if filterCond(it) {
+			ret = append(ret, copyItem(it))
+		}
+	}
+	return ret, last, nil
+}
+
+// every item in tableName in key order; for assertions in tests
+func (f *DynamoDB) Items(tableName string) []map[string]types.AttributeValue {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tbl, found := f.tables[tableName]
+	if !found {
+		return nil
+	}
+	var ret []map[string]types.AttributeValue
+	for _, it := range tbl.sorted() {
+		ret = append(ret, copyItem(it))
+	}
+	return ret
+}
+
+// the TTL attribute (empty if TTL is off), whether point-in-time recovery is on and the tags of tableName;
+// for assertions in tests
+func (f *DynamoDB) TableSettings(tableName string) (ttlAttr string, pitr bool, tags map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tbl, found := f.tables[tableName]
+	if !found {
+		return "", false, nil
+	}
+	tags = map[string]string{}
+	for _, tag := range tbl.tags {
+		tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return tbl.ttlAttr, tbl.pitr, tags
+}
+
+// names of the tables created so far, sorted
+func (f *DynamoDB) Tables() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var ret []string
+	for name := range f.tables {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
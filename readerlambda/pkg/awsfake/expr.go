@@ -0,0 +1,439 @@
+package awsfake
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// a small evaluator for dynamodb condition/filter/key-condition expressions; it understands what the
+// expression builder generates (comparisons, BETWEEN, IN, AND/OR/NOT, attribute_exists/not_exists,
+// begins_with, contains and size) which is all we use
+
+type item = map[string]types.AttributeValue
+
+type condFunc func(item) bool
+
+type operandFunc func(item) types.AttributeValue
+
+type exprParser struct {
+	toks   []string
+	pos    int
+	names  map[string]string
+	values map[string]types.AttributeValue
+}
+
+// parses expr into something we can run against items; nil/empty expressions match everything
+func compileCondition(expr *string, names map[string]string, values map[string]types.AttributeValue) (condFunc, error) {
+	if expr == nil || strings.TrimSpace(*expr) == "" {
+		return func(item) bool { return true }, nil
+	}
+
+	toks, tokErr := tokenize(*expr)
+	if tokErr != nil {
+		return nil, tokErr
+	}
+
+	p := &exprParser{toks: toks, names: names, values: values}
+	cond, err := p.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("bad expression [%s]: %s", *expr, err)
+	}
+	if p.pos != len(p.toks) {
+		return nil, fmt.Errorf("bad expression [%s]: unexpected [%s]", *expr, p.toks[p.pos])
+	}
+	return cond, nil
+}
+
+func tokenize(expr string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(expr); {
+		ch := rune(expr[i])
+		switch {
+		case unicode.IsSpace(ch):
+			i++
+		case strings.ContainsRune("(),.", ch):
+			toks = append(toks, string(ch))
+			i++
+		case ch == '<' || ch == '>' || ch == '=':
+			op := string(ch)
+			if i+1 < len(expr) && (expr[i+1] == '=' || (ch == '<' && expr[i+1] == '>')) {
+				op += string(expr[i+1])
+			}
+			toks = append(toks, op)
+			i += len(op)
+		case ch == '#' || ch == ':' || ch == '_' || unicode.IsLetter(ch) || unicode.IsDigit(ch):
+			j := i + 1
+			for j < len(expr) && (expr[j] == '_' || unicode.IsLetter(rune(expr[j])) || unicode.IsDigit(rune(expr[j]))) {
+				j++
+			}
+			toks = append(toks, expr[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected character [%c] in expression", ch)
+		}
+	}
+	return toks, nil
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) next() string {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+func (p *exprParser) expect(tok string) error {
+	if got := p.next(); got != tok {
+		return fmt.Errorf("expected [%s], got [%s]", tok, got)
+	}
+	return nil
+}
+
+func (p *exprParser) isKeyword(kw string) bool {
+	return strings.EqualFold(p.peek(), kw)
+}
+
+func (p *exprParser) parseOr() (condFunc, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("OR") {
+		p.next()
+		right, rErr := p.parseAnd()
+		if rErr != nil {
+			return nil, rErr
+		}
+		l := left
+		left = func(it item) bool { return l(it) || right(it) }
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (condFunc, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("AND") {
+		p.next()
+		right, rErr := p.parseNot()
+		if rErr != nil {
+			return nil, rErr
+		}
+		l := left
+		left = func(it item) bool { return l(it) && right(it) }
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseNot() (condFunc, error) {
+	if p.isKeyword("NOT") {
+		p.next()
+		inner, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(it item) bool { return !inner(it) }, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (condFunc, error) {
+	if p.peek() == "(" {
+		p.next()
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(")")
+	}
+
+	// condition functions
+	if fn := strings.ToLower(p.peek()); p.pos+1 < len(p.toks) && p.toks[p.pos+1] == "(" && fn != "size" {
+		p.next()
+		args, err := p.parseArgs()
+		if err != nil {
+			return nil, err
+		}
+		return conditionFunc(fn, args)
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	switch op := p.next(); {
+	case op == "=", op == "<>", op == "<", op == "<=", op == ">", op == ">=":
+		right, rErr := p.parseOperand()
+		if rErr != nil {
+			return nil, rErr
+		}
+		return func(it item) bool { return compareOp(op, left(it), right(it)) }, nil
+
+	case strings.EqualFold(op, "BETWEEN"):
+		low, lErr := p.parseOperand()
+		if lErr != nil {
+			return nil, lErr
+		}
+		if !p.isKeyword("AND") {
+			return nil, fmt.Errorf("expected AND in BETWEEN")
+		}
+		p.next()
+		high, hErr := p.parseOperand()
+		if hErr != nil {
+			return nil, hErr
+		}
+		return func(it item) bool {
+			val := left(it)
+			return compareOp(">=", val, low(it)) && compareOp("<=", val, high(it))
+		}, nil
+
+	case strings.EqualFold(op, "IN"):
+		args, aErr := p.parseArgs()
+		if aErr != nil {
+			return nil, aErr
+		}
+		return func(it item) bool {
+			val := left(it)
+			for _, arg := range args {
+				if compareOp("=", val, arg(it)) {
+					return true
+				}
+			}
+			return false
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported operator [%s]", op)
+	}
+}
+
+// ( operand [, operand...] )
+func (p *exprParser) parseArgs() ([]operandFunc, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var args []operandFunc
+	for {
+		arg, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.peek() != "," {
+			break
+		}
+		p.next()
+	}
+	return args, p.expect(")")
+}
+
+func (p *exprParser) parseOperand() (operandFunc, error) {
+	tok := p.next()
+	switch {
+	case tok == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+
+	case strings.HasPrefix(tok, ":"):
+		val, found := p.values[tok]
+		if !found {
+			return nil, fmt.Errorf("no value for [%s]", tok)
+		}
+		return func(item) types.AttributeValue { return val }, nil
+
+	case strings.EqualFold(tok, "size") && p.peek() == "(":
+		args, err := p.parseArgs()
+		if err != nil {
+			return nil, err
+		}
+		if len(args) != 1 {
+			return nil, fmt.Errorf("size takes one argument")
+		}
+		return func(it item) types.AttributeValue {
+			if n, ok := sizeOf(args[0](it)); ok {
+				return &types.AttributeValueMemberN{Value: fmt.Sprint(n)}
+			}
+			return nil
+		}, nil
+	}
+
+	// a (possibly nested) attribute path
+	path := []string{}
+	for {
+		name, err := p.resolveName(tok)
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, name)
+		if p.peek() != "." {
+			break
+		}
+		p.next()
+		tok = p.next()
+	}
+	return func(it item) types.AttributeValue { return lookupPath(it, path) }, nil
+}
+
+func (p *exprParser) resolveName(tok string) (string, error) {
+	if !strings.HasPrefix(tok, "#") {
+		return tok, nil
+	}
+	name, found := p.names[tok]
+	if !found {
+		return "", fmt.Errorf("no name for [%s]", tok)
+	}
+	return name, nil
+}
+
+func lookupPath(it item, path []string) types.AttributeValue {
+	var cur types.AttributeValue = &types.AttributeValueMemberM{Value: it}
+	for _, part := range path {
+		m, ok := cur.(*types.AttributeValueMemberM)
+		if !ok {
+			return nil
+		}
+		if cur, ok = m.Value[part]; !ok {
+			return nil
+		}
+	}
+	return cur
+}
+
+func conditionFunc(fn string, args []operandFunc) (condFunc, error) {
+	switch fn {
+	case "attribute_exists", "attribute_not_exists":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%s takes one argument", fn)
+		}
+		want := fn == "attribute_exists"
+		return func(it item) bool { return (args[0](it) != nil) == want }, nil
+
+	case "begins_with":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("begins_with takes two arguments")
+		}
+		return func(it item) bool {
+			str, ok1 := args[0](it).(*types.AttributeValueMemberS)
+			prefix, ok2 := args[1](it).(*types.AttributeValueMemberS)
+			return ok1 && ok2 && strings.HasPrefix(str.Value, prefix.Value)
+		}, nil
+
+	case "contains":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("contains takes two arguments")
+		}
+		return func(it item) bool { return contains(args[0](it), args[1](it)) }, nil
+	}
+	return nil, fmt.Errorf("unsupported function [%s]", fn)
+}
+
+func contains(haystack, needle types.AttributeValue) bool {
+	switch h := haystack.(type) {
+	case *types.AttributeValueMemberS:
+		n, ok := needle.(*types.AttributeValueMemberS)
+		return ok && strings.Contains(h.Value, n.Value)
+	case *types.AttributeValueMemberSS:
+		n, ok := needle.(*types.AttributeValueMemberS)
+		if !ok {
+			return false
+		}
+		for _, v := range h.Value {
+			if v == n.Value {
+				return true
+			}
+		}
+	case *types.AttributeValueMemberL:
+		for _, v := range h.Value {
+			if compareOp("=", v, needle) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sizeOf(av types.AttributeValue) (int, bool) {
+	switch v := av.(type) {
+	case *types.AttributeValueMemberS:
+		return len(v.Value), true
+	case *types.AttributeValueMemberB:
+		return len(v.Value), true
+	case *types.AttributeValueMemberSS:
+		return len(v.Value), true
+	case *types.AttributeValueMemberNS:
+		return len(v.Value), true
+	case *types.AttributeValueMemberL:
+		return len(v.Value), true
+	case *types.AttributeValueMemberM:
+		return len(v.Value), true
+	}
+	return 0, false
+}
+
+// missing attributes never compare as true (same as dynamodb)
+func compareOp(op string, a, b types.AttributeValue) bool {
+	if a == nil || b == nil {
+		return false
+	}
+
+	if op == "=" || op == "<>" {
+		equal := reflect.DeepEqual(a, b)
+		if cmp, ok := compareScalars(a, b); ok {
+			equal = cmp == 0
+		}
+		return equal == (op == "=")
+	}
+
+	cmp, ok := compareScalars(a, b)
+	if !ok {
+		return false
+	}
+	switch op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// orders two strings, numbers or binaries of the same type
+func compareScalars(a, b types.AttributeValue) (int, bool) {
+	switch av := a.(type) {
+	case *types.AttributeValueMemberS:
+		if bv, ok := b.(*types.AttributeValueMemberS); ok {
+			return strings.Compare(av.Value, bv.Value), true
+		}
+	case *types.AttributeValueMemberN:
+		if bv, ok := b.(*types.AttributeValueMemberN); ok {
+			an, _, aErr := big.ParseFloat(av.Value, 10, 128, big.ToNearestEven)
+			bn, _, bErr := big.ParseFloat(bv.Value, 10, 128, big.ToNearestEven)
+			if aErr == nil && bErr == nil {
+				return an.Cmp(bn), true
+			}
+		}
+	case *types.AttributeValueMemberB:
+		if bv, ok := b.(*types.AttributeValueMemberB); ok {
+			return bytes.Compare(av.Value, bv.Value), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,222 @@
+package awsfake
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// an in-memory stand-in for the bits of S3 we use; good enough to drive the reader lambda in tests
+// and local runs without a real bucket (or minio)
+type S3 struct {
+	mu      sync.Mutex
+	objects map[string]*Object
+}
+
+type Object struct {
+	Body     []byte
+	ETag     string
+	Metadata map[string]string
+	Tags     map[string]string
+	Modified time.Time
+}
+
+func NewS3() *S3 {
+	return &S3{objects: map[string]*Object{}}
+}
+
+func objKey(bucket, key string) string {
+	return bucket + "/" + key
+}
+
+// drops an object into the fake; returns its etag
+func (f *S3) Put(bucket, key string, body []byte, metadata map[string]string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sum := md5.Sum(body)
+	obj := &Object{Body: append([]byte(nil), body...), ETag: hex.EncodeToString(sum[:]), Metadata: metadata, Tags: map[string]string{}, Modified: time.Now().UTC()}
+	f.objects[objKey(bucket, key)] = obj
+	return obj.ETag
+}
+
+// returns a copy of the stored object, or nil
+func (f *S3) Object(bucket, key string) *Object {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	obj, found := f.objects[objKey(bucket, key)]
+	if !found {
+		return nil
+	}
+	cp := *obj
+	return &cp
+}
+
+// every key in bucket, sorted
+func (f *S3) Keys(bucket string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var ret []string
+	for k := range f.objects {
+		if rest, found := strings.CutPrefix(k, bucket+"/"); found {
+			ret = append(ret, rest)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func noSuchKey(bucket, key string) error {
+	return &s3types.NoSuchKey{Message: aws.String(fmt.Sprintf("no such key %s/%s", bucket, key))}
+}
+
+func (f *S3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	bucket, key := aws.ToString(params.Bucket), aws.ToString(params.Key)
+	obj := f.Object(bucket, key)
+	if obj == nil {
+		return nil, noSuchKey(bucket, key)
+	}
+	if params.IfMatch != nil && strings.Trim(*params.IfMatch, `"`) != obj.ETag {
+		return nil, &smithy.GenericAPIError{Code: "PreconditionFailed", Message: fmt.Sprintf("etag of %s/%s does not match", bucket, key)}
+	}
+
+	body := obj.Body
+	if params.Range != nil { // only the "bytes=N-" and "bytes=N-M" forms
+		var start, end int64 = 0, int64(len(body)) - 1
+		if n, _ := fmt.Sscanf(aws.ToString(params.Range), "bytes=%d-%d", &start, &end); n < 1 {
+			return nil, fmt.Errorf("unsupported range [%s]", aws.ToString(params.Range))
+		}
+		if start > int64(len(body)) {
+			start = int64(len(body))
+		}
+		end = min(end, int64(len(body))-1)
+		body = body[start : end+1]
+	}
+
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: aws.Int64(int64(len(body))),
+		ETag:          aws.String(`"` + obj.ETag + `"`),
+		Metadata:      obj.Metadata,
+		LastModified:  aws.Time(obj.Modified),
+	}, nil
+}
+
+// one page of keys under Prefix, in key order; MaxKeys (default 1000) and continuation tokens work, delimiters don't
+func (f *S3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	bucket, prefix := aws.ToString(params.Bucket), aws.ToString(params.Prefix)
+	maxKeys := int(aws.ToInt32(params.MaxKeys))
+	if maxKeys <= 0 {
+		maxKeys = 1000
+	}
+	after := aws.ToString(params.ContinuationToken)
+
+	ret := &s3.ListObjectsV2Output{Name: params.Bucket, Prefix: params.Prefix}
+	for _, key := range f.Keys(bucket) {
+		if !strings.HasPrefix(key, prefix) || key <= after {
+			continue
+		}
+		if len(ret.Contents) == maxKeys {
+			ret.IsTruncated = aws.Bool(true)
+			ret.NextContinuationToken = ret.Contents[len(ret.Contents)-1].Key
+			break
+		}
+		obj := f.Object(bucket, key)
+		if obj == nil {
+			continue // deleted since Keys
+		}
+		ret.Contents = append(ret.Contents, s3types.Object{Key: aws.String(key), Size: aws.Int64(int64(len(obj.Body))), ETag: aws.String(`"` + obj.ETag + `"`), LastModified: aws.Time(obj.Modified)})
+	}
+	ret.KeyCount = aws.Int32(int32(len(ret.Contents)))
+	return ret, nil
+}
+
+func (f *S3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	bucket, key := aws.ToString(params.Bucket), aws.ToString(params.Key)
+	obj := f.Object(bucket, key)
+	if obj == nil {
+		return nil, &s3types.NotFound{Message: aws.String(fmt.Sprintf("no such key %s/%s", bucket, key))}
+	}
+
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(obj.Body))),
+		ETag:          aws.String(`"` + obj.ETag + `"`),
+		Metadata:      obj.Metadata,
+		LastModified:  aws.Time(obj.Modified),
+	}, nil
+}
+
+func (f *S3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	var body []byte
+	if params.Body != nil {
+		var readErr error
+		if body, readErr = io.ReadAll(params.Body); readErr != nil {
+			return nil, readErr
+		}
+	}
+
+	etag := f.Put(aws.ToString(params.Bucket), aws.ToString(params.Key), body, params.Metadata)
+	return &s3.PutObjectOutput{ETag: aws.String(`"` + etag + `"`)}, nil
+}
+
+func (f *S3) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	src, unescErr := url.PathUnescape(aws.ToString(params.CopySource))
+	if unescErr != nil {
+		return nil, unescErr
+	}
+	srcBucket, srcKey, found := strings.Cut(src, "/")
+	if !found {
+		return nil, fmt.Errorf("bad copy source [%s]", aws.ToString(params.CopySource))
+	}
+
+	obj := f.Object(srcBucket, srcKey)
+	if obj == nil {
+		return nil, noSuchKey(srcBucket, srcKey)
+	}
+
+	f.Put(aws.ToString(params.Bucket), aws.ToString(params.Key), obj.Body, obj.Metadata)
+	return &s3.CopyObjectOutput{}, nil
+}
+
+// like the real thing, deleting something that isn't there is not an error
+func (f *S3) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.objects, objKey(aws.ToString(params.Bucket), aws.ToString(params.Key)))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (f *S3) PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key := aws.ToString(params.Bucket), aws.ToString(params.Key)
+	obj, found := f.objects[objKey(bucket, key)]
+	if !found {
+		return nil, noSuchKey(bucket, key)
+	}
+
+	obj.Tags = map[string]string{}
+	if params.Tagging != nil {
+		for _, tag := range params.Tagging.TagSet {
+			obj.Tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
+	}
+	return &s3.PutObjectTaggingOutput{}, nil
+}
@@ -0,0 +1,255 @@
+package canary
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/util"
+)
+
+const DYNDB_TABLE_CANARIES = `canaryCredentials`
+
+// how many times RecordSighting re-reads a canary that changed underneath it before giving up
+const sightingAttempts = 3
+
+// returned by Save when the address is already registered (re-registering would lose its sightings)
+var ErrExists = errors.New("canary already registered")
+
+// a fake ("honey") credential planted with a vendor or in a system; if it turns up in a dump, that's where
+// the dump came from. only a hash of the password is kept
+type Canary struct {
+	Email        string     `json:"email" dynamodbav:"email"` // lowercased
+	PasswordHash string     `json:"-" dynamodbav:"passwordHash"`
+	Label        string     `json:"label" dynamodbav:"label"` // where it was planted, e.g. "payroll vendor"
+	CreatedAt    time.Time  `json:"createdAt" dynamodbav:"createdAt"`
+	Sightings    []Sighting `json:"sightings,omitempty" dynamodbav:"sightings,omitempty"`
+	Version      int        `json:"-" dynamodbav:"version"` // bumped on every write so concurrent sightings don't clobber each other
+}
+
+// one ingest the canary turned up in
+type Sighting struct {
+	JobID           string    `json:"jobId" dynamodbav:"jobId"`
+	SourceID        string    `json:"sourceId,omitempty" dynamodbav:"sourceId,omitempty"`
+	Bucket          string    `json:"bucket,omitempty" dynamodbav:"bucket,omitempty"`
+	Key             string    `json:"key,omitempty" dynamodbav:"key,omitempty"`
+	Filename        string    `json:"filename,omitempty" dynamodbav:"filename,omitempty"`
+	Line            int       `json:"line,omitempty" dynamodbav:"line,omitempty"`
+	PasswordMatched bool      `json:"passwordMatched" dynamodbav:"passwordMatched"` // false if only the address turned up
+	SeenAt          time.Time `json:"seenAt" dynamodbav:"seenAt"`
+}
+
+func (c Canary) GetAttrDefs() []types.AttributeDefinition {
+	return []types.AttributeDefinition{
+		{
+			AttributeName: aws.String("email"),
+			AttributeType: types.ScalarAttributeTypeS,
+		},
+	}
+}
+
+func (c Canary) GetKeySchema() []types.KeySchemaElement {
+	return []types.KeySchemaElement{
+		{
+			AttributeName: aws.String("email"),
+			KeyType:       types.KeyTypeHash,
+		},
+	}
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// a canary for email/password; the label is required, it's how you know who leaked it
+func New(email, password, label string) (*Canary, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if user, domain, found := strings.Cut(email, "@"); !found || user == "" || domain == "" || strings.ContainsAny(email, " \t:") {
+		return nil, fmt.Errorf("[%s] is not an email address", email)
+	}
+	if password == "" {
+		return nil, errors.New("a canary needs a password")
+	}
+	if strings.TrimSpace(label) == "" {
+		return nil, errors.New("a canary needs a label saying where it was planted")
+	}
+	return &Canary{Email: email, PasswordHash: hashPassword(password), Label: strings.TrimSpace(label), CreatedAt: time.Now().UTC()}, nil
+}
+
+// the index of the first of passwords that is the canary's password; -1 if none are
+func (c *Canary) MatchPassword(passwords []string) int {
+	for idx, password := range passwords {
+		if hashPassword(password) == c.PasswordHash {
+			return idx
+		}
+	}
+	return -1
+}
+
+func emailKey(email string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{"email": &types.AttributeValueMemberS{Value: strings.ToLower(strings.TrimSpace(email))}}
+}
+
+// registers a canary; ErrExists if its address already is one
+func Save(ctx context.Context, cli util.DynamoDBAPI, tableName string, c *Canary) error {
+	if cli == nil {
+		return errors.New("passed dynamodb client was nil")
+	}
+	item, err := attributevalue.MarshalMap(c)
+	if err != nil {
+		return fmt.Errorf("failed to marshal canary: %s", err)
+	}
+	_, err = cli.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(email)"),
+	})
+	var condFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &condFailed) {
+		return fmt.Errorf("%w: %s", ErrExists, c.Email)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save canary [%s]: %s", c.Email, err)
+	}
+	return nil
+}
+
+// a single canary; nil (and no error) if there isn't one
+func Get(ctx context.Context, cli util.DynamoDBAPI, tableName, email string) (*Canary, error) {
+	if cli == nil {
+		return nil, errors.New("passed dynamodb client was nil")
+	}
+	res, err := cli.GetItem(ctx, &dynamodb.GetItemInput{TableName: aws.String(tableName), Key: emailKey(email)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get canary [%s]: %s", email, err)
+	}
+	if len(res.Item) == 0 {
+		return nil, nil
+	}
+	c := &Canary{}
+	if err := attributevalue.UnmarshalMap(res.Item, c); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal canary [%s]: %s", email, err)
+	}
+	return c, nil
+}
+
+// retires a canary (and its sightings); returns false if there wasn't one
+func Delete(ctx context.Context, cli util.DynamoDBAPI, tableName, email string) (bool, error) {
+	if cli == nil {
+		return false, errors.New("passed dynamodb client was nil")
+	}
+	res, err := cli.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:    aws.String(tableName),
+		Key:          emailKey(email),
+		ReturnValues: types.ReturnValueAllOld,
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to delete canary [%s]: %s", email, err)
+	}
+	return len(res.Attributes) > 0, nil
+}
+
+// every canary; there are only ever a handful so scanning is fine
+func List(ctx context.Context, cli util.DynamoDBAPI, tableName string) ([]*Canary, error) {
+	if cli == nil {
+		return nil, errors.New("passed dynamodb client was nil")
+	}
+
+	var ret []*Canary
+	paginator := dynamodb.NewScanPaginator(cli, &dynamodb.ScanInput{TableName: aws.String(tableName)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan canaries: %s", err)
+		}
+
+		var pageCanaries []*Canary
+		if unmarshErr := attributevalue.UnmarshalListOfMaps(page.Items, &pageCanaries); unmarshErr != nil {
+			return nil, fmt.Errorf("failed to unmarshal canaries: %s", unmarshErr)
+		}
+		ret = append(ret, pageCanaries...)
+	}
+	return ret, nil
+}
+
+// adds a sighting to the canary for email; one per job, so a job spanning several invocations (or an
+// object delivered twice under the same job) is only recorded once. returns false if the job was already
+// recorded, or the canary has since been deleted
+func RecordSighting(ctx context.Context, cli util.DynamoDBAPI, tableName, email string, sighting Sighting) (bool, error) {
+	for attempt := 0; attempt < sightingAttempts; attempt++ {
+		c, err := Get(ctx, cli, tableName, email)
+		if err != nil || c == nil {
+			return false, err
+		}
+		for _, seen := range c.Sightings {
+			if seen.JobID == sighting.JobID {
+				return false, nil
+			}
+		}
+
+		prevVersion := c.Version
+		c.Sightings = append(c.Sightings, sighting)
+		c.Version++
+		item, err := attributevalue.MarshalMap(c)
+		if err != nil {
+			return false, fmt.Errorf("failed to marshal canary: %s", err)
+		}
+		_, err = cli.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:                 aws.String(tableName),
+			Item:                      item,
+			ConditionExpression:       aws.String("#v = :v"),
+			ExpressionAttributeNames:  map[string]string{"#v": "version"},
+			ExpressionAttributeValues: map[string]types.AttributeValue{":v": &types.AttributeValueMemberN{Value: strconv.Itoa(prevVersion)}},
+		})
+		var condFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &condFailed) {
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to record sighting of canary [%s]: %s", email, err)
+		}
+		return true, nil
+	}
+	return false, fmt.Errorf("canary [%s] kept changing while recording a sighting; gave up after %d attempts", email, sightingAttempts)
+}
+
+// the canaries held in memory for checking credentials as they're ingested
+type Set struct {
+	byEmail map[string]*Canary
+}
+
+func NewSet(canaries []*Canary) *Set {
+	s := &Set{byEmail: map[string]*Canary{}}
+	for _, c := range canaries {
+		s.byEmail[c.Email] = c
+	}
+	return s
+}
+
+// loads every canary; nil (and no error) if there aren't any
+func Load(ctx context.Context, cli util.DynamoDBAPI, tableName string) (*Set, error) {
+	canaries, err := List(ctx, cli, tableName)
+	if err != nil || len(canaries) == 0 {
+		return nil, err
+	}
+	return NewSet(canaries), nil
+}
+
+// the canary cred's address belongs to, if any. nil-safe
+func (s *Set) Match(cred *credparser.CredentialInfo) *Canary {
+	if s == nil || cred == nil {
+		return nil
+	}
+	return s.byEmail[strings.ToLower(cred.User)+"@"+strings.ToLower(cred.Domain)]
+}
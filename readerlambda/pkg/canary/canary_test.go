@@ -0,0 +1,98 @@
+package canary
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/newodahs/readerlambda/pkg/awsfake"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/util"
+)
+
+func Test_New(t *testing.T) {
+	testSet := []struct {
+		Name      string
+		Email     string
+		Password  string
+		Label     string
+		ExpectErr bool
+	}{
+		{Name: "Good", Email: " Honey.Pot@Example.com ", Password: "Tr1pwire!", Label: "payroll vendor"},
+		{Name: "NotAnAddress", Email: "example.com", Password: "x", Label: "vendor", ExpectErr: true},
+		{Name: "NoPassword", Email: "honey@example.com", Label: "vendor", ExpectErr: true},
+		{Name: "NoLabel", Email: "honey@example.com", Password: "x", Label: " ", ExpectErr: true},
+	}
+
+	for _, test := range testSet {
+		t.Run(test.Name, func(t *testing.T) {
+			c, err := New(test.Email, test.Password, test.Label)
+			if (err != nil) != test.ExpectErr {
+				t.Fatalf("unexpected error state: %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if c.Email != "honey.pot@example.com" || c.PasswordHash == test.Password {
+				t.Errorf("unexpected canary %+v", c)
+			}
+			if c.MatchPassword([]string{"nope", test.Password}) != 1 || c.MatchPassword([]string{"nope"}) != -1 {
+				t.Errorf("password matching is wrong")
+			}
+		})
+	}
+}
+
+func Test_Canaries(t *testing.T) {
+	const tableName = "canaryTest"
+	ctx := context.Background()
+	cli := awsfake.NewDynamoDB()
+	if err := util.EnsureDynamoDBTable(ctx, cli, tableName, Canary{}, nil); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+
+	if none, err := Load(ctx, cli, tableName); none != nil || err != nil {
+		t.Errorf("expected no canaries, got %v (%v)", none, err)
+	}
+
+	c, _ := New("honey@example.com", "Tr1pwire!", "payroll vendor")
+	if err := Save(ctx, cli, tableName, c); err != nil {
+		t.Fatalf("failed to save: %s", err)
+	}
+	if err := Save(ctx, cli, tableName, c); !errors.Is(err, ErrExists) {
+		t.Errorf("expected registering twice to fail with ErrExists, got %v", err)
+	}
+
+	set, err := Load(ctx, cli, tableName)
+	if err != nil {
+		t.Fatalf("failed to load: %s", err)
+	}
+	if set.Match(&credparser.CredentialInfo{User: "HONEY", Domain: "example.com"}) == nil {
+		t.Errorf("expected the canary to match case-insensitively")
+	}
+	if set.Match(&credparser.CredentialInfo{User: "someone", Domain: "example.com"}) != nil {
+		t.Errorf("expected nothing else to match")
+	}
+
+	for idx, expect := range []bool{true, false, true} {
+		jobID := []string{"job-1", "job-1", "job-2"}[idx]
+		recorded, err := RecordSighting(ctx, cli, tableName, "honey@example.com", Sighting{JobID: jobID, Filename: "dump.txt", Line: 7})
+		if err != nil || recorded != expect {
+			t.Errorf("sighting %d: expected recorded %t, got %t (%v)", idx, expect, recorded, err)
+		}
+	}
+	got, _ := Get(ctx, cli, tableName, "Honey@example.com")
+	if got == nil || len(got.Sightings) != 2 || got.Sightings[0].Line != 7 || got.PasswordHash != c.PasswordHash {
+		t.Errorf("unexpected canary after sightings %+v", got)
+	}
+
+	if recorded, err := RecordSighting(ctx, cli, tableName, "gone@example.com", Sighting{JobID: "job-1"}); recorded || err != nil {
+		t.Errorf("expected nothing recorded for a missing canary, got %t (%v)", recorded, err)
+	}
+	if found, err := Delete(ctx, cli, tableName, "honey@example.com"); !found || err != nil {
+		t.Errorf("expected the canary to be deleted, got %t (%v)", found, err)
+	}
+	if found, _ := Delete(ctx, cli, tableName, "honey@example.com"); found {
+		t.Errorf("expected nothing left to delete")
+	}
+}
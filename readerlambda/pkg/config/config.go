@@ -0,0 +1,662 @@
+package config
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/newodahs/readerlambda/pkg/alerts"
+	"github.com/newodahs/readerlambda/pkg/canary"
+	"github.com/newodahs/readerlambda/pkg/credstore"
+	"github.com/newodahs/readerlambda/pkg/envelope"
+	"github.com/newodahs/readerlambda/pkg/ingest"
+	"github.com/newodahs/readerlambda/pkg/jobs"
+	"github.com/newodahs/readerlambda/pkg/ledger"
+	"github.com/newodahs/readerlambda/pkg/retention"
+	"github.com/newodahs/readerlambda/pkg/sources"
+	"github.com/newodahs/readerlambda/pkg/tenants"
+	"github.com/newodahs/readerlambda/pkg/util"
+	"github.com/newodahs/readerlambda/pkg/watchlist"
+	"github.com/newodahs/readerlambda/pkg/webhook"
+)
+
+// shared settings for every entry point (both lambdas and both consoles); loaded from, in increasing order
+// of precedence: defaults, an optional JSON file, environment variables and command line flags
+
+const (
+	DEFAULT_LOCAL_DYNAMODB_ENDPOINT = "http://localhost:8000"
+	DEFAULT_LOCAL_REGION            = "us-east-1" // dynamodb-local doesn't care, but the sdk wants one
+	DEFAULT_BIND_ADDR               = "0.0.0.0:8080"
+)
+
+// where the master key for encrypting stored passwords lives (see the envelope package); none means
+// passwords are stored in plaintext
+const (
+	KEY_PROVIDER_NONE  = ""
+	KEY_PROVIDER_LOCAL = "local" // a key file; dev and tests only
+	KEY_PROVIDER_KMS   = "kms"
+)
+
+// admin tokens shorter than this are refused; they're the only thing between a caller and plaintext passwords
+const MIN_ADMIN_TOKEN_LEN = 16
+
+// environment variables; unset (or empty) means leave the value alone
+const (
+	ENV_CONFIG_FILE              = "CONFIG_FILE"
+	ENV_REGION                   = "AWS_REGION"
+	ENV_DYNAMODB_ENDPOINT        = "DYNAMODB_ENDPOINT"
+	ENV_S3_ENDPOINT              = "S3_ENDPOINT"
+	ENV_LOCAL_CREDENTIALS        = "LOCAL_CREDENTIALS"
+	ENV_TABLE_CREDENTIALS        = "TABLE_CREDENTIALS"
+	ENV_TABLE_SOURCES            = "TABLE_SOURCES"
+	ENV_TABLE_SOURCE_CREDENTIALS = "TABLE_SOURCE_CREDENTIALS"
+	ENV_TABLE_JOBS               = "TABLE_JOBS"
+	ENV_TABLE_PROCESSED          = "TABLE_PROCESSED"
+	ENV_TABLE_TOMBSTONES         = "TABLE_TOMBSTONES"
+	ENV_TABLE_WATCHLIST          = "TABLE_WATCHLIST"
+	ENV_TABLE_DELIVERIES         = "TABLE_DELIVERIES"
+	ENV_TABLE_CANARIES           = "TABLE_CANARIES"
+	ENV_TABLE_ON_DEMAND          = "TABLE_ON_DEMAND" // create missing tables pay per request
+	ENV_TLS_CERT_FILE            = "TLS_CERT_FILE"
+	ENV_TLS_KEY_FILE             = "TLS_KEY_FILE"
+	ENV_CORS_ORIGINS             = "CORS_ORIGINS" // comma separated
+	ENV_BIND_ADDR                = "BIND_ADDR"
+	ENV_KEY_PROVIDER             = "KEY_PROVIDER"
+	ENV_KEY_FILE                 = "KEY_FILE"
+	ENV_KMS_KEY_ID               = "KMS_KEY_ID"
+	ENV_ADMIN_TOKENS             = "ADMIN_TOKENS"  // comma separated
+	ENV_TENANT_TOKENS            = "TENANT_TOKENS" // tenant=token, comma separated
+	ENV_LOOKUP_KEY               = "LOOKUP_KEY"    // base64
+	ENV_RETENTION                = "RETENTION"
+	ENV_RETENTION_DOMAINS        = "RETENTION_DOMAINS" // domain=period, comma separated
+	ENV_RETENTION_TENANTS        = "RETENTION_TENANTS" // tenant=period, comma separated
+	ENV_TENANTS                  = "TENANTS"           // tenant=domain|domain, comma separated
+	ENV_ALERT_SNS_TOPIC          = "ALERT_SNS_TOPIC"   // topic ARN
+	ENV_ALERT_FILE               = "ALERT_FILE"
+	ENV_WEBHOOK_URL              = "WEBHOOK_URL"
+	ENV_WEBHOOK_SECRET           = "WEBHOOK_SECRET"
+	ENV_ALERT_WEBHOOK_URL        = "ALERT_WEBHOOK_URL" // deprecated; see AlertWebhookURL
+)
+
+type Tables struct {
+	Credentials       string `json:"credentials,omitempty"`
+	Sources           string `json:"sources,omitempty"`
+	SourceCredentials string `json:"sourceCredentials,omitempty"`
+	Jobs              string `json:"jobs,omitempty"`
+	Processed         string `json:"processed,omitempty"`
+	Tombstones        string `json:"tombstones,omitempty"`
+	Watchlist         string `json:"watchlist,omitempty"`
+	Deliveries        string `json:"deliveries,omitempty"`
+	Canaries          string `json:"canaries,omitempty"`
+}
+
+// the tables the ingester writes to
+func (t Tables) Ingest() ingest.Tables {
+	return ingest.Tables{
+		Credentials:       t.Credentials,
+		SourceCredentials: t.SourceCredentials,
+		Jobs:              t.Jobs,
+		Tombstones:        t.Tombstones,
+		Watchlist:         t.Watchlist,
+		Canaries:          t.Canaries,
+	}
+}
+
+type Config struct {
+	Region           string `json:"region,omitempty"`
+	DynamoDBEndpoint string `json:"dynamodbEndpoint,omitempty"` // empty for the real thing
+	S3Endpoint       string `json:"s3Endpoint,omitempty"`       // empty for the real thing; path-style addressing is used otherwise
+	LocalCredentials bool   `json:"localCredentials,omitempty"` // placeholder credentials for dynamodb-local instead of the usual chain
+
+	Tables       Tables             `json:"tables,omitempty"`
+	TableOptions *util.TableOptions `json:"tableOptions,omitempty"` // how missing tables are created; nil for the defaults
+
+	TLSCertFile string   `json:"tlsCertFile,omitempty"`
+	TLSKeyFile  string   `json:"tlsKeyFile,omitempty"`
+	CORSOrigins []string `json:"corsOrigins,omitempty"`
+	BindAddr    string   `json:"bindAddr,omitempty"`
+
+	KeyProvider string   `json:"keyProvider,omitempty"` // one of the KEY_PROVIDER_ constants
+	KeyFile     string   `json:"keyFile,omitempty"`     // local provider
+	KMSKeyID    string   `json:"kmsKeyId,omitempty"`    // kms provider; key id, ARN or alias
+	AdminTokens []string `json:"adminTokens,omitempty"` // bearer tokens allowed to read plaintext passwords from the API
+	LookupKey   string   `json:"lookupKey,omitempty"`   // base64; if set credentials are stored under HMAC'd keys (needs a key provider)
+
+	// which tenant each email domain belongs to, e.g. "acme=acme.com|acme.co.uk,globex=globex.com"
+	Tenants string `json:"tenants,omitempty"`
+	// bearer tokens for tenants managing their own watches through the API, e.g. ["acme=<token>", "globex=<token>"]
+	TenantTokens []string `json:"tenantTokens,omitempty"`
+
+	Retention        string `json:"retention,omitempty"`        // how long credentials are kept from their breach date, e.g. 365d; empty keeps them forever
+	RetentionTenants string `json:"retentionTenants,omitempty"` // per-tenant overrides, e.g. "acme=90d,globex=forever"
+	RetentionDomains string `json:"retentionDomains,omitempty"` // per-domain overrides (winning over the tenant's), e.g. "example.com=90d,example.org=forever"
+
+	// where watchlist alerts go (any or all of them, plus the webhook); with none set the watchlist isn't checked
+	AlertSNSTopic string `json:"alertSnsTopic,omitempty"` // topic ARN
+	AlertFile     string `json:"alertFile,omitempty"`     // JSON lines appended to a local file; for tests and the console
+
+	// signed webhooks for alerts and finished ingest jobs; failed deliveries are retried from the deliveries table
+	WebhookURL    string `json:"webhookUrl,omitempty"`
+	WebhookSecret string `json:"webhookSecret,omitempty"` // HMAC-SHA256 signing key; required with a URL
+
+	// the old unsigned alert webhook, replaced by WebhookURL; still read so setting it fails validation
+	// rather than alerts quietly going nowhere
+	AlertWebhookURL string `json:"alertWebhookUrl,omitempty"`
+}
+
+func Default() *Config {
+	return &Config{
+		Tables: Tables{
+			Credentials:       credstore.DYNDB_TABLE_EXPLOITCRED,
+			Sources:           sources.DYNDB_TABLE_SOURCES,
+			SourceCredentials: sources.DYNDB_TABLE_SOURCECREDS,
+			Jobs:              jobs.DYNDB_TABLE_JOBS,
+			Processed:         ledger.DYNDB_TABLE_PROCESSED,
+			Tombstones:        credstore.DYNDB_TABLE_TOMBSTONES,
+			Watchlist:         watchlist.DYNDB_TABLE_WATCHLIST,
+			Deliveries:        webhook.DYNDB_TABLE_DELIVERIES,
+			Canaries:          canary.DYNDB_TABLE_CANARIES,
+		},
+		CORSOrigins: []string{"*"},
+		BindAddr:    DEFAULT_BIND_ADDR,
+	}
+}
+
+// points at dynamodb-local (unless an endpoint was already configured) with placeholder credentials;
+// what the consoles' -localdb means
+func (cfg *Config) UseLocalDynamoDB() {
+	if cfg.DynamoDBEndpoint == "" {
+		cfg.DynamoDBEndpoint = DEFAULT_LOCAL_DYNAMODB_ENDPOINT
+	}
+	cfg.LocalCredentials = true
+}
+
+// the command line side of the config; register on a FlagSet before parsing, then Load
+type Flags struct {
+	fs     *flag.FlagSet
+	file   *string
+	values map[string]*string
+}
+
+// flag name => how it's applied to the config
+var flagSetters = map[string]struct {
+	usage string
+	set   func(cfg *Config, val string)
+}{
+	"region":                   {"AWS region", func(cfg *Config, val string) { cfg.Region = val }},
+	"dynamodb-endpoint":        {"DynamoDB endpoint URL (e.g. " + DEFAULT_LOCAL_DYNAMODB_ENDPOINT + " for dynamodb-local)", func(cfg *Config, val string) { cfg.DynamoDBEndpoint = val }},
+	"s3-endpoint":              {"S3-compatible endpoint URL (e.g. http://localhost:9000 for minio)", func(cfg *Config, val string) { cfg.S3Endpoint = val }},
+	"table-credentials":        {"Credentials table name", func(cfg *Config, val string) { cfg.Tables.Credentials = val }},
+	"table-sources":            {"Sources table name", func(cfg *Config, val string) { cfg.Tables.Sources = val }},
+	"table-source-credentials": {"Source/credential link table name", func(cfg *Config, val string) { cfg.Tables.SourceCredentials = val }},
+	"table-jobs":               {"Ingest jobs table name", func(cfg *Config, val string) { cfg.Tables.Jobs = val }},
+	"table-processed":          {"Processed objects table name", func(cfg *Config, val string) { cfg.Tables.Processed = val }},
+	"table-tombstones":         {"Erased address (tombstone) table name", func(cfg *Config, val string) { cfg.Tables.Tombstones = val }},
+	"table-watchlist":          {"Watched domains/addresses table name", func(cfg *Config, val string) { cfg.Tables.Watchlist = val }},
+	"table-deliveries":         {"Webhook deliveries table name", func(cfg *Config, val string) { cfg.Tables.Deliveries = val }},
+	"table-canaries":           {"Canary credentials table name", func(cfg *Config, val string) { cfg.Tables.Canaries = val }},
+	"tls-cert":                 {"TLS certificate file", func(cfg *Config, val string) { cfg.TLSCertFile = val }},
+	"tls-key":                  {"TLS key file", func(cfg *Config, val string) { cfg.TLSKeyFile = val }},
+	"cors-origins":             {"Comma separated list of allowed CORS origins", func(cfg *Config, val string) { cfg.CORSOrigins = splitList(val) }},
+	"bind":                     {"Address (host:port) to listen on", func(cfg *Config, val string) { cfg.BindAddr = val }},
+	"key-provider":             {"Where the password encryption key lives: local or kms (empty stores plaintext)", func(cfg *Config, val string) { cfg.KeyProvider = val }},
+	"key-file":                 {"Key file for -key-provider=local", func(cfg *Config, val string) { cfg.KeyFile = val }},
+	"kms-key-id":               {"KMS key id, ARN or alias for -key-provider=kms", func(cfg *Config, val string) { cfg.KMSKeyID = val }},
+	"admin-tokens":             {"Comma separated bearer tokens allowed to read plaintext passwords", func(cfg *Config, val string) { cfg.AdminTokens = splitList(val) }},
+	"lookup-key":               {"Base64 key for storing credentials under hashed (HMAC) keys", func(cfg *Config, val string) { cfg.LookupKey = val }},
+	"retention":                {"How long credentials are kept from their breach date (e.g. 365d, 2y; empty keeps them forever)", func(cfg *Config, val string) { cfg.Retention = val }},
+	"retention-domains":        {"Comma separated per-domain retention overrides (e.g. example.com=90d,example.org=forever)", func(cfg *Config, val string) { cfg.RetentionDomains = val }},
+	"retention-tenants":        {"Comma separated per-tenant retention overrides (e.g. acme=90d,globex=forever)", func(cfg *Config, val string) { cfg.RetentionTenants = val }},
+	"tenant-tokens":            {"Comma separated tenant=token bearer tokens tenants manage their own watches with", func(cfg *Config, val string) { cfg.TenantTokens = splitList(val) }},
+	"tenants":                  {"Comma separated tenants and their email domains (e.g. acme=acme.com|acme.co.uk,globex=globex.com)", func(cfg *Config, val string) { cfg.Tenants = val }},
+	"alert-sns-topic":          {"SNS topic ARN watchlist alerts are published to", func(cfg *Config, val string) { cfg.AlertSNSTopic = val }},
+	"alert-file":               {"File watchlist alerts are appended to (JSON lines)", func(cfg *Config, val string) { cfg.AlertFile = val }},
+	"webhook":                  {"URL alerts and finished ingest jobs are POSTed to as signed webhooks", func(cfg *Config, val string) { cfg.WebhookURL = val }},
+	"alert-webhook":            {"Deprecated: replaced by -webhook and -webhook-secret (setting it is an error)", func(cfg *Config, val string) { cfg.AlertWebhookURL = val }},
+	"webhook-secret":           {"Secret webhooks are signed with (HMAC-SHA256)", func(cfg *Config, val string) { cfg.WebhookSecret = val }},
+}
+
+var envSetters = map[string]func(cfg *Config, val string){
+	ENV_REGION:                   flagSetters["region"].set,
+	ENV_DYNAMODB_ENDPOINT:        flagSetters["dynamodb-endpoint"].set,
+	ENV_S3_ENDPOINT:              flagSetters["s3-endpoint"].set,
+	ENV_TABLE_CREDENTIALS:        flagSetters["table-credentials"].set,
+	ENV_TABLE_SOURCES:            flagSetters["table-sources"].set,
+	ENV_TABLE_SOURCE_CREDENTIALS: flagSetters["table-source-credentials"].set,
+	ENV_TABLE_JOBS:               flagSetters["table-jobs"].set,
+	ENV_TABLE_PROCESSED:          flagSetters["table-processed"].set,
+	ENV_TABLE_TOMBSTONES:         flagSetters["table-tombstones"].set,
+	ENV_TABLE_WATCHLIST:          flagSetters["table-watchlist"].set,
+	ENV_TABLE_DELIVERIES:         flagSetters["table-deliveries"].set,
+	ENV_TABLE_CANARIES:           flagSetters["table-canaries"].set,
+	ENV_TLS_CERT_FILE:            flagSetters["tls-cert"].set,
+	ENV_TLS_KEY_FILE:             flagSetters["tls-key"].set,
+	ENV_CORS_ORIGINS:             flagSetters["cors-origins"].set,
+	ENV_BIND_ADDR:                flagSetters["bind"].set,
+	ENV_KEY_PROVIDER:             flagSetters["key-provider"].set,
+	ENV_KEY_FILE:                 flagSetters["key-file"].set,
+	ENV_KMS_KEY_ID:               flagSetters["kms-key-id"].set,
+	ENV_ADMIN_TOKENS:             flagSetters["admin-tokens"].set,
+	ENV_LOOKUP_KEY:               flagSetters["lookup-key"].set,
+	ENV_RETENTION:                flagSetters["retention"].set,
+	ENV_RETENTION_DOMAINS:        flagSetters["retention-domains"].set,
+	ENV_RETENTION_TENANTS:        flagSetters["retention-tenants"].set,
+	ENV_TENANTS:                  flagSetters["tenants"].set,
+	ENV_TENANT_TOKENS:            flagSetters["tenant-tokens"].set,
+	ENV_ALERT_SNS_TOPIC:          flagSetters["alert-sns-topic"].set,
+	ENV_ALERT_FILE:               flagSetters["alert-file"].set,
+	ENV_WEBHOOK_URL:              flagSetters["webhook"].set,
+	ENV_WEBHOOK_SECRET:           flagSetters["webhook-secret"].set,
+	ENV_ALERT_WEBHOOK_URL:        flagSetters["alert-webhook"].set,
+	ENV_LOCAL_CREDENTIALS: func(cfg *Config, val string) {
+		cfg.LocalCredentials = isTrue(val)
+	},
+	ENV_TABLE_ON_DEMAND: func(cfg *Config, val string) {
+		if cfg.TableOptions == nil {
+			cfg.TableOptions = &util.TableOptions{}
+		}
+		cfg.TableOptions.OnDemand = isTrue(val)
+		if cfg.TableOptions.OnDemand {
+			cfg.TableOptions.ReadCapacity, cfg.TableOptions.WriteCapacity = 0, 0
+		}
+	},
+}
+
+func AddFlags(fs *flag.FlagSet) *Flags {
+	f := &Flags{fs: fs, values: map[string]*string{}}
+	f.file = fs.String("config", "", "Optional JSON config file (also "+ENV_CONFIG_FILE+")")
+	for name, setter := range flagSetters {
+		f.values[name] = fs.String(name, "", setter.usage)
+	}
+	return f
+}
+
+// loads (and validates) the config for a parsed FlagSet; only flags actually given override the file/environment
+func (f *Flags) Load() (*Config, error) {
+	given := map[string]bool{}
+	f.fs.Visit(func(fl *flag.Flag) { given[fl.Name] = true })
+
+	cfg, err := load(*f.file)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, setter := range flagSetters {
+		if given[name] {
+			setter.set(cfg, *f.values[name])
+		}
+	}
+	return cfg, cfg.Validate()
+}
+
+// for the lambdas, which have no command line
+func FromEnv() (*Config, error) {
+	cfg, err := load("")
+	if err != nil {
+		return nil, err
+	}
+	return cfg, cfg.Validate()
+}
+
+func load(file string) (*Config, error) {
+	cfg := Default()
+
+	if file == "" {
+		file = os.Getenv(ENV_CONFIG_FILE)
+	}
+	if file != "" {
+		if err := cfg.readFile(file); err != nil {
+			return nil, err
+		}
+	}
+
+	for env, set := range envSetters {
+		if val := os.Getenv(env); val != "" {
+			set(cfg, val)
+		}
+	}
+	return cfg, nil
+}
+
+// the file only needs to hold what differs from the defaults
+func (cfg *Config) readFile(filename string) error {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %s", err)
+	}
+	defer fh.Close()
+
+	dec := json.NewDecoder(fh)
+	dec.DisallowUnknownFields() // a typo'd setting should be loud, not silently ignored
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("failed to parse config file [%s]: %s", filename, err)
+	}
+	return nil
+}
+
+// the rules from the dynamodb docs
+var tableNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,255}$`)
+
+// checks everything that's set; returns every problem found, joined
+func (cfg *Config) Validate() error {
+	var errs []error
+
+	for name, endpoint := range map[string]string{"dynamodb endpoint": cfg.DynamoDBEndpoint, "s3 endpoint": cfg.S3Endpoint, "webhook": cfg.WebhookURL} {
+		if endpoint == "" {
+			continue
+		}
+		if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("%s [%s] must be an http(s) URL", name, endpoint))
+		}
+	}
+
+	for name, table := range map[string]string{
+		"credentials":        cfg.Tables.Credentials,
+		"sources":            cfg.Tables.Sources,
+		"source credentials": cfg.Tables.SourceCredentials,
+		"jobs":               cfg.Tables.Jobs,
+		"processed":          cfg.Tables.Processed,
+		"tombstones":         cfg.Tables.Tombstones,
+		"watchlist":          cfg.Tables.Watchlist,
+		"deliveries":         cfg.Tables.Deliveries,
+		"canaries":           cfg.Tables.Canaries,
+	} {
+		if !tableNameRegex.MatchString(table) {
+			errs = append(errs, fmt.Errorf("%s table name [%s] is not a valid dynamodb table name", name, table))
+		}
+	}
+
+	if err := cfg.TableOptions.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		errs = append(errs, errors.New("tls cert and key files must be given together"))
+	}
+	for _, file := range []string{cfg.TLSCertFile, cfg.TLSKeyFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			errs = append(errs, fmt.Errorf("tls file: %s", err))
+		}
+	}
+
+	// the cors middleware refuses (panics) without any origin at all; "*" is how to allow any
+	if len(cfg.CORSOrigins) == 0 {
+		errs = append(errs, errors.New("at least one cors origin is needed (* allows any)"))
+	}
+	for _, origin := range cfg.CORSOrigins {
+		if origin == "*" {
+			continue
+		}
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			errs = append(errs, fmt.Errorf("cors origin [%s] must be * or scheme://host[:port]", origin))
+		}
+	}
+
+	if cfg.BindAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.BindAddr); err != nil {
+			errs = append(errs, fmt.Errorf("bind address [%s] must be host:port: %s", cfg.BindAddr, err))
+		}
+	}
+
+	switch cfg.KeyProvider {
+	case KEY_PROVIDER_NONE:
+	case KEY_PROVIDER_LOCAL:
+		if cfg.KeyFile == "" {
+			errs = append(errs, errors.New("the local key provider needs a key file"))
+		}
+	case KEY_PROVIDER_KMS:
+		if cfg.KMSKeyID == "" {
+			errs = append(errs, errors.New("the kms key provider needs a kms key id"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("key provider [%s] must be %s or %s", cfg.KeyProvider, KEY_PROVIDER_LOCAL, KEY_PROVIDER_KMS))
+	}
+
+	if cfg.LookupKey != "" {
+		if _, err := cfg.NewKeyHasher(); err != nil {
+			errs = append(errs, err)
+		}
+		if cfg.KeyProvider == KEY_PROVIDER_NONE {
+			errs = append(errs, errors.New("a lookup key needs a key provider (identities are stored encrypted)"))
+		}
+	}
+
+	if _, err := cfg.TenantDirectory(); err != nil {
+		errs = append(errs, err)
+	} else if _, err := cfg.RetentionPolicy(); err != nil {
+		errs = append(errs, err)
+	} else if _, err := cfg.TenantTokenMap(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if cfg.AlertSNSTopic != "" && !strings.HasPrefix(cfg.AlertSNSTopic, "arn:") {
+		errs = append(errs, fmt.Errorf("alert sns topic [%s] must be a topic ARN", cfg.AlertSNSTopic))
+	}
+	if cfg.AlertWebhookURL != "" {
+		errs = append(errs, fmt.Errorf("the alert webhook (%s, -alert-webhook) has been replaced by signed webhooks; set %s and %s instead",
+			ENV_ALERT_WEBHOOK_URL, ENV_WEBHOOK_URL, ENV_WEBHOOK_SECRET))
+	}
+	if cfg.WebhookURL != "" && len(cfg.WebhookSecret) < webhook.MIN_SECRET_LEN {
+		errs = append(errs, fmt.Errorf("webhooks need a secret of at least %d characters to sign with", webhook.MIN_SECRET_LEN))
+	}
+
+	for idx, token := range cfg.AdminTokens {
+		if len(token) < MIN_ADMIN_TOKEN_LEN {
+			errs = append(errs, fmt.Errorf("admin token %d is shorter than %d characters", idx+1, MIN_ADMIN_TOKEN_LEN))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// the sdk config with our region applied (and placeholder credentials for dynamodb-local)
+func (cfg *Config) AWSConfig(ctx context.Context) (aws.Config, error) {
+	var opts []func(*awsconfig.LoadOptions) error
+	region := cfg.Region
+	if region == "" && cfg.LocalCredentials {
+		region = DEFAULT_LOCAL_REGION
+	}
+	if region != "" {
+		opts = append(opts, awsconfig.WithRegion(region))
+	}
+
+	sdkConfig, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to load default config: %s", err)
+	}
+	return sdkConfig, nil
+}
+
+func (cfg *Config) DynamoDBClient(sdkConfig aws.Config) *dynamodb.Client {
+	return dynamodb.NewFromConfig(sdkConfig, func(o *dynamodb.Options) {
+		if cfg.DynamoDBEndpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.DynamoDBEndpoint)
+		}
+		if cfg.LocalCredentials {
+			o.Credentials = aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+				return aws.Credentials{
+					AccessKeyID:     `fakeMyKeyId`,
+					SecretAccessKey: `fakeSecretAccessKey`,
+				}, nil
+			})
+		}
+	})
+}
+
+func (cfg *Config) S3Client(sdkConfig aws.Config) *s3.Client {
+	return s3.NewFromConfig(sdkConfig, func(o *s3.Options) {
+		if cfg.S3Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.S3Endpoint)
+			o.UsePathStyle = true // minio and friends don't do virtual-hosted buckets
+		}
+	})
+}
+
+// the cipher for the configured key provider; nil (and no error) if passwords aren't encrypted
+func (cfg *Config) NewCipher(ctx context.Context) (*envelope.Cipher, error) {
+	var provider envelope.KeyProvider
+	switch cfg.KeyProvider {
+	case KEY_PROVIDER_NONE:
+		return nil, nil
+	case KEY_PROVIDER_LOCAL:
+		keys, err := envelope.LoadKeyFile(cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		provider = keys
+	case KEY_PROVIDER_KMS:
+		sdkConfig, err := cfg.AWSConfig(ctx)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := envelope.NewKMSKeys(kms.NewFromConfig(sdkConfig), cfg.KMSKeyID)
+		if err != nil {
+			return nil, err
+		}
+		if err := keys.Resolve(ctx); err != nil {
+			return nil, err
+		}
+		provider = keys
+	default:
+		return nil, fmt.Errorf("unknown key provider [%s]", cfg.KeyProvider)
+	}
+	return envelope.NewCipher(provider), nil
+}
+
+// the hasher for the configured lookup key; nil (and no error) if credentials are stored under their
+// plain domain/user
+func (cfg *Config) NewKeyHasher() (*credstore.KeyHasher, error) {
+	if cfg.LookupKey == "" {
+		return nil, nil
+	}
+	secret, err := base64.StdEncoding.DecodeString(cfg.LookupKey)
+	if err != nil {
+		return nil, fmt.Errorf("lookup key isn't valid base64: %s", err)
+	}
+	return credstore.NewKeyHasher(secret)
+}
+
+// the configured tenants; nil (and no error) if there aren't any
+func (cfg *Config) TenantDirectory() (*tenants.Directory, error) {
+	return tenants.Parse(cfg.Tenants)
+}
+
+// each tenant token and the tenant it's for; every tenant must be configured (see Tenants) and no token
+// can be shared with another tenant or be an admin token
+func (cfg *Config) TenantTokenMap() (map[string]string, error) {
+	dir, err := cfg.TenantDirectory()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := map[string]string{}
+	var errs []error
+	for idx, pair := range cfg.TenantTokens {
+		tenant, token, found := strings.Cut(pair, "=")
+		tenant, token = strings.TrimSpace(tenant), strings.TrimSpace(token)
+		switch {
+		case !found || tenant == "" || token == "":
+			errs = append(errs, fmt.Errorf("tenant token %d must be tenant=token", idx+1))
+		case !dir.Has(tenant):
+			errs = append(errs, fmt.Errorf("tenant token %d is for unknown tenant [%s]", idx+1, tenant))
+		case len(token) < MIN_ADMIN_TOKEN_LEN:
+			errs = append(errs, fmt.Errorf("tenant token %d is shorter than %d characters", idx+1, MIN_ADMIN_TOKEN_LEN))
+		case slices.Contains(cfg.AdminTokens, token):
+			errs = append(errs, fmt.Errorf("tenant token %d is also an admin token", idx+1))
+		case ret[token] != "" && ret[token] != tenant:
+			errs = append(errs, fmt.Errorf("tenant token %d is also [%s]'s", idx+1, ret[token]))
+		default:
+			ret[token] = tenant
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return ret, nil
+}
+
+// the configured retention policy; nil (and no error) if credentials are kept forever
+func (cfg *Config) RetentionPolicy() (*retention.Policy, error) {
+	dir, err := cfg.TenantDirectory()
+	if err != nil {
+		return nil, err
+	}
+	domains, err := retention.ParseDomains(cfg.RetentionDomains)
+	if err != nil {
+		return nil, err
+	}
+	tenantPeriods, err := retention.ParseDomains(cfg.RetentionTenants)
+	if err != nil {
+		return nil, err
+	}
+	return retention.New(cfg.Retention, domains, tenantPeriods, dir)
+}
+
+// the configured webhook sender, recording deliveries through cli; nil if webhooks aren't configured
+func (cfg *Config) NewWebhookSender(cli util.DynamoDBAPI) *webhook.Sender {
+	if cfg.WebhookURL == "" {
+		return nil
+	}
+	return webhook.NewSender(cli, cfg.Tables.Deliveries, cfg.WebhookURL, []byte(cfg.WebhookSecret))
+}
+
+// every configured alert destination, webhooks (if set) included; nil (and no error) if there aren't any
+func (cfg *Config) NewNotifier(ctx context.Context, webhooks *webhook.Sender) (alerts.Notifier, error) {
+	var ret alerts.Notifiers
+	if webhooks != nil {
+		ret = append(ret, webhooks)
+	}
+	if cfg.AlertSNSTopic != "" {
+		sdkConfig, err := cfg.AWSConfig(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, &alerts.SNSNotifier{SNS: sns.NewFromConfig(sdkConfig), TopicARN: cfg.AlertSNSTopic})
+	}
+	if cfg.AlertFile != "" {
+		ret = append(ret, &alerts.FileNotifier{Path: cfg.AlertFile})
+	}
+	if len(ret) == 0 {
+		return nil, nil
+	}
+	return ret, nil
+}
+
+// an ingester writing to our tables
+func (cfg *Config) NewIngester(cli util.DynamoDBAPI) *ingest.Ingester {
+	ing := ingest.NewWithTables(cli, cfg.Tables.Ingest(), cfg.TableOptions)
+	ing.Retention, _ = cfg.RetentionPolicy() // checked by Validate
+	return ing
+}
+
+func isTrue(val string) bool {
+	return val == "1" || strings.EqualFold(val, "true")
+}
+
+func splitList(val string) []string {
+	var ret []string
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			ret = append(ret, item)
+		}
+	}
+	return ret
+}
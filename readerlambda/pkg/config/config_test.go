@@ -0,0 +1,279 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write %s: %s", name, err)
+	}
+	return path
+}
+
+// defaults < file < environment < flags
+func Test_Config_Precedence(t *testing.T) {
+	cfgFile := writeFile(t, "config.json", `{
+		"region": "us-west-2",
+		"dynamodbEndpoint": "http://dynamo.file:8000",
+		"tables": {"credentials": "fileCreds", "jobs": "fileJobs"},
+		"corsOrigins": ["https://file.example.com"]
+	}`)
+
+	t.Setenv(ENV_CONFIG_FILE, "")
+	t.Setenv(ENV_TABLE_JOBS, "envJobs")
+	t.Setenv(ENV_CORS_ORIGINS, "https://env.example.com, https://env2.example.com")
+	t.Setenv(ENV_DYNAMODB_ENDPOINT, "")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfgFlags := AddFlags(fs)
+	if err := fs.Parse([]string{"-config", cfgFile, "-table-credentials", "flagCreds", "-bind", "127.0.0.1:9090"}); err != nil {
+		t.Fatalf("failed to parse flags: %s", err)
+	}
+
+	cfg, err := cfgFlags.Load()
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+
+	expect := Default()
+	expect.Region = "us-west-2"                         // file
+	expect.DynamoDBEndpoint = "http://dynamo.file:8000" // file (empty env var doesn't count)
+	expect.Tables.Credentials = "flagCreds"             // flag over file
+	expect.Tables.Jobs = "envJobs"                      // env over file
+	expect.BindAddr = "127.0.0.1:9090"                  // flag over default
+	expect.CORSOrigins = []string{"https://env.example.com", "https://env2.example.com"}
+
+	if cfg.Region != expect.Region || cfg.DynamoDBEndpoint != expect.DynamoDBEndpoint || cfg.Tables != expect.Tables ||
+		cfg.BindAddr != expect.BindAddr || !slices.Equal(cfg.CORSOrigins, expect.CORSOrigins) {
+		t.Errorf("unexpected config:\n got %+v\nwant %+v", cfg, expect)
+	}
+}
+
+func Test_Config_Validate(t *testing.T) {
+	certFile := writeFile(t, "cert.pem", "not really a cert")
+
+	testSet := []struct {
+		Name      string
+		Modify    func(cfg *Config)
+		ExpectErr []string // substrings of the (joined) error
+	}{
+		{Name: "Defaults", Modify: func(cfg *Config) {}},
+		{Name: "Local", Modify: func(cfg *Config) { cfg.UseLocalDynamoDB() }},
+		{
+			Name:      "BadEndpoints",
+			Modify:    func(cfg *Config) { cfg.DynamoDBEndpoint = "localhost:8000"; cfg.S3Endpoint = "ftp://minio" },
+			ExpectErr: []string{"dynamodb endpoint", "s3 endpoint"},
+		},
+		{
+			Name:      "BadTables",
+			Modify:    func(cfg *Config) { cfg.Tables.Jobs = "no"; cfg.Tables.Sources = "bad name!" },
+			ExpectErr: []string{"jobs table name", "sources table name"},
+		},
+		{
+			Name:      "CertWithoutKey",
+			Modify:    func(cfg *Config) { cfg.TLSCertFile = certFile },
+			ExpectErr: []string{"must be given together"},
+		},
+		{
+			Name:      "MissingKeyFile",
+			Modify:    func(cfg *Config) { cfg.TLSCertFile = certFile; cfg.TLSKeyFile = certFile + ".missing" },
+			ExpectErr: []string{"tls file"},
+		},
+		{
+			Name: "BadCORS",
+			Modify: func(cfg *Config) {
+				cfg.CORSOrigins = []string{"https://ok.example.com", "example.com", "https://x.com/path"}
+			},
+			ExpectErr: []string{"[example.com]", "[https://x.com/path]"},
+		},
+		{
+			Name:      "NoCORS",
+			Modify:    func(cfg *Config) { cfg.CORSOrigins = []string{} },
+			ExpectErr: []string{"at least one cors origin"},
+		},
+		{
+			Name:      "BadBind",
+			Modify:    func(cfg *Config) { cfg.BindAddr = "0.0.0.0" },
+			ExpectErr: []string{"bind address"},
+		},
+		{
+			Name:   "LocalKeys",
+			Modify: func(cfg *Config) { cfg.KeyProvider = KEY_PROVIDER_LOCAL; cfg.KeyFile = "keys.json" },
+		},
+		{
+			Name:      "KeyProviderMissingSettings",
+			Modify:    func(cfg *Config) { cfg.KeyProvider = KEY_PROVIDER_KMS },
+			ExpectErr: []string{"kms key id"},
+		},
+		{
+			Name:      "BadKeyProvider",
+			Modify:    func(cfg *Config) { cfg.KeyProvider = "vault" },
+			ExpectErr: []string{"key provider [vault]"},
+		},
+		{
+			Name:      "LookupKeyWithoutKeyProvider",
+			Modify:    func(cfg *Config) { cfg.LookupKey = "c2hvcnQ=" },
+			ExpectErr: []string{"lookup key is 5 bytes", "needs a key provider"},
+		},
+		{
+			Name: "LookupKey",
+			Modify: func(cfg *Config) {
+				cfg.KeyProvider, cfg.KeyFile = KEY_PROVIDER_LOCAL, "keys.json"
+				cfg.LookupKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+			},
+		},
+		{
+			Name:   "Retention",
+			Modify: func(cfg *Config) { cfg.Retention = "2y"; cfg.RetentionDomains = "example.com=90d, example.org=forever" },
+		},
+		{
+			Name:      "BadRetention",
+			Modify:    func(cfg *Config) { cfg.Retention = "-5d"; cfg.RetentionDomains = "example.com=soon" },
+			ExpectErr: []string{"negative", "retention for [example.com]"},
+		},
+		{
+			Name: "TenantRetention",
+			Modify: func(cfg *Config) {
+				cfg.Tenants = "acme=acme.com|acme.co.uk,globex=globex.com"
+				cfg.RetentionTenants = "acme=90d,globex=forever"
+			},
+		},
+		{
+			Name:      "BadTenants",
+			Modify:    func(cfg *Config) { cfg.Tenants = "acme=acme.com,globex=ACME.com"; cfg.RetentionTenants = "acme=90d" },
+			ExpectErr: []string{"both tenant"},
+		},
+		{
+			Name:      "UnknownRetentionTenant",
+			Modify:    func(cfg *Config) { cfg.Tenants = "acme=acme.com"; cfg.RetentionTenants = "initech=90d" },
+			ExpectErr: []string{"unknown tenant [initech]"},
+		},
+		{
+			Name: "Alerts",
+			Modify: func(cfg *Config) {
+				cfg.AlertSNSTopic, cfg.AlertFile = "arn:aws:sns:us-east-1:123456789012:alerts", "alerts.jsonl"
+			},
+		},
+		{
+			Name:      "BadAlerts",
+			Modify:    func(cfg *Config) { cfg.AlertSNSTopic = "alerts" },
+			ExpectErr: []string{"topic ARN"},
+		},
+		{
+			Name: "Webhooks",
+			Modify: func(cfg *Config) {
+				cfg.WebhookURL, cfg.WebhookSecret, cfg.Tables.Deliveries = "https://hooks.example.com/breaches", "0123456789abcdef0123", "deliveries"
+			},
+		},
+		{
+			Name: "BadWebhooks",
+			Modify: func(cfg *Config) {
+				cfg.WebhookURL, cfg.WebhookSecret, cfg.Tables.Deliveries = "hooks.example.com", "short", ""
+			},
+			ExpectErr: []string{"webhook [hooks.example.com]", "secret of at least", "deliveries table"},
+		},
+		{
+			Name:      "OldAlertWebhook",
+			Modify:    func(cfg *Config) { cfg.AlertWebhookURL = "https://hooks.example.com/alerts" },
+			ExpectErr: []string{"ALERT_WEBHOOK_URL", "WEBHOOK_URL and WEBHOOK_SECRET"},
+		},
+		{
+			Name:      "ShortAdminToken",
+			Modify:    func(cfg *Config) { cfg.AdminTokens = []string{"0123456789abcdef0123", "short"} },
+			ExpectErr: []string{"admin token 2"},
+		},
+		{
+			Name: "TenantTokens",
+			Modify: func(cfg *Config) {
+				cfg.Tenants = "acme=acme.com,globex=globex.com"
+				cfg.TenantTokens = []string{"acme=acme-0123456789abcdef", "acme=acme-fedcba9876543210", "globex=globex-0123456789abcdef"}
+			},
+		},
+		{
+			Name: "BadTenantTokens",
+			Modify: func(cfg *Config) {
+				cfg.Tenants = "acme=acme.com,globex=globex.com"
+				cfg.AdminTokens = []string{"admin-0123456789abcdef"}
+				cfg.TenantTokens = []string{
+					"acme-0123456789abcdef", "initech=initech-0123456789abcdef", "acme=short",
+					"acme=admin-0123456789abcdef", "acme=shared-0123456789abcdef", "globex=shared-0123456789abcdef",
+				}
+			},
+			ExpectErr: []string{
+				"tenant token 1 must be tenant=token", "unknown tenant [initech]", "tenant token 3 is shorter",
+				"tenant token 4 is also an admin token", "tenant token 6 is also [acme]'s",
+			},
+		},
+	}
+
+	for _, test := range testSet {
+		t.Run(test.Name, func(t *testing.T) {
+			cfg := Default()
+			test.Modify(cfg)
+
+			err := cfg.Validate()
+			if (err != nil) != (len(test.ExpectErr) > 0) {
+				t.Fatalf("unexpected error state: %v", err)
+			}
+			for _, want := range test.ExpectErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("expected error to mention [%s]: %s", want, err)
+				}
+			}
+		})
+	}
+}
+
+// every way of saying "no origins" fails to load rather than starting an API that can't set up cors
+func Test_Config_EmptyCORS(t *testing.T) {
+	testSet := []struct {
+		Name  string
+		File  string
+		Env   string
+		Flags []string
+	}{
+		{Name: "Flag", Flags: []string{"-cors-origins="}},
+		{Name: "Flag Of Commas", Flags: []string{"-cors-origins", " , "}},
+		{Name: "Env Of Commas", Env: ",,"},
+		{Name: "File", File: `{"corsOrigins": []}`},
+	}
+
+	for _, test := range testSet {
+		t.Run(test.Name, func(t *testing.T) {
+			t.Setenv(ENV_CONFIG_FILE, "")
+			t.Setenv(ENV_CORS_ORIGINS, test.Env)
+
+			args := test.Flags
+			if test.File != "" {
+				args = append(args, "-config", writeFile(t, "config.json", test.File))
+			}
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			cfgFlags := AddFlags(fs)
+			if err := fs.Parse(args); err != nil {
+				t.Fatalf("failed to parse flags: %s", err)
+			}
+
+			if _, err := cfgFlags.Load(); err == nil || !strings.Contains(err.Error(), "at least one cors origin") {
+				t.Errorf("expected no cors origins to be rejected, got %v", err)
+			}
+		})
+	}
+}
+
+func Test_Config_BadFile(t *testing.T) {
+	cfgFile := writeFile(t, "config.json", `{"tabels": {"jobs": "typo"}}`)
+	t.Setenv(ENV_CONFIG_FILE, cfgFile)
+
+	if _, err := FromEnv(); err == nil || !strings.Contains(err.Error(), "tabels") {
+		t.Errorf("expected unknown field to be rejected, got %v", err)
+	}
+}
@@ -6,18 +6,171 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/newodahs/readerlambda/pkg/envelope"
 )
 
+// version of the stored shape of CredentialInfo; bump it (and add a decoder for the old shape in credstore)
+// whenever the stored attributes change in a way old items won't unmarshal into
+//
+//	1 - no schemaVersion attribute: username/domainname/email/password, later with provenance
+//	2 - schemaVersion on every item; password is a list, provenance lines up with it
+//	3 - passwords may be encrypted instead (passwordEnc, see the envelope package)
+//	4 - domainname/username may be HMACs of the canonical values, with the identity sealed in identityEnc
+const CREDENTIAL_SCHEMA_VERSION = 4
+
 type CredentialInfo struct {
 	User     string   `json:"username,omitempty" dynamodbav:"username,omitempty"`
 	Domain   string   `json:"domain,omitempty" dynamodbav:"domainname,omitempty"`
 	Email    string   `json:"email" dynamodbav:"email"`
 	Password []string `json:"password,omitempty" dynamodbav:"password,omitempty"`
+
+	// Provenance[i] describes where/when Password[i] came from; kept as a parallel list so
+	// existing consumers of Password (the UI, mostly) don't have to change
+	Provenance []*Provenance `json:"provenance,omitempty" dynamodbav:"provenance,omitempty"`
+
+	// when passwords are stored encrypted they're sealed here (in the same order) and Password is only
+	// filled in once they're opened; Encrypted tells API callers the passwords were withheld
+	Sealed    *envelope.Envelope `json:"-" dynamodbav:"passwordEnc,omitempty"`
+	Encrypted bool               `json:"encrypted,omitempty" dynamodbav:"-"`
+
+	// when stored under hashed keys, Domain/User hold the hashes until the identity (domain, user, email)
+	// sealed here is opened
+	SealedIdentity *envelope.Envelope `json:"-" dynamodbav:"identityEnc,omitempty"`
+
+	// set when read back: the stored key everything was sealed against (Domain/User may have been replaced
+	// by the opened identity since)
+	SealContext []byte `json:"-" dynamodbav:"-"`
+
+	// when the last of the passwords expires (the table's TTL attribute) and when the first one does (what
+	// the purge looks for); ExpiresAt is unset if any password is kept forever, see UpdateExpiry
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty" dynamodbav:"expiresAt,omitempty,unixtime"`
+	NextExpiry *time.Time `json:"-" dynamodbav:"nextExpiry,omitempty,unixtime"`
+
+	// where remediation of the credential as a whole has got to: the least far along of its passwords'
+	// (see UpdateStatus); stored so it can be filtered on
+	Status RemediationStatus `json:"status,omitempty" dynamodbav:"remediationStatus,omitempty"`
+
+	// how urgent the exposure is (see the severity package); set whenever the credential is stored and by
+	// rescoring, nil for anything stored before scoring existed
+	Severity *Severity `json:"severity,omitempty" dynamodbav:"severity,omitempty"`
+
+	// the version the item was stored as when read back; every write stamps CREDENTIAL_SCHEMA_VERSION
+	SchemaVersion int `json:"-" dynamodbav:"schemaVersion,omitempty"`
+}
+
+// what API callers without access to the plaintext see in place of each sealed password
+const REDACTED_PASSWORD = "********"
+
+// stands in for sealed passwords that weren't opened, keeping Password lined up with Provenance
+func (ci *CredentialInfo) Redact() {
+	if ci.Sealed == nil || len(ci.Password) > 0 {
+		return
+	}
+	ci.Password = make([]string, len(ci.Sealed.Values))
+	for idx := range ci.Password {
+		ci.Password[idx] = REDACTED_PASSWORD
+	}
+	ci.Encrypted = true
+}
+
+// additional data sealed values are bound to (the item's stored key), so they can't be copied onto another
+// credential
+func (ci CredentialInfo) SealingContext() []byte {
+	if ci.SealContext != nil {
+		return ci.SealContext
+	}
+	return []byte(ci.Domain + "\x00" + ci.User)
+}
+
+// where and when we saw a given password for a credential
+type Provenance struct {
+	Bucket     string     `json:"bucket,omitempty" dynamodbav:"bucket,omitempty"`     // set when ingested from S3
+	Key        string     `json:"key,omitempty" dynamodbav:"key,omitempty"`           // set when ingested from S3
+	Filename   string     `json:"filename,omitempty" dynamodbav:"filename,omitempty"` // set when ingested from a local file
+	Line       int        `json:"line,omitempty" dynamodbav:"line,omitempty"`
+	JobID      string     `json:"jobId,omitempty" dynamodbav:"jobId,omitempty"`
+	SourceID   string     `json:"sourceId,omitempty" dynamodbav:"sourceId,omitempty"`     // breach this came from, see the sources package
+	BreachDate *time.Time `json:"breachDate,omitempty" dynamodbav:"breachDate,omitempty"` // the source's, if it was known at ingest
+	FirstSeen  time.Time  `json:"firstSeen" dynamodbav:"firstSeen"`
+	LastSeen   time.Time  `json:"lastSeen" dynamodbav:"lastSeen"`
+
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" dynamodbav:"expiresAt,omitempty"` // per the retention policy; nil keeps it forever
+
+	Remediation *Remediation `json:"remediation,omitempty" dynamodbav:"remediation,omitempty"` // nil until someone looks at it (i.e. new)
+}
+
+// how far the help desk has got with an exposed password
+type RemediationStatus string
+
+const (
+	REMEDIATION_NEW            RemediationStatus = "new"
+	REMEDIATION_ACKNOWLEDGED   RemediationStatus = "acknowledged"
+	REMEDIATION_PASSWORD_RESET RemediationStatus = "password-reset"
+	REMEDIATION_FALSE_POSITIVE RemediationStatus = "false-positive"
+)
+
+// in order of progress (don't modify it); a credential's status is the earliest of its passwords'
+var RemediationOrder = []RemediationStatus{REMEDIATION_NEW, REMEDIATION_ACKNOWLEDGED, REMEDIATION_PASSWORD_RESET, REMEDIATION_FALSE_POSITIVE}
+
+func ParseRemediationStatus(raw string) (RemediationStatus, error) {
+	status := RemediationStatus(strings.ToLower(strings.TrimSpace(raw)))
+	if !slices.Contains(RemediationOrder, status) {
+		return "", fmt.Errorf("remediation status [%s] must be one of %v", raw, RemediationOrder)
+	}
+	return status, nil
+}
+
+// the latest remediation update on a password: who set what, when, and why
+type Remediation struct {
+	Status RemediationStatus `json:"status" dynamodbav:"status"`
+	By     string            `json:"by" dynamodbav:"by"`
+	At     time.Time         `json:"at" dynamodbav:"at"`
+	Notes  string            `json:"notes,omitempty" dynamodbav:"notes,omitempty"`
+}
+
+// how badly exposed a credential is; the score is 0-100, the rest is what it was worked out from
+type Severity struct {
+	Score      int             `json:"score" dynamodbav:"score"`
+	Level      SeverityLevel   `json:"level" dynamodbav:"level"`
+	Storage    PasswordStorage `json:"storage" dynamodbav:"storage"` // the most usable form any of its passwords leaked in
+	LatestLeak time.Time       `json:"latestLeak" dynamodbav:"latestLeak"`
+	Sources    int             `json:"sources" dynamodbav:"sources"`
+	Privileged bool            `json:"privileged,omitempty" dynamodbav:"privileged,omitempty"` // an admin/role account by its name
+	Reuse      int             `json:"reuse" dynamodbav:"reuse"`                               // other accounts in the domain sharing one of its passwords, as of the last rescore
+	ScoredAt   time.Time       `json:"scoredAt" dynamodbav:"scoredAt"`
+}
+
+type SeverityLevel string
+
+const (
+	SEVERITY_LOW      SeverityLevel = "low"
+	SEVERITY_MEDIUM   SeverityLevel = "medium"
+	SEVERITY_HIGH     SeverityLevel = "high"
+	SEVERITY_CRITICAL SeverityLevel = "critical"
+)
+
+// the form a password leaked in
+type PasswordStorage string
+
+const (
+	STORAGE_PLAINTEXT   PasswordStorage = "plaintext"
+	STORAGE_WEAK_HASH   PasswordStorage = "weak-hash"   // fast or unsalted (md5, sha1, ntlm, ...); as good as plaintext for most passwords
+	STORAGE_STRONG_HASH PasswordStorage = "strong-hash" // slow and salted (bcrypt, argon2, ...)
+)
+
+// a password nobody has looked at yet is new
+func (prov *Provenance) RemediationStatus() RemediationStatus {
+	if prov == nil || prov.Remediation == nil {
+		return REMEDIATION_NEW
+	}
+	return prov.Remediation.Status
 }
 
 func (ci CredentialInfo) String() string {
@@ -51,6 +204,7 @@ func (ci CredentialInfo) GetKeySchema() []types.KeySchemaElement {
 }
 
 func (ci CredentialInfo) GetKey() map[string]types.AttributeValue {
+	ci.SchemaVersion = CREDENTIAL_SCHEMA_VERSION
 	ret, err := attributevalue.MarshalMap(ci)
 	if err != nil {
 		panic(err) //TODO: I don't like panicing in library functions
@@ -58,7 +212,163 @@ func (ci CredentialInfo) GetKey() map[string]types.AttributeValue {
 	return ret
 }
 
-func GetCredentialInfoFile(filename string) (map[string]*CredentialInfo, error) {
+// adds passwd to the credential if we don't already have it; if we do, the existing provenance
+// is widened so FirstSeen/LastSeen cover both sightings (the original file/line are kept)
+//
+// returns true if the password was new for this credential
+func (ci *CredentialInfo) AddPassword(passwd string, prov *Provenance) bool {
+	ci.AlignProvenance()
+	if prov == nil {
+		prov = &Provenance{}
+	}
+
+	for idx, existing := range ci.Password {
+		if existing != passwd {
+			continue
+		}
+
+		cur := ci.Provenance[idx]
+		if cur.FirstSeen.IsZero() || (!prov.FirstSeen.IsZero() && prov.FirstSeen.Before(cur.FirstSeen)) {
+			cur.FirstSeen = prov.FirstSeen
+		}
+		if prov.LastSeen.After(cur.LastSeen) {
+			cur.LastSeen = prov.LastSeen
+		}
+		// seen again in a later breach; keep it as long as that one says, which may be forever (no expiry)
+		if cur.ExpiresAt != nil && (prov.ExpiresAt == nil || prov.ExpiresAt.After(*cur.ExpiresAt)) {
+			cur.ExpiresAt = prov.ExpiresAt
+		}
+		return false
+	}
+
+	ci.Password = append(ci.Password, passwd)
+	ci.Provenance = append(ci.Provenance, prov)
+	return true
+}
+
+// folds the passwords (and their provenance) from other into ci; returns the number of passwords that were new
+func (ci *CredentialInfo) Merge(other *CredentialInfo) int {
+	if other == nil {
+		return 0
+	}
+	other.AlignProvenance()
+
+	added := 0
+	for idx, passwd := range other.Password {
+		prov := *other.Provenance[idx] // copy so the two credentials don't share entries
+		if ci.AddPassword(passwd, &prov) {
+			added++
+		}
+	}
+	return added
+}
+
+// recomputes Status from the passwords' remediation; a new password puts the whole credential back to new
+func (ci *CredentialInfo) UpdateStatus() {
+	ci.AlignProvenance()
+	ci.Status = ""
+	if len(ci.Provenance) == 0 {
+		return
+	}
+	earliest := len(RemediationOrder) - 1
+	for _, prov := range ci.Provenance {
+		if idx := slices.Index(RemediationOrder, prov.RemediationStatus()); idx >= 0 && idx < earliest {
+			earliest = idx
+		}
+	}
+	ci.Status = RemediationOrder[earliest]
+}
+
+// recomputes ExpiresAt/NextExpiry from the passwords' expiry; a password without one is kept forever, and
+// so is the credential (though NextExpiry still says when its first expiring password goes)
+func (ci *CredentialInfo) UpdateExpiry() {
+	ci.AlignProvenance()
+	ci.ExpiresAt, ci.NextExpiry = nil, nil
+	forever := false
+	for _, prov := range ci.Provenance {
+		if prov.ExpiresAt == nil {
+			forever = true
+			continue
+		}
+		if ci.ExpiresAt == nil || prov.ExpiresAt.After(*ci.ExpiresAt) {
+			ci.ExpiresAt = prov.ExpiresAt
+		}
+		if ci.NextExpiry == nil || prov.ExpiresAt.Before(*ci.NextExpiry) {
+			ci.NextExpiry = prov.ExpiresAt
+		}
+	}
+	if forever {
+		ci.ExpiresAt = nil // the credential is kept, but its expiring passwords still go
+	}
+}
+
+// removes every password (plaintext or still sealed) that expired at or before now, along with its
+// provenance, and updates the credential's expiry; returns how many were removed
+func (ci *CredentialInfo) DropExpired(now time.Time) int {
+	ci.AlignProvenance()
+	if ci.Sealed != nil && len(ci.Sealed.Values) != len(ci.Provenance) {
+		return 0 // can't tell which sealed value is which; leave it for dynamodb's TTL
+	}
+
+	var keep []int
+	for idx, prov := range ci.Provenance {
+		if prov.ExpiresAt == nil || prov.ExpiresAt.After(now) {
+			keep = append(keep, idx)
+		}
+	}
+	dropped := len(ci.Provenance) - len(keep)
+	if dropped == 0 {
+		return 0
+	}
+
+	provenance := make([]*Provenance, 0, len(keep))
+	var passwords []string
+	var sealed [][]byte
+	for _, idx := range keep {
+		provenance = append(provenance, ci.Provenance[idx])
+		if idx < len(ci.Password) {
+			passwords = append(passwords, ci.Password[idx])
+		}
+		if ci.Sealed != nil {
+			sealed = append(sealed, ci.Sealed.Values[idx])
+		}
+	}
+	ci.Provenance, ci.Password = provenance, passwords
+	if ci.Sealed != nil {
+		ci.Sealed = &envelope.Envelope{Key: ci.Sealed.Key, Values: sealed} // the rest are still sealed under the same key and context
+	}
+	ci.UpdateExpiry()
+	ci.UpdateStatus()
+	return dropped
+}
+
+// items written before provenance existed only have the password list; pad so the two line up
+func (ci *CredentialInfo) AlignProvenance() {
+	for len(ci.Provenance) < len(ci.Password) {
+		ci.Provenance = append(ci.Provenance, &Provenance{})
+	}
+	for idx, prov := range ci.Provenance {
+		if prov == nil {
+			ci.Provenance[idx] = &Provenance{}
+		}
+	}
+}
+
+// fills in the caller-known provenance (bucket/key or filename, job, timestamps) on every password
+// in credList; line numbers come from the parser and are left alone
+func StampProvenance(credList map[string]*CredentialInfo, tmpl Provenance) {
+	for _, cred := range credList {
+		cred.AlignProvenance()
+		for _, prov := range cred.Provenance {
+			line := prov.Line
+			*prov = tmpl
+			prov.Line = line
+		}
+	}
+}
+
+// parses filename and stamps each password with the filename and the current time; jobID may be empty
+func GetCredentialInfoFile(filename, jobID string) (map[string]*CredentialInfo, error) {
 
 	credFile, fErr := os.Open(filename)
 	if fErr != nil {
@@ -66,7 +376,12 @@ func GetCredentialInfoFile(filename string) (map[string]*CredentialInfo, error)
 	}
 	defer credFile.Close()
 
-	return GetCredentialInfo(bufio.NewScanner(credFile))
+	credList, err := GetCredentialInfo(bufio.NewScanner(credFile))
+
+	now := time.Now().UTC()
+	StampProvenance(credList, Provenance{Filename: filename, JobID: jobID, FirstSeen: now, LastSeen: now})
+
+	return credList, err
 }
 
 // refactored to these regexes but not a lot of time to test them; cursory testing shows they do what I need though
@@ -77,81 +392,153 @@ var (
 
 var ErrBadParameter = errors.New("bad parameter passed")
 
+// why a line was thrown out; these end up as counters on ingest jobs and in rejects files so keep them stable
+type RejectReason string
+
+const (
+	REJECT_DUPLICATE   RejectReason = "duplicate"   // exact same line already seen in this input
+	REJECT_UNPARSEABLE RejectReason = "unparseable" // didn't match either line format
+	REJECT_NO_EMAIL    RejectReason = "no-email"    // matched, but the email field is missing a user or domain
+)
+
+// a rejected line; GetCredentialInfo joins these together so callers can errors.As/unwrap them for details
+type ParseError struct {
+	Line   int          `json:"line"`
+	Raw    string       `json:"raw"`
+	Reason RejectReason `json:"reason"`
+	msg    string
+}
+
+func (pe *ParseError) Error() string {
+	return pe.msg
+}
+
+// returns every *ParseError wrapped up in err (as joined by GetCredentialInfo)
+func ParseErrors(err error) []*ParseError {
+	if err == nil {
+		return nil
+	}
+
+	if pe, ok := err.(*ParseError); ok {
+		return []*ParseError{pe}
+	}
+
+	var ret []*ParseError
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, wrapped := range joined.Unwrap() {
+			ret = append(ret, ParseErrors(wrapped)...)
+		}
+	}
+	return ret
+}
+
+// line-at-a-time parser; GetCredentialInfo is the simple wrapper around this, the ingest pipeline
+// uses it directly so it can flush credentials out in batches instead of holding a whole dump in memory
+type Parser struct {
+	credList map[string]*CredentialInfo
+	dupChk   map[string]struct{} //for ignoring duplicates..
+
+	LinesRead int
+	Accepted  int
+	Rejected  map[RejectReason]int
+}
+
+func NewParser() *Parser {
+	return &Parser{
+		credList: map[string]*CredentialInfo{},
+		dupChk:   map[string]struct{}{},
+		Rejected: map[RejectReason]int{},
+	}
+}
+
+func (p *Parser) reject(reason RejectReason, cur string, lineCnt int, msg string) error {
+	p.Rejected[reason]++
+	return &ParseError{Line: lineCnt, Raw: cur, Reason: reason, msg: msg}
+}
+
+// parses a single line; returns a *ParseError if the line was rejected
+func (p *Parser) ParseLine(lineCnt int, cur string) error {
+	p.LinesRead++
+
+	if _, exists := p.dupChk[cur]; exists {
+		return p.reject(REJECT_DUPLICATE, cur, lineCnt, fmt.Sprintf("duplicate found; already processed [%s] (duplicate @ line [%d])", cur, lineCnt))
+	}
+	p.dupChk[cur] = struct{}{}
+
+	var email, passwd string
+	// split the line apart
+	if splitLine := passwordNormRegex.FindAllStringSubmatch(cur, -1); splitLine == nil {
+		// try the backward regex as this may be out of expected order
+		if splitLine = passwordBackwardRegex.FindAllStringSubmatch(cur, -1); splitLine == nil {
+			return p.reject(REJECT_UNPARSEABLE, cur, lineCnt, fmt.Sprintf("failed to parse credentials [%s] at line [%d]", cur, lineCnt))
+		}
+		email = splitLine[0][2]
+		passwd = splitLine[0][1]
+	} else {
+		email = splitLine[0][1]
+		passwd = splitLine[0][2]
+	}
+
+	// with the change to regex, we don't need to have complicated logic here, we can just call split once...
+	username, domain := splitEmailUserDomain(email)
+	if username == "" || domain == "" {
+		return p.reject(REJECT_NO_EMAIL, cur, lineCnt, fmt.Sprintf("failed to find username and password from credential [%s] at line [%d]; could not determine email field", cur, lineCnt))
+	}
+
+	p.Accepted++
+
+	//see if we already processed this entry...
+	if _, exists := p.credList[email]; exists {
+		p.credList[email].AddPassword(passwd, &Provenance{Line: lineCnt})
+		return nil
+	}
+
+	p.credList[email] = &CredentialInfo{User: username, Domain: domain, Email: email, Password: []string{passwd}, Provenance: []*Provenance{{Line: lineCnt}}}
+	return nil
+}
+
+// records line as seen without parsing it (e.g. it was read by an earlier invocation working through the
+// same input), so the same line turning up again is rejected as a duplicate
+func (p *Parser) Remember(line string) {
+	p.dupChk[line] = struct{}{}
+}
+
+// the credentials parsed since the parser was created (or last flushed)
+func (p *Parser) Credentials() map[string]*CredentialInfo {
+	return p.credList
+}
+
+// number of distinct credentials currently held
+func (p *Parser) Pending() int {
+	return len(p.credList)
+}
+
+// hands back the credentials parsed so far and starts a fresh batch; duplicate line tracking is kept
+// so a line repeated across batches is still rejected
+func (p *Parser) Flush() map[string]*CredentialInfo {
+	ret := p.credList
+	p.credList = map[string]*CredentialInfo{}
+	return ret
+}
+
 // trying to keep this as simple as possible
 func GetCredentialInfo(scanner *bufio.Scanner) (map[string]*CredentialInfo, error) {
 	if scanner == nil {
 		return nil, ErrBadParameter
 	}
 
-	//for ignoring duplicates..
-	credList := map[string]*CredentialInfo{}
-	dupChk := map[string]struct{}{}
-
-	// var ret []*CredentialInfo
+	p := NewParser()
 	var runningErr error
 	for lineCnt := 1; scanner.Scan(); lineCnt++ {
-		cur := scanner.Text()
-
-		if _, exists := dupChk[cur]; exists {
-			runningErr = errors.Join(runningErr, fmt.Errorf("duplicate found; already processed [%s] (duplicate @ line [%d])", cur, lineCnt))
-			continue
+		if lineErr := p.ParseLine(lineCnt, scanner.Text()); lineErr != nil {
+			runningErr = errors.Join(runningErr, lineErr)
 		}
-		dupChk[cur] = struct{}{}
-
-		var email, passwd string
-		// split the line apart
-		if splitLine := passwordNormRegex.FindAllStringSubmatch(cur, -1); splitLine == nil {
-			// try the backward regex as this may be out of expected order
-			if splitLine = passwordBackwardRegex.FindAllStringSubmatch(cur, -1); splitLine == nil {
-				runningErr = errors.Join(runningErr, fmt.Errorf("failed to parse credentials [%s] at line [%d]", cur, lineCnt))
-				continue
-			}
-			email = splitLine[0][2]
-			passwd = splitLine[0][1]
-		} else {
-			email = splitLine[0][1]
-			passwd = splitLine[0][2]
-		}
-
-		// TODO: Remove; old logic pre-regex change
-		//some of this data isn't well formed (mostly it appears colon separated, however, sometimes it's semi-colon, comma, or even in one case, three tildes)
-		//in the future we could refactor to use a regex for an email to help improve consistency
-		// idx, offset := findPasswordIdx(cur)
-		// if idx == 0 && offset == 0 {
-		// 	runningErr = errors.Join(runningErr, fmt.Errorf("failed to parse credentials [%s] at line [%d]", cur, lineCnt))
-		// 	continue
-		// }
-		// we assume the email is in position 1, if it's not we need to swap these
-		// email := cur[:idx]
-		// passwd := cur[idx+offset:]
-
-		// with the change to regex, we don't need to have complicated logic here, we can just call split once...
-		username, domain := splitEmailUserDomain(email) // try the split, swap if not successful
-		if username == "" || domain == "" {
-			runningErr = errors.Join(runningErr, fmt.Errorf("failed to find username and password from credential [%s] at line [%d]; could not determine email field", cur, lineCnt))
-			continue
-
-			// TODO: Remove; old logic pre-regex change
-			// 	//swap the email and password, they may be in reverse order
-			// 	tmp := email
-			// 	email = passwd
-			// 	passwd = tmp
-			// 	if username, domain = splitEmailUserDomain(email); username == "" || domain == "" {
-			// 		runningErr = errors.Join(runningErr, fmt.Errorf("failed to find username and password from credential [%s] at line [%d]; could not determine email field", cur, lineCnt))
-			// 		continue
-			// 	}
-		}
-
-		//see if we already processed this entry...
-		if _, exists := credList[email]; exists { // TODO: filter out duplicate passwords?
-			credList[email].Password = append(credList[email].Password, passwd)
-			continue
-		}
-
-		credList[email] = &CredentialInfo{User: username, Domain: domain, Email: email, Password: []string{passwd}}
+	}
+	if scanErr := scanner.Err(); scanErr != nil {
+		runningErr = errors.Join(runningErr, fmt.Errorf("failed while reading credentials: %w", scanErr))
 	}
 
-	return credList, runningErr
+	return p.Credentials(), runningErr
 }
 
 func splitEmailUserDomain(email string) (user, domain string) {
@@ -166,28 +553,3 @@ func splitEmailUserDomain(email string) (user, domain string) {
 
 	return email[:idx], email[idx+1:]
 }
-
-// TODO: Remove; old logic pre-regex change
-// func findPasswordIdx(cred string) (index int, offset int) {
-// 	idx := strings.Index(cred, `:`)
-// 	if idx > 0 {
-// 		return idx, 1
-// 	}
-
-// 	idx = strings.Index(cred, `;`)
-// 	if idx > 0 {
-// 		return idx, 1
-// 	}
-
-// 	idx = strings.Index(cred, `,`)
-// 	if idx > 0 {
-// 		return idx, 1
-// 	}
-
-// 	idx = strings.Index(cred, `~~~`)
-// 	if idx > 0 {
-// 		return idx, 3
-// 	}
-
-// 	return 0, 0
-// }
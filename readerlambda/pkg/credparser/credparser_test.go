@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"strings"
 	"testing"
+	"time"
 )
 
 // I normally write a lot more unit tests than this, but as this is a throw-away challenge
@@ -144,3 +145,55 @@ func Test_CredentialParser_DirectString(t *testing.T) {
 		}
 	}
 }
+
+// provenance is the caller's business except for line numbers, so make sure those line up with the
+// passwords and that merging keeps the earliest first-seen and latest last-seen
+func Test_CredentialParser_Provenance(t *testing.T) {
+	creds := []string{"testName@blah.com:somePassword", "garbage line", "testName@blah.com;otherPassword", "testName@blah.com:somePassword "}
+
+	credList, _ := GetCredentialInfo(bufio.NewScanner(strings.NewReader(strings.Join(creds, "\n"))))
+	cred, found := credList["testName@blah.com"]
+	if !found {
+		t.Fatalf("missing expected credential for [testName@blah.com]")
+	}
+
+	if len(cred.Provenance) != len(cred.Password) {
+		t.Fatalf("provenance count (%d) does not match password count (%d)", len(cred.Provenance), len(cred.Password))
+	}
+	expectLines := []int{1, 3, 4}
+	for idx, line := range expectLines {
+		if cred.Provenance[idx].Line != line {
+			t.Errorf("password [%s] has line %d, expected %d", cred.Password[idx], cred.Provenance[idx].Line, line)
+		}
+	}
+
+	first := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	StampProvenance(credList, Provenance{Filename: "first.txt", JobID: "job1", FirstSeen: first, LastSeen: first})
+	if cred.Provenance[1].Filename != "first.txt" || cred.Provenance[1].Line != 3 {
+		t.Errorf("stamped provenance lost filename or line: %+v", cred.Provenance[1])
+	}
+
+	second := first.Add(24 * time.Hour)
+	again := &CredentialInfo{User: "testName", Domain: "blah.com", Email: "testName@blah.com", Password: []string{"somePassword", "brandNew"},
+		Provenance: []*Provenance{{Filename: "second.txt", Line: 9, FirstSeen: second, LastSeen: second}, {Filename: "second.txt", Line: 10, FirstSeen: second, LastSeen: second}}}
+
+	if added := cred.Merge(again); added != 1 {
+		t.Errorf("merge reported %d new passwords, expected 1", added)
+	}
+	if len(cred.Password) != 4 {
+		t.Fatalf("expected 4 passwords after merge, got %d", len(cred.Password))
+	}
+	if prov := cred.Provenance[0]; !prov.FirstSeen.Equal(first) || !prov.LastSeen.Equal(second) || prov.Filename != "first.txt" {
+		t.Errorf("merged provenance not widened correctly: %+v", prov)
+	}
+	if prov := cred.Provenance[3]; prov.Filename != "second.txt" || prov.Line != 10 {
+		t.Errorf("new password provenance not carried over: %+v", prov)
+	}
+
+	// legacy items (no provenance stored) should still merge cleanly
+	legacy := &CredentialInfo{Email: "testName@blah.com", Password: []string{"old"}}
+	legacy.Merge(cred)
+	if len(legacy.Provenance) != len(legacy.Password) {
+		t.Errorf("legacy merge left provenance (%d) and passwords (%d) misaligned", len(legacy.Provenance), len(legacy.Password))
+	}
+}
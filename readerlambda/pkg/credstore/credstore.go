@@ -0,0 +1,310 @@
+package credstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/envelope"
+	"github.com/newodahs/readerlambda/pkg/severity"
+	"github.com/newodahs/readerlambda/pkg/util"
+)
+
+const DYNDB_TABLE_EXPLOITCRED = `exploitedCredentials`
+
+// pulls a single credential by its stored key (see KeyHasher); returns nil (and no error) if it isn't stored
+func GetCredential(ctx context.Context, cli util.DynamoDBAPI, tableName, domain, user string) (*credparser.CredentialInfo, error) {
+	if cli == nil {
+		return nil, errors.New("passed dynamodb client was nil")
+	}
+
+	res, err := cli.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key:       credentialKeyItem(CredentialKey{Domain: domain, User: user}),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get credential [%s@%s]: %s", user, domain, err)
+	}
+
+	if len(res.Item) == 0 {
+		return nil, nil
+	}
+
+	cred, decodeErr := DecodeCredential(res.Item)
+	if decodeErr != nil {
+		return nil, fmt.Errorf("failed to unmarshal credential [%s@%s]: %s", user, domain, decodeErr)
+	}
+
+	return cred, nil
+}
+
+// how many times StoreCredential re-reads a credential that changed underneath it before giving up
+const storeAttempts = 5
+
+// writes cred to the table, merging with anything already stored under the same key so we keep
+// passwords (and their provenance) from earlier dumps rather than overwriting them; with a cipher the
+// passwords are stored encrypted (which means opening what's already stored to merge with it), with keys
+// it's stored under hashed keys (see EncodeCredential), without them cred's domain/user are canonicalised in
+// place so it's stored under the same key however a dump cased it. the merged credential is scored as it's written
+//
+// only written if nothing else (another ingest, a remediation update) changed the credential since we read
+// it; if something did it's read again and merged again
+//
+// returns the number of passwords that were not already stored
+func StoreCredential(ctx context.Context, cli util.DynamoDBAPI, tableName string, cipher *envelope.Cipher, keys *KeyHasher, cred *credparser.CredentialInfo) (int, error) {
+	if cred == nil {
+		return 0, errors.New("nil credential passed to StoreCredential")
+	}
+	if cli == nil {
+		return 0, errors.New("passed dynamodb client was nil")
+	}
+
+	if keys == nil {
+		cred.Domain, cred.User = CanonicalIdentity(cred.Domain, cred.User) // Email keeps however it was written
+	}
+	key := keys.Key(cred.Domain, cred.User)
+	for attempt := 0; attempt < storeAttempts; attempt++ {
+		res, getErr := cli.GetItem(ctx, &dynamodb.GetItemInput{TableName: aws.String(tableName), Key: credentialKeyItem(key), ConsistentRead: aws.Bool(true)})
+		if getErr != nil {
+			return 0, fmt.Errorf("failed to get credential [%s]: %s", cred.Email, getErr)
+		}
+
+		toStore := cred
+		added := len(cred.Password)
+		put := &dynamodb.PutItemInput{ConditionExpression: aws.String("attribute_not_exists(domainname)")} // nobody stored it first
+		if len(res.Item) > 0 {
+			existing, decodeErr := DecodeCredential(res.Item)
+			if decodeErr != nil {
+				return 0, fmt.Errorf("failed to unmarshal credential [%s]: %s", cred.Email, decodeErr)
+			}
+			if openErr := OpenCredential(ctx, cipher, existing); openErr != nil {
+				return 0, openErr
+			}
+			added = existing.Merge(cred)
+			toStore = existing
+			put = storedUnchanged(res.Item)
+		}
+		toStore.UpdateExpiry()
+		toStore.UpdateStatus()
+		severity.Update(toStore, time.Now())
+
+		item, encErr := EncodeCredential(ctx, cipher, keys, toStore)
+		if encErr != nil {
+			return 0, encErr
+		}
+
+		put.TableName = aws.String(tableName)
+		put.Item = item
+		_, putErr := cli.PutItem(ctx, put)
+		var condFailed *types.ConditionalCheckFailedException
+		if errors.As(putErr, &condFailed) {
+			continue // stored (or changed) by someone else since we read it; merge with theirs
+		}
+		if putErr != nil {
+			return 0, fmt.Errorf("failed to store credential [%s]: %s", cred.Email, putErr)
+		}
+		return added, nil
+	}
+	return 0, fmt.Errorf("credential [%s] kept changing while storing it; gave up after %d attempts", cred.Email, storeAttempts)
+}
+
+// a put conditional on item still being as we read it (the caller fills in the table and what to write); its
+// provenance changes with every password added and every remediation update (items from before provenance
+// have none until they're written)
+func storedUnchanged(item map[string]types.AttributeValue) *dynamodb.PutItemInput {
+	prov, found := item["provenance"]
+	if !found {
+		return &dynamodb.PutItemInput{ConditionExpression: aws.String("attribute_exists(domainname) AND attribute_not_exists(provenance)")}
+	}
+	return &dynamodb.PutItemInput{
+		ConditionExpression:       aws.String("#prov = :prov"),
+		ExpressionAttributeNames:  map[string]string{"#prov": "provenance"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":prov": prov},
+	}
+}
+
+// identifies a credential by its table key
+type CredentialKey struct {
+	Domain string `json:"domain"`
+	User   string `json:"user"`
+}
+
+func credentialKeyItem(key CredentialKey) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"domainname": &types.AttributeValueMemberS{Value: key.Domain},
+		"username":   &types.AttributeValueMemberS{Value: key.User},
+	}
+}
+
+// dynamodb caps BatchGetItem at 100 keys
+const batchGetLimit = 100
+
+// how long batchGet waits before asking again for keys dynamodb didn't get to (doubling each time, up to
+// batchGetMaxDelay), and how many times it asks before giving up
+var (
+	batchGetBaseDelay = 50 * time.Millisecond
+	batchGetMaxDelay  = 5 * time.Second
+)
+
+const batchGetAttempts = 10
+
+// reads keys (no more than batchGetLimit, no duplicates) from tableName, handing each item found to found;
+// dynamodb may hand back unprocessed keys under load, so those are asked for again with a backoff. what
+// names the items in errors
+func batchGet(ctx context.Context, cli util.DynamoDBAPI, tableName, what string, keys []map[string]types.AttributeValue, found func(item map[string]types.AttributeValue)) error {
+	pending := map[string]types.KeysAndAttributes{tableName: {Keys: keys}}
+	delay := batchGetBaseDelay
+	for attempt := 0; len(pending) > 0; attempt++ {
+		if attempt > 0 {
+			if attempt >= batchGetAttempts {
+				return fmt.Errorf("dynamodb still hadn't read %d %s after %d attempts", len(pending[tableName].Keys), what, batchGetAttempts)
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+			delay = min(delay*2, batchGetMaxDelay)
+		}
+
+		res, err := cli.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{RequestItems: pending})
+		if err != nil {
+			return fmt.Errorf("failed during BatchGetItem on %s: %s", what, err)
+		}
+		for _, item := range res.Responses[tableName] {
+			found(item)
+		}
+		pending = res.UnprocessedKeys
+	}
+	return nil
+}
+
+// fetches every credential in keys; keys that aren't stored are simply missing from the result
+//
+// returns the credentials found and a count of items that failed to unmarshal
+func BatchGetCredentials(ctx context.Context, cli util.DynamoDBAPI, tableName string, keys []CredentialKey) ([]*credparser.CredentialInfo, int, error) {
+	if cli == nil {
+		return nil, 0, errors.New("passed dynamodb client was nil")
+	}
+
+	var ret []*credparser.CredentialInfo
+	errCount := 0
+	for start := 0; start < len(keys); start += batchGetLimit {
+		end := min(start+batchGetLimit, len(keys))
+
+		var reqKeys []map[string]types.AttributeValue
+		for _, key := range keys[start:end] {
+			reqKeys = append(reqKeys, credentialKeyItem(key))
+		}
+
+		if err := batchGet(ctx, cli, tableName, "credentials", reqKeys, func(item map[string]types.AttributeValue) {
+			cred, decodeErr := DecodeCredential(item)
+			if decodeErr != nil {
+				errCount++
+				return
+			}
+			ret = append(ret, cred)
+		}); err != nil {
+			return nil, errCount, err
+		}
+	}
+
+	return ret, errCount, nil
+}
+
+// every credential stored for domain, or just user's there if user isn't empty (hashed with keys, as they were
+// stored), reading every page. with a status only credentials at it come back; that's a filter on the query so
+// dynamodb doesn't send the rest (credentials stored before remediation existed have no status and count as new)
+//
+// returns a count of items that failed to unmarshal
+func QueryCompromised(ctx context.Context, cli util.DynamoDBAPI, tableName string, keys *KeyHasher, domain, user string, status credparser.RemediationStatus) ([]*credparser.CredentialInfo, int, error) {
+	if cli == nil {
+		return nil, 0, errors.New("passed dynamodb client was nil")
+	}
+
+	keyCond := expression.Key("domainname").Equal(expression.Value(keys.DomainKey(domain)))
+	if user != "" {
+		key := keys.Key(domain, user)
+		keyCond = expression.Key("domainname").Equal(expression.Value(key.Domain)).And(expression.Key("username").Equal(expression.Value(key.User)))
+	}
+	builder := expression.NewBuilder().WithKeyCondition(keyCond)
+	if status != "" {
+		filter := expression.Name(ATTR_REMEDIATION_STATUS).Equal(expression.Value(string(status)))
+		if status == credparser.REMEDIATION_NEW {
+			filter = filter.Or(expression.Name(ATTR_REMEDIATION_STATUS).AttributeNotExists())
+		}
+		builder = builder.WithFilter(filter)
+	}
+	expr, err := builder.Build()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to build query expression: %s", err)
+	}
+
+	var ret []*credparser.CredentialInfo
+	errCount := 0
+	paginator := dynamodb.NewQueryPaginator(cli, &dynamodb.QueryInput{
+		TableName:                 aws.String(tableName),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, errCount, fmt.Errorf("failed to query credentials for [%s]: %s", domain, err)
+		}
+		for _, item := range page.Items {
+			cred, decodeErr := DecodeCredential(item) // upgrades items stored at older schema versions
+			if decodeErr != nil {
+				errCount++
+				continue
+			}
+			if status != "" && cred.Status != status {
+				continue // stored before its status was kept up to date; what it decodes to is what counts
+			}
+			ret = append(ret, cred)
+		}
+	}
+	return ret, errCount, nil
+}
+
+// calls fn with every credential stored for domain (hashed with keys, as it was stored), a page at a time;
+// stops at the first error fn returns
+//
+// returns a count of items that failed to unmarshal
+func QueryDomain(ctx context.Context, cli util.DynamoDBAPI, tableName string, keys *KeyHasher, domain string, fn func(*credparser.CredentialInfo) error) (int, error) {
+	if cli == nil {
+		return 0, errors.New("passed dynamodb client was nil")
+	}
+
+	errCount := 0
+	paginator := dynamodb.NewQueryPaginator(cli, &dynamodb.QueryInput{
+		TableName:                 aws.String(tableName),
+		KeyConditionExpression:    aws.String("domainname = :d"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":d": &types.AttributeValueMemberS{Value: keys.DomainKey(domain)}},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return errCount, fmt.Errorf("failed to query credentials for [%s]: %s", domain, err)
+		}
+		for _, item := range page.Items {
+			cred, decodeErr := DecodeCredential(item)
+			if decodeErr != nil {
+				errCount++
+				continue
+			}
+			if err := fn(cred); err != nil {
+				return errCount, err
+			}
+		}
+	}
+	return errCount, nil
+}
@@ -0,0 +1,1281 @@
+package credstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/newodahs/readerlambda/pkg/awsfake"
+	"github.com/newodahs/readerlambda/pkg/canary"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/envelope"
+	"github.com/newodahs/readerlambda/pkg/retention"
+	"github.com/newodahs/readerlambda/pkg/sources"
+	"github.com/newodahs/readerlambda/pkg/util"
+	"github.com/newodahs/readerlambda/pkg/watchlist"
+)
+
+func str(val string) types.AttributeValue { return &types.AttributeValueMemberS{Value: val} }
+
+func Test_DecodeCredential(t *testing.T) {
+	seen := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	current := credparser.CredentialInfo{User: "first", Domain: "example.com", Email: "first@example.com"}
+	current.AddPassword("hunter2", &credparser.Provenance{Filename: "dump.txt", Line: 3, FirstSeen: seen, LastSeen: seen})
+
+	testSet := []struct {
+		Name            string
+		Item            map[string]types.AttributeValue
+		ExpectErr       bool
+		ExpectVersion   int
+		ExpectEmail     string
+		ExpectPasswords []string
+		ExpectFilenames []string // one per password
+	}{
+		{
+			Name:            "Current",
+			Item:            current.GetKey(),
+			ExpectVersion:   credparser.CREDENTIAL_SCHEMA_VERSION,
+			ExpectEmail:     "first@example.com",
+			ExpectPasswords: []string{"hunter2"},
+			ExpectFilenames: []string{"dump.txt"},
+		},
+		{
+			Name: "Original", // as the very first version of the lambda wrote them
+			Item: map[string]types.AttributeValue{
+				"username": str("first"), "domainname": str("example.com"), "email": str("first@example.com"),
+				"password": &types.AttributeValueMemberL{Value: []types.AttributeValue{str("a"), str("b")}},
+			},
+			ExpectVersion:   1,
+			ExpectEmail:     "first@example.com",
+			ExpectPasswords: []string{"a", "b"},
+			ExpectFilenames: []string{"", ""},
+		},
+		{
+			Name: "HandLoaded", // single password, no email, provenance that doesn't fit
+			Item: map[string]types.AttributeValue{
+				"username": str("first"), "domainname": str("example.com"),
+				"password": str("solo"),
+				"provenance": &types.AttributeValueMemberL{Value: []types.AttributeValue{
+					&types.AttributeValueMemberM{Value: map[string]types.AttributeValue{"line": str("not a number")}},
+					&types.AttributeValueMemberM{Value: map[string]types.AttributeValue{"filename": str("extra.txt")}},
+				}},
+			},
+			ExpectVersion:   1,
+			ExpectEmail:     "first@example.com",
+			ExpectPasswords: []string{"solo"},
+			ExpectFilenames: []string{""},
+		},
+		{
+			Name: "StringSet",
+			Item: map[string]types.AttributeValue{
+				"username": str("first"), "domainname": str("example.com"), "email": str("first@example.com"),
+				"password": &types.AttributeValueMemberSS{Value: []string{"x", "y"}},
+			},
+			ExpectVersion:   1,
+			ExpectEmail:     "first@example.com",
+			ExpectPasswords: []string{"x", "y"},
+			ExpectFilenames: []string{"", ""},
+		},
+		{
+			Name: "BadPasswordV1",
+			Item: map[string]types.AttributeValue{
+				"username": str("first"), "domainname": str("example.com"),
+				"password": &types.AttributeValueMemberN{Value: "12"},
+			},
+			ExpectErr: true,
+		},
+		{
+			Name: "BadPasswordV2", // the current version is strict
+			Item: map[string]types.AttributeValue{
+				"username": str("first"), "domainname": str("example.com"), "email": str("first@example.com"),
+				"password":          &types.AttributeValueMemberN{Value: "12"},
+				ATTR_SCHEMA_VERSION: &types.AttributeValueMemberN{Value: "2"},
+			},
+			ExpectErr: true,
+		},
+		{
+			Name: "FromTheFuture",
+			Item: map[string]types.AttributeValue{
+				"username": str("first"), "domainname": str("example.com"),
+				ATTR_SCHEMA_VERSION: &types.AttributeValueMemberN{Value: "99"},
+			},
+			ExpectErr: true,
+		},
+	}
+
+	for _, test := range testSet {
+		t.Run(test.Name, func(t *testing.T) {
+			cred, err := DecodeCredential(test.Item)
+			if (err != nil) != test.ExpectErr {
+				t.Fatalf("unexpected error state: %v", err)
+			}
+			if err != nil {
+				return
+			}
+
+			if cred.SchemaVersion != test.ExpectVersion || cred.Email != test.ExpectEmail || !slices.Equal(cred.Password, test.ExpectPasswords) {
+				t.Errorf("unexpected credential: %+v", cred)
+			}
+			var filenames []string
+			for _, prov := range cred.Provenance {
+				filenames = append(filenames, prov.Filename)
+			}
+			if !slices.Equal(filenames, test.ExpectFilenames) {
+				t.Errorf("unexpected provenance filenames: %v", filenames)
+			}
+
+			// and every write is at the current version
+			if version, _ := ItemSchemaVersion(cred.GetKey()); version != credparser.CREDENTIAL_SCHEMA_VERSION {
+				t.Errorf("expected the credential to be written at version %d, got %d", credparser.CREDENTIAL_SCHEMA_VERSION, version)
+			}
+		})
+	}
+}
+
+func seedV1(t *testing.T, cli *awsfake.DynamoDB, tableName string, cnt int) {
+	t.Helper()
+
+	if err := util.EnsureDynamoDBTable(context.Background(), cli, tableName, credparser.CredentialInfo{}, nil); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	for i := range cnt {
+		if _, err := cli.PutItem(context.Background(), &dynamodb.PutItemInput{
+			TableName: aws.String(tableName),
+			Item: map[string]types.AttributeValue{
+				"username": str(fmt.Sprintf("user%03d", i)), "domainname": str(fmt.Sprintf("domain%d.com", i%7)),
+				"password": str(fmt.Sprintf("pass%d", i)),
+			},
+		}); err != nil {
+			t.Fatalf("failed to seed: %s", err)
+		}
+	}
+}
+
+func Test_Migrator(t *testing.T) {
+	const tableName = "credsTest"
+	cli := awsfake.NewDynamoDB()
+	seedV1(t, cli, tableName, 50)
+
+	// one item at the current version already (e.g. an ingest got there first) and one we can't decode
+	if _, err := StoreCredential(context.Background(), cli, tableName, nil, nil, &credparser.CredentialInfo{User: "fresh", Domain: "domain1.com", Email: "fresh@domain1.com", Password: []string{"p"}}); err != nil {
+		t.Fatalf("failed to store: %s", err)
+	}
+	cli.PutItem(context.Background(), &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item:      map[string]types.AttributeValue{"username": str("broken"), "domainname": str("domain2.com"), "password": &types.AttributeValueMemberBOOL{Value: true}},
+	})
+
+	// stop (as if interrupted) after a few pages, persisting the state as JSON like the console does
+	state := NewMigrationState(tableName, 3)
+	var saved []byte
+	pages := 0
+	stopErr := errors.New("interrupted")
+	mig := NewMigrator(cli)
+	mig.PageSize = 4
+	mig.OnProgress = func(state *MigrationState) error {
+		var err error
+		saved, err = json.Marshal(state)
+		if pages++; pages == 5 {
+			return stopErr
+		}
+		return err
+	}
+	if err := mig.Run(context.Background(), state); err == nil {
+		t.Fatalf("expected the first run to be interrupted")
+	}
+	if state.Done() {
+		t.Fatalf("expected the first run to be partial")
+	}
+
+	// resume from what was saved
+	resumed := &MigrationState{}
+	if err := json.Unmarshal(saved, resumed); err != nil {
+		t.Fatalf("failed to load state: %s", err)
+	}
+	mig.OnProgress = nil
+	if err := mig.Run(context.Background(), resumed); err != nil {
+		t.Fatalf("failed to resume: %s", err)
+	}
+	if !resumed.Done() {
+		t.Fatalf("expected the migration to finish")
+	}
+
+	totals := resumed.Totals()
+	if totals.Failed != 1 {
+		t.Errorf("expected the broken item to fail, got %+v", totals)
+	}
+
+	// everything but the broken item is now at the current version, untouched otherwise
+	migrated := 0
+	for _, item := range cli.Items(tableName) {
+		version, _ := ItemSchemaVersion(item)
+		if stringAttr(item["username"]) == "broken" {
+			if version != 1 {
+				t.Errorf("expected the broken item to be left alone")
+			}
+			continue
+		}
+		if version != credparser.CREDENTIAL_SCHEMA_VERSION {
+			t.Errorf("item %v still at version %d", item, version)
+			continue
+		}
+		if stringAttr(item["username"]) != "fresh" {
+			migrated++
+		}
+		cred, err := DecodeCredential(item)
+		if err != nil || len(cred.Password) != 1 || cred.Email != cred.User+"@"+cred.Domain {
+			t.Errorf("unexpected migrated credential %+v: %v", cred, err)
+		}
+	}
+	if migrated != 50 {
+		t.Errorf("expected 50 migrated items, got %d", migrated)
+	}
+
+	// nothing left to do
+	again := NewMigrationState(tableName, 2)
+	if err := NewMigrator(cli).Run(context.Background(), again); err != nil || again.Totals().Migrated != 0 {
+		t.Errorf("expected a second migration to be a no-op: %v %+v", err, again.Totals())
+	}
+}
+
+func Test_Migrator_DryRun(t *testing.T) {
+	const tableName = "credsTest"
+	cli := awsfake.NewDynamoDB()
+	seedV1(t, cli, tableName, 10)
+
+	mig := NewMigrator(cli)
+	mig.DryRun = true
+	state := NewMigrationState(tableName, 2)
+	if err := mig.Run(context.Background(), state); err != nil {
+		t.Fatalf("failed dry run: %s", err)
+	}
+	if totals := state.Totals(); totals.Migrated != 10 {
+		t.Errorf("expected 10 items to need migrating, got %+v", totals)
+	}
+	for _, item := range cli.Items(tableName) {
+		if _, found := item[ATTR_SCHEMA_VERSION]; found {
+			t.Errorf("dry run wrote %v", item)
+		}
+	}
+}
+
+func newTestCipher(t *testing.T) (*envelope.LocalKeys, *envelope.Cipher) {
+	keys, _, err := (*envelope.LocalKeys)(nil).Rotate()
+	if err != nil {
+		t.Fatalf("failed to make keys: %s", err)
+	}
+	return keys, envelope.NewCipher(keys)
+}
+
+func Test_StoreCredential_Encrypted(t *testing.T) {
+	const tableName = "credsTest"
+	ctx := context.Background()
+	cli := awsfake.NewDynamoDB()
+	if err := util.EnsureDynamoDBTable(ctx, cli, tableName, credparser.CredentialInfo{}, nil); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	_, cipher := newTestCipher(t)
+
+	key := CredentialKey{Domain: "example.com", User: "first"}
+	for _, passwd := range []string{"hunter2", "letmein", "hunter2"} {
+		cred := &credparser.CredentialInfo{User: key.User, Domain: key.Domain, Email: "first@example.com"}
+		cred.AddPassword(passwd, &credparser.Provenance{Filename: "dump.txt"})
+		if _, err := StoreCredential(ctx, cli, tableName, cipher, nil, cred); err != nil {
+			t.Fatalf("failed to store: %s", err)
+		}
+	}
+
+	items := cli.Items(tableName)
+	if len(items) != 1 {
+		t.Fatalf("expected one item, got %d", len(items))
+	}
+	if _, found := items[0][ATTR_PASSWORD]; found {
+		t.Errorf("plaintext passwords were stored: %v", items[0])
+	}
+
+	stored, err := GetCredential(ctx, cli, tableName, key.Domain, key.User)
+	if err != nil || stored == nil || stored.Sealed == nil || len(stored.Password) != 0 {
+		t.Fatalf("expected a sealed credential, got %+v: %v", stored, err)
+	}
+	if err := OpenCredential(ctx, nil, stored); !errors.Is(err, ErrNoCipher) {
+		t.Errorf("expected ErrNoCipher opening without a cipher, got %v", err)
+	}
+	if err := OpenCredential(ctx, cipher, stored); err != nil {
+		t.Fatalf("failed to open: %s", err)
+	}
+	if !slices.Equal(stored.Password, []string{"hunter2", "letmein"}) || len(stored.Provenance) != 2 {
+		t.Errorf("unexpected passwords %v (%d provenance)", stored.Password, len(stored.Provenance))
+	}
+
+	// sealed for this item only
+	moved := *stored.Sealed
+	other := &credparser.CredentialInfo{User: "second", Domain: key.Domain, Sealed: &moved}
+	if err := OpenCredential(ctx, cipher, other); err == nil {
+		t.Errorf("expected passwords moved to another item not to open")
+	}
+
+	// without a cipher we can't merge into what's stored
+	if _, err := StoreCredential(ctx, cli, tableName, nil, nil, &credparser.CredentialInfo{User: key.User, Domain: key.Domain, Password: []string{"x"}}); !errors.Is(err, ErrNoCipher) {
+		t.Errorf("expected ErrNoCipher storing without a cipher, got %v", err)
+	}
+
+	redacted, _ := GetCredential(ctx, cli, tableName, key.Domain, key.User)
+	redacted.Redact()
+	if !redacted.Encrypted || !slices.Equal(redacted.Password, []string{credparser.REDACTED_PASSWORD, credparser.REDACTED_PASSWORD}) {
+		t.Errorf("unexpected redaction %+v", redacted)
+	}
+}
+
+func Test_Migrator_Rekey(t *testing.T) {
+	const tableName = "credsTest"
+	ctx := context.Background()
+	cli := awsfake.NewDynamoDB()
+	seedV1(t, cli, tableName, 20) // plaintext
+
+	keys, cipher := newTestCipher(t)
+	for i := range 10 {
+		cred := &credparser.CredentialInfo{User: fmt.Sprintf("sealed%02d", i), Domain: "example.com", Password: []string{fmt.Sprintf("pass%d", i)}}
+		if _, err := StoreCredential(ctx, cli, tableName, cipher, nil, cred); err != nil {
+			t.Fatalf("failed to store: %s", err)
+		}
+	}
+	oldKeyID := cipher.CurrentKeyID()
+	if _, _, err := keys.Rotate(); err != nil {
+		t.Fatalf("failed to rotate: %s", err)
+	}
+
+	// a state started before the rotation finished doesn't carry over to the new key
+	mig := NewMigrator(cli)
+	mig.Cipher = cipher
+	mig.PageSize = 3
+	if err := mig.Run(ctx, NewRekeyState(tableName, 2, oldKeyID)); err == nil {
+		t.Errorf("expected a state for another master key to be refused")
+	}
+
+	state := NewRekeyState(tableName, 2, cipher.CurrentKeyID())
+	if err := mig.Run(ctx, state); err != nil {
+		t.Fatalf("failed to rekey: %s", err)
+	}
+	if totals := state.Totals(); totals.Migrated != 30 || totals.Failed != 0 {
+		t.Errorf("expected 30 items re-keyed, got %+v", totals)
+	}
+
+	// everything is sealed under the new key and still opens
+	for _, item := range cli.Items(tableName) {
+		if _, found := item[ATTR_PASSWORD]; found {
+			t.Errorf("plaintext left in %v", item)
+		}
+		cred, err := DecodeCredential(item)
+		if err != nil || cred.Sealed == nil || cred.Sealed.Key.KeyID != cipher.CurrentKeyID() {
+			t.Errorf("expected %v sealed under the new key: %v", item, err)
+			continue
+		}
+		if err := OpenCredential(ctx, envelope.NewCipher(keys), cred); err != nil || len(cred.Password) != 1 {
+			t.Errorf("failed to open re-keyed %s: %v", cred.User, err)
+		}
+	}
+
+	again := NewRekeyState(tableName, 2, cipher.CurrentKeyID())
+	if err := mig.Run(ctx, again); err != nil || again.Totals().Scanned != 0 {
+		t.Errorf("expected a second rekey to find nothing: %v %+v", err, again.Totals())
+	}
+}
+
+func Test_StoreCredential_HashedKeys(t *testing.T) {
+	const tableName = "credsTest"
+	ctx := context.Background()
+	cli := awsfake.NewDynamoDB()
+	if err := util.EnsureDynamoDBTable(ctx, cli, tableName, credparser.CredentialInfo{}, nil); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	keys, cipher := newTestCipher(t)
+	hasher, err := NewKeyHasher(bytes.Repeat([]byte{7}, MIN_LOOKUP_KEY_SIZE))
+	if err != nil {
+		t.Fatalf("failed to make hasher: %s", err)
+	}
+	if _, err := NewKeyHasher([]byte("short")); err == nil {
+		t.Errorf("expected a short lookup key to be refused")
+	}
+	if _, err := StoreCredential(ctx, cli, tableName, nil, hasher, &credparser.CredentialInfo{User: "x", Domain: "y", Password: []string{"z"}}); err == nil {
+		t.Errorf("expected hashed keys without a cipher to be refused")
+	}
+
+	// the same credential, differently cased, lands on one item
+	for _, ident := range [][2]string{{"example.com", "first"}, {"EXAMPLE.com", "First"}} {
+		cred := &credparser.CredentialInfo{Domain: ident[0], User: ident[1], Email: ident[1] + "@" + ident[0], Password: []string{"hunter2"}}
+		if _, err := StoreCredential(ctx, cli, tableName, cipher, hasher, cred); err != nil {
+			t.Fatalf("failed to store: %s", err)
+		}
+	}
+	if _, err := StoreCredential(ctx, cli, tableName, cipher, hasher, &credparser.CredentialInfo{User: "first", Domain: "other.com", Email: "first@other.com", Password: []string{"pw"}}); err != nil {
+		t.Fatalf("failed to store: %s", err)
+	}
+
+	items := cli.Items(tableName)
+	if len(items) != 2 {
+		t.Fatalf("expected two items, got %d", len(items))
+	}
+	for _, item := range items {
+		visible := maps.Clone(item) // the sealed envelopes are random bytes; anything could turn up in them
+		delete(visible, ATTR_PASSWORD_ENC)
+		delete(visible, ATTR_IDENTITY_ENC)
+		raw, _ := json.Marshal(visible)
+		for _, clear := range []string{`"first"`, "first@", "example.com", "other.com", "hunter2"} {
+			if strings.Contains(strings.ToLower(string(raw)), clear) {
+				t.Errorf("stored item gives away [%s]: %s", clear, raw)
+			}
+		}
+	}
+
+	// same user in another domain doesn't hash the same
+	if a, b := hasher.Key("example.com", "first"), hasher.Key("other.com", "first"); a.User == b.User || a.Domain == b.Domain {
+		t.Errorf("expected different keys, got %+v and %+v", a, b)
+	}
+	if plain := (*KeyHasher)(nil).Key(" Example.com", "First"); plain.Domain != "example.com" || plain.User != "first" {
+		t.Errorf("expected a nil hasher to canonicalise keys, got %+v", plain)
+	}
+
+	key := hasher.Key("Example.com", "FIRST")
+	stored, err := GetCredential(ctx, cli, tableName, key.Domain, key.User)
+	if err != nil || stored == nil {
+		t.Fatalf("expected to find the credential by its hashed key: %v", err)
+	}
+	if err := OpenIdentity(ctx, nil, stored); !errors.Is(err, ErrNoCipher) {
+		t.Errorf("expected ErrNoCipher, got %v", err)
+	}
+	if err := OpenCredential(ctx, cipher, stored); err != nil {
+		t.Fatalf("failed to open: %s", err)
+	}
+	if stored.Domain != "example.com" || stored.User != "first" || stored.Email != "first@example.com" || !slices.Equal(stored.Password, []string{"hunter2"}) {
+		t.Errorf("unexpected credential %+v", stored)
+	}
+
+	// a whole domain by its hashed partition key, however it's cased
+	var inDomain []*credparser.CredentialInfo
+	failed, err := QueryDomain(ctx, cli, tableName, hasher, "EXAMPLE.com", func(cred *credparser.CredentialInfo) error {
+		inDomain = append(inDomain, cred)
+		return nil
+	})
+	if err != nil || failed != 0 || len(inDomain) != 1 || inDomain[0].User != key.User {
+		t.Errorf("expected the one credential in the domain, got %d (%d failed, %v)", len(inDomain), failed, err)
+	}
+
+	// identity opened for everyone, passwords still masked
+	masked, _ := GetCredential(ctx, cli, tableName, key.Domain, key.User)
+	if err := OpenIdentity(ctx, cipher, masked); err != nil || masked.Email != "first@example.com" {
+		t.Errorf("failed to open identity: %v %+v", err, masked)
+	}
+	masked.Redact()
+	if !masked.Encrypted || masked.Password[0] != credparser.REDACTED_PASSWORD {
+		t.Errorf("expected masked passwords, got %v", masked.Password)
+	}
+
+	// re-keying moves both the passwords and the identity
+	if _, _, err := keys.Rotate(); err != nil {
+		t.Fatalf("failed to rotate: %s", err)
+	}
+	mig := NewMigrator(cli)
+	mig.Cipher = cipher
+	state := NewRekeyState(tableName, 2, cipher.CurrentKeyID())
+	if err := mig.Run(ctx, state); err != nil || state.Totals().Migrated != 2 {
+		t.Fatalf("failed to rekey: %v %+v", err, state.Totals())
+	}
+	for _, item := range cli.Items(tableName) {
+		cred, _ := DecodeCredential(item)
+		if cred.Sealed.Key.KeyID != cipher.CurrentKeyID() || cred.SealedIdentity.Key.KeyID != cipher.CurrentKeyID() {
+			t.Errorf("expected both envelopes under the new key")
+		}
+		if err := OpenCredential(ctx, cipher, cred); err != nil || cred.User != "first" {
+			t.Errorf("failed to open re-keyed credential: %v", err)
+		}
+	}
+}
+
+// credentials stored before the lookup key was turned on move to their hashed keys, links and all
+func Test_Migrator_HashKeys(t *testing.T) {
+	const tableName, linkTable = "credsTest", "linksTest"
+	ctx := context.Background()
+	cli := awsfake.NewDynamoDB()
+	seedV1(t, cli, tableName, 5) // plaintext passwords too
+	if err := util.EnsureDynamoDBTable(ctx, cli, linkTable, sources.SourceCredential{}, nil); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	_, cipher := newTestCipher(t)
+	hasher, _ := NewKeyHasher(bytes.Repeat([]byte{7}, MIN_LOOKUP_KEY_SIZE))
+
+	store := func(keys *KeyHasher, domain, user, sourceID, passwd string) {
+		t.Helper()
+		cred := &credparser.CredentialInfo{Domain: domain, User: user, Email: user + "@" + domain}
+		cred.AddPassword(passwd, &credparser.Provenance{SourceID: sourceID})
+		key := CredentialKey{Domain: domain, User: user}
+		if keys == nil { // written as it was before plain keys were canonicalised
+			item, err := EncodeCredential(ctx, cipher, nil, cred)
+			if err == nil {
+				_, err = cli.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(tableName), Item: item})
+			}
+			if err != nil {
+				t.Fatalf("failed to store: %s", err)
+			}
+		} else {
+			if _, err := StoreCredential(ctx, cli, tableName, cipher, keys, cred); err != nil {
+				t.Fatalf("failed to store: %s", err)
+			}
+			key = keys.Key(domain, user)
+		}
+		if err := sources.Link(ctx, cli, linkTable, sourceID, &credparser.CredentialInfo{Domain: key.Domain, User: key.User}); err != nil {
+			t.Fatalf("failed to link: %s", err)
+		}
+	}
+	// two casings of one address from before, and the same address again since the lookup key went on
+	store(nil, "Example.com", "Bob", "first-breach", "a")
+	store(nil, "example.com", "bob", "second-breach", "b")
+	store(hasher, "example.com", "bob", "third-breach", "c")
+
+	mig := NewMigrator(cli)
+	mig.Cipher = cipher
+	mig.PageSize = 2
+	if err := mig.Run(ctx, NewHashKeysState(tableName, 2)); err == nil {
+		t.Errorf("expected moving without the links table to be refused")
+	}
+	mig.Keys = hasher
+	mig.LinkTable = linkTable
+
+	mig.DryRun = true
+	dry := NewHashKeysState(tableName, 2)
+	if err := mig.Run(ctx, dry); err != nil || dry.Totals().Migrated != 7 || len(cli.Items(tableName)) != 8 {
+		t.Fatalf("unexpected dry run: %+v (%v)", dry.Totals(), err)
+	}
+
+	mig.DryRun = false
+	state := NewHashKeysState(tableName, 2)
+	if err := mig.Run(ctx, state); err != nil || state.Totals().Migrated != 7 || state.Totals().Failed != 0 {
+		t.Fatalf("unexpected move: %+v (%v)", state.Totals(), err)
+	}
+
+	items := cli.Items(tableName)
+	if len(items) != 6 {
+		t.Errorf("expected the two casings merged into the hashed item, got %d items", len(items))
+	}
+	for _, item := range items {
+		if _, found := item[ATTR_IDENTITY_ENC]; !found {
+			t.Errorf("expected every item under a hashed key: %v", item)
+		}
+	}
+
+	key := hasher.Key("example.com", "bob")
+	bob, err := GetCredential(ctx, cli, tableName, key.Domain, key.User)
+	if err != nil || bob == nil {
+		t.Fatalf("expected bob under his hashed key: %v", err)
+	}
+	if err := OpenCredential(ctx, cipher, bob); err != nil {
+		t.Fatalf("failed to open: %s", err)
+	}
+	if slices.Sort(bob.Password); !slices.Equal(bob.Password, []string{"a", "b", "c"}) {
+		t.Errorf("expected every password merged, got %v", bob.Password)
+	}
+	if old, _ := GetCredential(ctx, cli, tableName, "domain0.com", "user000"); old != nil {
+		t.Errorf("expected the plain item gone")
+	}
+	moved := hasher.Key("domain0.com", "user000")
+	if cred, _ := GetCredential(ctx, cli, tableName, moved.Domain, moved.User); cred == nil || OpenCredential(ctx, cipher, cred) != nil || cred.Email != "user000@domain0.com" {
+		t.Errorf("expected the original item moved with an email, got %+v", cred)
+	}
+
+	links := cli.Items(linkTable)
+	if len(links) != 3 {
+		t.Errorf("expected one link per source, got %d", len(links))
+	}
+	for _, link := range links {
+		if stringAttr(link["credKey"]) != sources.CredKey(key.Domain, key.User) {
+			t.Errorf("expected links to the hashed key, got %v", link)
+		}
+	}
+
+	again := NewHashKeysState(tableName, 2)
+	if err := mig.Run(ctx, again); err != nil || again.Totals().Scanned != 0 {
+		t.Errorf("expected nothing left to move: %v %+v", err, again.Totals())
+	}
+}
+
+// without a lookup key hashkeys just moves plain items stored under a non-canonical key to the canonical one
+func Test_Migrator_CanonicalKeys(t *testing.T) {
+	const tableName, linkTable = "credsTest", "linksTest"
+	ctx := context.Background()
+	cli := awsfake.NewDynamoDB()
+	seedV1(t, cli, tableName, 3)
+	if err := util.EnsureDynamoDBTable(ctx, cli, linkTable, sources.SourceCredential{}, nil); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+
+	// as an ingest would have stored it before plain keys were canonicalised
+	legacy := &credparser.CredentialInfo{Domain: "Example.com", User: "Bob", Email: "Bob@Example.com"}
+	legacy.AddPassword("a", &credparser.Provenance{SourceID: "first-breach"})
+	item, _ := EncodeCredential(ctx, nil, nil, legacy)
+	if _, err := cli.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(tableName), Item: item}); err != nil {
+		t.Fatalf("failed to seed: %s", err)
+	}
+	if err := sources.Link(ctx, cli, linkTable, "first-breach", legacy); err != nil {
+		t.Fatalf("failed to link: %s", err)
+	}
+
+	// and the same address since
+	cred := &credparser.CredentialInfo{Domain: "EXAMPLE.com", User: "bob", Email: "bob@EXAMPLE.com"}
+	cred.AddPassword("b", &credparser.Provenance{SourceID: "second-breach"})
+	if _, err := StoreCredential(ctx, cli, tableName, nil, nil, cred); err != nil {
+		t.Fatalf("failed to store: %s", err)
+	}
+	if cred.Domain != "example.com" || cred.User != "bob" || cred.Email != "bob@EXAMPLE.com" {
+		t.Errorf("expected the key canonicalised and the email left alone, got %+v", cred)
+	}
+
+	mig := NewMigrator(cli)
+	mig.LinkTable = linkTable
+	state := NewHashKeysState(tableName, 2)
+	if err := mig.Run(ctx, state); err != nil || state.Totals().Migrated != 1 || state.Totals().Skipped != 4 {
+		t.Fatalf("unexpected move: %+v (%v)", state.Totals(), err)
+	}
+
+	if len(cli.Items(tableName)) != 4 {
+		t.Errorf("expected the legacy item merged into the canonical one")
+	}
+	bob, err := GetCredential(ctx, cli, tableName, "example.com", "bob")
+	if err != nil || bob == nil {
+		t.Fatalf("expected bob under his canonical key: %v", err)
+	}
+	if slices.Sort(bob.Password); !slices.Equal(bob.Password, []string{"a", "b"}) {
+		t.Errorf("expected every password merged, got %v", bob.Password)
+	}
+	for _, link := range cli.Items(linkTable) {
+		if stringAttr(link["credKey"]) != sources.CredKey("example.com", "bob") {
+			t.Errorf("expected links to the canonical key, got %v", link)
+		}
+	}
+}
+
+func Test_Purger(t *testing.T) {
+	const tableName, linkTable = "credsTest", "linksTest"
+	ctx := context.Background()
+	cli := awsfake.NewDynamoDB()
+	if err := util.EnsureDynamoDBTable(ctx, cli, tableName, credparser.CredentialInfo{}, nil); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	if err := util.EnsureDynamoDBTable(ctx, cli, linkTable, sources.SourceCredential{}, nil); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	_, cipher := newTestCipher(t)
+	policy, _ := retention.New("30d", map[string]string{"keep.example.com": "forever"}, nil, nil)
+	now := time.Now()
+	old, recent := now.Add(-60*retention.DAY), now.Add(-time.Hour)
+
+	store := func(domain, user, sourceID string, basis time.Time, passwds ...string) {
+		t.Helper()
+		cred := &credparser.CredentialInfo{Domain: domain, User: user, Email: user + "@" + domain}
+		for _, passwd := range passwds {
+			cred.AddPassword(passwd, &credparser.Provenance{SourceID: sourceID, FirstSeen: basis})
+		}
+		policy.Stamp(cred, basis)
+		if _, err := StoreCredential(ctx, cli, tableName, cipher, nil, cred); err != nil {
+			t.Fatalf("failed to store: %s", err)
+		}
+		if err := sources.Link(ctx, cli, linkTable, sourceID, cred); err != nil {
+			t.Fatalf("failed to link: %s", err)
+		}
+	}
+	store("example.com", "gone", "old-breach", old, "a", "b")
+	store("example.com", "partial", "old-breach", old, "expired")
+	store("example.com", "partial", "new-breach", recent, "current")
+	store("keep.example.com", "kept", "old-breach", old, "forever")
+
+	if _, found := cli.Items(tableName)[0][ATTR_NEXT_EXPIRY].(*types.AttributeValueMemberN); !found {
+		t.Errorf("expected %s to be stored as a number: %v", ATTR_NEXT_EXPIRY, cli.Items(tableName)[0])
+	}
+
+	purger := NewPurger(cli, tableName, linkTable)
+	purger.PageSize = 1
+	purger.DryRun = true
+	expect := PurgeStats{Scanned: 2, Deleted: 1, Trimmed: 1, Passwords: 3}
+	if stats, err := purger.Run(ctx); err != nil || stats != expect {
+		t.Fatalf("unexpected dry run: %+v (%v)", stats, err)
+	}
+	if len(cli.Items(tableName)) != 3 || len(cli.Items(linkTable)) != 4 {
+		t.Fatalf("dry run changed something")
+	}
+
+	purger.DryRun = false
+	if stats, err := purger.Run(ctx); err != nil || stats != expect {
+		t.Fatalf("unexpected purge: %+v (%v)", stats, err)
+	}
+	if stats, err := purger.Run(ctx); err != nil || stats != (PurgeStats{}) {
+		t.Errorf("expected nothing left to purge, got %+v (%v)", stats, err)
+	}
+
+	if gone, _ := GetCredential(ctx, cli, tableName, "example.com", "gone"); gone != nil {
+		t.Errorf("expected the fully expired credential to be deleted")
+	}
+	partial, err := GetCredential(ctx, cli, tableName, "example.com", "partial")
+	if err != nil || partial == nil {
+		t.Fatalf("expected the partially expired credential to be kept: %v", err)
+	}
+	if err := OpenCredential(ctx, cipher, partial); err != nil {
+		t.Fatalf("trimmed passwords no longer open: %s", err)
+	}
+	if !slices.Equal(partial.Password, []string{"current"}) || len(partial.Provenance) != 1 || !partial.NextExpiry.Equal(*partial.ExpiresAt) {
+		t.Errorf("unexpected trimmed credential %+v", partial)
+	}
+	if kept, _ := GetCredential(ctx, cli, tableName, "keep.example.com", "kept"); kept == nil || kept.ExpiresAt != nil {
+		t.Errorf("expected the credential kept forever to be left alone, got %+v", kept)
+	}
+
+	var links []string
+	for _, src := range []string{"old-breach", "new-breach"} {
+		srcLinks, _ := sources.ListLinks(ctx, cli, linkTable, src)
+		for _, link := range srcLinks {
+			links = append(links, src+":"+link.CredKey)
+		}
+	}
+	slices.Sort(links)
+	if expect := []string{"new-breach:example.com#partial", "old-breach:keep.example.com#kept"}; !slices.Equal(links, expect) {
+		t.Errorf("expected links %v, got %v", expect, links)
+	}
+}
+
+func Test_Erase(t *testing.T) {
+	ctx := context.Background()
+	cli := awsfake.NewDynamoDB()
+	tables := ErasureTables{Credentials: "credsTest", SourceCredentials: "linksTest", Tombstones: "tombstonesTest", Watchlist: "watchTest", Canaries: "canaryTest"}
+	for table, schema := range map[string]util.DymamoSchema{
+		tables.Credentials: credparser.CredentialInfo{}, tables.SourceCredentials: sources.SourceCredential{}, tables.Tombstones: Tombstone{},
+		tables.Watchlist: watchlist.Entry{}, tables.Canaries: canary.Canary{},
+	} {
+		if err := util.EnsureDynamoDBTable(ctx, cli, table, schema, nil); err != nil {
+			t.Fatalf("failed to create table: %s", err)
+		}
+	}
+	_, cipher := newTestCipher(t)
+	hasher, _ := NewKeyHasher(bytes.Repeat([]byte{7}, MIN_LOOKUP_KEY_SIZE))
+
+	for _, user := range []string{"first", "second"} {
+		cred := &credparser.CredentialInfo{Domain: "example.com", User: user, Email: user + "@example.com"}
+		cred.AddPassword("a", &credparser.Provenance{SourceID: "breach-1"})
+		cred.AddPassword("b", &credparser.Provenance{SourceID: "breach-2"})
+		if _, err := StoreCredential(ctx, cli, tables.Credentials, cipher, hasher, cred); err != nil {
+			t.Fatalf("failed to store: %s", err)
+		}
+		for _, src := range SourceIDs(cred) {
+			key := hasher.Key(cred.Domain, cred.User)
+			if err := sources.Link(ctx, cli, tables.SourceCredentials, src, &credparser.CredentialInfo{Domain: key.Domain, User: key.User}); err != nil {
+				t.Fatalf("failed to link: %s", err)
+			}
+		}
+	}
+
+	// watched by two owners, along with its domain and the other address; and a canary
+	for _, watch := range [][2]string{{"first@example.com", "acme"}, {"First@Example.com", "soc"}, {"example.com", "acme"}, {"second@example.com", "acme"}} {
+		entry, _ := watchlist.NewEntry(watch[0], watch[1], "")
+		if err := watchlist.Save(ctx, cli, tables.Watchlist, entry); err != nil {
+			t.Fatalf("failed to save watch: %s", err)
+		}
+	}
+	honey, _ := canary.New("first@example.com", "bait", "planted in the vendor portal")
+	if err := canary.Save(ctx, cli, tables.Canaries, honey); err != nil {
+		t.Fatalf("failed to save canary: %s", err)
+	}
+
+	if _, err := Erase(ctx, cli, tables, hasher, "not-an-address", ""); err == nil {
+		t.Errorf("expected a bad address to be refused")
+	}
+	erasure, err := Erase(ctx, cli, tables, hasher, " First@Example.com", "ticket-1")
+	if err != nil {
+		t.Fatalf("failed to erase: %s", err)
+	}
+	if !erasure.Found || erasure.Passwords != 2 || erasure.SourceLinks != 2 || erasure.Watches != 2 || !erasure.Canary || erasure.Tombstone.Reference != "ticket-1" {
+		t.Errorf("unexpected erasure %+v", erasure)
+	}
+
+	if len(cli.Items(tables.Credentials)) != 1 || len(cli.Items(tables.SourceCredentials)) != 2 {
+		t.Errorf("expected only the other credential (and its links) to be left")
+	}
+	if len(cli.Items(tables.Watchlist)) != 2 || len(cli.Items(tables.Canaries)) != 0 {
+		t.Errorf("expected only the watches on the domain and the other address to be left")
+	}
+	raw, _ := json.Marshal(cli.Items(tables.Tombstones))
+	if strings.Contains(strings.ToLower(string(raw)), "first") {
+		t.Errorf("tombstone gives the address away: %s", raw)
+	}
+
+	if ts, err := GetTombstone(ctx, cli, tables.Tombstones, hasher, "first@example.COM"); err != nil || ts == nil {
+		t.Errorf("expected a tombstone, got %v (%v)", ts, err)
+	}
+	if ts, _ := GetTombstone(ctx, cli, tables.Tombstones, hasher, "second@example.com"); ts != nil {
+		t.Errorf("unexpected tombstone for an address that wasn't erased")
+	}
+	if ts, err := GetTombstone(ctx, cli, tables.Tombstones, nil, "first@example.com"); ts != nil || err != nil {
+		t.Errorf("expected no tombstones without a lookup key, got %v (%v)", ts, err)
+	}
+
+	// erasing again (or something never stored) still leaves a tombstone
+	if again, err := Erase(ctx, cli, tables, hasher, "first@example.com", ""); err != nil || again.Found {
+		t.Errorf("unexpected second erasure %+v (%v)", again, err)
+	}
+	found, err := Tombstoned(ctx, cli, tables.Tombstones, []string{hasher.TombstoneKey("example.com", "FIRST"), hasher.TombstoneKey("example.com", "second"), hasher.TombstoneKey("example.com", "first")})
+	if err != nil || len(found) != 1 || !found[hasher.TombstoneKey("example.com", "first")] {
+		t.Errorf("unexpected tombstone check %v (%v)", found, err)
+	}
+}
+
+// an item from before provenance existed (so there's none to compare) is remediated rather than retried
+// until we give up
+func Test_SetRemediation_Legacy(t *testing.T) {
+	const tableName = "credsTest"
+	ctx := context.Background()
+	cli := awsfake.NewDynamoDB()
+	if err := util.EnsureDynamoDBTable(ctx, cli, tableName, credparser.CredentialInfo{}, nil); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	item := map[string]types.AttributeValue{"username": str("legacy"), "domainname": str("example.com"), "password": str("old")}
+	if _, err := cli.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(tableName), Item: item}); err != nil {
+		t.Fatalf("failed to put legacy item: %s", err)
+	}
+
+	cred, err := SetRemediation(ctx, cli, tableName, nil, "legacy@example.com", RemediationUpdate{Status: credparser.REMEDIATION_PASSWORD_RESET, By: "helpdesk"})
+	if err != nil || cred == nil {
+		t.Fatalf("failed to set remediation on a legacy item: %v", err)
+	}
+	stored, err := GetCredential(ctx, cli, tableName, "example.com", "legacy")
+	if err != nil || stored == nil {
+		t.Fatalf("failed to load credential: %v", err)
+	}
+	if stored.Status != credparser.REMEDIATION_PASSWORD_RESET || !slices.Equal(stored.Password, []string{"old"}) {
+		t.Errorf("unexpected stored credential [%s] %v", stored.Status, stored.Password)
+	}
+}
+
+// without a lookup key everything is still erased from the plain-keyed tables; there's just no tombstone
+func Test_Erase_NoLookupKey(t *testing.T) {
+	ctx := context.Background()
+	cli := awsfake.NewDynamoDB()
+	tables := ErasureTables{Credentials: "credsTest", SourceCredentials: "linksTest", Tombstones: "tombstonesTest", Watchlist: "watchTest"}
+	for table, schema := range map[string]util.DymamoSchema{
+		tables.Credentials: credparser.CredentialInfo{}, tables.SourceCredentials: sources.SourceCredential{}, tables.Tombstones: Tombstone{},
+		tables.Watchlist: watchlist.Entry{},
+	} {
+		if err := util.EnsureDynamoDBTable(ctx, cli, table, schema, nil); err != nil {
+			t.Fatalf("failed to create table: %s", err)
+		}
+	}
+
+	cred := &credparser.CredentialInfo{Domain: "example.com", User: "first", Email: "first@example.com"}
+	cred.AddPassword("a", &credparser.Provenance{SourceID: "breach-1"})
+	if _, err := StoreCredential(ctx, cli, tables.Credentials, nil, nil, cred); err != nil {
+		t.Fatalf("failed to store: %s", err)
+	}
+	if err := sources.Link(ctx, cli, tables.SourceCredentials, "breach-1", cred); err != nil {
+		t.Fatalf("failed to link: %s", err)
+	}
+	entry, _ := watchlist.NewEntry("first@example.com", "acme", "")
+	if err := watchlist.Save(ctx, cli, tables.Watchlist, entry); err != nil {
+		t.Fatalf("failed to save watch: %s", err)
+	}
+
+	erasure, err := Erase(ctx, cli, tables, nil, "First@Example.com", "ticket-1")
+	if err != nil {
+		t.Fatalf("failed to erase: %s", err)
+	}
+	if !erasure.Found || erasure.Passwords != 1 || erasure.SourceLinks != 1 || erasure.Watches != 1 || erasure.Tombstone != nil {
+		t.Errorf("unexpected erasure %+v", erasure)
+	}
+	if len(cli.Items(tables.Credentials)) != 0 || len(cli.Items(tables.SourceCredentials)) != 0 || len(cli.Items(tables.Watchlist)) != 0 {
+		t.Errorf("expected everything about the address to be gone")
+	}
+	if len(cli.Items(tables.Tombstones)) != 0 {
+		t.Errorf("expected no tombstone without a lookup key")
+	}
+}
+
+// every page is read, and a status filter is applied by dynamodb (with unstatused items counting as new)
+func Test_QueryCompromised(t *testing.T) {
+	const tableName = "credsTest"
+	ctx := context.Background()
+	cli := awsfake.NewDynamoDB()
+	if err := util.EnsureDynamoDBTable(ctx, cli, tableName, credparser.CredentialInfo{}, nil); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	cli.MaxPageItems = 2
+
+	for idx := range 5 {
+		cred := &credparser.CredentialInfo{Domain: "example.com", User: fmt.Sprintf("user%d", idx), Email: fmt.Sprintf("user%d@example.com", idx)}
+		cred.AddPassword("pw", &credparser.Provenance{SourceID: "breach-1"})
+		if _, err := StoreCredential(ctx, cli, tableName, nil, nil, cred); err != nil {
+			t.Fatalf("failed to store: %s", err)
+		}
+	}
+	for _, email := range []string{"user1@example.com", "user3@example.com"} {
+		if _, err := SetRemediation(ctx, cli, tableName, nil, email, RemediationUpdate{Status: credparser.REMEDIATION_PASSWORD_RESET, By: "helpdesk"}); err != nil {
+			t.Fatalf("failed to set remediation: %s", err)
+		}
+	}
+	// from before remediation existed, and someone else's domain
+	for _, item := range []map[string]types.AttributeValue{
+		{"username": str("legacy"), "domainname": str("example.com"), "password": str("old")},
+		{"username": str("user0"), "domainname": str("other.com"), "password": str("old")},
+	} {
+		if _, err := cli.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(tableName), Item: item}); err != nil {
+			t.Fatalf("failed to seed: %s", err)
+		}
+	}
+
+	testSet := []struct {
+		Name   string
+		Domain string
+		User   string
+		Status credparser.RemediationStatus
+		Expect []string
+	}{
+		{Name: "Domain", Domain: "Example.com", Expect: []string{"legacy", "user0", "user1", "user2", "user3", "user4"}},
+		{Name: "New", Domain: "example.com", Status: credparser.REMEDIATION_NEW, Expect: []string{"legacy", "user0", "user2", "user4"}},
+		{Name: "Reset", Domain: "example.com", Status: credparser.REMEDIATION_PASSWORD_RESET, Expect: []string{"user1", "user3"}},
+		{Name: "Acknowledged", Domain: "example.com", Status: credparser.REMEDIATION_ACKNOWLEDGED},
+		{Name: "Address", Domain: "example.com", User: "User3", Expect: []string{"user3"}},
+		{Name: "Address Other Status", Domain: "example.com", User: "user3", Status: credparser.REMEDIATION_NEW},
+	}
+
+	for _, test := range testSet {
+		t.Run(test.Name, func(t *testing.T) {
+			creds, failed, err := QueryCompromised(ctx, cli, tableName, nil, test.Domain, test.User, test.Status)
+			if err != nil || failed != 0 {
+				t.Fatalf("failed to query: %v (%d failed)", err, failed)
+			}
+			var users []string
+			for _, cred := range creds {
+				users = append(users, cred.User)
+			}
+			if slices.Sort(users); !slices.Equal(users, test.Expect) {
+				t.Errorf("expected %v, got %v", test.Expect, users)
+			}
+		})
+	}
+}
+
+func Test_SetRemediation(t *testing.T) {
+	const tableName = "credsTest"
+	ctx := context.Background()
+	cli := awsfake.NewDynamoDB()
+	if err := util.EnsureDynamoDBTable(ctx, cli, tableName, credparser.CredentialInfo{}, nil); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	_, cipher := newTestCipher(t)
+	hasher, _ := NewKeyHasher(bytes.Repeat([]byte{7}, MIN_LOOKUP_KEY_SIZE))
+
+	store := func(passwords ...string) {
+		t.Helper()
+		cred := &credparser.CredentialInfo{Domain: "example.com", User: "first", Email: "first@example.com"}
+		for _, passwd := range passwords {
+			cred.AddPassword(passwd, &credparser.Provenance{SourceID: "breach-" + passwd})
+		}
+		if _, err := StoreCredential(ctx, cli, tableName, cipher, hasher, cred); err != nil {
+			t.Fatalf("failed to store: %s", err)
+		}
+	}
+	load := func() *credparser.CredentialInfo {
+		t.Helper()
+		key := hasher.Key("example.com", "first")
+		cred, err := GetCredential(ctx, cli, tableName, key.Domain, key.User)
+		if err != nil || cred == nil {
+			t.Fatalf("failed to load credential: %v", err)
+		}
+		return cred
+	}
+
+	store("a", "b")
+	if cred := load(); cred.Status != credparser.REMEDIATION_NEW {
+		t.Errorf("expected a fresh credential to be new, got [%s]", cred.Status)
+	}
+
+	// one password looked at; the other is still new so the credential is too
+	cred, err := SetRemediation(ctx, cli, tableName, hasher, "first@example.com", RemediationUpdate{Status: credparser.REMEDIATION_ACKNOWLEDGED, By: "helpdesk", Notes: "called them", Passwords: []int{0}})
+	if err != nil || cred == nil {
+		t.Fatalf("failed to set remediation: %v", err)
+	}
+	if cred.Status != credparser.REMEDIATION_NEW || cred.Provenance[0].RemediationStatus() != credparser.REMEDIATION_ACKNOWLEDGED {
+		t.Errorf("unexpected status [%s] / [%s]", cred.Status, cred.Provenance[0].RemediationStatus())
+	}
+
+	if _, err := SetRemediation(ctx, cli, tableName, hasher, "first@example.com", RemediationUpdate{Status: credparser.REMEDIATION_PASSWORD_RESET, By: "helpdesk"}); err != nil {
+		t.Fatalf("failed to set remediation: %s", err)
+	}
+	stored := load()
+	if stored.Status != credparser.REMEDIATION_PASSWORD_RESET || stored.Provenance[1].Remediation.By != "helpdesk" || stored.Provenance[1].Remediation.At.IsZero() {
+		t.Errorf("unexpected stored remediation [%s] %+v", stored.Status, stored.Provenance[1].Remediation)
+	}
+	if err := OpenIdentity(ctx, cipher, stored); err != nil {
+		t.Fatalf("failed to open identity: %s", err)
+	}
+	if err := OpenCredential(ctx, cipher, stored); err != nil || !slices.Equal(stored.Password, []string{"a", "b"}) {
+		t.Errorf("expected the passwords to still open, got %v (%v)", stored.Password, err)
+	}
+
+	// a password turning up in a new breach puts the credential back in the queue; the rest keep their state
+	store("b", "c")
+	stored = load()
+	if stored.Status != credparser.REMEDIATION_NEW || stored.Provenance[1].RemediationStatus() != credparser.REMEDIATION_PASSWORD_RESET {
+		t.Errorf("unexpected status after a new password [%s] / [%s]", stored.Status, stored.Provenance[1].RemediationStatus())
+	}
+
+	if _, err := SetRemediation(ctx, cli, tableName, hasher, "first@example.com", RemediationUpdate{Status: credparser.REMEDIATION_FALSE_POSITIVE, By: "helpdesk", Passwords: []int{3}}); !errors.Is(err, ErrNoSuchPassword) {
+		t.Errorf("expected a bad index to be refused, got %v", err)
+	}
+	if _, err := SetRemediation(ctx, cli, tableName, hasher, "first@example.com", RemediationUpdate{Status: credparser.REMEDIATION_FALSE_POSITIVE}); err == nil {
+		t.Errorf("expected an update without anyone behind it to be refused")
+	}
+	if missing, err := SetRemediation(ctx, cli, tableName, hasher, "nobody@example.com", RemediationUpdate{Status: credparser.REMEDIATION_ACKNOWLEDGED, By: "helpdesk"}); missing != nil || err != nil {
+		t.Errorf("expected nothing for an address we don't have, got %v (%v)", missing, err)
+	}
+}
+
+func Test_Rescore(t *testing.T) {
+	const credTable, sourceTable = "credsTest", "sourcesTest"
+	ctx := context.Background()
+	cli := awsfake.NewDynamoDB()
+	if err := util.EnsureDynamoDBTable(ctx, cli, credTable, credparser.CredentialInfo{}, nil); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	if err := util.EnsureDynamoDBTable(ctx, cli, sourceTable, sources.Source{}, nil); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	_, cipher := newTestCipher(t)
+	hasher, _ := NewKeyHasher(bytes.Repeat([]byte{7}, MIN_LOOKUP_KEY_SIZE))
+
+	breach := time.Now().AddDate(0, -1, 0).UTC()
+	if _, err := sources.Save(ctx, cli, sourceTable, &sources.Source{ID: "recent", Name: "Recent", BreachDate: &breach}); err != nil {
+		t.Fatalf("failed to save source: %s", err)
+	}
+	longAgo := time.Now().AddDate(-10, 0, 0)
+	for _, user := range []string{"admin", "jdoe", "asmith"} {
+		password := "Company2024!"
+		if user == "asmith" {
+			password = "unique"
+		}
+		cred := &credparser.CredentialInfo{Domain: "example.com", User: user, Email: user + "@example.com"}
+		cred.AddPassword(password, &credparser.Provenance{SourceID: "recent", FirstSeen: longAgo}) // stored before breach dates were kept
+		if _, err := StoreCredential(ctx, cli, credTable, cipher, hasher, cred); err != nil {
+			t.Fatalf("failed to store: %s", err)
+		}
+	}
+	load := func(user string) *credparser.CredentialInfo {
+		t.Helper()
+		key := hasher.Key("example.com", user)
+		cred, err := GetCredential(ctx, cli, credTable, key.Domain, key.User)
+		if err != nil || cred == nil || cred.Severity == nil {
+			t.Fatalf("failed to load a scored credential: %v", err)
+		}
+		return cred
+	}
+
+	// scored as stored, without knowing about reuse or the breach date
+	before := load("jdoe")
+	if before.Severity.Reuse != 0 || !before.Severity.LatestLeak.Equal(longAgo.UTC()) || before.Severity.Storage != credparser.STORAGE_PLAINTEXT {
+		t.Errorf("unexpected severity at ingest %+v", before.Severity)
+	}
+	if !load("admin").Severity.Privileged {
+		t.Errorf("expected admin@ to be privileged")
+	}
+
+	if _, err := Rescore(ctx, cli, RescoreTables{Credentials: credTable}, nil, hasher, "example.com"); !errors.Is(err, ErrNoCipher) {
+		t.Errorf("expected rescoring encrypted passwords without a cipher to fail, got %v", err)
+	}
+	stats, err := Rescore(ctx, cli, RescoreTables{Credentials: credTable, Sources: sourceTable}, cipher, hasher, "EXAMPLE.com")
+	if err != nil || stats.Credentials != 3 || stats.Updated != 3 || stats.Failed != 0 {
+		t.Fatalf("unexpected rescore %+v (%v)", stats, err)
+	}
+
+	after := load("jdoe")
+	if after.Severity.Reuse != 1 || !after.Severity.LatestLeak.Equal(breach) || after.Severity.Score <= before.Severity.Score {
+		t.Errorf("expected reuse and the breach date to raise the score, got %+v (was %d)", after.Severity, before.Severity.Score)
+	}
+	if load("asmith").Severity.Reuse != 0 {
+		t.Errorf("expected a unique password not to count as reused")
+	}
+	if after.Provenance[0].BreachDate != nil {
+		t.Errorf("expected the provenance to be left as stored")
+	}
+	if err := OpenCredential(ctx, cipher, after); err != nil || !slices.Equal(after.Password, []string{"Company2024!"}) {
+		t.Errorf("expected the passwords to still open, got %v (%v)", after.Password, err)
+	}
+
+	// nothing changed, nothing written; a later ingest keeps the reuse count
+	if stats, _ := Rescore(ctx, cli, RescoreTables{Credentials: credTable, Sources: sourceTable}, cipher, hasher, "example.com"); stats.Updated != 0 {
+		t.Errorf("expected an unchanged rescore to write nothing, got %+v", stats)
+	}
+	again := &credparser.CredentialInfo{Domain: "example.com", User: "jdoe", Email: "jdoe@example.com"}
+	again.AddPassword("another", &credparser.Provenance{FirstSeen: time.Now()})
+	if _, err := StoreCredential(ctx, cli, credTable, cipher, hasher, again); err != nil {
+		t.Fatalf("failed to store: %s", err)
+	}
+	if sev := load("jdoe").Severity; sev.Reuse != 1 || sev.Sources != 2 {
+		t.Errorf("expected the new ingest to keep the reuse count, got %+v", sev)
+	}
+}
+
+// runs race (once) just before the first put, as if another writer got there between our read and write
+type racingDynamoDB struct {
+	util.DynamoDBAPI
+	race func()
+}
+
+func (r *racingDynamoDB) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	if race := r.race; race != nil {
+		r.race = nil
+		race()
+	}
+	return r.DynamoDBAPI.PutItem(ctx, params, optFns...)
+}
+
+func Test_StoreCredential_Concurrent(t *testing.T) {
+	const tableName = "credsTest"
+	ctx := context.Background()
+	inner := awsfake.NewDynamoDB()
+	if err := util.EnsureDynamoDBTable(ctx, inner, tableName, credparser.CredentialInfo{}, nil); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	newCred := func(passwords ...string) *credparser.CredentialInfo {
+		cred := &credparser.CredentialInfo{Domain: "example.com", User: "first", Email: "first@example.com"}
+		for _, passwd := range passwords {
+			cred.AddPassword(passwd, &credparser.Provenance{SourceID: "breach-" + passwd})
+		}
+		return cred
+	}
+	racer := func(passwords ...string) func() {
+		return func() {
+			if _, err := StoreCredential(ctx, inner, tableName, nil, nil, newCred(passwords...)); err != nil {
+				t.Fatalf("failed to store the racing credential: %s", err)
+			}
+		}
+	}
+
+	// both first to store it, then both adding to it; nobody's passwords get lost either way
+	for _, test := range []struct{ Ours, Theirs, Expect []string }{
+		{Ours: []string{"a"}, Theirs: []string{"b"}, Expect: []string{"a", "b"}},
+		{Ours: []string{"c"}, Theirs: []string{"d", "a"}, Expect: []string{"a", "b", "c", "d"}},
+	} {
+		cli := &racingDynamoDB{DynamoDBAPI: inner, race: racer(test.Theirs...)}
+		if _, err := StoreCredential(ctx, cli, tableName, nil, nil, newCred(test.Ours...)); err != nil {
+			t.Fatalf("failed to store: %s", err)
+		}
+		stored, err := GetCredential(ctx, inner, tableName, "example.com", "first")
+		if err != nil || stored == nil {
+			t.Fatalf("failed to load: %v", err)
+		}
+		if got := slices.Sorted(slices.Values(stored.Password)); !slices.Equal(got, test.Expect) || len(stored.Provenance) != len(test.Expect) {
+			t.Errorf("expected %v, got %v (%d provenance)", test.Expect, got, len(stored.Provenance))
+		}
+	}
+}
+
+// serves only the first serve requested keys and hands the rest back as unprocessed, the given number of times
+type throttledDynamoDB struct {
+	util.DynamoDBAPI
+	throttles int
+	serve     int
+	calls     int
+}
+
+func (th *throttledDynamoDB) BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+	th.calls++
+	if th.throttles == 0 {
+		return th.DynamoDBAPI.BatchGetItem(ctx, params, optFns...)
+	}
+	th.throttles--
+	served, unprocessed := map[string]types.KeysAndAttributes{}, map[string]types.KeysAndAttributes{}
+	for table, req := range params.RequestItems {
+		cut := min(th.serve, len(req.Keys))
+		if cut > 0 {
+			served[table] = types.KeysAndAttributes{Keys: req.Keys[:cut]}
+		}
+		if cut < len(req.Keys) {
+			unprocessed[table] = types.KeysAndAttributes{Keys: req.Keys[cut:]}
+		}
+	}
+	res := &dynamodb.BatchGetItemOutput{}
+	if len(served) > 0 {
+		var err error
+		if res, err = th.DynamoDBAPI.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{RequestItems: served}, optFns...); err != nil {
+			return nil, err
+		}
+	}
+	res.UnprocessedKeys = unprocessed
+	return res, nil
+}
+
+func Test_BatchGetCredentials_Unprocessed(t *testing.T) {
+	const tableName = "credsTest"
+	ctx := context.Background()
+	inner := awsfake.NewDynamoDB()
+	if err := util.EnsureDynamoDBTable(ctx, inner, tableName, credparser.CredentialInfo{}, nil); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	var keys []CredentialKey
+	for _, user := range []string{"a", "b", "c"} {
+		cred := &credparser.CredentialInfo{Domain: "example.com", User: user, Email: user + "@example.com"}
+		cred.AddPassword("pw", nil)
+		if _, err := StoreCredential(ctx, inner, tableName, nil, nil, cred); err != nil {
+			t.Fatalf("failed to store: %s", err)
+		}
+		keys = append(keys, CredentialKey{Domain: "example.com", User: user})
+	}
+	defer func(base, maxDelay time.Duration) { batchGetBaseDelay, batchGetMaxDelay = base, maxDelay }(batchGetBaseDelay, batchGetMaxDelay)
+	batchGetBaseDelay, batchGetMaxDelay = time.Millisecond, 2*time.Millisecond
+
+	cli := &throttledDynamoDB{DynamoDBAPI: inner, throttles: 2, serve: 1}
+	creds, _, err := BatchGetCredentials(ctx, cli, tableName, keys)
+	if err != nil || len(creds) != 3 || cli.calls != 3 {
+		t.Errorf("expected all 3 credentials in 3 calls, got %d in %d (%v)", len(creds), cli.calls, err)
+	}
+
+	cli = &throttledDynamoDB{DynamoDBAPI: inner, throttles: batchGetAttempts}
+	if _, _, err := BatchGetCredentials(ctx, cli, tableName, keys); err == nil || cli.calls != batchGetAttempts {
+		t.Errorf("expected to give up after %d attempts, got %d (%v)", batchGetAttempts, cli.calls, err)
+	}
+}
+
+// tombstone checks back off and give up the same way
+func Test_Tombstoned_Unprocessed(t *testing.T) {
+	const tableName = "tombstonesTest"
+	ctx := context.Background()
+	inner := awsfake.NewDynamoDB()
+	if err := util.EnsureDynamoDBTable(ctx, inner, tableName, Tombstone{}, nil); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	hasher, _ := NewKeyHasher(bytes.Repeat([]byte{7}, MIN_LOOKUP_KEY_SIZE))
+	var keys []string
+	for _, user := range []string{"a", "b", "c"} {
+		keys = append(keys, hasher.TombstoneKey("example.com", user))
+		item, _ := attributevalue.MarshalMap(Tombstone{Key: keys[len(keys)-1], ErasedAt: time.Now().UTC()})
+		if _, err := inner.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(tableName), Item: item}); err != nil {
+			t.Fatalf("failed to put tombstone: %s", err)
+		}
+	}
+	defer func(base, maxDelay time.Duration) { batchGetBaseDelay, batchGetMaxDelay = base, maxDelay }(batchGetBaseDelay, batchGetMaxDelay)
+	batchGetBaseDelay, batchGetMaxDelay = time.Millisecond, 2*time.Millisecond
+
+	cli := &throttledDynamoDB{DynamoDBAPI: inner, throttles: 2, serve: 1}
+	found, err := Tombstoned(ctx, cli, tableName, keys)
+	if err != nil || len(found) != 3 || cli.calls != 3 {
+		t.Errorf("expected all 3 tombstones in 3 calls, got %d in %d (%v)", len(found), cli.calls, err)
+	}
+
+	cli = &throttledDynamoDB{DynamoDBAPI: inner, throttles: batchGetAttempts}
+	if _, err := Tombstoned(ctx, cli, tableName, keys); err == nil || cli.calls != batchGetAttempts {
+		t.Errorf("expected to give up after %d attempts, got %d (%v)", batchGetAttempts, cli.calls, err)
+	}
+}
@@ -0,0 +1,241 @@
+package credstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/newodahs/readerlambda/pkg/canary"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/sources"
+	"github.com/newodahs/readerlambda/pkg/util"
+	"github.com/newodahs/readerlambda/pkg/watchlist"
+)
+
+const DYNDB_TABLE_TOMBSTONES = `erasedCredentials`
+
+// left behind when an address is erased so ingests don't store it again; only holds a hash of the address
+// (see KeyHasher.TombstoneKey), never the address itself
+type Tombstone struct {
+	Key       string    `json:"-" dynamodbav:"tombstoneKey"`
+	ErasedAt  time.Time `json:"erasedAt" dynamodbav:"erasedAt"`
+	Reference string    `json:"reference,omitempty" dynamodbav:"reference,omitempty"` // whatever the requester gave, e.g. a ticket number
+}
+
+func (ts Tombstone) GetAttrDefs() []types.AttributeDefinition {
+	return []types.AttributeDefinition{
+		{
+			AttributeName: aws.String("tombstoneKey"),
+			AttributeType: types.ScalarAttributeTypeS,
+		},
+	}
+}
+
+func (ts Tombstone) GetKeySchema() []types.KeySchemaElement {
+	return []types.KeySchemaElement{
+		{
+			AttributeName: aws.String("tombstoneKey"),
+			KeyType:       types.KeyTypeHash,
+		},
+	}
+}
+
+// every table that can hold something about an address; Watchlist and Canaries are skipped if empty. the
+// rejects files ingests leave in S3 can hold it too, those are postprocess.ScrubRejects' job
+type ErasureTables struct {
+	Credentials       string
+	SourceCredentials string
+	Tombstones        string
+	Watchlist         string
+	Canaries          string
+}
+
+// what an erasure removed
+type Erasure struct {
+	Found       bool       `json:"found"`       // a credential was stored for the address
+	Passwords   int        `json:"passwords"`   // how many passwords it had
+	SourceLinks int        `json:"sourceLinks"` // links to the sources it appeared in
+	Watches     int        `json:"watches"`     // watches on the address (by anyone)
+	Canary      bool       `json:"canary"`      // the address was a canary
+	Tombstone   *Tombstone `json:"tombstone"`   // nil without a lookup key; see Erase
+}
+
+// splits an address the way the parser does (user before the first @)
+func SplitAddress(email string) (domain, user string, err error) {
+	user, domain, found := strings.Cut(strings.TrimSpace(email), "@")
+	if !found || user == "" || domain == "" {
+		return "", "", fmt.Errorf("[%s] is not an email address", email)
+	}
+	return domain, user, nil
+}
+
+// removes everything stored about email (its credential, source links, watches on it and its canary record)
+// and records a tombstone so it isn't ingested again; erasing an address that was never stored still records
+// the tombstone, and erasing one twice is harmless. keys must match how credentials are stored
+//
+// the tombstone goes in first, so an ingest running alongside can't put the address back afterwards
+// unless it had already checked (erasing again takes care of that). without keys there's no tombstone (see
+// KeyHasher.TombstoneKey); everything else is still erased, but a later ingest can store the address again
+func Erase(ctx context.Context, cli util.DynamoDBAPI, tables ErasureTables, keys *KeyHasher, email, reference string) (*Erasure, error) {
+	if cli == nil {
+		return nil, errors.New("passed dynamodb client was nil")
+	}
+	domain, user, err := SplitAddress(email)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &Erasure{}
+	if keys == nil {
+		log.Printf("WARNING: no lookup key; erasing (reference [%s]) without a tombstone, so a later ingest may store the address again", reference)
+	} else {
+		ret.Tombstone = &Tombstone{Key: keys.TombstoneKey(domain, user), ErasedAt: time.Now().UTC(), Reference: reference}
+		item, err := attributevalue.MarshalMap(ret.Tombstone)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal tombstone: %s", err)
+		}
+		if _, err := cli.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(tables.Tombstones), Item: item}); err != nil {
+			return nil, fmt.Errorf("failed to record tombstone: %s", err)
+		}
+	}
+
+	// the rest are independent of each other; one failing doesn't stop the others
+	var errs []error
+	if err := eraseWatches(ctx, cli, tables.Watchlist, email, ret); err != nil {
+		errs = append(errs, err)
+	}
+	if tables.Canaries != "" {
+		found, err := canary.Delete(ctx, cli, tables.Canaries, email)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		ret.Canary = found
+	}
+
+	key := keys.Key(domain, user)
+	cred, err := GetCredential(ctx, cli, tables.Credentials, key.Domain, key.User)
+	if err != nil || cred == nil {
+		return ret, errors.Join(append(errs, err)...)
+	}
+	ret.Found = true
+	ret.Passwords = len(cred.Provenance)
+
+	if _, err := cli.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(tables.Credentials),
+		Key:       credentialKeyItem(key),
+	}); err != nil {
+		return ret, errors.Join(append(errs, fmt.Errorf("failed to delete credential: %s", err))...)
+	}
+
+	// links are keyed by the stored key, same as the credential
+	for _, sourceID := range SourceIDs(cred) {
+		if err := sources.Unlink(ctx, cli, tables.SourceCredentials, sourceID, key.Domain, key.User); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		ret.SourceLinks++
+	}
+	return ret, errors.Join(errs...)
+}
+
+// deletes every owner's watch on the address itself; watches on its domain aren't about the address
+func eraseWatches(ctx context.Context, cli util.DynamoDBAPI, tableName, email string, erasure *Erasure) error {
+	if tableName == "" {
+		return nil
+	}
+	entries, err := watchlist.ForTarget(ctx, cli, tableName, email)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, entry := range entries {
+		if _, err := watchlist.Delete(ctx, cli, tableName, entry.Target, entry.Owner); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		erasure.Watches++
+	}
+	return errors.Join(errs...)
+}
+
+// the distinct sources cred's passwords came from, in the order first seen
+func SourceIDs(cred *credparser.CredentialInfo) []string {
+	var ret []string
+	seen := map[string]bool{}
+	for _, prov := range cred.Provenance {
+		if prov == nil || prov.SourceID == "" || seen[prov.SourceID] {
+			continue
+		}
+		seen[prov.SourceID] = true
+		ret = append(ret, prov.SourceID)
+	}
+	return ret
+}
+
+// the tombstone for email; nil (and no error) if it hasn't been erased, which is always the case without a
+// lookup key
+func GetTombstone(ctx context.Context, cli util.DynamoDBAPI, tableName string, keys *KeyHasher, email string) (*Tombstone, error) {
+	if cli == nil {
+		return nil, errors.New("passed dynamodb client was nil")
+	}
+	if keys == nil {
+		return nil, nil
+	}
+	domain, user, err := SplitAddress(email)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := cli.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key:       map[string]types.AttributeValue{"tombstoneKey": &types.AttributeValueMemberS{Value: keys.TombstoneKey(domain, user)}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tombstone: %s", err)
+	}
+	if len(res.Item) == 0 {
+		return nil, nil
+	}
+
+	ts := &Tombstone{}
+	if err := attributevalue.UnmarshalMap(res.Item, ts); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tombstone: %s", err)
+	}
+	return ts, nil
+}
+
+// which of tombstoneKeys have a tombstone; used by ingests to drop erased addresses a batch at a time
+func Tombstoned(ctx context.Context, cli util.DynamoDBAPI, tableName string, tombstoneKeys []string) (map[string]bool, error) {
+	if cli == nil {
+		return nil, errors.New("passed dynamodb client was nil")
+	}
+
+	ret := map[string]bool{}
+	for start := 0; start < len(tombstoneKeys); start += batchGetLimit {
+		end := min(start+batchGetLimit, len(tombstoneKeys))
+
+		var reqKeys []map[string]types.AttributeValue
+		seen := map[string]bool{}
+		for _, key := range tombstoneKeys[start:end] {
+			if !seen[key] { // BatchGetItem refuses duplicates
+				seen[key] = true
+				reqKeys = append(reqKeys, map[string]types.AttributeValue{"tombstoneKey": &types.AttributeValueMemberS{Value: key}})
+			}
+		}
+
+		if err := batchGet(ctx, cli, tableName, "tombstones", reqKeys, func(item map[string]types.AttributeValue) {
+			ret[stringAttr(item["tombstoneKey"])] = true
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,68 @@
+package credstore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// lookup keys shorter than this are refused
+const MIN_LOOKUP_KEY_SIZE = 32
+
+// turns a credential's domain/user into the key it's stored under. a nil *KeyHasher (the default) stores
+// them canonical, trimmed and lowercased, but readable; otherwise both are HMAC-SHA256 (hex) of the canonical values
+// under a server-side lookup key, so a dump of the table doesn't give away whose credentials are in it. the
+// same domain hashes the same everywhere (it's still the partition key, so domain lookups work); usernames
+// are hashed along with their domain, so the same name in two domains can't be matched up
+//
+// the lookup key can't be rotated without rewriting every item, and is separate from the master keys
+// for exactly that reason
+type KeyHasher struct {
+	secret []byte
+}
+
+func NewKeyHasher(secret []byte) (*KeyHasher, error) {
+	if len(secret) < MIN_LOOKUP_KEY_SIZE {
+		return nil, fmt.Errorf("lookup key is %d bytes, want at least %d", len(secret), MIN_LOOKUP_KEY_SIZE)
+	}
+	return &KeyHasher{secret: secret}, nil
+}
+
+// what hashed keys are computed from (and what's compared); domains and usernames are case-insensitive
+func CanonicalIdentity(domain, user string) (string, string) {
+	return strings.ToLower(strings.TrimSpace(domain)), strings.ToLower(strings.TrimSpace(user))
+}
+
+func (kh *KeyHasher) mac(parts ...string) string {
+	mac := hmac.New(sha256.New, kh.secret)
+	mac.Write([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// the partition key for domain
+func (kh *KeyHasher) DomainKey(domain string) string {
+	domain, _ = CanonicalIdentity(domain, "")
+	if kh == nil {
+		return domain
+	}
+	return kh.mac("domain", domain)
+}
+
+// the stored key for domain/user
+func (kh *KeyHasher) Key(domain, user string) CredentialKey {
+	domain, user = CanonicalIdentity(domain, user)
+	if kh == nil {
+		return CredentialKey{Domain: domain, User: user}
+	}
+	return CredentialKey{Domain: kh.mac("domain", domain), User: kh.mac("user", domain, user)}
+}
+
+// what an erased address's tombstone is stored under: an HMAC of the canonical address under the lookup key.
+// there's no tombstone without a lookup key (a plain hash of an address is a dictionary attack away from the
+// address), so callers check for one first; see Erase
+func (kh *KeyHasher) TombstoneKey(domain, user string) string {
+	domain, user = CanonicalIdentity(domain, user)
+	return kh.mac("tombstone", domain, user)
+}
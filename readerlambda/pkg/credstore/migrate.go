@@ -0,0 +1,457 @@
+package credstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/envelope"
+	"github.com/newodahs/readerlambda/pkg/sources"
+	"github.com/newodahs/readerlambda/pkg/util"
+)
+
+const (
+	DEFAULT_MIGRATE_SEGMENTS  = 4
+	DEFAULT_MIGRATE_PAGE_SIZE = 100
+)
+
+// what a migration does to the items it selects
+const (
+	MIGRATE_SCHEMA = "schema"   // rewrite items stored at an older schema version at the current one
+	MIGRATE_REKEY  = "rekey"    // re-wrap sealed passwords with the current master key (and seal any plaintext ones)
+	MIGRATE_HASH   = "hashkeys" // move credentials stored under plain domain/user to their hashed keys (see KeyHasher), or their canonical ones without a lookup key
+)
+
+// where a migration of the credential table has got to; persist it (see Migrator.OnProgress) and hand it
+// back to Run to carry on after an interruption
+type MigrationState struct {
+	Kind          string          `json:"kind,omitempty"` // MIGRATE_SCHEMA if empty (state files from before re-keying)
+	Table         string          `json:"table"`
+	TargetVersion int             `json:"targetVersion"`
+	TargetKeyID   string          `json:"targetKeyId,omitempty"` // rekey only: the master key everything ends up wrapped by
+	Segments      []*SegmentState `json:"segments"`
+}
+
+// one parallel scan segment; After is the last key handled, so a resumed scan starts just past it
+type SegmentState struct {
+	Segment  int            `json:"segment"`
+	Done     bool           `json:"done"`
+	After    *CredentialKey `json:"after,omitempty"`
+	Scanned  int            `json:"scanned"`  // old-version items looked at
+	Migrated int            `json:"migrated"` // rewritten at the target version
+	Skipped  int            `json:"skipped"`  // changed underneath us (e.g. by an ingest, which writes the new version anyway)
+	Failed   int            `json:"failed"`   // couldn't be decoded or written; left as they were
+}
+
+func NewMigrationState(tableName string, segments int) *MigrationState {
+	if segments <= 0 {
+		segments = DEFAULT_MIGRATE_SEGMENTS
+	}
+	state := &MigrationState{Kind: MIGRATE_SCHEMA, Table: tableName, TargetVersion: credparser.CREDENTIAL_SCHEMA_VERSION}
+	for i := range segments {
+		state.Segments = append(state.Segments, &SegmentState{Segment: i})
+	}
+	return state
+}
+
+// a migration that moves every credential's passwords under the master key keyID (the cipher's current one)
+func NewRekeyState(tableName string, segments int, keyID string) *MigrationState {
+	state := NewMigrationState(tableName, segments)
+	state.Kind = MIGRATE_REKEY
+	state.TargetKeyID = keyID
+	return state
+}
+
+// a migration that moves every credential still stored under its plain domain/user to its hashed key
+func NewHashKeysState(tableName string, segments int) *MigrationState {
+	state := NewMigrationState(tableName, segments)
+	state.Kind = MIGRATE_HASH
+	return state
+}
+
+func (ms *MigrationState) IsRekey() bool {
+	return ms.Kind == MIGRATE_REKEY
+}
+
+func (ms *MigrationState) IsHashKeys() bool {
+	return ms.Kind == MIGRATE_HASH
+}
+
+func (ms *MigrationState) Done() bool {
+	for _, seg := range ms.Segments {
+		if !seg.Done {
+			return false
+		}
+	}
+	return true
+}
+
+// totals across every segment
+func (ms *MigrationState) Totals() SegmentState {
+	var ret SegmentState
+	ret.Done = ms.Done()
+	for _, seg := range ms.Segments {
+		ret.Scanned += seg.Scanned
+		ret.Migrated += seg.Migrated
+		ret.Skipped += seg.Skipped
+		ret.Failed += seg.Failed
+	}
+	return ret
+}
+
+// rewrites every credential stored at an older schema version at the current one (or, for a rekey, every
+// credential whose passwords aren't sealed under the current master key, or for hashkeys every credential
+// not stored under a hashed key); the table is split into segments
+// scanned in parallel, each advancing a page at a time, so an interrupted run picks up where it left off.
+// safe to run alongside ingests: an item is only rewritten if it hasn't changed since it was read
+type Migrator struct {
+	DynDBCli  util.DynamoDBAPI
+	Cipher    *envelope.Cipher // passwords are sealed with this when rewritten; required for a rekey or hashkeys
+	Keys      *KeyHasher       // hashkeys only: the lookup key credentials are moved under; nil just canonicalises plain keys
+	LinkTable string           // hashkeys only: source links are moved along with their credentials
+	PageSize  int              // items evaluated per scan request
+	DryRun    bool             // decode and count, but don't write anything
+
+	// optional; called after every page (never concurrently) with the updated state, e.g. to save it
+	OnProgress func(state *MigrationState) error
+}
+
+func NewMigrator(cli util.DynamoDBAPI) *Migrator {
+	return &Migrator{DynDBCli: cli, PageSize: DEFAULT_MIGRATE_PAGE_SIZE}
+}
+
+// runs (or resumes) state until every segment is done, ctx is cancelled or progress can't be saved
+func (m *Migrator) Run(ctx context.Context, state *MigrationState) error {
+	if m.DynDBCli == nil {
+		return errors.New("passed dynamodb client was nil")
+	}
+	if state == nil || len(state.Segments) == 0 {
+		return errors.New("no migration state passed")
+	}
+	if state.TargetVersion != credparser.CREDENTIAL_SCHEMA_VERSION {
+		return fmt.Errorf("migration state targets schema version %d, this code writes %d; start a new migration", state.TargetVersion, credparser.CREDENTIAL_SCHEMA_VERSION)
+	}
+	switch state.Kind {
+	case "", MIGRATE_SCHEMA:
+	case MIGRATE_REKEY:
+		if m.Cipher == nil {
+			return errors.New("re-keying needs a key provider")
+		}
+		if state.TargetKeyID != m.Cipher.CurrentKeyID() {
+			return fmt.Errorf("migration state re-keys to master key [%s] but the current one is [%s]; start a new migration", state.TargetKeyID, m.Cipher.CurrentKeyID())
+		}
+	case MIGRATE_HASH:
+		if m.Keys != nil && m.Cipher == nil {
+			return errors.New("moving to hashed keys needs a key provider")
+		}
+		if m.LinkTable == "" {
+			return errors.New("moving to hashed keys needs the source links table")
+		}
+	default:
+		return fmt.Errorf("unknown migration kind [%s]", state.Kind)
+	}
+
+	var mu sync.Mutex // guards state (and OnProgress) across the segment goroutines
+	progress := func() error {
+		if m.OnProgress == nil {
+			return nil
+		}
+		return m.OnProgress(state)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(state.Segments))
+	for idx, seg := range state.Segments {
+		if seg.Done {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := m.runSegment(ctx, state, seg, &mu, progress); err != nil {
+				errs[idx] = fmt.Errorf("segment %d: %s", seg.Segment, err)
+				cancel() // no point carrying on if we can't record where we are
+			}
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+func (m *Migrator) runSegment(ctx context.Context, state *MigrationState, seg *SegmentState, mu *sync.Mutex, progress func() error) error {
+	pageSize := m.PageSize
+	if pageSize <= 0 {
+		pageSize = DEFAULT_MIGRATE_PAGE_SIZE
+	}
+
+	for !seg.Done {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		input := &dynamodb.ScanInput{
+			TableName:     aws.String(state.Table),
+			Segment:       aws.Int32(int32(seg.Segment)),
+			TotalSegments: aws.Int32(int32(len(state.Segments))),
+			Limit:         aws.Int32(int32(pageSize)),
+		}
+		switch {
+		case state.IsHashKeys():
+			input.FilterExpression = aws.String("attribute_not_exists(#i)") // hashed keys always come with a sealed identity
+			input.ExpressionAttributeNames = map[string]string{"#i": ATTR_IDENTITY_ENC}
+		case state.IsRekey():
+			input.FilterExpression = aws.String("attribute_exists(#p) OR #e.#k.#id <> :key OR #i.#k.#id <> :key")
+			input.ExpressionAttributeNames = map[string]string{"#p": ATTR_PASSWORD, "#e": ATTR_PASSWORD_ENC, "#i": ATTR_IDENTITY_ENC, "#k": "key", "#id": "keyId"}
+			input.ExpressionAttributeValues = map[string]types.AttributeValue{
+				":key": &types.AttributeValueMemberS{Value: state.TargetKeyID},
+			}
+		default:
+			input.FilterExpression = aws.String("attribute_not_exists(#v) OR #v < :target")
+			input.ExpressionAttributeNames = map[string]string{"#v": ATTR_SCHEMA_VERSION}
+			input.ExpressionAttributeValues = map[string]types.AttributeValue{
+				":target": &types.AttributeValueMemberN{Value: strconv.Itoa(state.TargetVersion)},
+			}
+		}
+		mu.Lock()
+		if seg.After != nil {
+			input.ExclusiveStartKey = credentialKeyItem(*seg.After)
+		}
+		mu.Unlock()
+
+		res, err := m.DynDBCli.Scan(ctx, input)
+		if err != nil {
+			return fmt.Errorf("failed to scan credentials: %s", err)
+		}
+
+		var page SegmentState
+		for _, item := range res.Items {
+			page.Scanned++
+			migrate := m.migrateItem
+			switch {
+			case state.IsRekey():
+				migrate = m.rekeyItem
+			case state.IsHashKeys():
+				migrate = m.hashItem
+			}
+			switch migrate(ctx, state.Table, item) {
+			case migrateOK:
+				page.Migrated++
+			case migrateSkipped:
+				page.Skipped++
+			case migrateFailed:
+				page.Failed++
+			}
+		}
+
+		mu.Lock()
+		seg.Scanned += page.Scanned
+		seg.Migrated += page.Migrated
+		seg.Skipped += page.Skipped
+		seg.Failed += page.Failed
+		if len(res.LastEvaluatedKey) == 0 {
+			seg.Done = true
+		} else {
+			seg.After = &CredentialKey{Domain: stringAttr(res.LastEvaluatedKey["domainname"]), User: stringAttr(res.LastEvaluatedKey["username"])}
+		}
+		progressErr := progress()
+		mu.Unlock()
+		if progressErr != nil {
+			return fmt.Errorf("failed to save migration progress: %s", progressErr)
+		}
+	}
+	return nil
+}
+
+type migrateResult int
+
+const (
+	migrateOK migrateResult = iota
+	migrateSkipped
+	migrateFailed
+)
+
+func (m *Migrator) migrateItem(ctx context.Context, tableName string, item map[string]types.AttributeValue) migrateResult {
+	cred, err := DecodeCredential(item)
+	if err != nil {
+		log.Printf("WARNING: failed to decode credential [%s@%s]: %s", stringAttr(item["username"]), stringAttr(item["domainname"]), err)
+		return migrateFailed
+	}
+	if cred.SchemaVersion >= credparser.CREDENTIAL_SCHEMA_VERSION {
+		return migrateSkipped // the filter should have kept these out
+	}
+	if m.DryRun {
+		return migrateOK
+	}
+
+	toStore, err := EncodeCredential(ctx, m.Cipher, nil, cred) // keys stay as they are, hashed or not; moving them is hashkeys' job
+	if err != nil {
+		log.Printf("WARNING: %s", err)
+		return migrateFailed
+	}
+
+	// only if nobody has rewritten it since we read it
+	input := &dynamodb.PutItemInput{
+		TableName:                aws.String(tableName),
+		Item:                     toStore,
+		ExpressionAttributeNames: map[string]string{"#v": ATTR_SCHEMA_VERSION},
+	}
+	if _, versioned := item[ATTR_SCHEMA_VERSION]; versioned {
+		input.ConditionExpression = aws.String("#v = :read")
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{":read": item[ATTR_SCHEMA_VERSION]}
+	} else {
+		input.ConditionExpression = aws.String("attribute_not_exists(#v)")
+	}
+
+	return m.putItem(ctx, input, cred)
+}
+
+// sealed passwords (and identities) only need their data key re-wrapped, the values are left alone;
+// plaintext ones get sealed. either way the write only goes through if the item is still as we read it
+func (m *Migrator) rekeyItem(ctx context.Context, tableName string, item map[string]types.AttributeValue) migrateResult {
+	cred, err := DecodeCredential(item)
+	if err != nil {
+		log.Printf("WARNING: failed to decode credential [%s@%s]: %s", stringAttr(item["username"]), stringAttr(item["domainname"]), err)
+		return migrateFailed
+	}
+
+	sealed := map[string]*envelope.Envelope{ATTR_PASSWORD_ENC: cred.Sealed, ATTR_IDENTITY_ENC: cred.SealedIdentity}
+	if m.DryRun {
+		if len(cred.Password) > 0 {
+			return migrateOK
+		}
+		for _, env := range sealed {
+			if env != nil && env.Key.KeyID != m.Cipher.CurrentKeyID() {
+				return migrateOK
+			}
+		}
+		return migrateSkipped
+	}
+
+	input := &dynamodb.PutItemInput{TableName: aws.String(tableName)}
+	if len(cred.Password) > 0 {
+		if input.Item, err = EncodeCredential(ctx, m.Cipher, nil, cred); err != nil {
+			log.Printf("WARNING: %s", err)
+			return migrateFailed
+		}
+		input.ConditionExpression = aws.String("attribute_exists(#p)")
+		input.ExpressionAttributeNames = map[string]string{"#p": ATTR_PASSWORD}
+		return m.putItem(ctx, input, cred)
+	}
+
+	var conds []string
+	input.ExpressionAttributeNames = map[string]string{"#k": "key", "#id": "keyId"}
+	input.ExpressionAttributeValues = map[string]types.AttributeValue{}
+	changed := false
+	for _, attr := range []string{ATTR_PASSWORD_ENC, ATTR_IDENTITY_ENC} {
+		env := sealed[attr]
+		if env == nil {
+			continue
+		}
+		readKeyID := env.Key.KeyID
+		wrapped, wrapErr := m.Cipher.Rewrap(ctx, env)
+		if wrapErr != nil {
+			log.Printf("WARNING: failed to re-wrap credential [%s@%s]: %s", cred.User, cred.Domain, wrapErr)
+			return migrateFailed
+		}
+		changed = changed || wrapped
+
+		// #a0.#k.#id = :a0 and so on
+		name := fmt.Sprintf("a%d", len(conds))
+		conds = append(conds, fmt.Sprintf("#%s.#k.#id = :%s", name, name))
+		input.ExpressionAttributeNames["#"+name] = attr
+		input.ExpressionAttributeValues[":"+name] = &types.AttributeValueMemberS{Value: readKeyID}
+	}
+	if !changed {
+		return migrateSkipped
+	}
+	input.Item = cred.GetKey()
+	input.ConditionExpression = aws.String(strings.Join(conds, " AND "))
+	return m.putItem(ctx, input, cred)
+}
+
+// stores the credential under its hashed key (merged with anything already there, e.g. from an ingest since
+// the lookup key was turned on, or a differently cased copy), moves its source links and then deletes the
+// plain item, if it's still as we read it. an interruption part way leaves both; running again finishes it.
+// without a lookup key the same goes for plain items whose key isn't canonical (from before it was)
+func (m *Migrator) hashItem(ctx context.Context, tableName string, item map[string]types.AttributeValue) migrateResult {
+	cred, err := DecodeCredential(item)
+	if err != nil {
+		log.Printf("WARNING: failed to decode credential [%s@%s]: %s", stringAttr(item["username"]), stringAttr(item["domainname"]), err)
+		return migrateFailed
+	}
+	if cred.SealedIdentity != nil {
+		return migrateSkipped // the filter should have kept these out
+	}
+	plain := CredentialKey{Domain: cred.Domain, User: cred.User}
+	if m.Keys == nil && m.Keys.Key(plain.Domain, plain.User) == plain {
+		return migrateSkipped // already where it belongs
+	}
+	if m.DryRun {
+		return migrateOK
+	}
+
+	if err := OpenCredential(ctx, m.Cipher, cred); err != nil {
+		log.Printf("WARNING: %s", err)
+		return migrateFailed
+	}
+	if cred.Email == "" {
+		cred.Email = cred.User + "@" + cred.Domain // the original items had no email
+	}
+	if _, err := StoreCredential(ctx, m.DynDBCli, tableName, m.Cipher, m.Keys, cred); err != nil {
+		log.Printf("WARNING: failed to move credential [%s@%s] to its hashed key: %s", plain.User, plain.Domain, err)
+		return migrateFailed
+	}
+
+	key := m.Keys.Key(cred.Domain, cred.User)
+	for _, sourceID := range SourceIDs(cred) {
+		if err := sources.Link(ctx, m.DynDBCli, m.LinkTable, sourceID, &credparser.CredentialInfo{Domain: key.Domain, User: key.User}); err != nil {
+			log.Printf("WARNING: %s", err)
+			return migrateFailed
+		}
+		if err := sources.Unlink(ctx, m.DynDBCli, m.LinkTable, sourceID, plain.Domain, plain.User); err != nil {
+			log.Printf("WARNING: %s", err)
+			return migrateFailed
+		}
+	}
+
+	unchanged := storedUnchanged(item)
+	if _, err := m.DynDBCli.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                 aws.String(tableName),
+		Key:                       credentialKeyItem(plain),
+		ConditionExpression:       unchanged.ConditionExpression,
+		ExpressionAttributeNames:  unchanged.ExpressionAttributeNames,
+		ExpressionAttributeValues: unchanged.ExpressionAttributeValues,
+	}); err != nil {
+		var condFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &condFailed) {
+			return migrateSkipped // changed since we read it; the next run moves what's new
+		}
+		log.Printf("WARNING: failed to delete plain credential [%s@%s]: %s", plain.User, plain.Domain, err)
+		return migrateFailed
+	}
+	return migrateOK
+}
+
+func (m *Migrator) putItem(ctx context.Context, input *dynamodb.PutItemInput, cred *credparser.CredentialInfo) migrateResult {
+	if _, putErr := m.DynDBCli.PutItem(ctx, input); putErr != nil {
+		var condFailed *types.ConditionalCheckFailedException
+		if errors.As(putErr, &condFailed) {
+			return migrateSkipped
+		}
+		log.Printf("WARNING: failed to rewrite credential [%s@%s]: %s", cred.User, cred.Domain, putErr)
+		return migrateFailed
+	}
+	return migrateOK
+}
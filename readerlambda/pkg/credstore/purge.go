@@ -0,0 +1,175 @@
+package credstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/newodahs/readerlambda/pkg/sources"
+	"github.com/newodahs/readerlambda/pkg/util"
+)
+
+const DEFAULT_PURGE_PAGE_SIZE = 100
+
+// what a purge did
+type PurgeStats struct {
+	Scanned   int `json:"scanned"`   // items with at least one expired password
+	Deleted   int `json:"deleted"`   // every password had expired; the item (and its source links) are gone
+	Trimmed   int `json:"trimmed"`   // only some had; those were removed and the rest kept
+	Passwords int `json:"passwords"` // passwords removed, across both
+	Skipped   int `json:"skipped"`   // changed underneath us (e.g. by an ingest); the next purge picks them up
+	Failed    int `json:"failed"`    // couldn't be decoded or written; left as they were
+}
+
+// hard-deletes what the retention policy says has expired: credentials whose passwords have all expired
+// are removed, and expired passwords are removed from credentials that still have some in retention.
+// dynamodb's TTL (on expiresAt) gets around to whole items eventually by itself, but takes its time and
+// can't touch individual passwords
+//
+// safe to run alongside ingests: an item is only changed if it hasn't been since it was read
+type Purger struct {
+	DynDBCli  util.DynamoDBAPI
+	CredTable string
+	LinkTable string           // source links of removed credentials are deleted from here; empty leaves them
+	PageSize  int              // items evaluated per scan request
+	DryRun    bool             // count what would be removed, but don't change anything
+	Now       func() time.Time // nil for time.Now
+}
+
+func NewPurger(cli util.DynamoDBAPI, credTable, linkTable string) *Purger {
+	return &Purger{DynDBCli: cli, CredTable: credTable, LinkTable: linkTable, PageSize: DEFAULT_PURGE_PAGE_SIZE}
+}
+
+// purges everything expired as of now; stops early (returning what it got through and ctx's error) if ctx
+// is done, in which case the next run simply starts over
+func (p *Purger) Run(ctx context.Context) (PurgeStats, error) {
+	var stats PurgeStats
+	if p.DynDBCli == nil {
+		return stats, errors.New("passed dynamodb client was nil")
+	}
+
+	now := time.Now()
+	if p.Now != nil {
+		now = p.Now()
+	}
+	pageSize := p.PageSize
+	if pageSize <= 0 {
+		pageSize = DEFAULT_PURGE_PAGE_SIZE
+	}
+
+	input := &dynamodb.ScanInput{
+		TableName:                aws.String(p.CredTable),
+		Limit:                    aws.Int32(int32(pageSize)),
+		FilterExpression:         aws.String("#n <= :now"),
+		ExpressionAttributeNames: map[string]string{"#n": ATTR_NEXT_EXPIRY},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+
+		res, err := p.DynDBCli.Scan(ctx, input)
+		if err != nil {
+			return stats, fmt.Errorf("failed to scan credentials: %s", err)
+		}
+		for _, item := range res.Items {
+			stats.Scanned++
+			p.purgeItem(ctx, item, now, &stats)
+		}
+
+		if len(res.LastEvaluatedKey) == 0 {
+			return stats, nil
+		}
+		input.ExclusiveStartKey = res.LastEvaluatedKey
+	}
+}
+
+func (p *Purger) purgeItem(ctx context.Context, item map[string]types.AttributeValue, now time.Time, stats *PurgeStats) {
+	domain, user := stringAttr(item["domainname"]), stringAttr(item["username"]) // as stored, hashed or not
+	cred, err := DecodeCredential(item)
+	if err != nil {
+		log.Printf("WARNING: failed to decode credential [%s@%s]: %s", user, domain, err)
+		stats.Failed++
+		return
+	}
+
+	before := map[string]bool{}
+	for _, prov := range cred.Provenance {
+		before[prov.SourceID] = true
+	}
+	dropped := cred.DropExpired(now)
+	if dropped == 0 {
+		stats.Skipped++ // nothing due after all, or sealed passwords we can't line up with their provenance
+		return
+	}
+	if p.DryRun {
+		p.count(stats, len(cred.Provenance) == 0, dropped)
+		return
+	}
+
+	// only if nobody has added (or re-seen) a password since we read it
+	cond := aws.String("#prov = :prov")
+	names := map[string]string{"#prov": "provenance"}
+	values := map[string]types.AttributeValue{":prov": item["provenance"]}
+
+	var writeErr error
+	if len(cred.Provenance) == 0 {
+		_, writeErr = p.DynDBCli.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName:                 aws.String(p.CredTable),
+			Key:                       credentialKeyItem(CredentialKey{Domain: domain, User: user}),
+			ConditionExpression:       cond,
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: values,
+		})
+	} else {
+		_, writeErr = p.DynDBCli.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:                 aws.String(p.CredTable),
+			Item:                      cred.GetKey(), // still sealed (if it was); the remaining values are untouched
+			ConditionExpression:       cond,
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: values,
+		})
+	}
+	if writeErr != nil {
+		var condFailed *types.ConditionalCheckFailedException
+		if errors.As(writeErr, &condFailed) {
+			stats.Skipped++
+			return
+		}
+		log.Printf("WARNING: failed to purge credential [%s@%s]: %s", user, domain, writeErr)
+		stats.Failed++
+		return
+	}
+	p.count(stats, len(cred.Provenance) == 0, dropped)
+
+	// the credential no longer has anything from these sources
+	for _, prov := range cred.Provenance {
+		delete(before, prov.SourceID)
+	}
+	for sourceID := range before {
+		if sourceID == "" || p.LinkTable == "" {
+			continue
+		}
+		if unlinkErr := sources.Unlink(ctx, p.DynDBCli, p.LinkTable, sourceID, domain, user); unlinkErr != nil {
+			log.Printf("WARNING: %s", unlinkErr)
+		}
+	}
+}
+
+func (p *Purger) count(stats *PurgeStats, deleted bool, dropped int) {
+	if deleted {
+		stats.Deleted++
+	} else {
+		stats.Trimmed++
+	}
+	stats.Passwords += dropped
+}
@@ -0,0 +1,100 @@
+package credstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/util"
+)
+
+// how many times SetRemediation re-reads a credential that changed underneath it before giving up
+const remediationAttempts = 3
+
+// returned by SetRemediation when an index doesn't name one of the credential's passwords
+var ErrNoSuchPassword = errors.New("no such password")
+
+// a remediation update for one credential
+type RemediationUpdate struct {
+	Status    credparser.RemediationStatus
+	By        string
+	Notes     string
+	Passwords []int     // indexes into the credential's passwords (as listed by the api); empty updates all of them
+	At        time.Time // zero for now
+}
+
+// records update against the passwords of the credential stored for email, leaving everything else about
+// it (sealed passwords included) as it was; keys must match how credentials are stored. returns the updated
+// credential, or nil (and no error) if there isn't one
+//
+// only written if nothing else (e.g. an ingest) changed the passwords since we read them; if something did
+// it's read again and retried
+func SetRemediation(ctx context.Context, cli util.DynamoDBAPI, tableName string, keys *KeyHasher, email string, update RemediationUpdate) (*credparser.CredentialInfo, error) {
+	if cli == nil {
+		return nil, errors.New("passed dynamodb client was nil")
+	}
+	domain, user, err := SplitAddress(email)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(update.By) == "" {
+		return nil, errors.New("remediation update must say who made it")
+	}
+	if update.At.IsZero() {
+		update.At = time.Now()
+	}
+
+	key := keys.Key(domain, user)
+	for attempt := 0; attempt < remediationAttempts; attempt++ {
+		res, err := cli.GetItem(ctx, &dynamodb.GetItemInput{TableName: aws.String(tableName), Key: credentialKeyItem(key)})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get credential: %s", err)
+		}
+		if len(res.Item) == 0 {
+			return nil, nil
+		}
+		cred, err := DecodeCredential(res.Item)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode credential: %s", err)
+		}
+
+		indexes := update.Passwords
+		if len(indexes) == 0 {
+			for idx := range cred.Provenance {
+				indexes = append(indexes, idx)
+			}
+		}
+		for _, idx := range indexes {
+			if idx < 0 || idx >= len(cred.Provenance) {
+				return nil, fmt.Errorf("%w: %d (the credential has %d)", ErrNoSuchPassword, idx, len(cred.Provenance))
+			}
+			cred.Provenance[idx].Remediation = &credparser.Remediation{
+				Status: update.Status,
+				By:     strings.TrimSpace(update.By),
+				At:     update.At.UTC(),
+				Notes:  update.Notes,
+			}
+		}
+		cred.UpdateStatus()
+
+		put := storedUnchanged(res.Item) // items from before provenance existed don't have one to compare
+		put.TableName = aws.String(tableName)
+		put.Item = cred.GetKey() // written back as read; sealed passwords stay sealed
+		_, err = cli.PutItem(ctx, put)
+		var condFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &condFailed) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to store remediation: %s", err)
+		}
+		return cred, nil
+	}
+	return nil, fmt.Errorf("credential kept changing while recording remediation; gave up after %d attempts", remediationAttempts)
+}
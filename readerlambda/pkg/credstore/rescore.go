@@ -0,0 +1,161 @@
+package credstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/envelope"
+	"github.com/newodahs/readerlambda/pkg/severity"
+	"github.com/newodahs/readerlambda/pkg/sources"
+	"github.com/newodahs/readerlambda/pkg/util"
+)
+
+// the tables a rescore reads
+type RescoreTables struct {
+	Credentials string
+	Sources     string // for the breach dates of passwords ingested before they were kept on the provenance; empty skips
+}
+
+// what a rescore did
+type RescoreStats struct {
+	Credentials int `json:"credentials"`
+	Updated     int `json:"updated"`    // scores that changed and were written
+	Skipped     int `json:"skipped"`    // changed (so rescored) by something else while we were at it, or gone
+	Unreadable  int `json:"unreadable"` // couldn't be read or decrypted
+	Failed      int `json:"failed"`     // couldn't be written
+}
+
+// a credential read for rescoring
+type rescoreEntry struct {
+	key       CredentialKey
+	cred      *credparser.CredentialInfo // opened
+	passwords []string                   // distinct
+}
+
+// recomputes the severity of every credential stored for domain, including how many of the domain's
+// accounts share each password (which scoring at ingest can't know). only changed scores are written, and
+// only the score: everything else is left as stored. cipher and keys must match how credentials are stored
+func Rescore(ctx context.Context, cli util.DynamoDBAPI, tables RescoreTables, cipher *envelope.Cipher, keys *KeyHasher, domain string) (RescoreStats, error) {
+	var stats RescoreStats
+	if cli == nil {
+		return stats, errors.New("passed dynamodb client was nil")
+	}
+
+	breachDates := map[string]*time.Time{}
+	var entries []*rescoreEntry
+	failed, err := QueryDomain(ctx, cli, tables.Credentials, keys, domain, func(cred *credparser.CredentialInfo) error {
+		entry := &rescoreEntry{key: CredentialKey{Domain: cred.Domain, User: cred.User}, cred: cred}
+		if err := OpenCredential(ctx, cipher, cred); err != nil {
+			if errors.Is(err, ErrNoCipher) {
+				return err
+			}
+			stats.Unreadable++
+			return nil
+		}
+		for _, prov := range cred.Provenance {
+			if prov.BreachDate != nil || prov.SourceID == "" || tables.Sources == "" {
+				continue
+			}
+			date, cached := breachDates[prov.SourceID]
+			if !cached {
+				src, err := sources.Get(ctx, cli, tables.Sources, prov.SourceID)
+				if err != nil {
+					return err
+				}
+				if src != nil {
+					date = src.BreachDate
+				}
+				breachDates[prov.SourceID] = date
+			}
+			prov.BreachDate = date // only for scoring; the provenance isn't written back
+		}
+		entry.passwords = slices.Compact(slices.Sorted(slices.Values(cred.Password)))
+		entries = append(entries, entry)
+		return nil
+	})
+	stats.Unreadable += failed
+	if err != nil {
+		return stats, err
+	}
+
+	// password => how many of the domain's accounts have it
+	holders := map[string]int{}
+	for _, entry := range entries {
+		for _, password := range entry.passwords {
+			holders[password]++
+		}
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		stats.Credentials++
+		reuse := 0
+		for _, password := range entry.passwords {
+			reuse = max(reuse, holders[password]-1)
+		}
+		sev := severity.Score(entry.cred, reuse, now)
+		if severity.Same(sev, entry.cred.Severity) {
+			continue
+		}
+
+		written, err := writeSeverity(ctx, cli, tables.Credentials, entry, sev)
+		switch {
+		case ctx.Err() != nil:
+			return stats, ctx.Err()
+		case err != nil:
+			stats.Failed++
+		case written:
+			stats.Updated++
+		default:
+			stats.Skipped++
+		}
+	}
+	return stats, nil
+}
+
+// sets the stored credential's severity, leaving the rest of the item (sealed passwords included) as
+// stored. if its passwords changed since it was scored (an ingest, which scores it as it stores it) it's
+// left alone; returns false then, or if the credential has gone
+func writeSeverity(ctx context.Context, cli util.DynamoDBAPI, tableName string, entry *rescoreEntry, sev *credparser.Severity) (bool, error) {
+	av, err := attributevalue.Marshal(sev)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal severity: %s", err)
+	}
+
+	res, err := cli.GetItem(ctx, &dynamodb.GetItemInput{TableName: aws.String(tableName), Key: credentialKeyItem(entry.key)})
+	if err != nil {
+		return false, fmt.Errorf("failed to get credential: %s", err)
+	}
+	if len(res.Item) == 0 {
+		return false, nil
+	}
+	current, err := DecodeCredential(res.Item)
+	if err != nil {
+		return false, fmt.Errorf("failed to decode credential: %s", err)
+	}
+	if len(current.Provenance) != len(entry.cred.Provenance) {
+		return false, nil
+	}
+
+	input := storedUnchanged(res.Item)
+	input.TableName = aws.String(tableName)
+	input.Item = res.Item
+	input.Item["severity"] = av
+	_, err = cli.PutItem(ctx, input)
+	var condFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &condFailed) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to store severity: %s", err)
+	}
+	return true, nil
+}
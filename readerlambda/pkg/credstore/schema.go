@@ -0,0 +1,233 @@
+package credstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/envelope"
+)
+
+// attribute every credential item carries its stored shape's version in (see credparser.CREDENTIAL_SCHEMA_VERSION)
+const ATTR_SCHEMA_VERSION = "schemaVersion"
+
+// where passwords are kept: in plaintext, or sealed (see EncodeCredential)
+const (
+	ATTR_PASSWORD     = "password"
+	ATTR_PASSWORD_ENC = "passwordEnc"
+)
+
+// where the domain/user/email of a credential stored under hashed keys are kept, sealed
+const ATTR_IDENTITY_ENC = "identityEnc"
+
+// when a credential expires as a whole (the table's TTL attribute) and when its first password does (see
+// credparser.CredentialInfo.UpdateExpiry)
+const (
+	ATTR_EXPIRES_AT  = "expiresAt"
+	ATTR_NEXT_EXPIRY = "nextExpiry"
+)
+
+// the credential's overall remediation status (see credparser.CredentialInfo.UpdateStatus)
+const ATTR_REMEDIATION_STATUS = "remediationStatus"
+
+// reads one stored version of a credential item into the current struct
+type credentialDecoder func(item map[string]types.AttributeValue) (*credparser.CredentialInfo, error)
+
+var credentialDecoders = map[int]credentialDecoder{
+	1: decodeCredentialV1,
+	2: decodeCredentialV2,
+	3: decodeCredentialV2, // only added passwordEnc, which the struct picks up (see EncodeCredential/OpenCredential)
+	4: decodeCredentialV2, // likewise identityEnc
+}
+
+// the version an item was stored as; items from before versioning have no attribute and are version 1
+func ItemSchemaVersion(item map[string]types.AttributeValue) (int, error) {
+	switch av := item[ATTR_SCHEMA_VERSION].(type) {
+	case nil:
+		return 1, nil
+	case *types.AttributeValueMemberN:
+		version, err := strconv.Atoi(av.Value)
+		if err != nil || version < 1 {
+			return 0, fmt.Errorf("bad %s [%s]", ATTR_SCHEMA_VERSION, av.Value)
+		}
+		return version, nil
+	}
+	return 0, fmt.Errorf("%s is not a number", ATTR_SCHEMA_VERSION)
+}
+
+// unmarshals a stored credential of any version we know, upgrading it to the current shape; SchemaVersion
+// on the result is the version it was stored as (writing it back stores the current version)
+func DecodeCredential(item map[string]types.AttributeValue) (*credparser.CredentialInfo, error) {
+	version, err := ItemSchemaVersion(item)
+	if err != nil {
+		return nil, err
+	}
+	if version > credparser.CREDENTIAL_SCHEMA_VERSION {
+		return nil, fmt.Errorf("credential schema version %d is newer than this code understands (%d)", version, credparser.CREDENTIAL_SCHEMA_VERSION)
+	}
+
+	decode, found := credentialDecoders[version]
+	if !found {
+		return nil, fmt.Errorf("no decoder for credential schema version %d", version)
+	}
+	cred, err := decode(item)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode version %d credential: %s", version, err)
+	}
+	cred.SchemaVersion = version
+	cred.UpdateStatus() // stored before remediation existed (or by hand) shows as new
+	cred.SealContext = []byte(stringAttr(item["domainname"]) + "\x00" + stringAttr(item["username"]))
+	return cred, nil
+}
+
+// the current shape; anything off is an error
+func decodeCredentialV2(item map[string]types.AttributeValue) (*credparser.CredentialInfo, error) {
+	cred := &credparser.CredentialInfo{}
+	if err := attributevalue.UnmarshalMap(item, cred); err != nil {
+		return nil, err
+	}
+	cred.AlignProvenance()
+	return cred, nil
+}
+
+// everything written before versioning: the original four attributes, later with provenance. these were
+// also loaded by hand/other tools, so be forgiving: a single password as a string or a string set, and
+// provenance entries that don't unmarshal are dropped rather than failing the whole credential
+func decodeCredentialV1(item map[string]types.AttributeValue) (*credparser.CredentialInfo, error) {
+	cred := &credparser.CredentialInfo{
+		User:   stringAttr(item["username"]),
+		Domain: stringAttr(item["domainname"]),
+		Email:  stringAttr(item["email"]),
+	}
+	if cred.Email == "" && cred.User != "" && cred.Domain != "" {
+		cred.Email = cred.User + "@" + cred.Domain
+	}
+
+	switch passwd := item[ATTR_PASSWORD].(type) {
+	case nil:
+	case *types.AttributeValueMemberS:
+		cred.Password = []string{passwd.Value}
+	case *types.AttributeValueMemberSS:
+		cred.Password = passwd.Value
+	case *types.AttributeValueMemberL:
+		for _, elem := range passwd.Value {
+			str, ok := elem.(*types.AttributeValueMemberS)
+			if !ok {
+				return nil, fmt.Errorf("password list holds a %T", elem)
+			}
+			cred.Password = append(cred.Password, str.Value)
+		}
+	default:
+		return nil, fmt.Errorf("password is a %T", passwd)
+	}
+
+	if provList, ok := item["provenance"].(*types.AttributeValueMemberL); ok {
+		for _, elem := range provList.Value {
+			prov := &credparser.Provenance{}
+			if err := attributevalue.Unmarshal(elem, prov); err != nil {
+				prov = &credparser.Provenance{}
+			}
+			cred.Provenance = append(cred.Provenance, prov)
+		}
+	}
+	if len(cred.Provenance) > len(cred.Password) {
+		cred.Provenance = cred.Provenance[:len(cred.Password)]
+	}
+	cred.AlignProvenance()
+
+	return cred, nil
+}
+
+func stringAttr(av types.AttributeValue) string {
+	if str, ok := av.(*types.AttributeValueMemberS); ok {
+		return str.Value
+	}
+	return ""
+}
+
+var ErrNoCipher = errors.New("credential is encrypted but no key provider is configured")
+
+// the item to store for cred, at the current version. with keys its domain/user are replaced by their hashes
+// and the identity is sealed in identityEnc (which needs a cipher); with a cipher the passwords are sealed
+// and only passwordEnc is written. both are bound to the stored key. without a cipher the passwords are
+// written as they are, and anything still sealed is written back sealed
+func EncodeCredential(ctx context.Context, cipher *envelope.Cipher, keys *KeyHasher, cred *credparser.CredentialInfo) (map[string]types.AttributeValue, error) {
+	toStore := *cred
+	toStore.Encrypted = false
+	toStore.SealContext = nil
+	if keys != nil {
+		if cipher == nil {
+			return nil, errors.New("storing credentials under hashed keys needs a key provider")
+		}
+		domain, user := CanonicalIdentity(cred.Domain, cred.User)
+		key := keys.Key(domain, user)
+		toStore.Domain, toStore.User, toStore.Email = key.Domain, key.User, ""
+
+		identity, err := cipher.Seal(ctx, toStore.SealingContext(), []string{domain, user, cred.Email})
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt identity for [%s]: %s", cred.Email, err)
+		}
+		toStore.SealedIdentity = identity
+	}
+
+	if cipher != nil && len(cred.Password) > 0 {
+		sealed, err := cipher.Seal(ctx, toStore.SealingContext(), cred.Password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt passwords for [%s]: %s", cred.Email, err)
+		}
+		toStore.Sealed = sealed
+		toStore.Password = nil
+	} else if toStore.Sealed != nil {
+		toStore.Password = nil // opened but we've no cipher to re-seal with; keep what was stored
+	}
+	return toStore.GetKey(), nil
+}
+
+// puts back the domain/user/email of a credential stored under hashed keys; a no-op for anything else
+func OpenIdentity(ctx context.Context, cipher *envelope.Cipher, cred *credparser.CredentialInfo) error {
+	if cred.SealedIdentity == nil {
+		return nil
+	}
+	if cipher == nil {
+		return ErrNoCipher
+	}
+
+	identity, err := cipher.Open(ctx, cred.SealedIdentity, cred.SealingContext())
+	if err != nil {
+		return fmt.Errorf("failed to decrypt identity for [%s@%s]: %s", cred.User, cred.Domain, err)
+	}
+	if len(identity) != 3 {
+		return fmt.Errorf("sealed identity for [%s@%s] has %d values", cred.User, cred.Domain, len(identity))
+	}
+	cred.SealContext = cred.SealingContext() // keep what the passwords were sealed against
+	cred.Domain, cred.User, cred.Email = identity[0], identity[1], identity[2]
+	cred.SealedIdentity = nil
+	return nil
+}
+
+// decrypts cred's identity (see OpenIdentity) and passwords into Password; a no-op for credentials stored
+// in plaintext
+func OpenCredential(ctx context.Context, cipher *envelope.Cipher, cred *credparser.CredentialInfo) error {
+	if err := OpenIdentity(ctx, cipher, cred); err != nil {
+		return err
+	}
+	if cred.Sealed == nil || (len(cred.Password) > 0 && !cred.Encrypted) {
+		return nil
+	}
+	if cipher == nil {
+		return ErrNoCipher
+	}
+
+	passwords, err := cipher.Open(ctx, cred.Sealed, cred.SealingContext())
+	if err != nil {
+		return fmt.Errorf("failed to decrypt passwords for [%s]: %s", cred.Email, err)
+	}
+	cred.Password = passwords
+	cred.Encrypted = false
+	cred.AlignProvenance()
+	return nil
+}
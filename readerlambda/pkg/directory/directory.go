@@ -0,0 +1,381 @@
+package directory
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// what a directory export is in
+type Format string
+
+const (
+	FORMAT_CSV  Format = "csv"
+	FORMAT_LDIF Format = "ldif"
+)
+
+// one person from the directory
+type Employee struct {
+	ID              string     `json:"id,omitempty"`
+	Name            string     `json:"name,omitempty"`
+	Email           string     `json:"email"`             // primary address, lowercased
+	Aliases         []string   `json:"aliases,omitempty"` // other addresses they receive mail at, lowercased
+	Active          bool       `json:"active"`
+	PasswordChanged *time.Time `json:"passwordChanged,omitempty"` // nil if the export didn't say (or it was never set)
+}
+
+// every address the employee could turn up in a dump under; primary first
+func (e *Employee) Addresses() []string {
+	return append([]string{e.Email}, e.Aliases...)
+}
+
+// a parsed export; entries with no email address (groups, service OUs, people without a mailbox) are skipped
+type Directory struct {
+	Employees []*Employee
+	Skipped   int
+}
+
+func ParseFormat(raw string) (Format, error) {
+	switch Format(strings.ToLower(strings.TrimSpace(raw))) {
+	case FORMAT_CSV:
+		return FORMAT_CSV, nil
+	case FORMAT_LDIF, "ldf":
+		return FORMAT_LDIF, nil
+	}
+	return "", fmt.Errorf("unknown directory format [%s]; must be csv or ldif", raw)
+}
+
+// guesses from a file name; anything that isn't .ldif/.ldf is taken to be CSV
+func FormatFromName(name string) Format {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".ldif", ".ldf":
+		return FORMAT_LDIF
+	}
+	return FORMAT_CSV
+}
+
+func Parse(r io.Reader, format Format) (*Directory, error) {
+	switch format {
+	case FORMAT_CSV:
+		return ParseCSV(r)
+	case FORMAT_LDIF:
+		return ParseLDIF(r)
+	}
+	return nil, fmt.Errorf("unknown directory format [%s]", format)
+}
+
+// normalized header name => what the column holds; headers are matched ignoring case, spaces, _ and -
+var csvColumns = map[string]string{
+	"email": "email", "mail": "email", "emailaddress": "email", "primaryemail": "email", "userprincipalname": "upn",
+	"aliases": "aliases", "alias": "aliases", "proxyaddresses": "aliases", "othermail": "aliases", "emailaliases": "aliases",
+	"passwordchanged": "pwdchanged", "passwordlastchanged": "pwdchanged", "lastpasswordchange": "pwdchanged", "pwdlastset": "pwdchanged", "passwordlastset": "pwdchanged",
+	"active": "active", "enabled": "active", "status": "active", "employmentstatus": "active", "useraccountcontrol": "uac",
+	"id": "id", "employeeid": "id", "employeenumber": "id",
+	"name": "name", "displayname": "name", "fullname": "name",
+}
+
+func normalizeHeader(header string) string {
+	return strings.NewReplacer(" ", "", "_", "", "-", "").Replace(strings.ToLower(strings.TrimSpace(header)))
+}
+
+// a CSV export with a header row; it needs an email column (userPrincipalName will do), everything else is
+// optional. aliases are separated by ; | or spaces. without an active/enabled/status column everyone is
+// taken to be active
+func ParseCSV(r io.Reader) (*Directory, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory header: %s", err)
+	}
+	columns := map[string]int{}
+	for idx, name := range header {
+		if col, found := csvColumns[normalizeHeader(strings.TrimPrefix(name, "\ufeff"))]; found {
+			if _, dup := columns[col]; !dup {
+				columns[col] = idx
+			}
+		}
+	}
+	_, hasEmail := columns["email"]
+	_, hasUPN := columns["upn"]
+	if !hasEmail && !hasUPN {
+		return nil, errors.New("directory CSV needs an email (or mail/userPrincipalName) column")
+	}
+
+	ret := &Directory{}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read directory at line %d: %s", line, err)
+		}
+		get := func(col string) string {
+			if idx, found := columns[col]; found && idx < len(record) {
+				return strings.TrimSpace(record[idx])
+			}
+			return ""
+		}
+
+		attrs := map[string][]string{}
+		for _, col := range []string{"email", "upn", "id", "name", "pwdchanged", "active", "uac"} {
+			if val := get(col); val != "" {
+				attrs[col] = []string{val}
+			}
+		}
+		attrs["aliases"] = strings.FieldsFunc(get("aliases"), func(r rune) bool { return r == ';' || r == '|' || r == ',' || r == ' ' })
+
+		emp, err := newEmployee(attrs)
+		if err != nil {
+			return nil, fmt.Errorf("bad directory entry at line %d: %s", line, err)
+		}
+		if emp == nil {
+			ret.Skipped++
+			continue
+		}
+		ret.Employees = append(ret.Employees, emp)
+	}
+	return ret, nil
+}
+
+// LDIF attribute (lowercased) => what it holds
+var ldifAttrs = map[string]string{
+	"mail":                 "email",
+	"userprincipalname":    "upn",
+	"proxyaddresses":       "aliases",
+	"othermailbox":         "aliases",
+	"mailalternateaddress": "aliases",
+	"pwdlastset":           "pwdchanged",
+	"passwordlastset":      "pwdchanged",
+	"shadowlastchange":     "shadowchange",
+	"useraccountcontrol":   "uac",
+	"employeeid":           "id",
+	"employeenumber":       "id",
+	"displayname":          "name",
+	"cn":                   "cn",
+	"nsaccountlock":        "locked",
+}
+
+// an LDIF export (e.g. ldifde or ldapsearch output) of user entries. active is worked out from
+// userAccountControl (AD) or nsAccountLock; password changes from pwdLastSet (AD) or shadowLastChange
+func ParseLDIF(r io.Reader) (*Directory, error) {
+	ret := &Directory{}
+	attrs := map[string][]string{}
+	inEntry := false
+
+	finish := func() error {
+		if inEntry {
+			emp, err := newEmployee(attrs)
+			if err != nil {
+				return fmt.Errorf("bad directory entry [%s]: %s", strings.Join(attrs["dn"], ""), err)
+			}
+			if emp == nil {
+				ret.Skipped++
+			} else {
+				ret.Employees = append(ret.Employees, emp)
+			}
+		}
+		attrs, inEntry = map[string][]string{}, false
+		return nil
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.HasPrefix(line, " ") && len(lines) > 0 { // folded onto the line before
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read directory: %s", err)
+	}
+
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			if err := finish(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			return nil, fmt.Errorf("bad LDIF line [%s]", line)
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch {
+		case strings.HasPrefix(value, ":"): // base64
+			decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[1:]))
+			if err != nil {
+				return nil, fmt.Errorf("bad base64 value for [%s]: %s", name, err)
+			}
+			value = string(decoded)
+		case strings.HasPrefix(value, "<"): // a URL to fetch it from; not something we follow
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		if name == "dn" {
+			inEntry = true
+			attrs["dn"] = []string{value}
+			continue
+		}
+		if name == "version" && !inEntry {
+			continue
+		}
+		inEntry = true
+		if col, known := ldifAttrs[name]; known {
+			attrs[col] = append(attrs[col], value)
+		}
+	}
+	if err := finish(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// builds an employee from the collected attributes (see the csv/ldif maps); nil if it has no address
+func newEmployee(attrs map[string][]string) (*Employee, error) {
+	emp := &Employee{Active: true}
+	seen := map[string]bool{}
+	addAddress := func(raw string) {
+		addr := canonicalAddress(raw)
+		if addr == "" || seen[addr] {
+			return
+		}
+		seen[addr] = true
+		if emp.Email == "" {
+			emp.Email = addr
+		} else {
+			emp.Aliases = append(emp.Aliases, addr)
+		}
+	}
+
+	// AD marks the primary proxy address with an upper case SMTP:
+	for _, raw := range attrs["aliases"] {
+		if strings.HasPrefix(raw, "SMTP:") && len(attrs["email"]) == 0 {
+			addAddress(raw)
+		}
+	}
+	for _, col := range []string{"email", "aliases", "upn"} {
+		for _, raw := range attrs[col] {
+			addAddress(raw)
+		}
+	}
+	if emp.Email == "" {
+		return nil, nil
+	}
+
+	emp.ID = first(attrs["id"])
+	emp.Name = first(attrs["name"])
+	if emp.Name == "" {
+		emp.Name = first(attrs["cn"])
+	}
+
+	if raw := first(attrs["active"]); raw != "" {
+		active, err := parseActive(raw)
+		if err != nil {
+			return nil, err
+		}
+		emp.Active = active
+	}
+	if raw := first(attrs["uac"]); raw != "" {
+		uac, err := strconv.ParseInt(raw, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad userAccountControl [%s]", raw)
+		}
+		emp.Active = emp.Active && uac&0x2 == 0 // ACCOUNTDISABLE
+	}
+	if strings.EqualFold(first(attrs["locked"]), "true") {
+		emp.Active = false
+	}
+
+	var err error
+	if raw := first(attrs["pwdchanged"]); raw != "" {
+		if emp.PasswordChanged, err = parseDate(raw); err != nil {
+			return nil, err
+		}
+	} else if raw := first(attrs["shadowchange"]); raw != "" {
+		days, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, fmt.Errorf("bad shadowLastChange [%s]", raw)
+		}
+		if days > 0 {
+			changed := time.Unix(0, 0).UTC().AddDate(0, 0, days)
+			emp.PasswordChanged = &changed
+		}
+	}
+	return emp, nil
+}
+
+func first(vals []string) string {
+	if len(vals) == 0 {
+		return ""
+	}
+	return vals[0]
+}
+
+// lowercased, with any smtp: (proxyAddresses) or mailto: prefix dropped; empty if it isn't an address
+// (including proxy addresses of other types, e.g. x500:)
+func canonicalAddress(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if prefix, rest, found := strings.Cut(raw, ":"); found {
+		switch strings.ToLower(prefix) {
+		case "smtp", "mailto":
+			raw = rest
+		default:
+			return ""
+		}
+	}
+	raw = strings.ToLower(strings.TrimSpace(raw))
+	if user, domain, found := strings.Cut(raw, "@"); !found || user == "" || domain == "" || strings.ContainsAny(raw, " \t") {
+		return ""
+	}
+	return raw
+}
+
+func parseActive(raw string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "1", "true", "yes", "y", "active", "enabled", "current", "employed":
+		return true, nil
+	case "0", "false", "no", "n", "inactive", "disabled", "terminated", "leaver", "left", "suspended":
+		return false, nil
+	}
+	return false, fmt.Errorf("can't tell whether [%s] means active or not", raw)
+}
+
+// dates as HR systems tend to export them, plus AD's pwdLastSet (100ns intervals since 1601; 0 means never
+// set, i.e. must change at next logon)
+func parseDate(raw string) (*time.Time, error) {
+	if filetime, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		if filetime <= 0 {
+			return nil, nil
+		}
+		const epochDelta = 116444736000000000 // 1601-01-01 to 1970-01-01 in 100ns intervals
+		t := time.Unix(0, (filetime-epochDelta)*100).UTC()
+		return &t, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02", "20060102150405.0Z", "20060102150405Z"} {
+		if t, err := time.Parse(layout, raw); err == nil {
+			t = t.UTC()
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("can't read password change date [%s]; use YYYY-MM-DD or RFC3339", raw)
+}
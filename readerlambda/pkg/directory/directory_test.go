@@ -0,0 +1,279 @@
+package directory
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/newodahs/readerlambda/pkg/awsfake"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/credstore"
+	"github.com/newodahs/readerlambda/pkg/envelope"
+	"github.com/newodahs/readerlambda/pkg/sources"
+	"github.com/newodahs/readerlambda/pkg/util"
+)
+
+func Test_Directory_Parse(t *testing.T) {
+	testSet := []struct {
+		Name          string
+		Format        Format
+		Input         string
+		ExpectEmails  []string
+		ExpectAliases [][]string
+		ExpectActive  []bool
+		ExpectChanged []string // YYYY-MM-DD, "" for none
+		ExpectSkipped int
+		ExpectErr     bool
+	}{
+		{
+			Name:   "CSV",
+			Format: FORMAT_CSV,
+			Input: "\ufeffEmployee ID,Display Name,Mail,Proxy Addresses,Password Last Changed,Status\n" +
+				"1,Jane Doe,Jane.Doe@Example.com,jd@example.com;j.doe@example.com,2024-03-01,Active\n" +
+				"2,Old Timer,old@example.com,,2020-01-01T10:00:00Z,terminated\n" +
+				"3,No Mailbox,,,,active\n" +
+				"4,Never Changed,never@example.com,,,active\n",
+			ExpectEmails:  []string{"jane.doe@example.com", "old@example.com", "never@example.com"},
+			ExpectAliases: [][]string{{"jd@example.com", "j.doe@example.com"}, nil, nil},
+			ExpectActive:  []bool{true, false, true},
+			ExpectChanged: []string{"2024-03-01", "2020-01-01", ""},
+			ExpectSkipped: 1,
+		},
+		{
+			Name:          "CSV UPN Only",
+			Format:        FORMAT_CSV,
+			Input:         "userPrincipalName,pwdLastSet\nbob@example.com,133540000000000000\n",
+			ExpectEmails:  []string{"bob@example.com"},
+			ExpectAliases: [][]string{nil},
+			ExpectActive:  []bool{true},
+			ExpectChanged: []string{"2024-03-04"},
+		},
+		{
+			Name:      "CSV Without Email",
+			Format:    FORMAT_CSV,
+			Input:     "name,status\nJane,active\n",
+			ExpectErr: true,
+		},
+		{
+			Name:      "CSV Bad Status",
+			Format:    FORMAT_CSV,
+			Input:     "email,status\njane@example.com,maybe\n",
+			ExpectErr: true,
+		},
+		{
+			Name:   "LDIF",
+			Format: FORMAT_LDIF,
+			Input: "version: 1\n\n" +
+				"# a user\n" +
+				"dn: CN=Jane Doe,OU=Staff,DC=example,DC=com\n" +
+				"displayName: Jane Doe\n" +
+				"proxyAddresses: SMTP:Jane.Doe@example.com\n" +
+				"proxyAddresses: smtp:jd@example.com\n" +
+				"proxyAddresses: X500:/o=Example/cn=jdoe\n" +
+				"userAccountControl: 512\n" +
+				"pwdLastSet: 133540000000000000\n\n" +
+				"dn: CN=Disabled,OU=Staff,DC=example,DC=com\n" +
+				"mail: gone@exam\n ple.com\n" +
+				"userAccountControl: 514\n\n" +
+				"dn: CN=Staff,OU=Groups,DC=example,DC=com\n" +
+				"objectClass: group\n\n" +
+				"dn:: Q049QmFzZTY0LERDPWV4YW1wbGUsREM9Y29t\n" +
+				"mail:: YjY0QGV4YW1wbGUuY29t\n",
+			ExpectEmails:  []string{"jane.doe@example.com", "gone@example.com", "b64@example.com"},
+			ExpectAliases: [][]string{{"jd@example.com"}, nil, nil},
+			ExpectActive:  []bool{true, false, true},
+			ExpectChanged: []string{"2024-03-04", "", ""},
+			ExpectSkipped: 1,
+		},
+		{
+			Name:      "LDIF Garbage",
+			Format:    FORMAT_LDIF,
+			Input:     "dn: x\nthis is not ldif\n",
+			ExpectErr: true,
+		},
+	}
+
+	for _, test := range testSet {
+		t.Run(test.Name, func(t *testing.T) {
+			dir, err := Parse(strings.NewReader(test.Input), test.Format)
+			if (err != nil) != test.ExpectErr {
+				t.Fatalf("unexpected error state: %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if len(dir.Employees) != len(test.ExpectEmails) || dir.Skipped != test.ExpectSkipped {
+				t.Fatalf("expected %d employees (%d skipped), got %d (%d)", len(test.ExpectEmails), test.ExpectSkipped, len(dir.Employees), dir.Skipped)
+			}
+			for idx, emp := range dir.Employees {
+				if emp.Email != test.ExpectEmails[idx] || strings.Join(emp.Aliases, ",") != strings.Join(test.ExpectAliases[idx], ",") {
+					t.Errorf("employee %d: expected %s %v, got %s %v", idx, test.ExpectEmails[idx], test.ExpectAliases[idx], emp.Email, emp.Aliases)
+				}
+				if emp.Active != test.ExpectActive[idx] {
+					t.Errorf("employee %d: expected active %t", idx, test.ExpectActive[idx])
+				}
+				changed := ""
+				if emp.PasswordChanged != nil {
+					changed = emp.PasswordChanged.Format("2006-01-02")
+				}
+				if changed != test.ExpectChanged[idx] {
+					t.Errorf("employee %d: expected password change [%s], got [%s]", idx, test.ExpectChanged[idx], changed)
+				}
+			}
+		})
+	}
+
+	if FormatFromName("export.LDIF") != FORMAT_LDIF || FormatFromName("export.csv") != FORMAT_CSV {
+		t.Errorf("unexpected format from name")
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Errorf("expected an unknown format to be refused")
+	}
+}
+
+func Test_Directory_Reconcile(t *testing.T) {
+	const credTable, sourceTable = "credsTest", "sourcesTest"
+	ctx := context.Background()
+	cli := awsfake.NewDynamoDB()
+	if err := util.EnsureDynamoDBTable(ctx, cli, credTable, credparser.CredentialInfo{}, nil); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	if err := util.EnsureDynamoDBTable(ctx, cli, sourceTable, sources.Source{}, nil); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+
+	breach := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := sources.Save(ctx, cli, sourceTable, &sources.Source{ID: "old-breach", Name: "Old Breach", BreachDate: &breach}); err != nil {
+		t.Fatalf("failed to save source: %s", err)
+	}
+	recent := time.Date(2024, 9, 1, 0, 0, 0, 0, time.UTC)
+	store := func(user string, prov *credparser.Provenance) {
+		cred := &credparser.CredentialInfo{User: user, Domain: "example.com", Email: user + "@example.com"}
+		cred.AddPassword("pw-"+user, prov)
+		if _, err := credstore.StoreCredential(ctx, cli, credTable, nil, nil, cred); err != nil {
+			t.Fatalf("failed to store: %s", err)
+		}
+	}
+	store("jd", &credparser.Provenance{FirstSeen: recent})                          // jane's alias, seen after her change
+	store("bob", &credparser.Provenance{SourceID: "old-breach", FirstSeen: recent}) // breach date predates bob's change
+	store("carol", &credparser.Provenance{FirstSeen: recent, Remediation: &credparser.Remediation{Status: credparser.REMEDIATION_PASSWORD_RESET}})
+	store("old", &credparser.Provenance{FirstSeen: recent})
+	store("nobody", &credparser.Provenance{FirstSeen: recent})
+
+	dir, err := ParseCSV(strings.NewReader("email,aliases,passwordChanged,active\n" +
+		"jane@example.com,JD@example.com,2024-03-01,yes\n" +
+		"bob@example.com,,2024-03-01,yes\n" +
+		"carol@example.com,,,yes\n" +
+		"dave@example.com,,2024-03-01,yes\n" +
+		"old@example.com,,,no\n"))
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+
+	report, err := Reconcile(ctx, cli, Tables{Credentials: credTable, Sources: sourceTable}, nil, dir)
+	if err != nil {
+		t.Fatalf("failed to reconcile: %s", err)
+	}
+	if report.Employees != 5 || report.Active != 4 || report.ExposedActive != 3 || report.ExposedInactive != 1 ||
+		report.LeakAfterChange != 1 || report.UnknownChange != 1 || report.Remediated != 1 {
+		t.Fatalf("unexpected report counts: %+v", report)
+	}
+
+	expect := []struct {
+		Email      string
+		Address    string
+		Timing     Timing
+		Remediated bool
+	}{
+		{"jane@example.com", "jd@example.com", TIMING_AFTER_CHANGE, false},
+		{"bob@example.com", "bob@example.com", TIMING_BEFORE_CHANGE, false},
+		{"carol@example.com", "carol@example.com", TIMING_UNKNOWN, true},
+	}
+	for idx, want := range expect {
+		got := report.Findings[idx]
+		if got.Employee.Email != want.Email || len(got.Addresses) != 1 || got.Addresses[0] != want.Address || got.Timing != want.Timing || got.Remediated != want.Remediated {
+			t.Errorf("finding %d: expected %+v, got %+v", idx, want, got)
+		}
+	}
+	if !report.Findings[1].LatestLeak.Equal(breach) {
+		t.Errorf("expected bob's leak to be dated by the breach, got %s", report.Findings[1].LatestLeak)
+	}
+
+	if _, err := Reconcile(ctx, nil, Tables{}, nil, dir); err == nil {
+		t.Errorf("expected a nil client to be refused")
+	}
+}
+
+// addresses match whatever case the directory and the dump had them in, plain keys or hashed; ones stored
+// mixed-case before keys were canonicalised turn up once the hashkeys migration has moved them
+func Test_Directory_ReconcileMixedCase(t *testing.T) {
+	masterKeys, _, _ := (*envelope.LocalKeys)(nil).Rotate()
+	hasher, _ := credstore.NewKeyHasher([]byte(strings.Repeat("k", credstore.MIN_LOOKUP_KEY_SIZE)))
+
+	testSet := []struct {
+		Name   string
+		Cipher *envelope.Cipher
+		Keys   *credstore.KeyHasher
+		Legacy bool // stored as given, then migrated
+	}{
+		{Name: "PlainKeys"},
+		{Name: "LegacyPlainKeys", Legacy: true},
+		{Name: "HashedKeys", Cipher: envelope.NewCipher(masterKeys), Keys: hasher},
+	}
+
+	for _, test := range testSet {
+		t.Run(test.Name, func(t *testing.T) {
+			const credTable = "credsTest"
+			ctx := context.Background()
+			cli := awsfake.NewDynamoDB()
+			if err := util.EnsureDynamoDBTable(ctx, cli, credTable, credparser.CredentialInfo{}, nil); err != nil {
+				t.Fatalf("failed to create table: %s", err)
+			}
+
+			for _, addr := range []string{"Jane.Doe@Example.COM", "bob@example.com"} {
+				user, domain, _ := strings.Cut(addr, "@")
+				cred := &credparser.CredentialInfo{User: user, Domain: domain, Email: addr}
+				cred.AddPassword("pw", &credparser.Provenance{FirstSeen: time.Now().UTC()})
+				if test.Legacy {
+					item, _ := credstore.EncodeCredential(ctx, nil, nil, cred)
+					if _, err := cli.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(credTable), Item: item}); err != nil {
+						t.Fatalf("failed to seed: %s", err)
+					}
+				} else if _, err := credstore.StoreCredential(ctx, cli, credTable, test.Cipher, test.Keys, cred); err != nil {
+					t.Fatalf("failed to store: %s", err)
+				}
+			}
+			if test.Legacy {
+				if err := util.EnsureDynamoDBTable(ctx, cli, "linksTest", sources.SourceCredential{}, nil); err != nil {
+					t.Fatalf("failed to create table: %s", err)
+				}
+				mig := credstore.NewMigrator(cli)
+				mig.LinkTable = "linksTest"
+				state := credstore.NewHashKeysState(credTable, 1)
+				if err := mig.Run(ctx, state); err != nil || state.Totals().Migrated != 1 {
+					t.Fatalf("unexpected migration: %+v (%v)", state.Totals(), err)
+				}
+			}
+
+			dir, err := ParseCSV(strings.NewReader("email,active\njane.doe@example.com,yes\nBOB@Example.Com,yes\n"))
+			if err != nil {
+				t.Fatalf("failed to parse: %s", err)
+			}
+			report, err := Reconcile(ctx, cli, Tables{Credentials: credTable}, test.Keys, dir)
+			if err != nil {
+				t.Fatalf("failed to reconcile: %s", err)
+			}
+			if report.ExposedActive != 2 || len(report.Findings) != 2 {
+				t.Fatalf("expected both employees found, got %+v", report)
+			}
+			for _, finding := range report.Findings {
+				if len(finding.Addresses) != 1 || finding.Addresses[0] != strings.ToLower(finding.Employee.Email) {
+					t.Errorf("unexpected addresses for %s: %v", finding.Employee.Email, finding.Addresses)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package directory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/credstore"
+	"github.com/newodahs/readerlambda/pkg/sources"
+	"github.com/newodahs/readerlambda/pkg/util"
+)
+
+// how a leak lines up with the employee's last password change
+type Timing string
+
+const (
+	TIMING_AFTER_CHANGE  Timing = "after-change"  // leaked after they last changed it; the current password may be exposed
+	TIMING_BEFORE_CHANGE Timing = "before-change" // every leak predates the change
+	TIMING_UNKNOWN       Timing = "unknown"       // the directory didn't say when they last changed it
+)
+
+// the tables a reconciliation reads
+type Tables struct {
+	Credentials string
+	Sources     string
+}
+
+// an employee found in the store
+type Finding struct {
+	Employee   *Employee                    `json:"employee"`
+	Addresses  []string                     `json:"addresses"` // which of their addresses were exposed
+	Passwords  int                          `json:"passwords"` // across all of those addresses
+	Sources    []string                     `json:"sources,omitempty"`
+	LatestLeak time.Time                    `json:"latestLeak"`
+	Timing     Timing                       `json:"timing"`
+	Status     credparser.RemediationStatus `json:"status"`     // the least progressed of the exposed addresses
+	Remediated bool                         `json:"remediated"` // every exposed password was reset or is a false positive
+}
+
+// what a reconciliation found; Findings only covers active employees, leavers are just counted
+type Report struct {
+	ID              string     `json:"id"`
+	CreatedAt       time.Time  `json:"createdAt"`
+	Employees       int        `json:"employees"`
+	Active          int        `json:"active"`
+	Skipped         int        `json:"skipped"` // directory entries without an address
+	ExposedActive   int        `json:"exposedActive"`
+	ExposedInactive int        `json:"exposedInactive"`
+	LeakAfterChange int        `json:"leakAfterChange"` // exposed active employees whose leak is newer than their password
+	UnknownChange   int        `json:"unknownChange"`   // exposed active employees with no password change date
+	Remediated      int        `json:"remediated"`      // exposed active employees already dealt with
+	Findings        []*Finding `json:"findings"`
+	FailedDecode    int        `json:"failedDecode,omitempty"` // stored credentials that couldn't be read
+}
+
+// matches the directory against the credential store by canonical (lowercased) address, primary and
+// aliases alike, however either side has it cased. credentials stored under mixed-case plain keys (before
+// keys were canonicalised) aren't found until the hashkeys migration has moved them. a leak is dated by its source's breach date when one is known, otherwise by when we first
+// saw the password - which can only be later than the breach, so an unknown date errs towards flagging
+//
+// nothing is stored; the report is handed back to the caller
+func Reconcile(ctx context.Context, cli util.DynamoDBAPI, tables Tables, keys *credstore.KeyHasher, dir *Directory) (*Report, error) {
+	if cli == nil {
+		return nil, errors.New("passed dynamodb client was nil")
+	}
+	if dir == nil {
+		return nil, errors.New("passed directory was nil")
+	}
+
+	report := &Report{ID: util.NewID(), CreatedAt: time.Now().UTC(), Employees: len(dir.Employees), Skipped: dir.Skipped, Findings: []*Finding{}}
+
+	// stored key => the employees with that address (shared mailboxes can show up on more than one person)
+	byKey := map[credstore.CredentialKey][]match{}
+	var lookups []credstore.CredentialKey
+	for _, emp := range dir.Employees {
+		if emp.Active {
+			report.Active++
+		}
+		for _, addr := range emp.Addresses() {
+			domain, user, err := credstore.SplitAddress(addr)
+			if err != nil {
+				continue
+			}
+			key := keys.Key(credstore.CanonicalIdentity(domain, user))
+			if _, seen := byKey[key]; !seen {
+				lookups = append(lookups, key)
+			}
+			if !slices.Contains(byKey[key], match{emp, addr}) {
+				byKey[key] = append(byKey[key], match{emp, addr})
+			}
+		}
+	}
+
+	creds, failed, err := credstore.BatchGetCredentials(ctx, cli, tables.Credentials, lookups)
+	if err != nil {
+		return nil, err
+	}
+	report.FailedDecode = failed
+
+	breachDates := map[string]*time.Time{}
+	leakDate := func(prov *credparser.Provenance) (time.Time, error) {
+		if prov.SourceID != "" && tables.Sources != "" {
+			date, cached := breachDates[prov.SourceID]
+			if !cached {
+				src, err := sources.Get(ctx, cli, tables.Sources, prov.SourceID)
+				if err != nil {
+					return time.Time{}, err
+				}
+				if src != nil {
+					date = src.BreachDate
+				}
+				breachDates[prov.SourceID] = date
+			}
+			if date != nil {
+				return *date, nil
+			}
+		}
+		return prov.FirstSeen, nil
+	}
+
+	findings := map[*Employee]*Finding{}
+	for _, cred := range creds {
+		for _, m := range byKey[credstore.CredentialKey{Domain: cred.Domain, User: cred.User}] {
+			finding := findings[m.emp]
+			if finding == nil {
+				finding = &Finding{Employee: m.emp, Remediated: true}
+				findings[m.emp] = finding
+			}
+			if err := finding.add(m.addr, cred, leakDate); err != nil {
+				return nil, fmt.Errorf("failed to date leaks for [%s]: %s", m.addr, err)
+			}
+		}
+	}
+
+	for _, emp := range dir.Employees { // directory order, so the report reads like the export
+		finding := findings[emp]
+		if finding == nil {
+			continue
+		}
+		if !emp.Active {
+			report.ExposedInactive++
+			continue
+		}
+		finding.finish()
+		report.ExposedActive++
+		switch finding.Timing {
+		case TIMING_AFTER_CHANGE:
+			report.LeakAfterChange++
+		case TIMING_UNKNOWN:
+			report.UnknownChange++
+		}
+		if finding.Remediated {
+			report.Remediated++
+		}
+		report.Findings = append(report.Findings, finding)
+	}
+
+	// the ones needing attention first: not remediated, then leaked since the last change
+	slices.SortStableFunc(report.Findings, func(a, b *Finding) int {
+		if a.Remediated != b.Remediated {
+			return boolOrder(a.Remediated) - boolOrder(b.Remediated)
+		}
+		return timingOrder[a.Timing] - timingOrder[b.Timing]
+	})
+	return report, nil
+}
+
+// an employee and the address of theirs a stored key was computed from (with hashed keys the credential
+// itself can't say)
+type match struct {
+	emp  *Employee
+	addr string
+}
+
+var timingOrder = map[Timing]int{TIMING_AFTER_CHANGE: 0, TIMING_UNKNOWN: 1, TIMING_BEFORE_CHANGE: 2}
+
+func boolOrder(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// folds one of the employee's stored credentials into the finding
+func (f *Finding) add(addr string, cred *credparser.CredentialInfo, leakDate func(*credparser.Provenance) (time.Time, error)) error {
+	cred.AlignProvenance()
+	f.Addresses = append(f.Addresses, addr)
+	f.Passwords += len(cred.Provenance)
+	for _, prov := range cred.Provenance {
+		leaked, err := leakDate(prov)
+		if err != nil {
+			return err
+		}
+		if leaked.After(f.LatestLeak) {
+			f.LatestLeak = leaked
+		}
+		if prov.SourceID != "" && !slices.Contains(f.Sources, prov.SourceID) {
+			f.Sources = append(f.Sources, prov.SourceID)
+		}
+		switch prov.RemediationStatus() {
+		case credparser.REMEDIATION_PASSWORD_RESET, credparser.REMEDIATION_FALSE_POSITIVE:
+		default:
+			f.Remediated = false
+		}
+		if f.Status == "" || slices.Index(credparser.RemediationOrder, prov.RemediationStatus()) < slices.Index(credparser.RemediationOrder, f.Status) {
+			f.Status = prov.RemediationStatus()
+		}
+	}
+	return nil
+}
+
+func (f *Finding) finish() {
+	switch {
+	case f.Employee.PasswordChanged == nil:
+		f.Timing = TIMING_UNKNOWN
+	case f.LatestLeak.After(*f.Employee.PasswordChanged):
+		f.Timing = TIMING_AFTER_CHANGE
+	default:
+		f.Timing = TIMING_BEFORE_CHANGE
+	}
+	if f.Status == "" {
+		f.Status = credparser.REMEDIATION_NEW
+	}
+}
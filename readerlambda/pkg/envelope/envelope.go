@@ -0,0 +1,237 @@
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// envelope encryption for individual fields: values are sealed with AES-256-GCM under a random data key,
+// and the data key is stored alongside them wrapped by a KeyProvider (a local keyfile for dev/tests, KMS in
+// production), so the master key never leaves the provider and rotating it only means re-wrapping data keys
+
+const (
+	DATA_KEY_SIZE = 32 // AES-256
+
+	// a data key is reused (it's wrapped once, not per item) for at most this many seals or this long
+	DEFAULT_MAX_KEY_USES = 10000
+	DEFAULT_MAX_KEY_AGE  = time.Hour
+
+	// unwrapped data keys kept around so reads don't hit the provider for every item
+	DEFAULT_UNWRAP_CACHE = 1000
+)
+
+var ErrUnknownKey = errors.New("unknown master key")
+
+// wraps and unwraps data keys with a master key it holds (or can get at)
+type KeyProvider interface {
+	// the master key new data keys are wrapped with
+	CurrentKeyID() string
+	WrapKey(ctx context.Context, dataKey []byte) (*WrappedKey, error)
+	UnwrapKey(ctx context.Context, wk *WrappedKey) ([]byte, error)
+}
+
+// a data key encrypted by the master key KeyID
+type WrappedKey struct {
+	KeyID string `json:"keyId" dynamodbav:"keyId"`
+	Blob  []byte `json:"blob" dynamodbav:"blob"`
+}
+
+// the stored form of a list of sealed values: each value is nonce||ciphertext under the data key in Key
+type Envelope struct {
+	Key    WrappedKey `json:"key" dynamodbav:"key"`
+	Values [][]byte   `json:"values" dynamodbav:"values"`
+}
+
+type dataKey struct {
+	plain   []byte
+	wrapped WrappedKey
+	created time.Time
+	uses    int
+}
+
+// seals/opens envelopes using a KeyProvider; safe for concurrent use. a nil *Cipher means encryption
+// isn't configured
+type Cipher struct {
+	Provider   KeyProvider
+	MaxKeyUses int
+	MaxKeyAge  time.Duration
+
+	mu        sync.Mutex
+	current   *dataKey
+	unwrapped map[string][]byte     // wrapped key (id + blob) => data key
+	rewrapped map[string]WrappedKey // old wrapped key => the same data key under the current master key
+}
+
+func NewCipher(provider KeyProvider) *Cipher {
+	return &Cipher{
+		Provider:   provider,
+		MaxKeyUses: DEFAULT_MAX_KEY_USES,
+		MaxKeyAge:  DEFAULT_MAX_KEY_AGE,
+		unwrapped:  map[string][]byte{},
+		rewrapped:  map[string]WrappedKey{},
+	}
+}
+
+func (c *Cipher) CurrentKeyID() string {
+	return c.Provider.CurrentKeyID()
+}
+
+// the data key to seal with, minting (and wrapping) a new one when the current one is used up, too old or
+// belongs to a master key that's no longer current
+func (c *Cipher) sealingKey(ctx context.Context) (*dataKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cur := c.current; cur != nil && cur.uses < c.MaxKeyUses && time.Since(cur.created) < c.MaxKeyAge && cur.wrapped.KeyID == c.Provider.CurrentKeyID() {
+		cur.uses++
+		return cur, nil
+	}
+
+	plain := make([]byte, DATA_KEY_SIZE)
+	if _, err := rand.Read(plain); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %s", err)
+	}
+	wrapped, err := c.Provider.WrapKey(ctx, plain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %s", err)
+	}
+	c.current = &dataKey{plain: plain, wrapped: *wrapped, created: time.Now(), uses: 1}
+	c.cacheUnwrapped(*wrapped, plain)
+	return c.current, nil
+}
+
+func cacheKey(wk WrappedKey) string {
+	return wk.KeyID + "\x00" + string(wk.Blob)
+}
+
+// callers hold c.mu
+func (c *Cipher) cacheUnwrapped(wk WrappedKey, plain []byte) {
+	if len(c.unwrapped) >= DEFAULT_UNWRAP_CACHE {
+		clear(c.unwrapped) // crude, but keys are reused heavily so it refills with what's hot
+	}
+	c.unwrapped[cacheKey(wk)] = plain
+}
+
+func (c *Cipher) openingKey(ctx context.Context, wk WrappedKey) ([]byte, error) {
+	c.mu.Lock()
+	plain, found := c.unwrapped[cacheKey(wk)]
+	c.mu.Unlock()
+	if found {
+		return plain, nil
+	}
+
+	plain, err := c.Provider.UnwrapKey(ctx, &wk)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key (master key [%s]): %w", wk.KeyID, err) // %w so ErrUnknownKey shows through
+	}
+	if len(plain) != DATA_KEY_SIZE {
+		return nil, fmt.Errorf("unwrapped data key is %d bytes", len(plain))
+	}
+
+	c.mu.Lock()
+	c.cacheUnwrapped(wk, plain)
+	c.mu.Unlock()
+	return plain, nil
+}
+
+// encrypts values; aad (e.g. the item's key) is bound to every value, so ciphertexts can't be moved
+// between items
+func (c *Cipher) Seal(ctx context.Context, aad []byte, values []string) (*Envelope, error) {
+	dk, err := c.sealingKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(dk.plain)
+	if err != nil {
+		return nil, err
+	}
+
+	env := &Envelope{Key: dk.wrapped}
+	for _, val := range values {
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, fmt.Errorf("failed to generate nonce: %s", err)
+		}
+		env.Values = append(env.Values, gcm.Seal(nonce, nonce, []byte(val), aad))
+	}
+	return env, nil
+}
+
+// decrypts everything in env; aad must match what it was sealed with
+func (c *Cipher) Open(ctx context.Context, env *Envelope, aad []byte) ([]string, error) {
+	if env == nil {
+		return nil, nil
+	}
+	plain, err := c.openingKey(ctx, env.Key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(plain)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]string, 0, len(env.Values))
+	for idx, sealed := range env.Values {
+		if len(sealed) < gcm.NonceSize() {
+			return nil, fmt.Errorf("sealed value %d is truncated", idx)
+		}
+		val, openErr := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], aad)
+		if openErr != nil {
+			return nil, fmt.Errorf("failed to open sealed value %d: %s", idx, openErr)
+		}
+		ret = append(ret, string(val))
+	}
+	return ret, nil
+}
+
+// re-wraps env's data key with the current master key (the values themselves are untouched); returns false
+// if it already was
+func (c *Cipher) Rewrap(ctx context.Context, env *Envelope) (bool, error) {
+	current := c.Provider.CurrentKeyID()
+	if env == nil || env.Key.KeyID == current {
+		return false, nil
+	}
+
+	old := cacheKey(env.Key)
+	c.mu.Lock()
+	wk, found := c.rewrapped[old]
+	c.mu.Unlock()
+	if !found || wk.KeyID != current {
+		plain, err := c.openingKey(ctx, env.Key)
+		if err != nil {
+			return false, err
+		}
+		newKey, err := c.Provider.WrapKey(ctx, plain)
+		if err != nil {
+			return false, fmt.Errorf("failed to wrap data key: %s", err)
+		}
+		wk = *newKey
+
+		c.mu.Lock()
+		if len(c.rewrapped) >= DEFAULT_UNWRAP_CACHE {
+			clear(c.rewrapped)
+		}
+		c.rewrapped[old] = wk
+		c.cacheUnwrapped(wk, plain)
+		c.mu.Unlock()
+	}
+
+	env.Key = WrappedKey{KeyID: wk.KeyID, Blob: bytes.Clone(wk.Blob)}
+	return true, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("bad data key: %s", err)
+	}
+	return cipher.NewGCM(block)
+}
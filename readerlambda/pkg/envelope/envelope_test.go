@@ -0,0 +1,336 @@
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	kmstypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+func newLocalKeys(t *testing.T) *LocalKeys {
+	keys, _, err := (*LocalKeys)(nil).Rotate()
+	if err != nil {
+		t.Fatalf("failed to make keys: %s", err)
+	}
+	return keys
+}
+
+// counts wraps/unwraps so we can see the caching
+type countingProvider struct {
+	KeyProvider
+	wraps, unwraps int
+}
+
+func (cp *countingProvider) WrapKey(ctx context.Context, dataKey []byte) (*WrappedKey, error) {
+	cp.wraps++
+	return cp.KeyProvider.WrapKey(ctx, dataKey)
+}
+
+func (cp *countingProvider) UnwrapKey(ctx context.Context, wk *WrappedKey) ([]byte, error) {
+	cp.unwraps++
+	return cp.KeyProvider.UnwrapKey(ctx, wk)
+}
+
+func Test_Cipher_SealOpen(t *testing.T) {
+	ctx := context.Background()
+	provider := &countingProvider{KeyProvider: newLocalKeys(t)}
+	cipher := NewCipher(provider)
+
+	testSet := []struct {
+		Name   string
+		AAD    []byte
+		Values []string
+	}{
+		{Name: "One", AAD: []byte("example.com\x00first"), Values: []string{"hunter2"}},
+		{Name: "Several", AAD: []byte("example.com\x00second"), Values: []string{"a", "", "longer password with spaces"}},
+		{Name: "None", AAD: []byte("example.com\x00third")},
+	}
+
+	for _, test := range testSet {
+		t.Run(test.Name, func(t *testing.T) {
+			env, err := cipher.Seal(ctx, test.AAD, test.Values)
+			if err != nil {
+				t.Fatalf("failed to seal: %s", err)
+			}
+			for idx, sealed := range env.Values {
+				// anything short turns up in random bytes often enough to be meaningless
+				if len(test.Values[idx]) >= 6 && bytes.Contains(sealed, []byte(test.Values[idx])) {
+					t.Errorf("value %d sealed in the clear", idx)
+				}
+			}
+
+			opened, err := cipher.Open(ctx, env, test.AAD)
+			if err != nil || !slices.Equal(opened, test.Values) && len(test.Values) > 0 {
+				t.Errorf("unexpected open %v: %v", opened, err)
+			}
+			if _, err := cipher.Open(ctx, env, []byte("example.com\x00other")); err == nil && len(test.Values) > 0 {
+				t.Errorf("expected a different aad not to open")
+			}
+		})
+	}
+
+	// one data key for all of them, and it's cached for opening
+	if provider.wraps != 1 || provider.unwraps != 0 {
+		t.Errorf("expected one wrap and no unwraps, got %d/%d", provider.wraps, provider.unwraps)
+	}
+
+	// a fresh cipher has to unwrap, once
+	env, _ := cipher.Seal(ctx, nil, []string{"x"})
+	other := NewCipher(provider)
+	for range 3 {
+		if _, err := other.Open(ctx, env, nil); err != nil {
+			t.Fatalf("failed to open with another cipher: %s", err)
+		}
+	}
+	if provider.unwraps != 1 {
+		t.Errorf("expected one unwrap, got %d", provider.unwraps)
+	}
+
+	// data keys get replaced once they've been used enough
+	cipher.MaxKeyUses = 2
+	first, _ := cipher.Seal(ctx, nil, []string{"x"}) // the current key is long past 2 uses, so a new one
+	second, _ := cipher.Seal(ctx, nil, []string{"x"})
+	third, _ := cipher.Seal(ctx, nil, []string{"x"})
+	if !bytes.Equal(first.Key.Blob, second.Key.Blob) || bytes.Equal(second.Key.Blob, third.Key.Blob) {
+		t.Errorf("expected a new data key after MaxKeyUses")
+	}
+
+	// tampering is caught
+	env.Values[0][len(env.Values[0])-1] ^= 1
+	if _, err := cipher.Open(ctx, env, nil); err == nil {
+		t.Errorf("expected a tampered value not to open")
+	}
+}
+
+func Test_Cipher_Rewrap(t *testing.T) {
+	ctx := context.Background()
+	keys := newLocalKeys(t)
+	cipher := NewCipher(keys)
+	oldKeyID := keys.CurrentKeyID()
+
+	envs := []*Envelope{}
+	for _, val := range []string{"a", "b"} {
+		env, err := cipher.Seal(ctx, []byte(val), []string{val})
+		if err != nil {
+			t.Fatalf("failed to seal: %s", err)
+		}
+		envs = append(envs, env)
+	}
+
+	if changed, err := cipher.Rewrap(ctx, envs[0]); err != nil || changed {
+		t.Errorf("expected nothing to do before rotating: %v %v", changed, err)
+	}
+
+	if _, _, err := keys.Rotate(); err != nil {
+		t.Fatalf("failed to rotate: %s", err)
+	}
+	for idx, env := range envs {
+		values := slices.Clone(env.Values)
+		changed, err := cipher.Rewrap(ctx, env)
+		if err != nil || !changed {
+			t.Fatalf("failed to rewrap: %v %v", changed, err)
+		}
+		if env.Key.KeyID == oldKeyID || env.Key.KeyID != keys.CurrentKeyID() {
+			t.Errorf("expected envelope under the new key, got [%s]", env.Key.KeyID)
+		}
+		if !slices.EqualFunc(values, env.Values, bytes.Equal) {
+			t.Errorf("rewrap touched the sealed values")
+		}
+
+		// opens without the old key being around
+		onlyNew := &LocalKeys{current: keys.CurrentKeyID(), keys: map[string][]byte{keys.CurrentKeyID(): keys.keys[keys.CurrentKeyID()]}}
+		opened, err := NewCipher(onlyNew).Open(ctx, env, []byte([]string{"a", "b"}[idx]))
+		if err != nil || len(opened) != 1 {
+			t.Errorf("failed to open rewrapped envelope with only the new key: %v", err)
+		}
+	}
+
+	// and the old key really is needed for what wasn't rewrapped
+	stale, _ := NewCipher(&LocalKeys{current: oldKeyID, keys: map[string][]byte{oldKeyID: keys.keys[oldKeyID]}}).Seal(ctx, nil, []string{"c"})
+	onlyNew := &LocalKeys{current: keys.CurrentKeyID(), keys: map[string][]byte{keys.CurrentKeyID(): keys.keys[keys.CurrentKeyID()]}}
+	if _, err := NewCipher(onlyNew).Open(ctx, stale, nil); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected ErrUnknownKey, got %v", err)
+	}
+}
+
+func Test_LocalKeys_File(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keys.json")
+	keys := newLocalKeys(t)
+	if _, _, err := keys.Rotate(); err != nil {
+		t.Fatalf("failed to rotate: %s", err)
+	}
+	if err := keys.Save(keyFile); err != nil {
+		t.Fatalf("failed to save: %s", err)
+	}
+
+	// saving again replaces the file whole, leaving nothing else behind
+	if _, _, err := keys.Rotate(); err != nil {
+		t.Fatalf("failed to rotate: %s", err)
+	}
+	if err := keys.Save(keyFile); err != nil {
+		t.Fatalf("failed to save over the key file: %s", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(keyFile)); len(entries) != 1 {
+		t.Errorf("expected just the key file, got %v", entries)
+	}
+	if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("expected an owner-only key file, got %v (%v)", info, err)
+	}
+
+	loaded, err := LoadKeyFile(keyFile)
+	if err != nil {
+		t.Fatalf("failed to load: %s", err)
+	}
+	if loaded.CurrentKeyID() != keys.CurrentKeyID() || !slices.Equal(loaded.KeyIDs(), keys.KeyIDs()) || len(loaded.KeyIDs()) != 3 {
+		t.Errorf("unexpected keys after load: %s %v", loaded.CurrentKeyID(), loaded.KeyIDs())
+	}
+
+	env, _ := NewCipher(keys).Seal(context.Background(), nil, []string{"x"})
+	if opened, err := NewCipher(loaded).Open(context.Background(), env, nil); err != nil || opened[0] != "x" {
+		t.Errorf("failed to open with loaded keys: %v", err)
+	}
+
+	if _, err := NewLocalKeys("missing", map[string][]byte{"short": []byte("nope")}); err == nil {
+		t.Errorf("expected a bad key set to be refused")
+	}
+}
+
+// KMS as far as we use it: aliases resolve to key ARNs, the ARN used comes back from Encrypt and the
+// ciphertext says which key made it (so Decrypt doesn't need telling, but refuses a different key if told)
+type fakeKMS struct {
+	keys    map[string]*LocalKeys // by ARN
+	aliases map[string]string
+}
+
+func newFakeKMS(t *testing.T, arns ...string) *fakeKMS {
+	fk := &fakeKMS{keys: map[string]*LocalKeys{}, aliases: map[string]string{}}
+	for _, arn := range arns {
+		fk.keys[arn] = newLocalKeys(t)
+	}
+	return fk
+}
+
+func (fk *fakeKMS) arn(keyID string) (string, error) {
+	if arn, found := fk.aliases[keyID]; found {
+		keyID = arn
+	}
+	if _, found := fk.keys[keyID]; !found {
+		return "", fmt.Errorf("NotFoundException: key [%s] doesn't exist", keyID)
+	}
+	return keyID, nil
+}
+
+func (fk *fakeKMS) Encrypt(ctx context.Context, params *kms.EncryptInput, optFns ...func(*kms.Options)) (*kms.EncryptOutput, error) {
+	arn, err := fk.arn(aws.ToString(params.KeyId))
+	if err != nil {
+		return nil, err
+	}
+	wk, err := fk.keys[arn].WrapKey(ctx, params.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.EncryptOutput{CiphertextBlob: append([]byte(arn+"\x00"), wk.Blob...), KeyId: aws.String(arn)}, nil
+}
+
+func (fk *fakeKMS) Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	arn, blob, _ := bytes.Cut(params.CiphertextBlob, []byte("\x00"))
+	if params.KeyId != nil {
+		if asked, err := fk.arn(aws.ToString(params.KeyId)); err != nil || asked != string(arn) {
+			return nil, fmt.Errorf("IncorrectKeyException: ciphertext wasn't made with [%s]", aws.ToString(params.KeyId))
+		}
+	}
+	keys, found := fk.keys[string(arn)]
+	if !found {
+		return nil, fmt.Errorf("InvalidCiphertextException")
+	}
+	plain, err := keys.UnwrapKey(ctx, &WrappedKey{KeyID: keys.CurrentKeyID(), Blob: blob})
+	if err != nil {
+		return nil, err
+	}
+	return &kms.DecryptOutput{Plaintext: plain, KeyId: aws.String(string(arn))}, nil
+}
+
+func (fk *fakeKMS) DescribeKey(ctx context.Context, params *kms.DescribeKeyInput, optFns ...func(*kms.Options)) (*kms.DescribeKeyOutput, error) {
+	arn, err := fk.arn(aws.ToString(params.KeyId))
+	if err != nil {
+		return nil, err
+	}
+	return &kms.DescribeKeyOutput{KeyMetadata: &kmstypes.KeyMetadata{Arn: aws.String(arn), KeyId: aws.String(arn[strings.LastIndex(arn, "/")+1:])}}, nil
+}
+
+func Test_KMSKeys(t *testing.T) {
+	const firstARN = "arn:aws:kms:us-east-2:111122223333:key/1111aaaa-0000-0000-0000-000000000000"
+	const secondARN = "arn:aws:kms:us-east-2:111122223333:key/2222bbbb-0000-0000-0000-000000000000"
+	ctx := context.Background()
+
+	if _, err := NewKMSKeys(nil, "alias/creds"); err == nil {
+		t.Errorf("expected a nil client to be refused")
+	}
+
+	fk := newFakeKMS(t, firstARN, secondARN)
+	fk.aliases["alias/creds"] = firstARN
+	provider, err := NewKMSKeys(fk, "alias/creds")
+	if err != nil {
+		t.Fatalf("failed to make provider: %s", err)
+	}
+	if err := provider.Resolve(ctx); err != nil || provider.CurrentKeyID() != firstARN {
+		t.Fatalf("expected the alias resolved to [%s], got [%s] (%v)", firstARN, provider.CurrentKeyID(), err)
+	}
+
+	cipher := NewCipher(provider)
+	env, err := cipher.Seal(ctx, []byte("aad"), []string{"hunter2"})
+	if err != nil {
+		t.Fatalf("failed to seal: %s", err)
+	}
+	if env.Key.KeyID != firstARN {
+		t.Errorf("expected the key's ARN recorded, got [%s]", env.Key.KeyID)
+	}
+	if opened, err := NewCipher(provider).Open(ctx, env, []byte("aad")); err != nil || opened[0] != "hunter2" {
+		t.Errorf("failed to open: %v", err)
+	}
+
+	// moving the alias: old items still open (and need re-wrapping), new ones go to the new key
+	fk.aliases["alias/creds"] = secondARN
+	moved, _ := NewKMSKeys(fk, "alias/creds")
+	if err := moved.Resolve(ctx); err != nil || moved.CurrentKeyID() != secondARN {
+		t.Fatalf("expected the alias resolved to [%s], got [%s] (%v)", secondARN, moved.CurrentKeyID(), err)
+	}
+	if opened, err := NewCipher(moved).Open(ctx, env, []byte("aad")); err != nil || opened[0] != "hunter2" {
+		t.Errorf("failed to open after the alias moved: %v", err)
+	}
+	if env.Key.KeyID == moved.CurrentKeyID() {
+		t.Errorf("expected an item wrapped by the old key to need re-wrapping")
+	}
+	if newEnv, _ := NewCipher(moved).Seal(ctx, nil, []string{"x"}); newEnv == nil || newEnv.Key.KeyID != secondARN {
+		t.Errorf("expected new items wrapped by [%s], got %+v", secondARN, newEnv)
+	}
+
+	// items from before ARNs were recorded carry the alias; that isn't pinned
+	legacy := *env
+	legacy.Key.KeyID = "alias/creds"
+	if opened, err := NewCipher(moved).Open(ctx, &legacy, []byte("aad")); err != nil || opened[0] != "hunter2" {
+		t.Errorf("failed to open an item recorded under the alias: %v", err)
+	}
+
+	// the first wrap stands in for Resolve, and an ARN is taken as is
+	unresolved, _ := NewKMSKeys(fk, "alias/creds")
+	if _, err := NewCipher(unresolved).Seal(ctx, nil, []string{"x"}); err != nil || unresolved.CurrentKeyID() != secondARN {
+		t.Errorf("expected [%s] after the first wrap, got [%s] (%v)", secondARN, unresolved.CurrentKeyID(), err)
+	}
+	byARN, _ := NewKMSKeys(fk, firstARN)
+	if err := byARN.Resolve(ctx); err != nil || byARN.CurrentKeyID() != firstARN {
+		t.Errorf("expected [%s], got [%s] (%v)", firstARN, byARN.CurrentKeyID(), err)
+	}
+	if missing, _ := NewKMSKeys(fk, "alias/nope"); missing.Resolve(ctx) == nil {
+		t.Errorf("expected an unknown alias to fail")
+	}
+}
@@ -0,0 +1,114 @@
+package envelope
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// the KMS calls we make; satisfied by *kms.Client
+type KMSAPI interface {
+	Encrypt(ctx context.Context, params *kms.EncryptInput, optFns ...func(*kms.Options)) (*kms.EncryptOutput, error)
+	Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error)
+	DescribeKey(ctx context.Context, params *kms.DescribeKeyInput, optFns ...func(*kms.Options)) (*kms.DescribeKeyOutput, error)
+}
+
+// data keys wrapped by a KMS key (id, ARN or alias); the master key never leaves KMS
+//
+// KMS's own automatic rotation is transparent (old key material is kept), so re-wrapping is only needed
+// when moving to a different KMS key. that includes pointing an alias at another key: wrapped keys record
+// the ARN of the key that actually wrapped them, never the alias
+type KMSKeys struct {
+	Cli   KMSAPI
+	KeyID string
+
+	mu  sync.RWMutex
+	arn string // what KeyID resolves to; set by Resolve or the first wrap
+}
+
+func NewKMSKeys(cli KMSAPI, keyID string) (*KMSKeys, error) {
+	if cli == nil {
+		return nil, errors.New("passed kms client was nil")
+	}
+	if keyID == "" {
+		return nil, errors.New("no kms key id given")
+	}
+	return &KMSKeys{Cli: cli, KeyID: keyID}, nil
+}
+
+// looks up the ARN of the configured key, so CurrentKeyID is right before anything has been wrapped
+// (re-keying compares against it)
+func (k *KMSKeys) Resolve(ctx context.Context) error {
+	arn := k.KeyID
+	if !isKeyARN(arn) {
+		out, err := k.Cli.DescribeKey(ctx, &kms.DescribeKeyInput{KeyId: aws.String(k.KeyID)})
+		if err != nil {
+			return fmt.Errorf("failed to look up kms key [%s]: %s", k.KeyID, err)
+		}
+		if out.KeyMetadata == nil || aws.ToString(out.KeyMetadata.Arn) == "" {
+			return fmt.Errorf("kms key [%s] has no ARN", k.KeyID)
+		}
+		arn = aws.ToString(out.KeyMetadata.Arn)
+	}
+
+	k.mu.Lock()
+	k.arn = arn
+	k.mu.Unlock()
+	return nil
+}
+
+// the ARN of the key new data keys are wrapped with; the configured id until that's known
+func (k *KMSKeys) CurrentKeyID() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if k.arn != "" {
+		return k.arn
+	}
+	return k.KeyID
+}
+
+// the key id recorded is the ARN KMS hands back, which also becomes CurrentKeyID (if an alias has been
+// moved to another key since we resolved it, that's the key we're using now)
+func (k *KMSKeys) WrapKey(ctx context.Context, dataKey []byte) (*WrappedKey, error) {
+	out, err := k.Cli.Encrypt(ctx, &kms.EncryptInput{
+		KeyId:     aws.String(k.KeyID),
+		Plaintext: dataKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	keyID := aws.ToString(out.KeyId)
+	if keyID == "" {
+		keyID = k.CurrentKeyID()
+	}
+	k.mu.Lock()
+	k.arn = keyID
+	k.mu.Unlock()
+	return &WrappedKey{KeyID: keyID, Blob: out.CiphertextBlob}, nil
+}
+
+// the ciphertext says which key it was made with, so only a key ARN is passed along (as a check); items
+// wrapped before ARNs were recorded carry the alias, which may point somewhere else by now
+func (k *KMSKeys) UnwrapKey(ctx context.Context, wk *WrappedKey) ([]byte, error) {
+	params := &kms.DecryptInput{CiphertextBlob: wk.Blob}
+	if isKeyARN(wk.KeyID) {
+		params.KeyId = aws.String(wk.KeyID)
+	}
+	out, err := k.Cli.Decrypt(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
+
+// arn:aws:kms:<region>:<account>:key/<id>, as opposed to a bare key id or an alias (name or ARN)
+func isKeyARN(keyID string) bool {
+	return strings.HasPrefix(keyID, "arn:") && strings.Contains(keyID, ":key/")
+}
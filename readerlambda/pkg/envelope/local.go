@@ -0,0 +1,174 @@
+package envelope
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// master keys kept in a local JSON file; for development and tests, not production (anyone who can read the
+// file can decrypt everything)
+//
+//	{"current": "20240501", "keys": {"20240501": "<base64 of 32 random bytes>", ...}}
+//
+// old keys stay in the file so items wrapped with them can still be opened (and re-wrapped)
+type LocalKeys struct {
+	mu      sync.RWMutex
+	current string
+	keys    map[string][]byte
+}
+
+type localKeyFile struct {
+	Current string            `json:"current"`
+	Keys    map[string][]byte `json:"keys"` // []byte marshals as base64
+}
+
+func NewLocalKeys(current string, keys map[string][]byte) (*LocalKeys, error) {
+	lk := &LocalKeys{current: current, keys: map[string][]byte{}}
+	for id, key := range keys {
+		if len(key) != DATA_KEY_SIZE {
+			return nil, fmt.Errorf("master key [%s] is %d bytes, want %d", id, len(key), DATA_KEY_SIZE)
+		}
+		lk.keys[id] = key
+	}
+	if _, found := lk.keys[current]; !found {
+		return nil, fmt.Errorf("current master key [%s] isn't in the key set", current)
+	}
+	return lk, nil
+}
+
+func LoadKeyFile(filename string) (*LocalKeys, error) {
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %s", err)
+	}
+	var kf localKeyFile
+	if err := json.Unmarshal(raw, &kf); err != nil {
+		return nil, fmt.Errorf("failed to parse key file [%s]: %s", filename, err)
+	}
+	return NewLocalKeys(kf.Current, kf.Keys)
+}
+
+// owner read/write only. written to a temp file beside it and renamed over it, so a crash or full disk
+// part way through leaves the old file (and every key in it) intact
+func (lk *LocalKeys) Save(filename string) error {
+	lk.mu.RLock()
+	raw, err := json.MarshalIndent(localKeyFile{Current: lk.current, Keys: lk.keys}, "", "  ")
+	lk.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	fh, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp") // CreateTemp makes it 0600
+	if err != nil {
+		return fmt.Errorf("failed to write key file: %s", err)
+	}
+	tmpName := fh.Name()
+	_, err = fh.Write(raw)
+	if err == nil {
+		err = fh.Sync()
+	}
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, filename)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to write key file: %s", err)
+	}
+	return nil
+}
+
+// generates a new master key and makes it current; returns its id. a nil lk starts a new key set
+func (lk *LocalKeys) Rotate() (*LocalKeys, string, error) {
+	key := make([]byte, DATA_KEY_SIZE)
+	if _, err := rand.Read(key); err != nil {
+		return nil, "", fmt.Errorf("failed to generate master key: %s", err)
+	}
+
+	if lk == nil {
+		lk = &LocalKeys{keys: map[string][]byte{}}
+	}
+	lk.mu.Lock()
+	defer lk.mu.Unlock()
+
+	id := time.Now().UTC().Format("20060102T150405")
+	for n := 2; lk.keys[id] != nil; n++ { // more than one a second
+		id = fmt.Sprintf("%s-%d", time.Now().UTC().Format("20060102T150405"), n)
+	}
+	lk.keys[id] = key
+	lk.current = id
+	return lk, id, nil
+}
+
+// ids of every key in the set, sorted
+func (lk *LocalKeys) KeyIDs() []string {
+	lk.mu.RLock()
+	defer lk.mu.RUnlock()
+
+	ret := make([]string, 0, len(lk.keys))
+	for id := range lk.keys {
+		ret = append(ret, id)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (lk *LocalKeys) CurrentKeyID() string {
+	lk.mu.RLock()
+	defer lk.mu.RUnlock()
+	return lk.current
+}
+
+func (lk *LocalKeys) master(id string) ([]byte, error) {
+	lk.mu.RLock()
+	defer lk.mu.RUnlock()
+
+	key, found := lk.keys[id]
+	if !found {
+		return nil, fmt.Errorf("%w [%s]", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+// AES-GCM under the master key, with its id as additional data
+func (lk *LocalKeys) WrapKey(ctx context.Context, dataKey []byte) (*WrappedKey, error) {
+	id := lk.CurrentKeyID()
+	master, err := lk.master(id)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %s", err)
+	}
+	return &WrappedKey{KeyID: id, Blob: gcm.Seal(nonce, nonce, dataKey, []byte(id))}, nil
+}
+
+func (lk *LocalKeys) UnwrapKey(ctx context.Context, wk *WrappedKey) ([]byte, error) {
+	master, err := lk.master(wk.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	if len(wk.Blob) < gcm.NonceSize() {
+		return nil, fmt.Errorf("wrapped key is truncated")
+	}
+	return gcm.Open(nil, wk.Blob[:gcm.NonceSize()], wk.Blob[gcm.NonceSize():], []byte(wk.KeyID))
+}
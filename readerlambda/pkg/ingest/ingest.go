@@ -0,0 +1,508 @@
+package ingest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"strings"
+
+	"github.com/newodahs/readerlambda/pkg/alerts"
+	"github.com/newodahs/readerlambda/pkg/canary"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/credstore"
+	"github.com/newodahs/readerlambda/pkg/envelope"
+	"github.com/newodahs/readerlambda/pkg/jobs"
+	"github.com/newodahs/readerlambda/pkg/retention"
+	"github.com/newodahs/readerlambda/pkg/sources"
+	"github.com/newodahs/readerlambda/pkg/util"
+	"github.com/newodahs/readerlambda/pkg/watchlist"
+	"github.com/newodahs/readerlambda/pkg/webhook"
+)
+
+// how many distinct credentials we hold before writing them out
+const DEFAULT_BATCH_SIZE = 500
+
+// the parse -> store pipeline shared by the lambda and the console; one Run per object/file
+type Ingester struct {
+	DynDBCli       util.DynamoDBAPI // if nil we only parse; nothing is stored and the job isn't saved
+	CredTable      string
+	LinkTable      string
+	JobTable       string
+	TombstoneTable string // addresses with a tombstone here (see credstore.Erase) aren't stored; empty (or no Keys) skips the check
+	WatchTable     string // watched domains/addresses (see the watchlist package), read at the start of each run
+	CanaryTable    string // canary credentials (see the canary package), read at the start of each run; empty skips the check
+	BatchSize      int
+
+	TableOptions *util.TableOptions   // how EnsureTables creates missing tables; nil for the defaults
+	Cipher       *envelope.Cipher     // if set passwords are stored encrypted
+	Keys         *credstore.KeyHasher // if set credentials (and source links) are stored under hashed keys; needs Cipher
+	Retention    *retention.Policy    // if set passwords expire per the policy; nil keeps everything forever
+	Notifier     alerts.Notifier      // where watchlist alerts go (in the background; see alerts.Queue); nil doesn't check the watchlist at all
+	AlertWorkers int                  // alerts sent at once; 0 for alerts.DEFAULT_QUEUE_WORKERS
+	Webhooks     *webhook.Sender      // if set finished jobs are sent as webhooks (alerts go through Notifier)
+
+	// optional hooks; OnCredential is called after each credential has been written (stored is false
+	// if the write failed or we're parse-only)
+	OnReject     func(pe *credparser.ParseError)
+	OnCredential func(cred *credparser.CredentialInfo, stored bool)
+
+	// optional; called after every batch is written with the position just past everything stored so far.
+	// returning false stops the run early (RunFrom returns ErrStopped) so the caller can continue from
+	// that position later, e.g. when the lambda is about to run out of time
+	OnCheckpoint func(pos Position) bool
+
+	// optional; everything before the position RunFrom starts at (earlier invocations stored it). it's
+	// only read to remember its lines, so one repeated across parts is still rejected as a duplicate
+	Before io.Reader
+}
+
+// how far into the input we are: bytes consumed (including line endings) and the last line number read
+type Position struct {
+	Offset int64 `json:"offset"`
+	Line   int   `json:"line"`
+}
+
+var ErrStopped = errors.New("ingest stopped before reaching the end of the input")
+
+// RunFrom couldn't keep reading (it timed out, was cancelled, or the read itself failed); like ErrStopped
+// everything before the returned position is stored and the job is left running, so the rest can be
+// picked up from there. the cause is joined to it
+var ErrInterrupted = errors.New("ingest interrupted before reaching the end of the input")
+
+func New(cli util.DynamoDBAPI) *Ingester {
+	return &Ingester{
+		DynDBCli:       cli,
+		CredTable:      credstore.DYNDB_TABLE_EXPLOITCRED,
+		LinkTable:      sources.DYNDB_TABLE_SOURCECREDS,
+		JobTable:       jobs.DYNDB_TABLE_JOBS,
+		TombstoneTable: credstore.DYNDB_TABLE_TOMBSTONES,
+		WatchTable:     watchlist.DYNDB_TABLE_WATCHLIST,
+		CanaryTable:    canary.DYNDB_TABLE_CANARIES,
+		BatchSize:      DEFAULT_BATCH_SIZE,
+	}
+}
+
+// the tables an ingester writes to, by name; an empty tombstone, watchlist or canary table skips that check
+type Tables struct {
+	Credentials       string
+	SourceCredentials string
+	Jobs              string
+	Tombstones        string
+	Watchlist         string
+	Canaries          string
+}
+
+// an ingester writing to tables, creating any that are missing (see EnsureTables) with opts
+func NewWithTables(cli util.DynamoDBAPI, tables Tables, opts *util.TableOptions) *Ingester {
+	ing := New(cli)
+	ing.CredTable = tables.Credentials
+	ing.LinkTable = tables.SourceCredentials
+	ing.JobTable = tables.Jobs
+	ing.TombstoneTable = tables.Tombstones
+	ing.WatchTable = tables.Watchlist
+	ing.CanaryTable = tables.Canaries
+	ing.TableOptions = opts
+	return ing
+}
+
+// makes sure every table the pipeline writes to exists
+func (ing *Ingester) EnsureTables(ctx context.Context) error {
+	if ing.DynDBCli == nil {
+		return nil
+	}
+
+	// items only carry the TTL attribute with a retention policy, so it's safe to always turn on
+	credOpts := ing.TableOptions.WithTTL(credstore.ATTR_EXPIRES_AT)
+	if err := util.EnsureDynamoDBTable(ctx, ing.DynDBCli, ing.CredTable, credparser.CredentialInfo{}, credOpts); err != nil {
+		return err
+	}
+	if err := util.EnsureDynamoDBTable(ctx, ing.DynDBCli, ing.LinkTable, sources.SourceCredential{}, ing.TableOptions); err != nil {
+		return err
+	}
+	if ing.TombstoneTable != "" {
+		if err := util.EnsureDynamoDBTable(ctx, ing.DynDBCli, ing.TombstoneTable, credstore.Tombstone{}, ing.TableOptions); err != nil {
+			return err
+		}
+	}
+	if ing.WatchTable != "" {
+		if err := util.EnsureDynamoDBTable(ctx, ing.DynDBCli, ing.WatchTable, watchlist.Entry{}, ing.TableOptions); err != nil {
+			return err
+		}
+	}
+	if ing.CanaryTable != "" {
+		if err := util.EnsureDynamoDBTable(ctx, ing.DynDBCli, ing.CanaryTable, canary.Canary{}, ing.TableOptions); err != nil {
+			return err
+		}
+	}
+	if ing.Webhooks != nil {
+		deliveryOpts := ing.TableOptions.WithTTL(webhook.ATTR_EXPIRES_AT)
+		if err := util.EnsureDynamoDBTable(ctx, ing.DynDBCli, ing.Webhooks.Table, webhook.Delivery{}, deliveryOpts); err != nil {
+			return err
+		}
+	}
+	return util.EnsureDynamoDBTable(ctx, ing.DynDBCli, ing.JobTable, jobs.Job{}, jobs.TableOptions(ing.TableOptions))
+}
+
+// parses everything in r and stores it, keeping job up to date as we go; job should describe where
+// r came from (bucket/key or filename, source) as that's what ends up as each password's provenance
+//
+// rejected lines and failed writes are counted on the job, not returned; an error means we couldn't
+// finish reading the input
+func (ing *Ingester) Run(ctx context.Context, r io.Reader, job *jobs.Job) error {
+	_, err := ing.RunFrom(ctx, r, job, Position{})
+	if errors.Is(err, ErrInterrupted) {
+		ing.finish(context.Background(), job, err) // nobody's going to pick this one up again (and ctx may be done)
+	}
+	return err
+}
+
+// same as Run, but r starts at start (e.g. a ranged read from a checkpoint); job counts are added to
+// rather than replaced so a job spanning several invocations adds up
+//
+// returns the position reached; on ErrStopped or ErrInterrupted the job is saved but left running. a
+// line too long to parse fails the run outright, as reading it again won't go any better
+func (ing *Ingester) RunFrom(ctx context.Context, r io.Reader, job *jobs.Job, start Position) (Position, error) {
+	if r == nil || job == nil {
+		return start, credparser.ErrBadParameter
+	}
+	if job.Rejected == nil {
+		job.Rejected = map[credparser.RejectReason]int{}
+	}
+
+	ing.saveJob(ctx, job)
+	rs := &runState{watches: ing.loadWatchlist(ctx), canaries: ing.loadCanaries(ctx)}
+	if ing.Notifier != nil {
+		rs.alerts = alerts.NewQueue(ctx, ing.Notifier, ing.AlertWorkers)
+		defer rs.alerts.Close() // everything's been waited for by then; this just stops the workers
+	}
+
+	tmpl := credparser.Provenance{
+		Bucket:     job.Bucket,
+		Key:        job.Key,
+		Filename:   job.Filename,
+		JobID:      job.ID,
+		SourceID:   job.SourceID,
+		BreachDate: job.BreachDate,
+		FirstSeen:  job.Started,
+		LastSeen:   job.Started,
+	}
+
+	batchSize := ing.BatchSize
+	if batchSize <= 0 {
+		batchSize = DEFAULT_BATCH_SIZE
+	}
+
+	// count what the scanner consumes so we know the byte offset of each line boundary
+	var consumed int64
+	scanner := bufio.NewScanner(r)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		consumed += int64(advance)
+		return advance, token, err
+	})
+
+	p := credparser.NewParser()
+	if ing.Before != nil {
+		before := bufio.NewScanner(ing.Before)
+		for before.Scan() {
+			p.Remember(before.Text())
+		}
+		if readErr := before.Err(); readErr != nil {
+			return start, errors.Join(ErrInterrupted, fmt.Errorf("failed to read the input before line %d: %s", start.Line+1, readErr))
+		}
+	}
+
+	pos := start
+	stored := counts{pos: start} // what's been written out; an interrupted run only counts up to here
+	var runErr error
+	for lineCnt := start.Line + 1; scanner.Scan(); lineCnt++ {
+		if lineErr := p.ParseLine(lineCnt, scanner.Text()); lineErr != nil {
+			if pe, ok := lineErr.(*credparser.ParseError); ok && ing.OnReject != nil {
+				ing.OnReject(pe)
+			}
+		}
+		pos = Position{Offset: start.Offset + consumed, Line: lineCnt}
+
+		if p.Pending() >= batchSize {
+			ing.flush(ctx, p.Flush(), tmpl, job, rs)
+			stored = countsAt(pos, p)
+			if ing.OnCheckpoint != nil && !ing.OnCheckpoint(pos) {
+				runErr = ErrStopped
+				break
+			}
+		}
+
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			runErr = ctxErr
+			break
+		}
+	}
+	if runErr == nil {
+		runErr = scanner.Err()
+	}
+
+	// out of time or the read failed; whatever we parsed since the last batch was written gets read again
+	if runErr != nil && !errors.Is(runErr, ErrStopped) && !errors.Is(runErr, bufio.ErrTooLong) {
+		stored.addTo(job)
+		rs.alerted(job)
+		ing.saveJob(context.Background(), job) // ctx may well be what interrupted us
+		return stored.pos, errors.Join(ErrInterrupted, runErr)
+	}
+
+	ing.flush(ctx, p.Flush(), tmpl, job, rs)
+	countsAt(pos, p).addTo(job)
+	rs.alerted(job)
+
+	if errors.Is(runErr, ErrStopped) {
+		ing.saveJob(ctx, job)
+		return pos, runErr
+	}
+
+	ing.finish(ctx, job, runErr)
+	return pos, runErr
+}
+
+// what a run loads up front and hands down to each batch
+type runState struct {
+	watches  *watchlist.Matcher
+	canaries *canary.Set
+	alerts   *alerts.Queue // nil without a Notifier
+}
+
+// waits for the alerts raised so far and counts them on job
+func (rs *runState) alerted(job *jobs.Job) {
+	if rs.alerts == nil {
+		return
+	}
+	sent, failed := rs.alerts.Wait()
+	job.Alerts += sent
+	job.AlertFailures += failed
+}
+
+// the parser's counts as of a position
+type counts struct {
+	pos      Position
+	lines    int
+	accepted int
+	rejected map[credparser.RejectReason]int
+}
+
+func countsAt(pos Position, p *credparser.Parser) counts {
+	return counts{pos: pos, lines: p.LinesRead, accepted: p.Accepted, rejected: maps.Clone(p.Rejected)}
+}
+
+func (c counts) addTo(job *jobs.Job) {
+	job.LinesRead += c.lines
+	job.Accepted += c.accepted
+	for reason, cnt := range c.rejected {
+		job.Rejected[reason] += cnt
+	}
+}
+
+// marks a job the caller stopped (see OnCheckpoint and ErrStopped) as failed with err and saves it, so it
+// doesn't sit in the jobs table as running forever; a job that's already finished is left alone
+func (ing *Ingester) Fail(ctx context.Context, job *jobs.Job, err error) {
+	if job == nil || job.Finished != nil {
+		return
+	}
+	ing.finish(ctx, job, err)
+}
+
+// marks the job done (failed if err is set), saves it and queues it to go out
+func (ing *Ingester) finish(ctx context.Context, job *jobs.Job, err error) {
+	job.Finish(err)
+	ing.saveJob(ctx, job)
+	if _, sendErr := ing.Webhooks.Enqueue(ctx, webhook.EVENT_JOB_COMPLETED, job); sendErr != nil {
+		log.Printf("WARNING: %s", sendErr)
+	}
+}
+
+func (ing *Ingester) flush(ctx context.Context, credList map[string]*credparser.CredentialInfo, tmpl credparser.Provenance, job *jobs.Job, rs *runState) {
+	credparser.StampProvenance(credList, tmpl)
+
+	// retention counts from the breach if we know when it was, otherwise from when we first saw it
+	basis := tmpl.FirstSeen
+	if job.BreachDate != nil {
+		basis = *job.BreachDate
+	}
+
+	// erased addresses aren't stored again; if we can't tell which those are nothing in the batch is stored
+	erased, checkErr := ing.tombstoned(ctx, credList)
+	if checkErr != nil {
+		log.Printf("WARNING: not storing %d credentials: %s", len(credList), checkErr)
+	}
+
+	for _, cred := range credList {
+		ing.Retention.Stamp(cred, basis)
+		ing.checkCanary(ctx, rs, cred, job)
+
+		stored := false
+		if ing.DynDBCli != nil {
+			switch {
+			case checkErr != nil:
+				job.WriteFailures++
+			case ing.Keys != nil && erased[ing.Keys.TombstoneKey(cred.Domain, cred.User)]:
+				job.Suppressed++
+			default:
+				stored = ing.store(ctx, cred, job, rs)
+			}
+		}
+
+		if ing.OnCredential != nil {
+			ing.OnCredential(cred, stored)
+		}
+	}
+}
+
+func (ing *Ingester) store(ctx context.Context, cred *credparser.CredentialInfo, job *jobs.Job, rs *runState) bool {
+	added, storeErr := credstore.StoreCredential(ctx, ing.DynDBCli, ing.CredTable, ing.Cipher, ing.Keys, cred)
+	if storeErr != nil {
+		log.Printf("WARNING: failed to store exploited credential [%s] to dynamodb: %s", cred.Email, storeErr)
+		job.WriteFailures++
+		return false
+	}
+	job.Credentials++
+	job.NewPasswords += added
+
+	if job.SourceID != "" {
+		if linkErr := sources.Link(ctx, ing.DynDBCli, ing.LinkTable, job.SourceID, ing.linkTarget(cred)); linkErr != nil {
+			log.Printf("WARNING: %s", linkErr)
+		}
+	}
+
+	// only news is alerted on; a dump we've mostly seen before doesn't alert again for what we already had
+	if added > 0 {
+		ing.alert(rs, cred, added, job)
+	}
+	return true
+}
+
+// the watchlist for this run; nil if there's nobody to tell or nothing watched. a watchlist we can't read
+// doesn't stop the ingest, but nothing is alerted on
+func (ing *Ingester) loadWatchlist(ctx context.Context) *watchlist.Matcher {
+	if ing.DynDBCli == nil || ing.Notifier == nil || ing.WatchTable == "" {
+		return nil
+	}
+	watches, err := watchlist.Load(ctx, ing.DynDBCli, ing.WatchTable)
+	if err != nil {
+		log.Printf("WARNING: not alerting on this ingest: %s", err)
+	}
+	return watches
+}
+
+// the canaries for this run; nil if there aren't any. like the watchlist, failing to read them doesn't
+// stop the ingest
+func (ing *Ingester) loadCanaries(ctx context.Context) *canary.Set {
+	if ing.DynDBCli == nil || ing.CanaryTable == "" {
+		return nil
+	}
+	canaries, err := canary.Load(ctx, ing.DynDBCli, ing.CanaryTable)
+	if err != nil {
+		log.Printf("WARNING: not checking this ingest for canaries: %s", err)
+	}
+	return canaries
+}
+
+// if cred is one of our canaries, records where it turned up and raises a high priority alert; checked
+// whether or not we've seen the passwords before, as every dump it's in matters. only alerted on once
+// per job
+func (ing *Ingester) checkCanary(ctx context.Context, rs *runState, cred *credparser.CredentialInfo, job *jobs.Job) {
+	found := rs.canaries.Match(cred)
+	if found == nil {
+		return
+	}
+	job.Canaries++
+
+	sighting := canary.Sighting{
+		JobID:    job.ID,
+		SourceID: job.SourceID,
+		Bucket:   job.Bucket,
+		Key:      job.Key,
+		Filename: job.Filename,
+		SeenAt:   job.Started,
+	}
+	idx := found.MatchPassword(cred.Password)
+	sighting.PasswordMatched = idx >= 0
+	if idx < 0 {
+		idx = 0 // just the address; point at its first line
+	}
+	if idx < len(cred.Provenance) {
+		sighting.Line = cred.Provenance[idx].Line
+	}
+	log.Printf("WARNING: canary [%s] (%s) found in ingest job [%s] at line %d (password matched: %t)",
+		found.Email, found.Label, job.ID, sighting.Line, sighting.PasswordMatched)
+
+	recorded, err := canary.RecordSighting(ctx, ing.DynDBCli, ing.CanaryTable, found.Email, sighting)
+	if err != nil {
+		log.Printf("WARNING: %s", err) // still alert; better twice than not at all
+	} else if !recorded {
+		return
+	}
+	if rs.alerts == nil {
+		log.Printf("WARNING: no alert destination configured for canary [%s]", found.Email)
+		return
+	}
+
+	alert := alerts.New(alerts.ALERT_KIND_CANARY)
+	alert.Label = found.Label
+	alert.Email = alerts.MaskEmail(found.Email)
+	alert.Domain = strings.ToLower(cred.Domain)
+	alert.Passwords = len(cred.Password)
+	alert.PasswordMatched = sighting.PasswordMatched
+	alert.SourceID, alert.JobID = job.SourceID, job.ID
+	alert.Bucket, alert.Key, alert.Filename, alert.Line = job.Bucket, job.Key, job.Filename, sighting.Line
+	rs.alerts.Enqueue(alert)
+}
+
+// queues an alert for every owner watching cred's domain or address; they only get masked details
+func (ing *Ingester) alert(rs *runState, cred *credparser.CredentialInfo, added int, job *jobs.Job) {
+	for _, entry := range rs.watches.Match(cred) {
+		alert := alerts.New(alerts.ALERT_KIND_WATCHLIST)
+		alert.Owner = entry.Owner
+		alert.Watched = entry.Target
+		if entry.Kind == watchlist.KIND_ADDRESS {
+			alert.Watched = alerts.MaskEmail(entry.Target)
+		}
+		alert.Email = alerts.MaskEmail(cred.Email)
+		alert.Domain = strings.ToLower(cred.Domain)
+		alert.Passwords = added
+		alert.SourceID, alert.JobID = job.SourceID, job.ID
+		alert.Bucket, alert.Key, alert.Filename = job.Bucket, job.Key, job.Filename
+		rs.alerts.Enqueue(alert)
+	}
+}
+
+// the tombstone keys (see credstore.Erase) of everything in credList that has been erased; there are no
+// tombstones without a lookup key
+func (ing *Ingester) tombstoned(ctx context.Context, credList map[string]*credparser.CredentialInfo) (map[string]bool, error) {
+	if ing.DynDBCli == nil || ing.TombstoneTable == "" || ing.Keys == nil || len(credList) == 0 {
+		return nil, nil
+	}
+
+	tombstoneKeys := make([]string, 0, len(credList))
+	for _, cred := range credList {
+		tombstoneKeys = append(tombstoneKeys, ing.Keys.TombstoneKey(cred.Domain, cred.User))
+	}
+	return credstore.Tombstoned(ctx, ing.DynDBCli, ing.TombstoneTable, tombstoneKeys)
+}
+
+// links point at the stored key, so with hashed keys they don't give the address away either
+func (ing *Ingester) linkTarget(cred *credparser.CredentialInfo) *credparser.CredentialInfo {
+	key := ing.Keys.Key(cred.Domain, cred.User)
+	return &credparser.CredentialInfo{Domain: key.Domain, User: key.User}
+}
+
+// job bookkeeping should never stop an ingest; log and carry on
+func (ing *Ingester) saveJob(ctx context.Context, job *jobs.Job) {
+	if ing.DynDBCli == nil {
+		return
+	}
+
+	if err := jobs.Save(ctx, ing.DynDBCli, ing.JobTable, job); err != nil {
+		log.Printf("WARNING: failed to save ingest job [%s]: %s", job.ID, err)
+	}
+}
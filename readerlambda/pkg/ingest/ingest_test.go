@@ -0,0 +1,523 @@
+package ingest
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/newodahs/readerlambda/pkg/alerts"
+	"github.com/newodahs/readerlambda/pkg/awsfake"
+	"github.com/newodahs/readerlambda/pkg/canary"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/credstore"
+	"github.com/newodahs/readerlambda/pkg/envelope"
+	"github.com/newodahs/readerlambda/pkg/jobs"
+	"github.com/newodahs/readerlambda/pkg/util"
+	"github.com/newodahs/readerlambda/pkg/watchlist"
+	"github.com/newodahs/readerlambda/pkg/webhook"
+)
+
+// stop part way through, then pick up from the reported position the way the lambda does with a ranged read
+func Test_Ingest_ResumeFromCheckpoint(t *testing.T) {
+	input := "one@a.com:pw1\r\ntwo@a.com:pw2\ngarbage\nthree@b.com:pw3\nfour@b.com:pw4\n"
+
+	var seen []string
+	ing := New(nil) // parse only
+	ing.BatchSize = 1
+	ing.OnCredential = func(cred *credparser.CredentialInfo, stored bool) {
+		seen = append(seen, cred.Email)
+		if cred.Provenance[0].JobID == "" {
+			t.Errorf("credential [%s] missing job id in provenance", cred.Email)
+		}
+	}
+
+	checkpoints := 0
+	ing.OnCheckpoint = func(pos Position) bool {
+		checkpoints++
+		return checkpoints < 2
+	}
+
+	job := jobs.New()
+	pos, err := ing.RunFrom(context.TODO(), strings.NewReader(input), job, Position{})
+	if !errors.Is(err, ErrStopped) {
+		t.Fatalf("expected ErrStopped, got %v", err)
+	}
+	if pos.Line != 2 || pos.Offset != int64(len("one@a.com:pw1\r\ntwo@a.com:pw2\n")) {
+		t.Fatalf("stopped at unexpected position %+v", pos)
+	}
+	if job.Status != jobs.STATUS_RUNNING || job.LinesRead != 2 {
+		t.Errorf("job should still be running with 2 lines read: %+v", job)
+	}
+
+	var rejects []*credparser.ParseError
+	ing.OnCheckpoint = nil
+	ing.OnReject = func(pe *credparser.ParseError) { rejects = append(rejects, pe) }
+	pos, err = ing.RunFrom(context.TODO(), strings.NewReader(input[pos.Offset:]), job, pos)
+	if err != nil {
+		t.Fatalf("resumed run failed: %s", err)
+	}
+
+	if pos.Line != 5 || pos.Offset != int64(len(input)) {
+		t.Errorf("finished at unexpected position %+v", pos)
+	}
+	if strings.Join(seen, ",") != "one@a.com,two@a.com,three@b.com,four@b.com" {
+		t.Errorf("unexpected credentials across both runs: %v", seen)
+	}
+	if len(rejects) != 1 || rejects[0].Line != 3 || rejects[0].Reason != credparser.REJECT_UNPARSEABLE {
+		t.Errorf("expected the garbage line to be rejected at line 3: %+v", rejects)
+	}
+	if job.Status != jobs.STATUS_SUCCEEDED || job.LinesRead != 5 || job.Accepted != 4 || job.Rejected[credparser.REJECT_UNPARSEABLE] != 1 {
+		t.Errorf("job counts don't add up across both runs: %+v", job)
+	}
+}
+
+// a line repeated in a later part is still a duplicate when the earlier part is handed over as Before
+func Test_Ingest_DuplicatesAcrossParts(t *testing.T) {
+	first := "one@a.com:pw1\ntwo@a.com:pw2\n"
+	rest := "three@b.com:pw3\none@a.com:pw1\n"
+
+	var rejects []*credparser.ParseError
+	ing := New(nil)
+	ing.OnReject = func(pe *credparser.ParseError) { rejects = append(rejects, pe) }
+	ing.Before = strings.NewReader(first)
+
+	job := jobs.New()
+	if _, err := ing.RunFrom(context.TODO(), strings.NewReader(rest), job, Position{Offset: int64(len(first)), Line: 2}); err != nil {
+		t.Fatalf("ingest failed: %s", err)
+	}
+	if len(rejects) != 1 || rejects[0].Line != 4 || rejects[0].Reason != credparser.REJECT_DUPLICATE {
+		t.Errorf("expected line 4 to be rejected as a duplicate of line 1: %+v", rejects)
+	}
+	if job.LinesRead != 2 || job.Accepted != 1 {
+		t.Errorf("only this part's lines should be counted: %+v", job)
+	}
+
+	ing.Before = iotest.ErrReader(errors.New("connection reset"))
+	if _, err := ing.RunFrom(context.TODO(), strings.NewReader(rest), jobs.New(), Position{Offset: int64(len(first)), Line: 2}); !errors.Is(err, ErrInterrupted) {
+		t.Errorf("expected failing to read the earlier part to interrupt the run, got %v", err)
+	}
+}
+
+// a read that fails part way (or a run out of time) is resumable from the last batch written; a line the
+// scanner can't take is the object's fault and fails the job
+func Test_Ingest_Interrupted(t *testing.T) {
+	input := "one@a.com:pw1\ntwo@a.com:pw2\nthree@b.com:pw3\n"
+
+	var seen []string
+	ing := New(nil)
+	ing.BatchSize = 2
+	ing.OnCredential = func(cred *credparser.CredentialInfo, stored bool) { seen = append(seen, cred.Email) }
+
+	job := jobs.New()
+	broken := io.MultiReader(strings.NewReader(input), iotest.ErrReader(errors.New("connection reset")))
+	pos, err := ing.RunFrom(context.TODO(), broken, job, Position{})
+	if !errors.Is(err, ErrInterrupted) || !strings.Contains(err.Error(), "connection reset") {
+		t.Fatalf("expected ErrInterrupted with the cause, got %v", err)
+	}
+	if pos.Line != 2 || pos.Offset != int64(len("one@a.com:pw1\ntwo@a.com:pw2\n")) {
+		t.Errorf("expected to resume after the written batch, got %+v", pos)
+	}
+	slices.Sort(seen) // a batch comes out in no particular order
+	if job.Status != jobs.STATUS_RUNNING || job.LinesRead != 2 || job.Accepted != 2 || strings.Join(seen, ",") != "one@a.com,two@a.com" {
+		t.Errorf("only the written batch should count: %+v (saw %v)", job, seen)
+	}
+
+	if _, err := ing.RunFrom(context.TODO(), strings.NewReader(input[pos.Offset:]), job, pos); err != nil {
+		t.Fatalf("resumed run failed: %s", err)
+	}
+	if job.Status != jobs.STATUS_SUCCEEDED || job.LinesRead != 3 || job.Accepted != 3 {
+		t.Errorf("job counts don't add up after resuming: %+v", job)
+	}
+
+	// out of time counts the same way
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ing.RunFrom(ctx, strings.NewReader(input), jobs.New(), Position{}); !errors.Is(err, ErrInterrupted) || !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a cancelled run to be interrupted, got %v", err)
+	}
+
+	job = jobs.New()
+	tooLong := "one@a.com:pw1\n" + strings.Repeat("x", bufio.MaxScanTokenSize+1) + "\n"
+	if err := ing.Run(context.TODO(), strings.NewReader(tooLong), job); !errors.Is(err, bufio.ErrTooLong) || errors.Is(err, ErrInterrupted) {
+		t.Errorf("expected a line too long to fail outright, got %v", err)
+	}
+	if job.Status != jobs.STATUS_FAILED {
+		t.Errorf("expected the job to fail, got %s", job.Status)
+	}
+}
+
+// the job counts what happened and is saved as it goes, ending up partial when some writes failed
+func Test_Ingest_Job(t *testing.T) {
+	ctx := context.Background()
+	cli := awsfake.NewDynamoDB()
+	ing := New(cli)
+	if err := ing.EnsureTables(ctx); err != nil {
+		t.Fatalf("failed to create tables: %s", err)
+	}
+
+	job := jobs.New()
+	job.Filename = "dump.txt"
+	if err := ing.Run(ctx, strings.NewReader("one@a.com:pw1\none@a.com:pw2\ntwo@b.com:pw3\nnonsense\n"), job); err != nil {
+		t.Fatalf("ingest failed: %s", err)
+	}
+	if job.Status != jobs.STATUS_SUCCEEDED || job.LinesRead != 4 || job.Accepted != 3 || job.TotalRejected() != 1 || job.Credentials != 2 || job.NewPasswords != 3 {
+		t.Errorf("unexpected job counts: %+v", job)
+	}
+
+	// the same again adds nothing new; then a table that's gone fails every write
+	job = jobs.New()
+	if err := ing.Run(ctx, strings.NewReader("one@a.com:pw1\n"), job); err != nil || job.NewPasswords != 0 || job.Credentials != 1 {
+		t.Errorf("expected nothing new the second time: %+v (%v)", job, err)
+	}
+	ing.CredTable = "missingTable"
+	job = jobs.New()
+	if err := ing.Run(ctx, strings.NewReader("three@c.com:pw4\n"), job); err != nil {
+		t.Fatalf("ingest failed: %s", err)
+	}
+	if job.Status != jobs.STATUS_PARTIAL || job.WriteFailures != 1 {
+		t.Errorf("expected a partial job with a write failure: %+v", job)
+	}
+
+	saved, err := jobs.List(ctx, cli, ing.JobTable, jobs.STATUS_PARTIAL, 0)
+	if err != nil || len(saved) != 1 || saved[0].ID != job.ID || saved[0].WriteFailures != 1 {
+		t.Errorf("expected the partial job to be saved, got %v (%v)", saved, err)
+	}
+	if all, _ := jobs.List(ctx, cli, ing.JobTable, "", 0); len(all) != 3 {
+		t.Errorf("expected all 3 jobs to be saved, got %d", len(all))
+	}
+}
+
+// a run the caller stopped leaves the job running until Fail saves it as failed; a finished job is left alone
+func Test_Ingest_Fail(t *testing.T) {
+	ctx := context.Background()
+	cli := awsfake.NewDynamoDB()
+	ing := New(cli)
+	ing.BatchSize = 1
+	ing.OnCheckpoint = func(pos Position) bool { return false }
+	if err := ing.EnsureTables(ctx); err != nil {
+		t.Fatalf("failed to create tables: %s", err)
+	}
+
+	job := jobs.New()
+	if err := ing.Run(ctx, strings.NewReader("one@a.com:pw1\ntwo@a.com:pw2\n"), job); !errors.Is(err, ErrStopped) {
+		t.Fatalf("expected ErrStopped, got %v", err)
+	}
+	if saved, err := jobs.Get(ctx, cli, ing.JobTable, job.ID); err != nil || saved.Status != jobs.STATUS_RUNNING {
+		t.Fatalf("expected the stopped job to be saved as running, got %+v (%v)", saved, err)
+	}
+
+	ing.Fail(ctx, job, errors.New("failed to write output: broken pipe"))
+	saved, err := jobs.Get(ctx, cli, ing.JobTable, job.ID)
+	if err != nil || saved.Status != jobs.STATUS_FAILED || saved.Error != "failed to write output: broken pipe" || saved.Finished == nil {
+		t.Errorf("expected the job to be saved as failed, got %+v (%v)", saved, err)
+	}
+
+	ing.Fail(ctx, job, errors.New("something else"))
+	if saved, _ := jobs.Get(ctx, cli, ing.JobTable, job.ID); saved.Error != "failed to write output: broken pipe" {
+		t.Errorf("expected a finished job to be left alone, got %+v", saved)
+	}
+}
+
+// every named table is the one written to; empty optional tables aren't created at all
+func Test_Ingest_NewWithTables(t *testing.T) {
+	ctx := context.Background()
+	cli := awsfake.NewDynamoDB()
+	ing := NewWithTables(cli, Tables{Credentials: "creds", SourceCredentials: "links", Jobs: "runs", Watchlist: "watched"}, nil)
+	if err := ing.EnsureTables(ctx); err != nil {
+		t.Fatalf("failed to create tables: %s", err)
+	}
+
+	have := cli.Tables()
+	slices.Sort(have)
+	if strings.Join(have, ",") != "creds,links,runs,watched" {
+		t.Errorf("unexpected tables created: %v", have)
+	}
+}
+
+// a credential table made before retention existed gets TTL turned on the next time tables are ensured
+func Test_Ingest_EnsureTables_TTL(t *testing.T) {
+	ctx := context.Background()
+	cli := awsfake.NewDynamoDB()
+	ing := New(cli)
+	if err := util.EnsureDynamoDBTable(ctx, cli, ing.CredTable, credparser.CredentialInfo{}, nil); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	if ttl, _, _ := cli.TableSettings(ing.CredTable); ttl != "" {
+		t.Fatalf("expected no TTL to start with, got [%s]", ttl)
+	}
+
+	if err := ing.EnsureTables(ctx); err != nil {
+		t.Fatalf("failed to ensure tables: %s", err)
+	}
+	if ttl, _, _ := cli.TableSettings(ing.CredTable); ttl != credstore.ATTR_EXPIRES_AT {
+		t.Errorf("expected TTL on [%s], got [%s]", credstore.ATTR_EXPIRES_AT, ttl)
+	}
+}
+
+// erased addresses aren't stored again, and a batch isn't stored at all if we can't check
+func Test_Ingest_SuppressesErased(t *testing.T) {
+	ctx := context.Background()
+	cli := awsfake.NewDynamoDB()
+	ing := New(cli)
+	masterKeys, _, _ := (*envelope.LocalKeys)(nil).Rotate()
+	ing.Cipher = envelope.NewCipher(masterKeys) // hashed keys need one
+	ing.Keys, _ = credstore.NewKeyHasher([]byte(strings.Repeat("k", credstore.MIN_LOOKUP_KEY_SIZE)))
+	if err := ing.EnsureTables(ctx); err != nil {
+		t.Fatalf("failed to create tables: %s", err)
+	}
+
+	tables := credstore.ErasureTables{Credentials: ing.CredTable, SourceCredentials: ing.LinkTable, Tombstones: ing.TombstoneTable}
+	if _, err := credstore.Erase(ctx, cli, tables, ing.Keys, "Two@A.com", "ticket-1"); err != nil {
+		t.Fatalf("failed to erase: %s", err)
+	}
+
+	input := "one@a.com:pw1\ntwo@a.com:pw2\n"
+	job := jobs.New()
+	if err := ing.Run(ctx, strings.NewReader(input), job); err != nil {
+		t.Fatalf("ingest failed: %s", err)
+	}
+	if job.Credentials != 1 || job.Suppressed != 1 {
+		t.Errorf("expected one credential stored and one suppressed: %+v", job)
+	}
+	if two := ing.Keys.Key("a.com", "two"); len(cli.Items(ing.CredTable)) != 1 {
+		t.Errorf("erased address was stored again")
+	} else if cred, _ := credstore.GetCredential(ctx, cli, ing.CredTable, two.Domain, two.User); cred != nil {
+		t.Errorf("erased address was stored again")
+	}
+
+	ing.TombstoneTable = "missingTable"
+	job = jobs.New()
+	if err := ing.Run(ctx, strings.NewReader("three@a.com:pw3\n"), job); err != nil {
+		t.Fatalf("ingest failed: %s", err)
+	}
+	if job.Credentials != 0 || job.WriteFailures != 1 {
+		t.Errorf("expected the batch to fail when tombstones can't be checked: %+v", job)
+	}
+}
+
+// new credentials on a watched domain or address alert their owners, masked; ones we already had don't
+func Test_Ingest_Watchlist(t *testing.T) {
+	ctx := context.Background()
+	cli := awsfake.NewDynamoDB()
+	alertFile := filepath.Join(t.TempDir(), "alerts.jsonl")
+	ing := New(cli)
+	ing.Notifier = &alerts.FileNotifier{Path: alertFile}
+	if err := ing.EnsureTables(ctx); err != nil {
+		t.Fatalf("failed to create tables: %s", err)
+	}
+
+	for _, watch := range [][2]string{{"A.com", "tenant-a"}, {"jsmith@b.com", "tenant-b"}, {"a.com", "soc"}} {
+		entry, err := watchlist.NewEntry(watch[0], watch[1], "")
+		if err != nil {
+			t.Fatalf("bad watch: %s", err)
+		}
+		if err := watchlist.Save(ctx, cli, ing.WatchTable, entry); err != nil {
+			t.Fatalf("failed to save watch: %s", err)
+		}
+	}
+
+	input := "one@a.com:pw1\nJSmith@b.com:hunter2\nother@b.com:pw3\n"
+	job := jobs.New()
+	job.Filename = "dump.txt"
+	if err := ing.Run(ctx, strings.NewReader(input), job); err != nil {
+		t.Fatalf("ingest failed: %s", err)
+	}
+	if job.Alerts != 3 || job.AlertFailures != 0 {
+		t.Errorf("expected 3 alerts: %+v", job)
+	}
+
+	sent, err := alerts.ReadFile(alertFile)
+	if err != nil {
+		t.Fatalf("failed to read alerts: %s", err)
+	}
+	byOwner := map[string]*alerts.Alert{}
+	for _, alert := range sent {
+		byOwner[alert.Owner] = alert
+		if strings.Contains(alert.Email, "one@") || strings.Contains(alert.Email, "smit") || alert.Filename != "dump.txt" || alert.Passwords != 1 {
+			t.Errorf("unexpected alert %+v", alert)
+		}
+	}
+	if len(byOwner) != 3 || byOwner["tenant-b"].Email != "J****h@b.com" || byOwner["tenant-b"].Watched != "j****h@b.com" || byOwner["soc"].Watched != "a.com" {
+		t.Errorf("unexpected alerts %+v", byOwner)
+	}
+
+	// the same dump again has nothing new
+	job = jobs.New()
+	if err := ing.Run(ctx, strings.NewReader(input), job); err != nil {
+		t.Fatalf("ingest failed: %s", err)
+	}
+	if job.Alerts != 0 {
+		t.Errorf("expected no alerts for credentials we already had: %+v", job)
+	}
+}
+
+type blockingNotifier struct {
+	release chan struct{}
+}
+
+func (bn *blockingNotifier) Notify(ctx context.Context, alert *alerts.Alert) error {
+	select {
+	case <-bn.release:
+		return nil
+	case <-time.After(5 * time.Second):
+		return errors.New("the ingest waited on its alerts")
+	}
+}
+
+// a slow alert destination doesn't hold up the batches; the run waits for its alerts before it's done
+func Test_Ingest_AlertsInBackground(t *testing.T) {
+	ctx := context.Background()
+	cli := awsfake.NewDynamoDB()
+	notifier := &blockingNotifier{release: make(chan struct{})}
+	ing := New(cli)
+	ing.Notifier = notifier
+	ing.BatchSize = 1
+	if err := ing.EnsureTables(ctx); err != nil {
+		t.Fatalf("failed to create tables: %s", err)
+	}
+	entry, _ := watchlist.NewEntry("a.com", "soc", "")
+	if err := watchlist.Save(ctx, cli, ing.WatchTable, entry); err != nil {
+		t.Fatalf("failed to save watch: %s", err)
+	}
+
+	checkpoints := 0
+	ing.OnCheckpoint = func(pos Position) bool {
+		if checkpoints++; checkpoints == 3 { // every batch written with all of its alerts still stuck
+			close(notifier.release)
+		}
+		return true
+	}
+	job := jobs.New()
+	if err := ing.Run(ctx, strings.NewReader("one@a.com:pw1\ntwo@a.com:pw2\nthree@a.com:pw3\n"), job); err != nil {
+		t.Fatalf("ingest failed: %s", err)
+	}
+	if job.Credentials != 3 || job.Alerts != 3 || job.AlertFailures != 0 {
+		t.Errorf("expected 3 alerts sent once released: %+v", job)
+	}
+}
+
+// finished jobs are queued as signed webhooks and go out on the next retry run; a receiver that's down
+// leaves the delivery queued for another go
+func Test_Ingest_Webhooks(t *testing.T) {
+	const secret = "0123456789abcdef0123"
+	ctx := context.Background()
+	cli := awsfake.NewDynamoDB()
+
+	var mu sync.Mutex
+	var received []*webhook.Payload
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := io.ReadAll(r.Body)
+		if err := webhook.Verify([]byte(secret), r.Header, body, time.Now(), time.Minute); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		payload, _ := webhook.ReadPayload(body)
+		received = append(received, payload)
+	}))
+	defer srv.Close()
+
+	ing := New(cli)
+	ing.Webhooks = webhook.NewSender(cli, webhook.DYNDB_TABLE_DELIVERIES, srv.URL, []byte(secret))
+	if err := ing.EnsureTables(ctx); err != nil {
+		t.Fatalf("failed to create tables: %s", err)
+	}
+
+	job := jobs.New()
+	if err := ing.Run(ctx, strings.NewReader("one@a.com:pw1\n"), job); err != nil {
+		t.Fatalf("ingest failed: %s", err)
+	}
+	if len(received) != 0 {
+		t.Fatalf("expected the webhook to be queued rather than sent during the ingest, got %+v", received)
+	}
+	if stats, err := ing.Webhooks.Retry(ctx); err != nil || stats.Delivered != 1 {
+		t.Fatalf("expected the queued webhook to be delivered, got %+v (%v)", stats, err)
+	}
+	if len(received) != 1 || received[0].Event != webhook.EVENT_JOB_COMPLETED {
+		t.Fatalf("expected a job completed webhook, got %+v", received)
+	}
+	sent := &jobs.Job{}
+	if err := json.Unmarshal(received[0].Data, sent); err != nil || sent.ID != job.ID || sent.Status != jobs.STATUS_SUCCEEDED || sent.Credentials != 1 {
+		t.Errorf("unexpected job in the webhook %+v (%v)", sent, err)
+	}
+
+	mu.Lock()
+	status = http.StatusInternalServerError
+	mu.Unlock()
+	if err := ing.Run(ctx, strings.NewReader("two@a.com:pw2\n"), jobs.New()); err != nil {
+		t.Fatalf("ingest failed: %s", err)
+	}
+	if stats, _ := ing.Webhooks.Retry(ctx); stats.Pending != 1 {
+		t.Errorf("expected the failed webhook to be rescheduled, got %+v", stats)
+	}
+	if pending, _ := webhook.List(ctx, cli, webhook.DYNDB_TABLE_DELIVERIES, webhook.STATUS_PENDING); len(pending) != 1 {
+		t.Errorf("expected the undelivered webhook to be queued, got %d", len(pending))
+	}
+}
+
+// a dump with a canary in it is flagged, the sighting recorded and a high priority alert sent, once per job
+func Test_Ingest_Canary(t *testing.T) {
+	ctx := context.Background()
+	cli := awsfake.NewDynamoDB()
+	alertFile := filepath.Join(t.TempDir(), "alerts.jsonl")
+	ing := New(cli)
+	ing.Notifier = &alerts.FileNotifier{Path: alertFile}
+	if err := ing.EnsureTables(ctx); err != nil {
+		t.Fatalf("failed to create tables: %s", err)
+	}
+
+	planted, _ := canary.New("honey@vendor.com", "Tr1pwire!", "payroll vendor")
+	if err := canary.Save(ctx, cli, ing.CanaryTable, planted); err != nil {
+		t.Fatalf("failed to save canary: %s", err)
+	}
+
+	job := jobs.New()
+	job.Filename = "vendor-dump.txt"
+	if err := ing.Run(ctx, strings.NewReader("one@a.com:pw1\nHoney@vendor.com:Tr1pwire!\n"), job); err != nil {
+		t.Fatalf("ingest failed: %s", err)
+	}
+	if job.Canaries != 1 || job.Alerts != 1 {
+		t.Errorf("expected the canary to be flagged and alerted on: %+v", job)
+	}
+
+	sent, err := alerts.ReadFile(alertFile)
+	if err != nil || len(sent) != 1 {
+		t.Fatalf("expected one alert, got %d (%v)", len(sent), err)
+	}
+	if alert := sent[0]; alert.Kind != alerts.ALERT_KIND_CANARY || alert.Priority != alerts.PRIORITY_HIGH || alert.Label != "payroll vendor" ||
+		alert.Filename != "vendor-dump.txt" || alert.Line != 2 || !alert.PasswordMatched || strings.Contains(alert.Email, "honey") {
+		t.Errorf("unexpected canary alert %+v", alert)
+	}
+
+	recorded, _ := canary.Get(ctx, cli, ing.CanaryTable, "honey@vendor.com")
+	if recorded == nil || len(recorded.Sightings) != 1 || recorded.Sightings[0].JobID != job.ID || recorded.Sightings[0].Filename != "vendor-dump.txt" {
+		t.Errorf("expected the sighting to be recorded, got %+v", recorded)
+	}
+
+	// seen again in another dump (even with nothing new) it's flagged again
+	job = jobs.New()
+	job.Filename = "another.txt"
+	if err := ing.Run(ctx, strings.NewReader("honey@vendor.com:Tr1pwire!\n"), job); err != nil {
+		t.Fatalf("ingest failed: %s", err)
+	}
+	if job.Canaries != 1 || job.Alerts != 1 {
+		t.Errorf("expected the canary to be flagged in the second dump too: %+v", job)
+	}
+}
@@ -0,0 +1,263 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/util"
+)
+
+const DYNDB_TABLE_JOBS = `ingestJobs`
+
+type Status string
+
+const (
+	STATUS_RUNNING   Status = "running"
+	STATUS_SUCCEEDED Status = "succeeded"
+	STATUS_PARTIAL   Status = "partial" // finished, but some credentials failed to store
+	STATUS_FAILED    Status = "failed"
+)
+
+// a record of a single ingest (one S3 object or local file)
+type Job struct {
+	ID       string `json:"id" dynamodbav:"jobId"`
+	Bucket   string `json:"bucket,omitempty" dynamodbav:"bucket,omitempty"`
+	Key      string `json:"key,omitempty" dynamodbav:"key,omitempty"`
+	Filename string `json:"filename,omitempty" dynamodbav:"filename,omitempty"`
+	ETag     string `json:"etag,omitempty" dynamodbav:"etag,omitempty"`
+	Size     int64  `json:"size" dynamodbav:"size"`
+	SourceID string `json:"sourceId,omitempty" dynamodbav:"sourceId,omitempty"`
+
+	// when the source's breach happened, if known; retention is counted from it (see the retention package)
+	BreachDate *time.Time `json:"breachDate,omitempty" dynamodbav:"breachDate,omitempty"`
+
+	Status   Status     `json:"status" dynamodbav:"status"`
+	Error    string     `json:"error,omitempty" dynamodbav:"error,omitempty"`
+	Started  time.Time  `json:"started" dynamodbav:"started"`
+	Finished *time.Time `json:"finished,omitempty" dynamodbav:"finished,omitempty"`
+
+	LinesRead     int                             `json:"linesRead" dynamodbav:"linesRead"`
+	Accepted      int                             `json:"accepted" dynamodbav:"accepted"`
+	Rejected      map[credparser.RejectReason]int `json:"rejected,omitempty" dynamodbav:"rejected,omitempty"`
+	Credentials   int                             `json:"credentials" dynamodbav:"credentials"`   // distinct accounts written
+	NewPasswords  int                             `json:"newPasswords" dynamodbav:"newPasswords"` // passwords we didn't already have
+	WriteFailures int                             `json:"writeFailures" dynamodbav:"writeFailures"`
+	Suppressed    int                             `json:"suppressed,omitempty" dynamodbav:"suppressed,omitempty"` // erased addresses that weren't stored again
+	Alerts        int                             `json:"alerts,omitempty" dynamodbav:"alerts,omitempty"`         // watchlist alerts sent
+	AlertFailures int                             `json:"alertFailures,omitempty" dynamodbav:"alertFailures,omitempty"`
+	Canaries      int                             `json:"canaries,omitempty" dynamodbav:"canaries,omitempty"` // canary credentials found (see the canary package)
+}
+
+func (j Job) GetAttrDefs() []types.AttributeDefinition {
+	return []types.AttributeDefinition{
+		{
+			AttributeName: aws.String("jobId"),
+			AttributeType: types.ScalarAttributeTypeS,
+		},
+	}
+}
+
+func (j Job) GetKeySchema() []types.KeySchemaElement {
+	return []types.KeySchemaElement{
+		{
+			AttributeName: aws.String("jobId"),
+			KeyType:       types.KeyTypeHash,
+		},
+	}
+}
+
+// lists a status's jobs newest first (see List); started is stored as RFC3339, which sorts as a string
+const STATUS_INDEX = "status-started-index"
+
+var statuses = []Status{STATUS_RUNNING, STATUS_SUCCEEDED, STATUS_PARTIAL, STATUS_FAILED}
+
+// opts (nil for the defaults) with the job table's index, for util.EnsureDynamoDBTable
+func TableOptions(opts *util.TableOptions) *util.TableOptions {
+	return opts.WithIndexes([]types.GlobalSecondaryIndex{{
+		IndexName: aws.String(STATUS_INDEX),
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("status"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("started"), KeyType: types.KeyTypeRange},
+		},
+	}},
+		types.AttributeDefinition{AttributeName: aws.String("status"), AttributeType: types.ScalarAttributeTypeS},
+		types.AttributeDefinition{AttributeName: aws.String("started"), AttributeType: types.ScalarAttributeTypeS},
+	)
+}
+
+// the name we show for where a job's data came from
+func (j *Job) Object() string {
+	if j.Bucket != "" {
+		return fmt.Sprintf("s3://%s/%s", j.Bucket, j.Key)
+	}
+	return j.Filename
+}
+
+func (j *Job) TotalRejected() int {
+	total := 0
+	for _, cnt := range j.Rejected {
+		total += cnt
+	}
+	return total
+}
+
+// new job in the running state with a fresh id
+func New() *Job {
+	return &Job{ID: util.NewID(), Status: STATUS_RUNNING, Started: time.Now().UTC(), Rejected: map[credparser.RejectReason]int{}}
+}
+
+// marks the job finished; status is derived from err and the write failure count
+func (j *Job) Finish(err error) {
+	now := time.Now().UTC()
+	j.Finished = &now
+
+	switch {
+	case err != nil:
+		j.Status = STATUS_FAILED
+		j.Error = err.Error()
+	case j.WriteFailures > 0:
+		j.Status = STATUS_PARTIAL
+	default:
+		j.Status = STATUS_SUCCEEDED
+	}
+}
+
+func Save(ctx context.Context, cli util.DynamoDBAPI, tableName string, job *Job) error {
+	if cli == nil {
+		return errors.New("passed dynamodb client was nil")
+	}
+	if job == nil || job.ID == "" {
+		return credparser.ErrBadParameter
+	}
+
+	item, marshErr := attributevalue.MarshalMap(job)
+	if marshErr != nil {
+		return fmt.Errorf("failed to marshal job [%s]: %s", job.ID, marshErr)
+	}
+
+	if _, putErr := cli.PutItem(ctx, &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(tableName),
+	}); putErr != nil {
+		return fmt.Errorf("failed to store job [%s]: %s", job.ID, putErr)
+	}
+	return nil
+}
+
+// returns nil (no error) if the job doesn't exist
+func Get(ctx context.Context, cli util.DynamoDBAPI, tableName, jobID string) (*Job, error) {
+	if cli == nil {
+		return nil, errors.New("passed dynamodb client was nil")
+	}
+
+	res, err := cli.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key:       map[string]types.AttributeValue{"jobId": &types.AttributeValueMemberS{Value: jobID}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get job [%s]: %s", jobID, err)
+	}
+	if len(res.Item) == 0 {
+		return nil, nil
+	}
+
+	job := &Job{}
+	if unmarshErr := attributevalue.UnmarshalMap(res.Item, job); unmarshErr != nil {
+		return nil, fmt.Errorf("failed to unmarshal job [%s]: %s", jobID, unmarshErr)
+	}
+	return job, nil
+}
+
+// lists jobs newest first; status may be empty for all; limit <= 0 means no limit. reads STATUS_INDEX a
+// status at a time (so only as many jobs as asked for); a table still building it is scanned instead
+func List(ctx context.Context, cli util.DynamoDBAPI, tableName string, status Status, limit int) ([]*Job, error) {
+	if cli == nil {
+		return nil, errors.New("passed dynamodb client was nil")
+	}
+
+	wanted := statuses
+	if status != "" {
+		wanted = []Status{status}
+	}
+	var ret []*Job
+	for _, st := range wanted {
+		found, err := queryStatus(ctx, cli, tableName, st, limit)
+		if err != nil {
+			log.Printf("WARNING: couldn't list jobs by status (scanning instead): %s", err)
+			return scanJobs(ctx, cli, tableName, status, limit)
+		}
+		ret = append(ret, found...)
+	}
+	return newest(ret, limit), nil
+}
+
+// the jobs in status, newest first; at most limit (if > 0)
+func queryStatus(ctx context.Context, cli util.DynamoDBAPI, tableName string, status Status, limit int) ([]*Job, error) {
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(tableName),
+		IndexName:                 aws.String(STATUS_INDEX),
+		KeyConditionExpression:    aws.String("#s = :s"),
+		ExpressionAttributeNames:  map[string]string{"#s": "status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":s": &types.AttributeValueMemberS{Value: string(status)}},
+		ScanIndexForward:          aws.Bool(false),
+	}
+	if limit > 0 {
+		input.Limit = aws.Int32(int32(limit))
+	}
+
+	var ret []*Job
+	paginator := dynamodb.NewQueryPaginator(cli, input)
+	for paginator.HasMorePages() && (limit <= 0 || len(ret) < limit) {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query %s jobs: %s", status, err)
+		}
+		var pageJobs []*Job
+		if unmarshErr := attributevalue.UnmarshalListOfMaps(page.Items, &pageJobs); unmarshErr != nil {
+			return nil, fmt.Errorf("failed to unmarshal jobs: %s", unmarshErr)
+		}
+		ret = append(ret, pageJobs...)
+	}
+	return ret, nil
+}
+
+// the whole table; for tables without (or still building) STATUS_INDEX
+func scanJobs(ctx context.Context, cli util.DynamoDBAPI, tableName string, status Status, limit int) ([]*Job, error) {
+	var ret []*Job
+	paginator := dynamodb.NewScanPaginator(cli, &dynamodb.ScanInput{TableName: aws.String(tableName)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan jobs: %s", err)
+		}
+
+		var pageJobs []*Job
+		if unmarshErr := attributevalue.UnmarshalListOfMaps(page.Items, &pageJobs); unmarshErr != nil {
+			return nil, fmt.Errorf("failed to unmarshal jobs: %s", unmarshErr)
+		}
+		for _, job := range pageJobs {
+			if status == "" || job.Status == status {
+				ret = append(ret, job)
+			}
+		}
+	}
+	return newest(ret, limit), nil
+}
+
+// jobs newest first, cut to limit (if > 0)
+func newest(jobList []*Job, limit int) []*Job {
+	sort.SliceStable(jobList, func(i, j int) bool { return jobList[i].Started.After(jobList[j].Started) })
+	if limit > 0 && len(jobList) > limit {
+		jobList = jobList[:limit]
+	}
+	return jobList
+}
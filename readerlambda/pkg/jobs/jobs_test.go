@@ -0,0 +1,103 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/newodahs/readerlambda/pkg/awsfake"
+	"github.com/newodahs/readerlambda/pkg/util"
+)
+
+func Test_Job_Finish(t *testing.T) {
+	testSet := []struct {
+		Name          string
+		Err           error
+		WriteFailures int
+		Expect        Status
+	}{
+		{Name: "Clean", Expect: STATUS_SUCCEEDED},
+		{Name: "Write Failures", WriteFailures: 2, Expect: STATUS_PARTIAL},
+		{Name: "Failed", Err: errors.New("read failed"), WriteFailures: 2, Expect: STATUS_FAILED},
+	}
+
+	for _, test := range testSet {
+		t.Run(test.Name, func(t *testing.T) {
+			job := New()
+			job.WriteFailures = test.WriteFailures
+			job.Finish(test.Err)
+			if job.Status != test.Expect || job.Finished == nil {
+				t.Errorf("expected %s (finished), got %s (%v)", test.Expect, job.Status, job.Finished)
+			}
+			if test.Err != nil && job.Error != test.Err.Error() {
+				t.Errorf("expected the error to be kept, got [%s]", job.Error)
+			}
+		})
+	}
+}
+
+func Test_Jobs_List(t *testing.T) {
+	ctx := context.Background()
+	cli := awsfake.NewDynamoDB()
+	if err := util.EnsureDynamoDBTable(ctx, cli, "jobsTest", Job{}, TableOptions(nil)); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	// the same jobs in a table made before the index, which has to be scanned
+	if err := util.EnsureDynamoDBTable(ctx, cli, "oldJobsTest", Job{}, nil); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for idx, status := range []Status{STATUS_SUCCEEDED, STATUS_FAILED, STATUS_SUCCEEDED, STATUS_RUNNING, STATUS_PARTIAL, STATUS_SUCCEEDED} {
+		job := &Job{ID: string(rune('a' + idx)), Status: status, Started: base.Add(time.Duration(idx) * time.Hour)}
+		for _, table := range []string{"jobsTest", "oldJobsTest"} {
+			if err := Save(ctx, cli, table, job); err != nil {
+				t.Fatalf("failed to save: %s", err)
+			}
+		}
+	}
+
+	testSet := []struct {
+		Name     string
+		Status   Status
+		Limit    int
+		ExpectID string // newest first, concatenated
+	}{
+		{Name: "All", ExpectID: "fedcba"},
+		{Name: "All Limited", Limit: 4, ExpectID: "fedc"},
+		{Name: "Status", Status: STATUS_SUCCEEDED, ExpectID: "fca"},
+		{Name: "Status Limited", Status: STATUS_SUCCEEDED, Limit: 2, ExpectID: "fc"},
+		{Name: "None", Status: "bogus"},
+	}
+
+	for _, table := range []string{"jobsTest", "oldJobsTest"} {
+		for _, test := range testSet {
+			t.Run(table+" "+test.Name, func(t *testing.T) {
+				jobList, err := List(ctx, cli, table, test.Status, test.Limit)
+				if err != nil {
+					t.Fatalf("failed to list: %s", err)
+				}
+				got := ""
+				for _, job := range jobList {
+					got += job.ID
+				}
+				if got != test.ExpectID {
+					t.Errorf("expected [%s], got [%s]", test.ExpectID, got)
+				}
+			})
+		}
+	}
+
+	// ensuring the old table again adds the index, after which it's queried
+	if err := util.EnsureDynamoDBTable(ctx, cli, "oldJobsTest", Job{}, TableOptions(nil)); err != nil {
+		t.Fatalf("failed to ensure table: %s", err)
+	}
+	if jobList, err := queryStatus(ctx, cli, "oldJobsTest", STATUS_SUCCEEDED, 0); err != nil || len(jobList) != 3 {
+		t.Errorf("expected the added index to find 3 jobs, got %d (%v)", len(jobList), err)
+	}
+
+	if missing, err := Get(ctx, cli, "jobsTest", "nope"); missing != nil || err != nil {
+		t.Errorf("expected nothing for an unknown job, got %v (%v)", missing, err)
+	}
+}
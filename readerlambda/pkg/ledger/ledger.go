@@ -0,0 +1,246 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/util"
+)
+
+// the processed-object ledger; one entry per object version (bucket/key/etag) we've picked up, so
+// duplicate S3 deliveries and lambda retries don't re-ingest the same data
+const DYNDB_TABLE_PROCESSED = `processedObjects`
+
+type State string
+
+const (
+	STATE_IN_PROGRESS State = "in-progress"
+	STATE_COMPLETE    State = "complete"
+)
+
+// how long a claim is good for if the caller doesn't give us something better (the lambda max timeout)
+const DEFAULT_LEASE = 15 * time.Minute
+
+var (
+	ErrAlreadyProcessed = errors.New("object version already processed")
+	ErrInProgress       = errors.New("object version is being processed elsewhere")
+)
+
+type Entry struct {
+	ObjectID     string    `json:"objectId" dynamodbav:"objectId"`
+	Bucket       string    `json:"bucket,omitempty" dynamodbav:"bucket,omitempty"`
+	Key          string    `json:"key" dynamodbav:"key"`
+	ETag         string    `json:"etag" dynamodbav:"etag"` // S3 ETag, or a content hash for local files
+	State        State     `json:"state" dynamodbav:"state"`
+	JobID        string    `json:"jobId" dynamodbav:"jobId"` // the ingest job; carried over when an attempt resumes
+	Owner        string    `json:"owner" dynamodbav:"owner"` // token of whoever holds the claim right now
+	Attempts     int       `json:"attempts" dynamodbav:"attempts"`
+	LeaseExpires int64     `json:"leaseExpires" dynamodbav:"leaseExpires"` // unix seconds; a number so we can compare it in conditions
+	Updated      time.Time `json:"updated" dynamodbav:"updated"`
+
+	// checkpoint: everything before this byte offset/line has been stored
+	Offset int64 `json:"offset" dynamodbav:"offset"`
+	Line   int   `json:"line" dynamodbav:"line"`
+
+	Resumed bool `json:"-" dynamodbav:"-"` // set by Claim when we took over an earlier, unfinished attempt
+}
+
+func (e Entry) GetAttrDefs() []types.AttributeDefinition {
+	return []types.AttributeDefinition{
+		{
+			AttributeName: aws.String("objectId"),
+			AttributeType: types.ScalarAttributeTypeS,
+		},
+	}
+}
+
+func (e Entry) GetKeySchema() []types.KeySchemaElement {
+	return []types.KeySchemaElement{
+		{
+			AttributeName: aws.String("objectId"),
+			KeyType:       types.KeyTypeHash,
+		},
+	}
+}
+
+func ObjectID(bucket, key, etag string) string {
+	return fmt.Sprintf("%s/%s#%s", bucket, key, etag)
+}
+
+func Get(ctx context.Context, cli util.DynamoDBAPI, tableName, objectID string) (*Entry, error) {
+	if cli == nil {
+		return nil, errors.New("passed dynamodb client was nil")
+	}
+
+	res, err := cli.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(tableName),
+		Key:            map[string]types.AttributeValue{"objectId": &types.AttributeValueMemberS{Value: objectID}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ledger entry [%s]: %s", objectID, err)
+	}
+	if len(res.Item) == 0 {
+		return nil, nil
+	}
+
+	entry := &Entry{}
+	if unmarshErr := attributevalue.UnmarshalMap(res.Item, entry); unmarshErr != nil {
+		return nil, fmt.Errorf("failed to unmarshal ledger entry [%s]: %s", objectID, unmarshErr)
+	}
+	return entry, nil
+}
+
+// takes ownership of an object version for jobID; succeeds if nobody has seen it before or an earlier
+// attempt never finished and its lease ran out (or was released); in that case Resumed is set on the
+// returned entry, and the earlier attempt's job id and checkpoint are carried over so the caller can
+// pick up where it left off
+//
+// returns ErrAlreadyProcessed if the object version was fully ingested already, or ErrInProgress if
+// another invocation currently holds it
+func Claim(ctx context.Context, cli util.DynamoDBAPI, tableName, bucket, key, etag, jobID string, lease time.Duration) (*Entry, error) {
+	if cli == nil {
+		return nil, errors.New("passed dynamodb client was nil")
+	}
+	if key == "" || etag == "" || jobID == "" {
+		return nil, credparser.ErrBadParameter
+	}
+	if lease <= 0 {
+		lease = DEFAULT_LEASE
+	}
+
+	now := time.Now().UTC()
+	entry := &Entry{
+		ObjectID:     ObjectID(bucket, key, etag),
+		Bucket:       bucket,
+		Key:          key,
+		ETag:         etag,
+		State:        STATE_IN_PROGRESS,
+		JobID:        jobID,
+		Owner:        util.NewID(),
+		Attempts:     1,
+		LeaseExpires: now.Add(lease).Unix(),
+		Updated:      now,
+	}
+
+	// carry the attempt count forward if there's an abandoned entry; the condition below is what actually protects us
+	prev, getErr := Get(ctx, cli, tableName, entry.ObjectID)
+	if getErr != nil {
+		return nil, getErr
+	}
+	if prev != nil {
+		if prev.State == STATE_COMPLETE {
+			return prev, ErrAlreadyProcessed
+		}
+		entry.Attempts = prev.Attempts + 1
+		entry.Resumed = true
+		entry.Offset = prev.Offset
+		entry.Line = prev.Line
+		if prev.JobID != "" {
+			entry.JobID = prev.JobID
+		}
+	}
+
+	cond := expression.AttributeNotExists(expression.Name("objectId")).Or(
+		expression.Name("state").NotEqual(expression.Value(STATE_COMPLETE)).And(expression.Name("leaseExpires").LessThan(expression.Value(now.Unix()))),
+	)
+	if putErr := putEntry(ctx, cli, tableName, entry, cond); putErr != nil {
+		var condFailed *types.ConditionalCheckFailedException
+		if !errors.As(putErr, &condFailed) {
+			return nil, fmt.Errorf("failed to claim [%s]: %s", entry.ObjectID, putErr)
+		}
+
+		// lost the race or it's held; figure out which so the caller can log something useful
+		cur, curErr := Get(ctx, cli, tableName, entry.ObjectID)
+		if curErr != nil {
+			return nil, curErr
+		}
+		if cur != nil && cur.State == STATE_COMPLETE {
+			return cur, ErrAlreadyProcessed
+		}
+		return cur, ErrInProgress
+	}
+
+	return entry, nil
+}
+
+// marks the object version fully ingested; only works if we still own the claim
+func Complete(ctx context.Context, cli util.DynamoDBAPI, tableName string, entry *Entry) error {
+	return finish(ctx, cli, tableName, entry, STATE_COMPLETE)
+}
+
+// gives up the claim without completing it (e.g. after a failure, or to hand off to a continuation) so
+// the next attempt can pick it up right away instead of waiting out the lease; the checkpoint is kept
+func Release(ctx context.Context, cli util.DynamoDBAPI, tableName string, entry *Entry) error {
+	return finish(ctx, cli, tableName, entry, STATE_IN_PROGRESS)
+}
+
+// records progress on a claim we still hold
+func Checkpoint(ctx context.Context, cli util.DynamoDBAPI, tableName string, entry *Entry, offset int64, line int) error {
+	if cli == nil {
+		return errors.New("passed dynamodb client was nil")
+	}
+	if entry == nil {
+		return credparser.ErrBadParameter
+	}
+
+	entry.Offset = offset
+	entry.Line = line
+	entry.Updated = time.Now().UTC()
+
+	if err := putEntry(ctx, cli, tableName, entry, ownerCondition(entry)); err != nil {
+		return fmt.Errorf("failed to checkpoint [%s] at offset %d: %s", entry.ObjectID, offset, err)
+	}
+	return nil
+}
+
+func finish(ctx context.Context, cli util.DynamoDBAPI, tableName string, entry *Entry, state State) error {
+	if cli == nil {
+		return errors.New("passed dynamodb client was nil")
+	}
+	if entry == nil {
+		return credparser.ErrBadParameter
+	}
+
+	entry.State = state
+	entry.LeaseExpires = 0
+	entry.Updated = time.Now().UTC()
+
+	if err := putEntry(ctx, cli, tableName, entry, ownerCondition(entry)); err != nil {
+		return fmt.Errorf("failed to mark [%s] %s: %s", entry.ObjectID, state, err)
+	}
+	return nil
+}
+
+func ownerCondition(entry *Entry) expression.ConditionBuilder {
+	return expression.Name("owner").Equal(expression.Value(entry.Owner))
+}
+
+func putEntry(ctx context.Context, cli util.DynamoDBAPI, tableName string, entry *Entry, cond expression.ConditionBuilder) error {
+	item, marshErr := attributevalue.MarshalMap(entry)
+	if marshErr != nil {
+		return fmt.Errorf("failed to marshal ledger entry: %s", marshErr)
+	}
+
+	expr, exprErr := expression.NewBuilder().WithCondition(cond).Build()
+	if exprErr != nil {
+		return fmt.Errorf("failed to build condition expression: %s", exprErr)
+	}
+
+	_, err := cli.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                 aws.String(tableName),
+		Item:                      item,
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	return err
+}
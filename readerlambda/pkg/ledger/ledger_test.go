@@ -0,0 +1,195 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/newodahs/readerlambda/pkg/awsfake"
+	"github.com/newodahs/readerlambda/pkg/util"
+)
+
+const (
+	testTable  = "processedTest"
+	testBucket = "dumps"
+	testKey    = "a/dump.txt"
+	testETag   = "0123abcd"
+)
+
+func newTestTable(t *testing.T) *awsfake.DynamoDB {
+	t.Helper()
+
+	cli := awsfake.NewDynamoDB()
+	if err := util.EnsureDynamoDBTable(context.TODO(), cli, testTable, Entry{}, nil); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	return cli
+}
+
+// runs race (once) just before the first conditional put goes through, like another invocation
+// getting in between our read and our write
+type racingDynamoDB struct {
+	util.DynamoDBAPI
+	race func()
+}
+
+func (r *racingDynamoDB) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	if r.race != nil {
+		race := r.race
+		r.race = nil
+		race()
+	}
+	return r.DynamoDBAPI.PutItem(ctx, params, optFns...)
+}
+
+func Test_Ledger_Lifecycle(t *testing.T) {
+	ctx := context.TODO()
+	cli := newTestTable(t)
+
+	first, err := Claim(ctx, cli, testTable, testBucket, testKey, testETag, "job1", time.Hour)
+	if err != nil || first.Resumed || first.Attempts != 1 || first.JobID != "job1" {
+		t.Fatalf("unexpected first claim: %+v (%v)", first, err)
+	}
+	if _, err := Claim(ctx, cli, testTable, testBucket, testKey, testETag, "job2", time.Hour); !errors.Is(err, ErrInProgress) {
+		t.Errorf("expected a held claim to be in progress, got %v", err)
+	}
+	if _, err := Claim(ctx, cli, testTable, testBucket, testKey, "other-etag", "job3", time.Hour); err != nil {
+		t.Errorf("another version of the object should be claimable: %s", err)
+	}
+
+	if err := Checkpoint(ctx, cli, testTable, first, 1024, 50); err != nil {
+		t.Fatalf("failed to checkpoint: %s", err)
+	}
+	if err := Release(ctx, cli, testTable, first); err != nil {
+		t.Fatalf("failed to release: %s", err)
+	}
+
+	// released claims are taken over straight away, carrying the job and checkpoint forward
+	second, err := Claim(ctx, cli, testTable, testBucket, testKey, testETag, "job2", time.Hour)
+	if err != nil || !second.Resumed || second.Attempts != 2 || second.JobID != "job1" || second.Offset != 1024 || second.Line != 50 {
+		t.Fatalf("unexpected resumed claim: %+v (%v)", second, err)
+	}
+
+	// the first owner has lost the claim; it can't move the checkpoint or finish the object
+	if err := Checkpoint(ctx, cli, testTable, first, 2048, 100); err == nil {
+		t.Errorf("stale owner was able to checkpoint")
+	}
+	if err := Complete(ctx, cli, testTable, first); err == nil {
+		t.Errorf("stale owner was able to complete")
+	}
+
+	if err := Complete(ctx, cli, testTable, second); err != nil {
+		t.Fatalf("failed to complete: %s", err)
+	}
+	if _, err := Claim(ctx, cli, testTable, testBucket, testKey, testETag, "job4", time.Hour); !errors.Is(err, ErrAlreadyProcessed) {
+		t.Errorf("expected a completed object to be already processed, got %v", err)
+	}
+
+	entry, getErr := Get(ctx, cli, testTable, ObjectID(testBucket, testKey, testETag))
+	if getErr != nil || entry == nil || entry.State != STATE_COMPLETE || entry.Owner != second.Owner || entry.Offset != 1024 {
+		t.Errorf("unexpected entry after completing: %+v (%v)", entry, getErr)
+	}
+}
+
+func Test_Ledger_ExpiredLease(t *testing.T) {
+	ctx := context.TODO()
+	cli := newTestTable(t)
+
+	abandoned, err := Claim(ctx, cli, testTable, testBucket, testKey, testETag, "job1", time.Hour)
+	if err != nil {
+		t.Fatalf("failed to claim: %s", err)
+	}
+
+	// the invocation died without releasing; its lease runs out
+	abandoned.LeaseExpires = time.Now().Add(-time.Minute).Unix()
+	if err := Checkpoint(ctx, cli, testTable, abandoned, 10, 1); err != nil {
+		t.Fatalf("failed to checkpoint: %s", err)
+	}
+
+	taken, err := Claim(ctx, cli, testTable, testBucket, testKey, testETag, "job2", time.Hour)
+	if err != nil || !taken.Resumed || taken.JobID != "job1" || taken.Line != 1 {
+		t.Errorf("expected to take over the expired claim: %+v (%v)", taken, err)
+	}
+}
+
+func Test_Ledger_ClaimRace(t *testing.T) {
+	testSet := []struct {
+		Name    string
+		Expired bool                                            // an earlier attempt's lease has run out, so both racers see it as up for grabs
+		Racer   func(t *testing.T, cli util.DynamoDBAPI) *Entry // what the other invocation does between our read and our write
+		Expect  error
+	}{
+		{
+			Name: "Both New",
+			Racer: func(t *testing.T, cli util.DynamoDBAPI) *Entry {
+				entry, err := Claim(context.TODO(), cli, testTable, testBucket, testKey, testETag, "racer", time.Hour)
+				if err != nil {
+					t.Fatalf("racer failed to claim: %s", err)
+				}
+				return entry
+			},
+			Expect: ErrInProgress,
+		},
+		{
+			Name:    "Both Taking Over",
+			Expired: true,
+			Racer: func(t *testing.T, cli util.DynamoDBAPI) *Entry {
+				entry, err := Claim(context.TODO(), cli, testTable, testBucket, testKey, testETag, "racer", time.Hour)
+				if err != nil {
+					t.Fatalf("racer failed to claim: %s", err)
+				}
+				return entry
+			},
+			Expect: ErrInProgress,
+		},
+		{
+			Name: "Racer Finishes",
+			Racer: func(t *testing.T, cli util.DynamoDBAPI) *Entry {
+				entry, err := Claim(context.TODO(), cli, testTable, testBucket, testKey, testETag, "racer", time.Hour)
+				if err != nil {
+					t.Fatalf("racer failed to claim: %s", err)
+				}
+				if err := Complete(context.TODO(), cli, testTable, entry); err != nil {
+					t.Fatalf("racer failed to complete: %s", err)
+				}
+				return entry
+			},
+			Expect: ErrAlreadyProcessed,
+		},
+	}
+
+	for _, test := range testSet {
+		t.Run(test.Name, func(t *testing.T) {
+			ctx := context.TODO()
+			fake := newTestTable(t)
+
+			if test.Expired {
+				earlier, err := Claim(ctx, fake, testTable, testBucket, testKey, testETag, "earlier", time.Hour)
+				if err != nil {
+					t.Fatalf("failed to claim: %s", err)
+				}
+				earlier.LeaseExpires = time.Now().Add(-time.Minute).Unix()
+				if err := Checkpoint(ctx, fake, testTable, earlier, 0, 0); err != nil {
+					t.Fatalf("failed to checkpoint: %s", err)
+				}
+			}
+
+			var winner *Entry
+			cli := &racingDynamoDB{DynamoDBAPI: fake}
+			cli.race = func() { winner = test.Racer(t, fake) }
+
+			entry, err := Claim(ctx, cli, testTable, testBucket, testKey, testETag, "loser", time.Hour)
+			if !errors.Is(err, test.Expect) {
+				t.Fatalf("expected %v for the losing claim, got %v (%+v)", test.Expect, err, entry)
+			}
+
+			// whoever won keeps the claim
+			cur, getErr := Get(ctx, fake, testTable, ObjectID(testBucket, testKey, testETag))
+			if getErr != nil || cur == nil || winner == nil || cur.Owner != winner.Owner || cur.Attempts != winner.Attempts {
+				t.Errorf("the losing claim overwrote the winner: %+v (%v)", cur, getErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package ntlm
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/credstore"
+	"github.com/newodahs/readerlambda/pkg/envelope"
+	"github.com/newodahs/readerlambda/pkg/util"
+	"golang.org/x/crypto/md4"
+)
+
+// how many leaked addresses are listed per match; a common password can match hundreds
+const MAX_MATCH_ADDRESSES = 10
+
+// the NT hash of password (MD4 of its UTF-16LE encoding) as lowercase hex, the way AD exports have it
+func Hash(password string) string {
+	units := utf16.Encode([]rune(password))
+	buf := make([]byte, 0, len(units)*2)
+	for _, unit := range units {
+		buf = append(buf, byte(unit), byte(unit>>8))
+	}
+	h := md4.New()
+	h.Write(buf)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// a directory account and its current NT hash; the hash is unexported so it can't end up in a report
+type Account struct {
+	User     string // lowercased, without any DOMAIN\ prefix
+	Disabled bool   // per secretsdump's -user-status
+	hash     string
+}
+
+func NewAccount(user, hash string) (*Account, error) {
+	if _, name, found := strings.Cut(user, `\`); found {
+		user = name
+	}
+	user = strings.ToLower(strings.TrimSpace(user))
+	hash = strings.ToLower(strings.TrimSpace(hash))
+	if user == "" {
+		return nil, errors.New("no user name")
+	}
+	if raw, err := hex.DecodeString(hash); err != nil || len(raw) != md4.Size {
+		return nil, fmt.Errorf("[%s] doesn't have an NT hash (32 hex characters)", user)
+	}
+	return &Account{User: user, hash: hash}, nil
+}
+
+// reads an offline hash export: either user:NTHASH per line or pwdump/secretsdump style
+// (DOMAIN\user:RID:LMHASH:NTHASH:::, optionally with " (status=Disabled)" on the end). blank lines and #
+// comments are ignored; machine accounts (ending in $) are skipped and counted
+func ParseDump(r io.Reader) ([]*Account, int, error) {
+	var ret []*Account
+	skipped := 0
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		disabled := false
+		if idx := strings.LastIndex(text, " (status="); idx > 0 && strings.HasSuffix(text, ")") {
+			disabled = strings.EqualFold(text[idx+len(" (status="):len(text)-1], "disabled")
+			text = strings.TrimSpace(text[:idx])
+		}
+
+		fields := strings.Split(text, ":")
+		var user, hash string
+		switch {
+		case len(fields) >= 4: // pwdump
+			user, hash = fields[0], fields[3]
+		case len(fields) == 2:
+			user, hash = fields[0], fields[1]
+		default:
+			return nil, skipped, fmt.Errorf("bad hash export line %d; expected user:hash or pwdump format", line)
+		}
+		if strings.HasSuffix(strings.TrimSpace(user), "$") {
+			skipped++
+			continue
+		}
+
+		acct, err := NewAccount(user, hash)
+		if err != nil {
+			return nil, skipped, fmt.Errorf("bad hash export line %d: %s", line, err)
+		}
+		acct.Disabled = disabled
+		ret = append(ret, acct)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, skipped, fmt.Errorf("failed to read hash export: %s", err)
+	}
+	return ret, skipped, nil
+}
+
+// a directory account whose current password is one we've seen leaked
+type Match struct {
+	User      string   `json:"user"`
+	Disabled  bool     `json:"disabled,omitempty"`
+	Own       bool     `json:"own"`       // one of the leaked credentials is the account's own address
+	Leaks     int      `json:"leaks"`     // stored credentials with the password
+	Addresses []string `json:"addresses"` // up to MAX_MATCH_ADDRESSES of them, own first
+}
+
+// what a comparison found; neither passwords nor hashes are in it
+type Report struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"createdAt"`
+	Domains    []string  `json:"domains"`
+	Accounts   int       `json:"accounts"`
+	Passwords  int       `json:"passwords"`  // stored plaintext passwords hashed
+	Unreadable int       `json:"unreadable"` // stored credentials that couldn't be read or decrypted
+	Matched    int       `json:"matched"`
+	Matches    []*Match  `json:"matches"`
+}
+
+// hashes every password stored for domains and reports the accounts whose current hash is one of them.
+// the directory's hashes are only held in memory for the comparison; nothing is written anywhere. cipher
+// (and keys) must match how credentials are stored
+func Compare(ctx context.Context, cli util.DynamoDBAPI, tableName string, cipher *envelope.Cipher, keys *credstore.KeyHasher, domains []string, accounts []*Account) (*Report, error) {
+	if cli == nil {
+		return nil, errors.New("passed dynamodb client was nil")
+	}
+	if len(domains) == 0 {
+		return nil, errors.New("no domains to compare against")
+	}
+
+	report := &Report{ID: util.NewID(), CreatedAt: time.Now().UTC(), Accounts: len(accounts), Matches: []*Match{}}
+
+	// NT hash => addresses leaked with that password
+	leaked := map[string][]string{}
+	for _, domain := range domains {
+		domain, _ = credstore.CanonicalIdentity(domain, "")
+		if domain == "" || slices.Contains(report.Domains, domain) {
+			continue
+		}
+		report.Domains = append(report.Domains, domain)
+
+		failed, err := credstore.QueryDomain(ctx, cli, tableName, keys, domain, func(cred *credparser.CredentialInfo) error {
+			if err := credstore.OpenCredential(ctx, cipher, cred); err != nil {
+				if errors.Is(err, credstore.ErrNoCipher) {
+					return err
+				}
+				report.Unreadable++
+				return nil
+			}
+			credDomain, credUser := credstore.CanonicalIdentity(cred.Domain, cred.User) // hashed keys keep the identity as it was given
+			address := credUser + "@" + credDomain
+			for _, password := range slices.Compact(slices.Sorted(slices.Values(cred.Password))) {
+				if password == "" || password == credparser.REDACTED_PASSWORD {
+					continue
+				}
+				report.Passwords++
+				hash := Hash(password)
+				leaked[hash] = append(leaked[hash], address)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		report.Unreadable += failed
+	}
+
+	for _, acct := range accounts {
+		addresses := leaked[acct.hash]
+		if len(addresses) == 0 {
+			continue
+		}
+		match := &Match{User: acct.User, Disabled: acct.Disabled, Leaks: len(addresses)}
+		for _, addr := range addresses {
+			if acct.owns(addr) {
+				match.Own = true
+				match.Addresses = append([]string{addr}, match.Addresses...)
+			} else {
+				match.Addresses = append(match.Addresses, addr)
+			}
+		}
+		match.Addresses = match.Addresses[:min(len(match.Addresses), MAX_MATCH_ADDRESSES)]
+		report.Matches = append(report.Matches, match)
+	}
+	report.Matched = len(report.Matches)
+
+	// their own leaked password first; someone else's is still a known-leaked password, but less pressing
+	slices.SortStableFunc(report.Matches, func(a, b *Match) int {
+		if a.Own != b.Own {
+			if a.Own {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.User, b.User)
+	})
+	return report, nil
+}
+
+// whether a leaked address is the account's; the account name is compared with the address's user part
+// (or the whole address, for exports keyed by UPN)
+func (acct *Account) owns(address string) bool {
+	if strings.Contains(acct.User, "@") {
+		return acct.User == address
+	}
+	user, _, _ := strings.Cut(address, "@")
+	return acct.User == user
+}
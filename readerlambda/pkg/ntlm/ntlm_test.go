@@ -0,0 +1,194 @@
+package ntlm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/newodahs/readerlambda/pkg/awsfake"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/credstore"
+	"github.com/newodahs/readerlambda/pkg/envelope"
+	"github.com/newodahs/readerlambda/pkg/util"
+)
+
+func Test_Hash(t *testing.T) {
+	testSet := []struct {
+		Password string
+		Expect   string
+	}{
+		{Password: "", Expect: "31d6cfe0d16ae931b73c59d7e0c089c0"},
+		{Password: "password", Expect: "8846f7eaee8fb117ad06bdd830b7586c"},
+		{Password: "Password1", Expect: "64f12cddaa88057e06a81b54e73b949b"},
+	}
+
+	for _, test := range testSet {
+		if got := Hash(test.Password); got != test.Expect {
+			t.Errorf("hash of [%s]: expected %s, got %s", test.Password, test.Expect, got)
+		}
+	}
+}
+
+func Test_ParseDump(t *testing.T) {
+	testSet := []struct {
+		Name          string
+		Input         string
+		ExpectUsers   []string
+		ExpectSkipped int
+		ExpectErr     bool
+	}{
+		{
+			Name:        "Plain",
+			Input:       "# exported\njdoe:8846F7EAEE8FB117AD06BDD830B7586C\n\nasmith:64f12cddaa88057e06a81b54e73b949b\n",
+			ExpectUsers: []string{"jdoe", "asmith"},
+		},
+		{
+			Name: "Secretsdump",
+			Input: `EXAMPLE\Administrator:500:aad3b435b51404eeaad3b435b51404ee:31d6cfe0d16ae931b73c59d7e0c089c0:::` + "\n" +
+				`EXAMPLE\JDoe:1104:aad3b435b51404eeaad3b435b51404ee:8846f7eaee8fb117ad06bdd830b7586c::: (status=Disabled)` + "\n" +
+				`EXAMPLE\WKS01$:1105:aad3b435b51404eeaad3b435b51404ee:0123456789abcdef0123456789abcdef:::` + "\n",
+			ExpectUsers:   []string{"administrator", "jdoe"},
+			ExpectSkipped: 1,
+		},
+		{Name: "Bad Hash", Input: "jdoe:password\n", ExpectErr: true},
+		{Name: "Bad Line", Input: "jdoe\n", ExpectErr: true},
+	}
+
+	for _, test := range testSet {
+		t.Run(test.Name, func(t *testing.T) {
+			accounts, skipped, err := ParseDump(strings.NewReader(test.Input))
+			if (err != nil) != test.ExpectErr {
+				t.Fatalf("unexpected error state: %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if len(accounts) != len(test.ExpectUsers) || skipped != test.ExpectSkipped {
+				t.Fatalf("expected %d accounts (%d skipped), got %d (%d)", len(test.ExpectUsers), test.ExpectSkipped, len(accounts), skipped)
+			}
+			for idx, acct := range accounts {
+				if acct.User != test.ExpectUsers[idx] {
+					t.Errorf("account %d: expected %s, got %s", idx, test.ExpectUsers[idx], acct.User)
+				}
+			}
+			if test.Name == "Secretsdump" && !accounts[1].Disabled {
+				t.Errorf("expected the disabled status to be read")
+			}
+		})
+	}
+}
+
+func Test_Compare(t *testing.T) {
+	const tableName = "credsTest"
+	ctx := context.Background()
+	cli := awsfake.NewDynamoDB()
+	if err := util.EnsureDynamoDBTable(ctx, cli, tableName, credparser.CredentialInfo{}, nil); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	localKeys, _, err := (*envelope.LocalKeys)(nil).Rotate()
+	if err != nil {
+		t.Fatalf("failed to make keys: %s", err)
+	}
+	cipher := envelope.NewCipher(localKeys)
+
+	store := func(email string, passwords ...string) {
+		user, domain, _ := strings.Cut(email, "@")
+		cred := &credparser.CredentialInfo{User: user, Domain: domain, Email: email}
+		for _, password := range passwords {
+			cred.AddPassword(password, nil)
+		}
+		if _, err := credstore.StoreCredential(ctx, cli, tableName, cipher, nil, cred); err != nil {
+			t.Fatalf("failed to store: %s", err)
+		}
+	}
+	store("jdoe@example.com", "Summer2024!", "password")
+	store("asmith@example.com", "hunter2")
+	store("bob@example.com", "password")
+	store("carol@other.com", "Winter2023")
+
+	accounts, _, err := ParseDump(strings.NewReader(
+		"jdoe:" + Hash("password") + "\n" + // still using their own leaked password
+			"mallory:" + Hash("hunter2") + "\n" + // someone else's leaked password
+			"asmith:" + Hash("changed-since") + "\n" +
+			"carol:" + Hash("Winter2023") + "\n")) // only leaked in a domain we didn't ask about
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+
+	report, err := Compare(ctx, cli, tableName, cipher, nil, []string{"Example.com", "example.com"}, accounts)
+	if err != nil {
+		t.Fatalf("failed to compare: %s", err)
+	}
+	if len(report.Domains) != 1 || report.Accounts != 4 || report.Passwords != 4 || report.Matched != 2 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if got := report.Matches[0]; got.User != "jdoe" || !got.Own || got.Leaks != 2 || got.Addresses[0] != "jdoe@example.com" {
+		t.Errorf("expected jdoe's own leaked password first, got %+v", got)
+	}
+	if got := report.Matches[1]; got.User != "mallory" || got.Own || got.Leaks != 1 || got.Addresses[0] != "asmith@example.com" {
+		t.Errorf("expected mallory to match asmith's leaked password, got %+v", got)
+	}
+
+	raw, _ := json.Marshal(report)
+	for _, secret := range []string{Hash("password"), Hash("hunter2"), `"password"`, "hunter2"} {
+		if strings.Contains(string(raw), secret) {
+			t.Errorf("report gives away [%s]: %s", secret, raw)
+		}
+	}
+
+	if _, err := Compare(ctx, cli, tableName, nil, nil, []string{"example.com"}, accounts); !errors.Is(err, credstore.ErrNoCipher) {
+		t.Errorf("expected encrypted passwords without a cipher to fail, got %v", err)
+	}
+}
+
+// stored addresses are found and owned whatever case the dump had them in, plain keys or hashed
+func Test_Compare_MixedCase(t *testing.T) {
+	localKeys, _, err := (*envelope.LocalKeys)(nil).Rotate()
+	if err != nil {
+		t.Fatalf("failed to make keys: %s", err)
+	}
+	hasher, _ := credstore.NewKeyHasher([]byte(strings.Repeat("k", credstore.MIN_LOOKUP_KEY_SIZE)))
+
+	testSet := []struct {
+		Name string
+		Keys *credstore.KeyHasher
+	}{
+		{Name: "PlainKeys"},
+		{Name: "HashedKeys", Keys: hasher},
+	}
+
+	for _, test := range testSet {
+		t.Run(test.Name, func(t *testing.T) {
+			const tableName = "credsTest"
+			ctx := context.Background()
+			cli := awsfake.NewDynamoDB()
+			if err := util.EnsureDynamoDBTable(ctx, cli, tableName, credparser.CredentialInfo{}, nil); err != nil {
+				t.Fatalf("failed to create table: %s", err)
+			}
+			cipher := envelope.NewCipher(localKeys)
+
+			cred := &credparser.CredentialInfo{User: "JDoe", Domain: "Example.COM", Email: "JDoe@Example.COM"}
+			cred.AddPassword("password", nil)
+			if _, err := credstore.StoreCredential(ctx, cli, tableName, cipher, test.Keys, cred); err != nil {
+				t.Fatalf("failed to store: %s", err)
+			}
+
+			accounts, _, err := ParseDump(strings.NewReader("EXAMPLE\\JDOE:1001:aad3b435b51404eeaad3b435b51404ee:" + Hash("password") + ":::\n"))
+			if err != nil {
+				t.Fatalf("failed to parse: %s", err)
+			}
+			report, err := Compare(ctx, cli, tableName, cipher, test.Keys, []string{"EXAMPLE.com"}, accounts)
+			if err != nil {
+				t.Fatalf("failed to compare: %s", err)
+			}
+			if report.Passwords != 1 || report.Matched != 1 {
+				t.Fatalf("expected the mixed-case credential to be found, got %+v", report)
+			}
+			if got := report.Matches[0]; !got.Own || got.Addresses[0] != "jdoe@example.com" {
+				t.Errorf("expected jdoe's own leaked password, got %+v", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package postprocess
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+)
+
+// what happens to an object after it was ingested successfully; failed objects are always moved to
+// the failed prefix (in the quarantine bucket if one is configured)
+type Mode string
+
+const (
+	MODE_MOVE   Mode = "move"   // move to the processed prefix
+	MODE_DELETE Mode = "delete" // the original behavior
+	MODE_TAG    Mode = "tag"    // leave it in place and tag it
+)
+
+const (
+	DEFAULT_PROCESSED_PREFIX = `processed/`
+	DEFAULT_FAILED_PREFIX    = `failed/`
+	REJECTS_SUFFIX           = `.rejects.jsonl`
+	STATUS_TAG               = `credreader-status`
+)
+
+type Options struct {
+	Mode             Mode
+	ProcessedPrefix  string
+	FailedPrefix     string
+	RejectsPrefix    string // where rejects files go; empty means next to the object's destination
+	QuarantineBucket string // failed objects and rejects files go here instead of the source bucket, if set
+}
+
+func DefaultOptions() Options {
+	return Options{Mode: MODE_MOVE, ProcessedPrefix: DEFAULT_PROCESSED_PREFIX, FailedPrefix: DEFAULT_FAILED_PREFIX}
+}
+
+// reads POSTPROCESS_MODE, PROCESSED_PREFIX, FAILED_PREFIX, REJECTS_PREFIX and QUARANTINE_BUCKET on top of the defaults
+func OptionsFromEnv() (Options, error) {
+	opts := DefaultOptions()
+	if mode := os.Getenv("POSTPROCESS_MODE"); mode != "" {
+		opts.Mode = Mode(strings.ToLower(mode))
+	}
+	if prefix, set := os.LookupEnv("PROCESSED_PREFIX"); set {
+		opts.ProcessedPrefix = prefix
+	}
+	if prefix, set := os.LookupEnv("FAILED_PREFIX"); set {
+		opts.FailedPrefix = prefix
+	}
+	opts.RejectsPrefix = os.Getenv("REJECTS_PREFIX")
+	opts.QuarantineBucket = os.Getenv("QUARANTINE_BUCKET")
+
+	return opts, opts.Validate()
+}
+
+func (o Options) Validate() error {
+	switch o.Mode {
+	case MODE_MOVE, MODE_DELETE, MODE_TAG:
+	default:
+		return fmt.Errorf("unknown post-processing mode [%s]", o.Mode)
+	}
+
+	if o.FailedPrefix == "" && o.QuarantineBucket == "" {
+		return errors.New("failed objects need a failed prefix or a quarantine bucket")
+	}
+	if o.Mode == MODE_MOVE && o.ProcessedPrefix == "" {
+		return errors.New("move mode needs a processed prefix")
+	}
+	return nil
+}
+
+// the subset of the s3 client we use; lets tests swap in a local stand-in
+type S3API interface {
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error)
+}
+
+type Processor struct {
+	S3   S3API
+	Opts Options
+}
+
+func New(cli S3API, opts Options) *Processor {
+	return &Processor{S3: cli, Opts: opts}
+}
+
+// true for objects we wrote ourselves (processed/failed/rejects); the trigger shouldn't ingest those
+// or we'd chase our own tail
+func (p *Processor) Skip(key string) bool {
+	for _, prefix := range []string{p.Opts.ProcessedPrefix, p.Opts.FailedPrefix, p.Opts.RejectsPrefix} {
+		if prefix != "" && strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return strings.HasSuffix(key, REJECTS_SUFFIX)
+}
+
+// post-processes a successfully ingested object per the configured mode and writes its rejects file (if any)
+func (p *Processor) Succeeded(ctx context.Context, bucket, key, jobID string, rejects []*credparser.ParseError) error {
+	if p == nil || p.S3 == nil {
+		return credparser.ErrBadParameter
+	}
+
+	switch p.Opts.Mode {
+	case MODE_MOVE:
+		if err := p.WriteRejects(ctx, bucket, p.Opts.ProcessedPrefix, key, rejects); err != nil {
+			return err
+		}
+		return p.move(ctx, bucket, key, bucket, p.Opts.ProcessedPrefix+key)
+
+	case MODE_TAG:
+		if err := p.WriteRejects(ctx, bucket, p.Opts.ProcessedPrefix, key, rejects); err != nil {
+			return err
+		}
+		if _, err := p.S3.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+			Tagging: &s3types.Tagging{TagSet: []s3types.Tag{
+				{Key: aws.String(STATUS_TAG), Value: aws.String("processed")},
+				{Key: aws.String("credreader-job"), Value: aws.String(jobID)},
+			}},
+		}); err != nil {
+			return fmt.Errorf("failed to tag %s/%s: %s", bucket, key, err)
+		}
+		return nil
+
+	default: // MODE_DELETE
+		if err := p.WriteRejects(ctx, bucket, p.Opts.ProcessedPrefix, key, rejects); err != nil {
+			return err
+		}
+		if err := p.delete(ctx, bucket, key); err != nil {
+			return fmt.Errorf("failed to delete %s/%s: %s", bucket, key, err)
+		}
+		return nil
+	}
+}
+
+// quarantines an object we couldn't ingest, along with whatever rejects we collected before failing
+func (p *Processor) Failed(ctx context.Context, bucket, key string, rejects []*credparser.ParseError) error {
+	if p == nil || p.S3 == nil {
+		return credparser.ErrBadParameter
+	}
+
+	dstBucket := bucket
+	if p.Opts.QuarantineBucket != "" {
+		dstBucket = p.Opts.QuarantineBucket
+	}
+
+	if err := p.WriteRejects(ctx, dstBucket, p.Opts.FailedPrefix, key, rejects); err != nil {
+		return err
+	}
+	return p.move(ctx, bucket, key, dstBucket, p.Opts.FailedPrefix+key)
+}
+
+// key the rejects file for key ends up at, given the prefix of the object's destination
+func (p *Processor) RejectsKey(destPrefix, key string) string {
+	if p.Opts.RejectsPrefix != "" {
+		destPrefix = p.Opts.RejectsPrefix
+	}
+	return destPrefix + key + REJECTS_SUFFIX
+}
+
+// one JSON object per rejected line: {"line":N,"raw":"...","reason":"..."}; name is normally the object
+// key, callers writing rejects for part of an object tack something on to keep the parts apart
+func (p *Processor) WriteRejects(ctx context.Context, bucket, destPrefix, name string, rejects []*credparser.ParseError) error {
+	if len(rejects) == 0 {
+		return nil
+	}
+
+	if p.Opts.QuarantineBucket != "" {
+		bucket = p.Opts.QuarantineBucket
+	}
+
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, reject := range rejects {
+		if err := enc.Encode(reject); err != nil {
+			return fmt.Errorf("failed to encode reject for line [%d]: %s", reject.Line, err)
+		}
+	}
+
+	rejectsKey := p.RejectsKey(destPrefix, name)
+	if _, err := p.S3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(rejectsKey),
+		Body:        bytes.NewReader(buf.Bytes()),
+		ContentType: aws.String("application/x-ndjson"),
+	}); err != nil {
+		return fmt.Errorf("failed to write rejects file %s/%s: %s", bucket, rejectsKey, err)
+	}
+	return nil
+}
+
+// s3 has no move; copy then delete
+func (p *Processor) move(ctx context.Context, srcBucket, srcKey, dstBucket, dstKey string) error {
+	if _, err := p.S3.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(dstBucket),
+		Key:        aws.String(dstKey),
+		CopySource: aws.String(CopySource(srcBucket, srcKey)),
+	}); err != nil {
+		return fmt.Errorf("failed to copy %s/%s to %s/%s: %s", srcBucket, srcKey, dstBucket, dstKey, err)
+	}
+
+	if err := p.delete(ctx, srcBucket, srcKey); err != nil {
+		return fmt.Errorf("copied %s/%s to %s/%s but failed to delete the original: %s", srcBucket, srcKey, dstBucket, dstKey, err)
+	}
+	return nil
+}
+
+// how many times we try to delete an object (waiting deleteRetryDelay, doubled each time, in between); by
+// the time we delete, the object's ingest is already marked complete, so giving up leaves it behind until
+// something redelivers its event
+const deleteAttempts = 4
+
+var deleteRetryDelay = 250 * time.Millisecond
+
+// deletes are idempotent (deleting something that's gone isn't an error), so retrying them is always safe
+func (p *Processor) delete(ctx context.Context, bucket, key string) error {
+	delay := deleteRetryDelay
+	var err error
+	for attempt := 0; attempt < deleteAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return errors.Join(err, ctx.Err())
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+		if _, err = p.S3.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)}); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// CopyObject wants "bucket/key" with the key url-encoded (but the slashes left alone)
+func CopySource(bucket, key string) string {
+	segments := strings.Split(key, "/")
+	for idx, seg := range segments {
+		segments[idx] = url.PathEscape(seg)
+	}
+	return bucket + "/" + strings.Join(segments, "/")
+}
@@ -0,0 +1,204 @@
+package postprocess
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/newodahs/readerlambda/pkg/awsfake"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+)
+
+func Test_PostProcess_Modes(t *testing.T) {
+	rejects := []*credparser.ParseError{
+		{Line: 2, Raw: "garbage", Reason: credparser.REJECT_UNPARSEABLE},
+		{Line: 3, Raw: "dup@dup.com:pw", Reason: credparser.REJECT_DUPLICATE},
+	}
+
+	testSet := []struct {
+		Name         string
+		Opts         Options
+		Fail         bool
+		ExpectKeys   map[string][]string // bucket => keys left afterwards
+		ExpectTagged bool
+	}{
+		{
+			Name:       "Move",
+			Opts:       DefaultOptions(),
+			ExpectKeys: map[string][]string{"in": {"processed/dumps/a file.txt", "processed/dumps/a file.txt" + REJECTS_SUFFIX}},
+		},
+		{
+			Name:       "Delete",
+			Opts:       Options{Mode: MODE_DELETE, FailedPrefix: DEFAULT_FAILED_PREFIX, RejectsPrefix: "rejects/"},
+			ExpectKeys: map[string][]string{"in": {"rejects/dumps/a file.txt" + REJECTS_SUFFIX}},
+		},
+		{
+			Name:         "Tag",
+			Opts:         Options{Mode: MODE_TAG, ProcessedPrefix: DEFAULT_PROCESSED_PREFIX, FailedPrefix: DEFAULT_FAILED_PREFIX},
+			ExpectKeys:   map[string][]string{"in": {"dumps/a file.txt", "processed/dumps/a file.txt" + REJECTS_SUFFIX}},
+			ExpectTagged: true,
+		},
+		{
+			Name:       "Failed To Quarantine",
+			Opts:       Options{Mode: MODE_MOVE, ProcessedPrefix: DEFAULT_PROCESSED_PREFIX, FailedPrefix: DEFAULT_FAILED_PREFIX, QuarantineBucket: "quarantine"},
+			Fail:       true,
+			ExpectKeys: map[string][]string{"in": nil, "quarantine": {"failed/dumps/a file.txt", "failed/dumps/a file.txt" + REJECTS_SUFFIX}},
+		},
+	}
+
+	for _, curTest := range testSet {
+		t.Run(curTest.Name, func(t *testing.T) {
+			if err := curTest.Opts.Validate(); err != nil {
+				t.Fatalf("options failed validation: %s", err)
+			}
+
+			fake := awsfake.NewS3()
+			fake.Put("in", "dumps/a file.txt", []byte("someone@email.com:pw\ngarbage\n"), nil)
+
+			proc := New(fake, curTest.Opts)
+			var err error
+			if curTest.Fail {
+				err = proc.Failed(context.TODO(), "in", "dumps/a file.txt", rejects)
+			} else {
+				err = proc.Succeeded(context.TODO(), "in", "dumps/a file.txt", "job1", rejects)
+			}
+			if err != nil {
+				t.Fatalf("post-processing failed: %s", err)
+			}
+
+			for bucket, expectKeys := range curTest.ExpectKeys {
+				if got := fake.Keys(bucket); strings.Join(got, "|") != strings.Join(expectKeys, "|") {
+					t.Errorf("bucket [%s] has keys %v, expected %v", bucket, got, expectKeys)
+				}
+
+				for _, key := range expectKeys {
+					if !strings.HasSuffix(key, REJECTS_SUFFIX) {
+						continue
+					}
+
+					var got []*credparser.ParseError
+					scanner := bufio.NewScanner(bytes.NewReader(fake.Object(bucket, key).Body))
+					for scanner.Scan() {
+						pe := &credparser.ParseError{}
+						if jsonErr := json.Unmarshal(scanner.Bytes(), pe); jsonErr != nil {
+							t.Fatalf("bad rejects line [%s]: %s", scanner.Text(), jsonErr)
+						}
+						got = append(got, pe)
+					}
+					if len(got) != len(rejects) || got[0].Reason != credparser.REJECT_UNPARSEABLE || got[1].Line != 3 {
+						t.Errorf("rejects file contents don't match what we wrote: %+v", got)
+					}
+				}
+			}
+
+			if curTest.ExpectTagged {
+				if obj := fake.Object("in", "dumps/a file.txt"); obj == nil || obj.Tags[STATUS_TAG] != "processed" {
+					t.Errorf("expected object to be tagged as processed")
+				}
+			}
+
+			if !proc.Skip(proc.RejectsKey(curTest.Opts.FailedPrefix, "x")) || proc.Skip("dumps/a file.txt") {
+				t.Errorf("skip logic doesn't recognize our own output")
+			}
+		})
+	}
+}
+
+// fails the first `failures` deletes it gets
+type flakyS3 struct {
+	*awsfake.S3
+	failures int
+}
+
+func (f *flakyS3) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	if f.failures > 0 {
+		f.failures--
+		return nil, errors.New("service unavailable")
+	}
+	return f.S3.DeleteObject(ctx, params, optFns...)
+}
+
+func Test_PostProcess_DeleteRetry(t *testing.T) {
+	deleteRetryDelay = time.Millisecond
+
+	testSet := []struct {
+		Name      string
+		Mode      Mode
+		Failures  int
+		ExpectErr bool
+	}{
+		{Name: "Move Recovers", Mode: MODE_MOVE, Failures: deleteAttempts - 1},
+		{Name: "Delete Recovers", Mode: MODE_DELETE, Failures: deleteAttempts - 1},
+		{Name: "Move Gives Up", Mode: MODE_MOVE, Failures: deleteAttempts, ExpectErr: true},
+		{Name: "Delete Gives Up", Mode: MODE_DELETE, Failures: deleteAttempts, ExpectErr: true},
+	}
+
+	for _, curTest := range testSet {
+		t.Run(curTest.Name, func(t *testing.T) {
+			fake := &flakyS3{S3: awsfake.NewS3(), failures: curTest.Failures}
+			fake.Put("in", "dumps/a file.txt", []byte("someone@email.com:pw\n"), nil)
+
+			opts := DefaultOptions()
+			opts.Mode = curTest.Mode
+			err := New(fake, opts).Succeeded(context.TODO(), "in", "dumps/a file.txt", "job1", nil)
+			if (err != nil) != curTest.ExpectErr {
+				t.Fatalf("unexpected error state: %v", err)
+			}
+			if left := fake.Object("in", "dumps/a file.txt") != nil; left != curTest.ExpectErr {
+				t.Errorf("expected the original left behind: %t; bucket holds %v", curTest.ExpectErr, fake.Keys("in"))
+			}
+		})
+	}
+}
+
+// erasing an address takes its rejected lines out of every rejects file; a file left empty goes, anything
+// that isn't a rejects file is left alone
+func Test_ScrubRejects(t *testing.T) {
+	ctx := context.Background()
+	fakeS3 := awsfake.NewS3()
+	proc := New(fakeS3, DefaultOptions())
+
+	write := func(name string, raws ...string) {
+		t.Helper()
+		var rejects []*credparser.ParseError
+		for idx, raw := range raws {
+			rejects = append(rejects, &credparser.ParseError{Line: idx + 1, Raw: raw, Reason: credparser.REJECT_UNPARSEABLE})
+		}
+		if err := proc.WriteRejects(ctx, "bucket", DEFAULT_PROCESSED_PREFIX, name, rejects); err != nil {
+			t.Fatalf("failed to write rejects: %s", err)
+		}
+	}
+	write("a.txt", "Erased@Example.com:", "other@example.com:", "garbage")
+	write("b.txt", "  erased@example.COM\t")
+	write("c.txt", "nothing to see")
+	fakeS3.Put("bucket", DEFAULT_PROCESSED_PREFIX+"a.txt", []byte("erased@example.com:pw\n"), nil) // the dump itself isn't ours to touch
+	fakeS3.Put("bucket", "elsewhere/d.txt"+REJECTS_SUFFIX, []byte(`{"line":1,"raw":"erased@example.com"}`+"\n"), nil)
+
+	stats, err := ScrubRejects(ctx, fakeS3, "bucket", DEFAULT_PROCESSED_PREFIX, " Erased@example.com")
+	if err != nil {
+		t.Fatalf("failed to scrub: %s", err)
+	}
+	if stats != (ScrubStats{Files: 3, Rewritten: 2, Lines: 2}) {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	kept := fakeS3.Object("bucket", proc.RejectsKey(DEFAULT_PROCESSED_PREFIX, "a.txt"))
+	if kept == nil || strings.Contains(strings.ToLower(string(kept.Body)), "erased@") || strings.Count(string(kept.Body), "\n") != 2 {
+		t.Errorf("expected only the other lines left, got %v", kept)
+	}
+	if fakeS3.Object("bucket", proc.RejectsKey(DEFAULT_PROCESSED_PREFIX, "b.txt")) != nil {
+		t.Errorf("expected the emptied rejects file removed")
+	}
+	if obj := fakeS3.Object("bucket", DEFAULT_PROCESSED_PREFIX+"a.txt"); obj == nil || !bytes.Contains(obj.Body, []byte("erased@")) {
+		t.Errorf("expected the processed object left alone")
+	}
+	if fakeS3.Object("bucket", "elsewhere/d.txt"+REJECTS_SUFFIX) == nil {
+		t.Errorf("expected rejects outside the prefix left alone")
+	}
+}
@@ -0,0 +1,141 @@
+package postprocess
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+)
+
+// rejected lines are kept whole (and JSON escaped), so can be long
+const maxRejectLine = 4 * 1024 * 1024
+
+// the bits of S3 scrubbing rejects files needs
+type ScrubAPI interface {
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+// what a scrub went through and changed
+type ScrubStats struct {
+	Files     int // rejects files read
+	Rewritten int // ...that had the address in them (rewritten, or deleted if nothing else was left)
+	Lines     int // rejected lines removed
+}
+
+// removes every rejected line mentioning email from the rejects files under prefix in bucket; part of
+// erasing an address (see credstore.Erase), since a line that failed to parse is kept as it was. a file
+// left with nothing in it is deleted. matching is on the raw line, case-insensitively, so a mangled line
+// that still has the address in it goes too
+func ScrubRejects(ctx context.Context, cli ScrubAPI, bucket, prefix, email string) (ScrubStats, error) {
+	var stats ScrubStats
+	if cli == nil {
+		return stats, errors.New("passed s3 client was nil")
+	}
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return stats, errors.New("no address to scrub")
+	}
+
+	var errs []error
+	paginator := s3.NewListObjectsV2Paginator(cli, &s3.ListObjectsV2Input{Bucket: aws.String(bucket), Prefix: aws.String(prefix)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return stats, errors.Join(append(errs, fmt.Errorf("failed to list %s/%s: %s", bucket, prefix, err))...)
+		}
+
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			if !strings.HasSuffix(key, REJECTS_SUFFIX) {
+				continue
+			}
+			stats.Files++
+
+			removed, err := scrubObject(ctx, cli, bucket, key, email)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if removed > 0 {
+				stats.Rewritten++
+				stats.Lines += removed
+			}
+		}
+	}
+	return stats, errors.Join(errs...)
+}
+
+func scrubObject(ctx context.Context, cli ScrubAPI, bucket, key, email string) (int, error) {
+	res, err := cli.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return 0, fmt.Errorf("failed to read rejects file %s/%s: %s", bucket, key, err)
+	}
+	kept, removed, err := ScrubRejectLines(res.Body, email)
+	res.Body.Close()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read rejects file %s/%s: %s", bucket, key, err)
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+
+	if len(kept) == 0 {
+		if _, err := cli.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)}); err != nil {
+			return 0, fmt.Errorf("failed to delete rejects file %s/%s: %s", bucket, key, err)
+		}
+		return removed, nil
+	}
+	if _, err := cli.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(kept),
+		ContentType: aws.String("application/x-ndjson"),
+	}); err != nil {
+		return 0, fmt.Errorf("failed to rewrite rejects file %s/%s: %s", bucket, key, err)
+	}
+	return removed, nil
+}
+
+// the lines of a rejects file (see WriteRejects) that don't mention email (lowercased), and how many did;
+// also used on the rejects files the console's watch leaves on disk
+func ScrubRejectLines(rd io.Reader, email string) ([]byte, int, error) {
+	kept := &bytes.Buffer{}
+	removed := 0
+
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxRejectLine)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		// the raw line is what matters, but a line we can't decode is checked whole rather than kept blindly
+		text := string(line)
+		var reject credparser.ParseError
+		if json.Unmarshal(line, &reject) == nil {
+			text = reject.Raw
+		}
+		if strings.Contains(strings.ToLower(text), email) {
+			removed++
+			continue
+		}
+		kept.Write(line)
+		kept.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	return kept.Bytes(), removed, nil
+}
@@ -0,0 +1,200 @@
+package retention
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/tenants"
+)
+
+// how long credentials are kept, counted from the breach they came from (or from when we first saw them if
+// the breach date isn't known); expiry is stamped on each password at ingest and acted on by dynamodb's TTL
+// and the purge (see credstore.Purger)
+//
+// overrides are per tenant (by the email domain's tenant, see tenants.Directory) and per domain; a domain's
+// own override wins over its tenant's, which wins over Default
+type Policy struct {
+	Default   time.Duration            // 0 keeps forever
+	Tenants   map[string]time.Duration // tenant => period, overriding Default; 0 keeps that tenant's domains forever
+	Domains   map[string]time.Duration // lowercased domain => period, overriding the rest; 0 keeps that domain forever
+	Directory *tenants.Directory       // which tenant a domain belongs to
+}
+
+const DAY = 24 * time.Hour
+
+// reads a retention period: a go duration ("2160h"), a number of days ("90d") or years ("2y", 365 days
+// each); "0", "forever" and "" keep forever
+func ParsePeriod(raw string) (time.Duration, error) {
+	raw = strings.TrimSpace(strings.ToLower(raw))
+	switch raw {
+	case "", "0", "forever":
+		return 0, nil
+	}
+
+	var period time.Duration
+	if unit := raw[len(raw)-1]; unit == 'd' || unit == 'y' {
+		cnt, err := strconv.Atoi(raw[:len(raw)-1])
+		if err != nil {
+			return 0, fmt.Errorf("bad retention period [%s]", raw)
+		}
+		period = time.Duration(cnt) * DAY
+		if unit == 'y' {
+			period *= 365
+		}
+	} else {
+		var err error
+		if period, err = time.ParseDuration(raw); err != nil {
+			return 0, fmt.Errorf("bad retention period [%s]: %s", raw, err)
+		}
+	}
+
+	if period < 0 {
+		return 0, fmt.Errorf("retention period [%s] is negative", raw)
+	}
+	return period, nil
+}
+
+// builds a policy from a default period and domain => period and tenant => period overrides (see
+// ParsePeriod); every tenant must be in dir. nil (and no error) if nothing is ever going to expire
+func New(defaultPeriod string, domains, tenantPeriods map[string]string, dir *tenants.Directory) (*Policy, error) {
+	var errs []error
+	policy := &Policy{Domains: map[string]time.Duration{}, Tenants: map[string]time.Duration{}, Directory: dir}
+
+	var err error
+	if policy.Default, err = ParsePeriod(defaultPeriod); err != nil {
+		errs = append(errs, err)
+	}
+
+	expires := policy.Default > 0
+	for tenant, raw := range tenantPeriods {
+		tenant = strings.TrimSpace(tenant)
+		if !dir.Has(tenant) {
+			errs = append(errs, fmt.Errorf("retention override for unknown tenant [%s]", tenant))
+			continue
+		}
+		period, err := ParsePeriod(raw)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("retention for tenant [%s]: %s", tenant, err))
+			continue
+		}
+		policy.Tenants[tenant] = period
+		expires = expires || period > 0
+	}
+	for domain, raw := range domains {
+		domain = strings.TrimSpace(strings.ToLower(domain))
+		if domain == "" {
+			errs = append(errs, fmt.Errorf("retention override [%s] has no domain", raw))
+			continue
+		}
+		period, err := ParsePeriod(raw)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("retention for [%s]: %s", domain, err))
+			continue
+		}
+		policy.Domains[domain] = period
+		expires = expires || period > 0
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	if !expires {
+		return nil, nil
+	}
+	return policy, nil
+}
+
+// reads "example.com=90d,example.org=forever" into domain => period (or the same for tenants)
+func ParseDomains(raw string) (map[string]string, error) {
+	ret := map[string]string{}
+	for _, pair := range strings.Split(raw, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		domain, period, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, fmt.Errorf("retention override [%s] must be name=period", pair)
+		}
+		ret[strings.TrimSpace(domain)] = strings.TrimSpace(period)
+	}
+	return ret, nil
+}
+
+// how long credentials in domain are kept; 0 is forever. nil-safe (a nil policy keeps everything)
+func (p *Policy) For(domain string) time.Duration {
+	if p == nil {
+		return 0
+	}
+	if period, found := p.Domains[strings.ToLower(domain)]; found {
+		return period
+	}
+	if period, found := p.Tenants[p.Directory.Of(domain)]; found {
+		return period
+	}
+	return p.Default
+}
+
+// when something from domain seen at basis expires; nil if it's kept forever
+func (p *Policy) ExpiresAt(domain string, basis time.Time) *time.Time {
+	period := p.For(domain)
+	if period <= 0 || basis.IsZero() {
+		return nil
+	}
+	ret := basis.Add(period).UTC()
+	return &ret
+}
+
+// sets the expiry of every password in cred that doesn't have one yet (i.e. fresh from the parser) to
+// basis plus the domain's period, then updates the credential's own expiry
+func (p *Policy) Stamp(cred *credparser.CredentialInfo, basis time.Time) {
+	if p == nil || cred == nil {
+		return
+	}
+	cred.AlignProvenance()
+	expiresAt := p.ExpiresAt(cred.Domain, basis)
+	for _, prov := range cred.Provenance {
+		if prov.ExpiresAt == nil {
+			prov.ExpiresAt = expiresAt
+		}
+	}
+	cred.UpdateExpiry()
+}
+
+func (p *Policy) String() string {
+	if p == nil {
+		return "forever"
+	}
+	parts := []string{"default " + FormatPeriod(p.Default)}
+	tenantNames := make([]string, 0, len(p.Tenants))
+	for tenant := range p.Tenants {
+		tenantNames = append(tenantNames, tenant)
+	}
+	sort.Strings(tenantNames)
+	for _, tenant := range tenantNames {
+		parts = append(parts, "tenant "+tenant+" "+FormatPeriod(p.Tenants[tenant]))
+	}
+	domains := make([]string, 0, len(p.Domains))
+	for domain := range p.Domains {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	for _, domain := range domains {
+		parts = append(parts, domain+" "+FormatPeriod(p.Domains[domain]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func FormatPeriod(period time.Duration) string {
+	if period <= 0 {
+		return "forever"
+	}
+	if period%DAY == 0 {
+		return fmt.Sprintf("%dd", period/DAY)
+	}
+	return period.String()
+}
@@ -0,0 +1,141 @@
+package retention
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/tenants"
+)
+
+func Test_ParsePeriod(t *testing.T) {
+	testSet := []struct {
+		Name      string
+		Raw       string
+		Expect    time.Duration
+		ExpectErr bool
+	}{
+		{Name: "Empty", Raw: "", Expect: 0},
+		{Name: "Forever", Raw: " Forever ", Expect: 0},
+		{Name: "Days", Raw: "90d", Expect: 90 * DAY},
+		{Name: "Years", Raw: "2y", Expect: 2 * 365 * DAY},
+		{Name: "Duration", Raw: "36h", Expect: 36 * time.Hour},
+		{Name: "Negative", Raw: "-1d", ExpectErr: true},
+		{Name: "Garbage", Raw: "a while", ExpectErr: true},
+		{Name: "BadDays", Raw: "xd", ExpectErr: true},
+	}
+
+	for _, test := range testSet {
+		t.Run(test.Name, func(t *testing.T) {
+			got, err := ParsePeriod(test.Raw)
+			if (err != nil) != test.ExpectErr {
+				t.Fatalf("unexpected error state: %v", err)
+			}
+			if got != test.Expect {
+				t.Errorf("expected %s, got %s", test.Expect, got)
+			}
+		})
+	}
+}
+
+func Test_Policy(t *testing.T) {
+	domains, err := ParseDomains("Short.example.com=7d, keep.example.com=forever,,")
+	if err != nil {
+		t.Fatalf("failed to parse domains: %s", err)
+	}
+	dir, _ := tenants.Parse("acme=acme.com,globex=globex.com|short.example.com")
+	tenantPeriods, _ := ParseDomains("acme=30d,globex=forever")
+	policy, err := New("365d", domains, tenantPeriods, dir)
+	if err != nil || policy == nil {
+		t.Fatalf("failed to build policy: %v", err)
+	}
+
+	for domain, expect := range map[string]time.Duration{
+		"example.com":       365 * DAY,
+		"SHORT.example.com": 7 * DAY, // the domain's own override wins over its tenant's
+		"keep.example.com":  0,
+		"acme.com":          30 * DAY,
+		"mail.ACME.com":     30 * DAY,
+		"globex.com":        0,
+	} {
+		if got := policy.For(domain); got != expect {
+			t.Errorf("expected %s for [%s], got %s", expect, domain, got)
+		}
+	}
+	if got := policy.String(); got != "default 365d, tenant acme 30d, tenant globex forever, keep.example.com forever, short.example.com 7d" {
+		t.Errorf("unexpected description [%s]", got)
+	}
+
+	// nothing ever expires: no policy at all
+	if none, err := New("", map[string]string{"example.com": "0"}, map[string]string{"acme": "forever"}, dir); none != nil || err != nil {
+		t.Errorf("expected no policy, got %v (%v)", none, err)
+	}
+	if (*Policy)(nil).For("example.com") != 0 || (*Policy)(nil).ExpiresAt("example.com", time.Now()) != nil {
+		t.Errorf("expected a nil policy to keep everything")
+	}
+
+	if _, err := ParseDomains("example.com:7d"); err == nil {
+		t.Errorf("expected an override without = to be refused")
+	}
+	if _, err := New("1 fortnight", map[string]string{"example.com": "soon"}, nil, nil); err == nil || !strings.Contains(err.Error(), "example.com") {
+		t.Errorf("expected both bad periods to be reported, got %v", err)
+	}
+	if _, err := New("30d", nil, map[string]string{"initech": "7d"}, dir); err == nil || !strings.Contains(err.Error(), "initech") {
+		t.Errorf("expected an unknown tenant to be refused, got %v", err)
+	}
+	if _, err := New("30d", nil, map[string]string{"acme": "soon"}, dir); err == nil {
+		t.Errorf("expected a bad tenant period to be refused")
+	}
+}
+
+func Test_Policy_Stamp(t *testing.T) {
+	policy, _ := New("30d", map[string]string{"keep.example.com": "forever"}, nil, nil)
+	breach := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	later := breach.Add(400 * DAY)
+
+	cred := &credparser.CredentialInfo{Domain: "example.com", User: "first"}
+	cred.AddPassword("old", &credparser.Provenance{})
+	policy.Stamp(cred, breach)
+	if cred.ExpiresAt == nil || !cred.ExpiresAt.Equal(breach.Add(30*DAY)) {
+		t.Fatalf("unexpected expiry %v", cred.ExpiresAt)
+	}
+
+	// a new password from a later breach; existing ones keep their expiry
+	fresh := &credparser.CredentialInfo{Domain: "example.com", User: "first"}
+	fresh.AddPassword("new", &credparser.Provenance{})
+	fresh.AddPassword("old", &credparser.Provenance{})
+	policy.Stamp(fresh, later)
+	cred.Merge(fresh)
+	cred.UpdateExpiry()
+
+	if !cred.NextExpiry.Equal(later.Add(30*DAY)) || !cred.ExpiresAt.Equal(later.Add(30*DAY)) {
+		t.Errorf("expected both passwords to now expire with the later breach, got next %v last %v", cred.NextExpiry, cred.ExpiresAt)
+	}
+
+	// anything kept forever keeps the whole credential
+	kept := &credparser.CredentialInfo{Domain: "keep.example.com", User: "first"}
+	kept.AddPassword("pw", &credparser.Provenance{})
+	policy.Stamp(kept, breach)
+	if kept.ExpiresAt != nil || kept.NextExpiry != nil || kept.Provenance[0].ExpiresAt != nil {
+		t.Errorf("expected no expiry for a domain kept forever, got %v", kept.ExpiresAt)
+	}
+	cred.Merge(kept)
+	cred.UpdateExpiry()
+	if cred.ExpiresAt != nil {
+		t.Errorf("expected a password kept forever to keep the credential, got %v", cred.ExpiresAt)
+	}
+
+	// a password with an expiry seen again somewhere kept forever is kept forever
+	if cred.Provenance[0].ExpiresAt == nil {
+		t.Fatalf("expected [old] to still have an expiry")
+	}
+	again := &credparser.CredentialInfo{Domain: "keep.example.com", User: "first"}
+	again.AddPassword("old", &credparser.Provenance{})
+	policy.Stamp(again, later)
+	cred.Merge(again)
+	cred.UpdateExpiry()
+	if cred.Provenance[0].ExpiresAt != nil || cred.NextExpiry == nil || !cred.NextExpiry.Equal(later.Add(30*DAY)) {
+		t.Errorf("expected [old] kept forever and [new] still expiring, got %v / next %v", cred.Provenance[0].ExpiresAt, cred.NextExpiry)
+	}
+}
@@ -0,0 +1,203 @@
+package severity
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/newodahs/readerlambda/pkg/credparser"
+)
+
+// what each factor is worth at most; they add up to 100
+const (
+	WEIGHT_STORAGE    = 35
+	WEIGHT_RECENCY    = 25
+	WEIGHT_SOURCES    = 15
+	WEIGHT_PRIVILEGED = 15
+	WEIGHT_REUSE      = 10
+)
+
+// account names that usually hold (or can get) admin rights; matched against the whole user part, ignoring
+// separators and trailing digits, so admin@, it-admin@ and root2@ all count
+var privilegedNames = []string{
+	"admin", "administrator", "administrators", "itadmin", "sysadmin", "sysadmins", "root", "superuser", "it",
+	"helpdesk", "servicedesk", "itsupport", "security", "secops", "infosec", "netadmin", "domainadmin", "dba",
+	"devops", "ops", "backup", "webmaster", "postmaster", "hostmaster",
+}
+
+// shared role mailboxes; not privileged as such, but usually several people know the password and nobody owns it
+var roleNames = []string{
+	"info", "support", "sales", "billing", "accounts", "accounting", "finance", "payroll", "hr", "office",
+	"contact", "marketing", "legal", "purchasing", "reception", "noreply", "test", "service", "shared",
+}
+
+var nameNoise = regexp.MustCompile(`[^a-z]|[0-9]+$`)
+
+// how much an account's name alone says about it: WEIGHT_PRIVILEGED for admin-ish names, about half that for
+// role mailboxes, nothing for anyone else
+func nameWeight(user string) int {
+	user = strings.ToLower(user)
+	if base, _, found := strings.Cut(user, "+"); found { // sub-addressing doesn't change whose it is
+		user = base
+	}
+	name := nameNoise.ReplaceAllString(user, "")
+	switch {
+	case slices.Contains(privilegedNames, name) || strings.HasPrefix(name, "admin") || strings.HasSuffix(name, "admin"):
+		return WEIGHT_PRIVILEGED
+	case slices.Contains(roleNames, name):
+		return WEIGHT_PRIVILEGED / 2
+	}
+	return 0
+}
+
+var (
+	hexOnly    = regexp.MustCompile(`^[0-9a-fA-F]+$`)
+	strongHash = regexp.MustCompile(`^(\$2[abxy]?\$\d\d\$|\$argon2(id|i|d)\$|\$scrypt\$|\$7\$|\$[56]\$|\$pbkdf2|pbkdf2_sha(1|256|512)\$|\$y\$|\$gy\$|\{PBKDF2)`)
+	weakHash   = regexp.MustCompile(`^(\$1\$|\$apr1\$|\$[PH]\$|\{(SHA|SSHA|MD5|SMD5|SHA256|SSHA256|SHA512|SSHA512|CRYPT)\}|\*[0-9A-Fa-f]{40}$|md5\$|sha1\$)`)
+)
+
+// what form a leaked password is in, going by its shape: slow salted hashes (bcrypt, argon2, scrypt,
+// sha-crypt, pbkdf2) are strong; fast ones (md5, sha*, ntlm, md5-crypt, LDAP {SHA} ...) are weak; anything
+// else is taken to be plaintext. a plaintext password that happens to look like a hash is under-rated;
+// that's the rarer mistake
+func Classify(password string) credparser.PasswordStorage {
+	switch {
+	case strongHash.MatchString(password):
+		return credparser.STORAGE_STRONG_HASH
+	case weakHash.MatchString(password):
+		return credparser.STORAGE_WEAK_HASH
+	case hexOnly.MatchString(password) && slices.Contains([]int{16, 32, 40, 56, 64, 96, 128}, len(password)):
+		return credparser.STORAGE_WEAK_HASH
+	}
+	return credparser.STORAGE_PLAINTEXT
+}
+
+var storageWeight = map[credparser.PasswordStorage]int{
+	credparser.STORAGE_PLAINTEXT:   WEIGHT_STORAGE,
+	credparser.STORAGE_WEAK_HASH:   WEIGHT_STORAGE * 3 / 5,
+	credparser.STORAGE_STRONG_HASH: WEIGHT_STORAGE / 7,
+}
+
+// the most usable form among passwords (plaintext beats a weak hash beats a strong one)
+func worstStorage(passwords []string) credparser.PasswordStorage {
+	worst := credparser.STORAGE_STRONG_HASH
+	for _, password := range passwords {
+		if storage := Classify(password); storageWeight[storage] > storageWeight[worst] {
+			worst = storage
+		}
+	}
+	return worst
+}
+
+func recencyWeight(leaked, now time.Time) int {
+	age := now.Sub(leaked)
+	switch {
+	case age < 90*24*time.Hour:
+		return WEIGHT_RECENCY
+	case age < 365*24*time.Hour:
+		return WEIGHT_RECENCY * 7 / 10
+	case age < 2*365*24*time.Hour:
+		return WEIGHT_RECENCY / 2
+	case age < 5*365*24*time.Hour:
+		return WEIGHT_RECENCY / 4
+	}
+	return WEIGHT_RECENCY / 10
+}
+
+func sourcesWeight(cnt int) int {
+	return WEIGHT_SOURCES * min(cnt, 3) / 3
+}
+
+func reuseWeight(reuse int) int {
+	switch {
+	case reuse <= 0:
+		return 0
+	case reuse == 1:
+		return WEIGHT_REUSE / 2
+	case reuse < 5:
+		return WEIGHT_REUSE * 7 / 10
+	}
+	return WEIGHT_REUSE
+}
+
+func levelFor(score int) credparser.SeverityLevel {
+	switch {
+	case score >= 75:
+		return credparser.SEVERITY_CRITICAL
+	case score >= 50:
+		return credparser.SEVERITY_HIGH
+	case score >= 25:
+		return credparser.SEVERITY_MEDIUM
+	}
+	return credparser.SEVERITY_LOW
+}
+
+// when a password leaked: its source's breach date if known, otherwise when we first saw it
+func leakDate(prov *credparser.Provenance) time.Time {
+	if prov.BreachDate != nil {
+		return *prov.BreachDate
+	}
+	return prov.FirstSeen
+}
+
+// scores cred from its (opened) passwords, provenance and name; reuse is how many other accounts in the
+// domain share one of its passwords, which only a rescore of the whole domain can tell
+func Score(cred *credparser.CredentialInfo, reuse int, now time.Time) *credparser.Severity {
+	cred.AlignProvenance()
+	sev := &credparser.Severity{
+		Storage:    worstStorage(cred.Password),
+		Privileged: nameWeight(cred.User) == WEIGHT_PRIVILEGED,
+		Reuse:      reuse,
+		ScoredAt:   now.UTC(),
+	}
+	if cred.Encrypted || slices.Contains(cred.Password, credparser.REDACTED_PASSWORD) {
+		sev.Storage = credparser.STORAGE_PLAINTEXT // can't tell; assume the worst
+	}
+
+	var seen []string
+	for _, prov := range cred.Provenance {
+		if leaked := leakDate(prov); leaked.After(sev.LatestLeak) {
+			sev.LatestLeak = leaked
+		}
+		// dumps without a source still count separately, by where they came from
+		origin := prov.SourceID
+		if origin == "" {
+			origin = prov.Bucket + "/" + prov.Key + "/" + prov.Filename + "/" + prov.JobID
+		}
+		if !slices.Contains(seen, origin) {
+			seen = append(seen, origin)
+		}
+	}
+	sev.Sources = len(seen)
+
+	sev.Score = storageWeight[sev.Storage] + sourcesWeight(sev.Sources) + nameWeight(cred.User) + reuseWeight(reuse)
+	if !sev.LatestLeak.IsZero() {
+		sev.Score += recencyWeight(sev.LatestLeak, now)
+	}
+	sev.Level = levelFor(sev.Score)
+	return sev
+}
+
+// rescores cred as it's about to be stored, keeping the reuse count from its last score
+func Update(cred *credparser.CredentialInfo, now time.Time) {
+	reuse := 0
+	if cred.Severity != nil {
+		reuse = cred.Severity.Reuse
+	}
+	cred.Severity = Score(cred, reuse, now)
+}
+
+// whether two scores say the same thing (when they were worked out doesn't matter)
+func Same(a, b *credparser.Severity) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if !a.LatestLeak.Equal(b.LatestLeak) {
+		return false
+	}
+	x, y := *a, *b
+	x.ScoredAt, y.ScoredAt = time.Time{}, time.Time{}
+	x.LatestLeak, y.LatestLeak = time.Time{}, time.Time{} // compared above; read back they may differ in location
+	return x == y
+}
@@ -0,0 +1,97 @@
+package severity
+
+import (
+	"testing"
+	"time"
+
+	"github.com/newodahs/readerlambda/pkg/credparser"
+)
+
+func Test_Classify(t *testing.T) {
+	testSet := []struct {
+		Password string
+		Expect   credparser.PasswordStorage
+	}{
+		{Password: "Summer2024!", Expect: credparser.STORAGE_PLAINTEXT},
+		{Password: "135324", Expect: credparser.STORAGE_PLAINTEXT},
+		{Password: "5f4dcc3b5aa765d61d8327deb882cf99", Expect: credparser.STORAGE_WEAK_HASH},          // md5
+		{Password: "5baa61e4c9b93f3f0682250b6cf8331b7ee68fd8", Expect: credparser.STORAGE_WEAK_HASH},  // sha1
+		{Password: "*2470C0C06DEE42FD1618BB99005ADCA2EC9D1E19", Expect: credparser.STORAGE_WEAK_HASH}, // mysql
+		{Password: "{SSHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", Expect: credparser.STORAGE_WEAK_HASH},        // ldap
+		{Password: "$1$O3JMY.Tw$AdLnLjQ/5jXF9.MTp3gHv/", Expect: credparser.STORAGE_WEAK_HASH},        // md5-crypt
+		{Password: "$2y$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy", Expect: credparser.STORAGE_STRONG_HASH},
+		{Password: "$argon2id$v=19$m=65536,t=3,p=4$c2FsdA$aGFzaA", Expect: credparser.STORAGE_STRONG_HASH},
+		{Password: "pbkdf2_sha256$260000$salt$hash=", Expect: credparser.STORAGE_STRONG_HASH},
+	}
+
+	for _, test := range testSet {
+		if got := Classify(test.Password); got != test.Expect {
+			t.Errorf("[%s]: expected %s, got %s", test.Password, test.Expect, got)
+		}
+	}
+}
+
+func Test_Score(t *testing.T) {
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	recent, old := now.AddDate(0, -1, 0), now.AddDate(-6, 0, 0)
+
+	newCred := func(user string, passwords []string, provs ...*credparser.Provenance) *credparser.CredentialInfo {
+		cred := &credparser.CredentialInfo{User: user, Domain: "example.com", Email: user + "@example.com"}
+		for idx, password := range passwords {
+			cred.AddPassword(password, provs[idx])
+		}
+		return cred
+	}
+
+	testSet := []struct {
+		Name        string
+		Cred        *credparser.CredentialInfo
+		Reuse       int
+		ExpectScore int
+		ExpectLevel credparser.SeverityLevel
+		ExpectPriv  bool
+	}{
+		{
+			Name: "Admin Plaintext Recent Reused",
+			Cred: newCred("it-admin", []string{"Summer2024!", "Winter2023"},
+				&credparser.Provenance{SourceID: "a", FirstSeen: old, BreachDate: &recent}, &credparser.Provenance{SourceID: "b", FirstSeen: old}),
+			Reuse:       6,
+			ExpectScore: 35 + 25 + 10 + 15 + 10,
+			ExpectLevel: credparser.SEVERITY_CRITICAL,
+			ExpectPriv:  true,
+		},
+		{
+			Name:        "Person Strong Hash Old",
+			Cred:        newCred("jdoe", []string{"$2b$12$abcdefghijklmnopqrstuuABCDEFGHIJKLMNOPQRSTUVWXYZ01234"}, &credparser.Provenance{SourceID: "a", FirstSeen: old}),
+			ExpectScore: 5 + 2 + 5,
+			ExpectLevel: credparser.SEVERITY_LOW,
+		},
+		{
+			Name:        "Role Mailbox Weak Hash",
+			Cred:        newCred("Info", []string{"5f4dcc3b5aa765d61d8327deb882cf99"}, &credparser.Provenance{Filename: "dump.txt", FirstSeen: recent}),
+			Reuse:       1,
+			ExpectScore: 21 + 25 + 5 + 7 + 5,
+			ExpectLevel: credparser.SEVERITY_HIGH,
+		},
+	}
+
+	for _, test := range testSet {
+		t.Run(test.Name, func(t *testing.T) {
+			sev := Score(test.Cred, test.Reuse, now)
+			if sev.Score != test.ExpectScore || sev.Level != test.ExpectLevel || sev.Privileged != test.ExpectPriv {
+				t.Errorf("expected %d/%s (privileged %t), got %+v", test.ExpectScore, test.ExpectLevel, test.ExpectPriv, sev)
+			}
+		})
+	}
+
+	// storing again keeps the reuse the last rescore found
+	cred := testSet[0].Cred
+	cred.Severity = &credparser.Severity{Reuse: 3}
+	Update(cred, now)
+	if cred.Severity.Reuse != 3 || cred.Severity.Score != 35+25+10+15+7 {
+		t.Errorf("expected the reuse count to be kept, got %+v", cred.Severity)
+	}
+	if !Same(cred.Severity, Score(cred, 3, now.Add(time.Minute))) || Same(cred.Severity, Score(cred, 0, now)) || Same(nil, cred.Severity) {
+		t.Errorf("unexpected Same results")
+	}
+}
@@ -0,0 +1,405 @@
+package sources
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/util"
+)
+
+const (
+	DYNDB_TABLE_SOURCES     = `credentialSources`
+	DYNDB_TABLE_SOURCECREDS = `sourceCredentials`
+)
+
+// suffix of the sidecar manifest that may sit next to a dump in S3 (e.g. dumps/foo.txt + dumps/foo.txt.source.json)
+const MANIFEST_SUFFIX = `.source.json`
+
+// a breach/leak that one or more dumps came from
+type Source struct {
+	ID           string     `json:"id" dynamodbav:"sourceId"`
+	Name         string     `json:"name" dynamodbav:"name"`
+	Description  string     `json:"description,omitempty" dynamodbav:"description,omitempty"`
+	BreachDate   *time.Time `json:"breachDate,omitempty" dynamodbav:"breachDate,omitempty"`
+	AcquiredDate *time.Time `json:"acquiredDate,omitempty" dynamodbav:"acquiredDate,omitempty"`
+	Tags         []string   `json:"tags,omitempty" dynamodbav:"tags,omitempty"`
+	CreatedAt    time.Time  `json:"createdAt" dynamodbav:"createdAt"`
+}
+
+func (s Source) GetAttrDefs() []types.AttributeDefinition {
+	return []types.AttributeDefinition{
+		{
+			AttributeName: aws.String("sourceId"),
+			AttributeType: types.ScalarAttributeTypeS,
+		},
+	}
+}
+
+func (s Source) GetKeySchema() []types.KeySchemaElement {
+	return []types.KeySchemaElement{
+		{
+			AttributeName: aws.String("sourceId"),
+			KeyType:       types.KeyTypeHash,
+		},
+	}
+}
+
+// links a credential (by its table key) to a source so we can query credentials by source without scanning
+type SourceCredential struct {
+	SourceID string    `json:"sourceId" dynamodbav:"sourceId"`
+	CredKey  string    `json:"credKey" dynamodbav:"credKey"` // domainname#username
+	Domain   string    `json:"domain" dynamodbav:"domainname"`
+	User     string    `json:"username" dynamodbav:"username"`
+	LinkedAt time.Time `json:"linkedAt" dynamodbav:"linkedAt"`
+}
+
+func (sc SourceCredential) GetAttrDefs() []types.AttributeDefinition {
+	return []types.AttributeDefinition{
+		{
+			AttributeName: aws.String("sourceId"),
+			AttributeType: types.ScalarAttributeTypeS,
+		},
+		{
+			AttributeName: aws.String("credKey"),
+			AttributeType: types.ScalarAttributeTypeS,
+		},
+	}
+}
+
+func (sc SourceCredential) GetKeySchema() []types.KeySchemaElement {
+	return []types.KeySchemaElement{
+		{
+			AttributeName: aws.String("sourceId"),
+			KeyType:       types.KeyTypeHash,
+		},
+		{
+			AttributeName: aws.String("credKey"),
+			KeyType:       types.KeyTypeRange,
+		},
+	}
+}
+
+var ErrNoSource = errors.New("no source information found")
+
+var slugRegex = regexp.MustCompile(`[^a-z0-9]+`)
+
+// source ids are derived from the name so the same breach arriving in several dumps lands on one record;
+// a name with nothing to slug (punctuation only, another script) gets an id hashed from it instead, which
+// is just as stable
+func Slug(name string) string {
+	slug := strings.Trim(slugRegex.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if slug == "" && strings.TrimSpace(name) != "" {
+		sum := sha256.Sum256([]byte(strings.TrimSpace(name)))
+		slug = "source-" + hex.EncodeToString(sum[:6])
+	}
+	return slug
+}
+
+func ManifestKey(objectKey string) string {
+	return objectKey + MANIFEST_SUFFIX
+}
+
+func IsManifestKey(objectKey string) bool {
+	return strings.HasSuffix(objectKey, MANIFEST_SUFFIX)
+}
+
+// the sidecar manifest format; dates are YYYY-MM-DD (RFC3339 also accepted)
+type manifest struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	Description  string   `json:"description"`
+	BreachDate   string   `json:"breachDate"`
+	AcquiredDate string   `json:"acquiredDate"`
+	Tags         []string `json:"tags"`
+}
+
+func (m manifest) toSource() (*Source, error) {
+	if strings.TrimSpace(m.Name) == "" && strings.TrimSpace(m.ID) == "" {
+		return nil, ErrNoSource
+	}
+
+	ret := &Source{ID: strings.TrimSpace(m.ID), Name: m.Name, Description: m.Description}
+	if ret.ID == "" {
+		ret.ID = Slug(m.Name)
+	}
+	if ret.Name == "" {
+		ret.Name = ret.ID
+	}
+
+	var dateErr error
+	if ret.BreachDate, dateErr = parseDate(m.BreachDate); dateErr != nil {
+		return nil, fmt.Errorf("bad breach date: %w", dateErr)
+	}
+	if ret.AcquiredDate, dateErr = parseDate(m.AcquiredDate); dateErr != nil {
+		return nil, fmt.Errorf("bad acquired date: %w", dateErr)
+	}
+
+	for _, tag := range m.Tags {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			ret.Tags = append(ret.Tags, tag)
+		}
+	}
+
+	return ret, nil
+}
+
+func parseDate(raw string) (*time.Time, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	for _, layout := range []string{time.DateOnly, time.RFC3339} {
+		if parsed, err := time.Parse(layout, raw); err == nil {
+			parsed = parsed.UTC()
+			return &parsed, nil
+		}
+	}
+	return nil, fmt.Errorf("unrecognized date [%s]", raw)
+}
+
+// reads a sidecar manifest (JSON) describing the source of a dump
+func ParseManifest(r io.Reader) (*Source, error) {
+	if r == nil {
+		return nil, credparser.ErrBadParameter
+	}
+
+	var m manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("failed to decode source manifest: %w", err)
+	}
+
+	return m.toSource()
+}
+
+// builds a source from S3 user metadata (x-amz-meta-source-name, -source-id, -source-description,
+// -source-breach-date, -source-acquired-date, -source-tags as a comma list); the SDK hands us the keys
+// without the x-amz-meta- prefix
+//
+// returns ErrNoSource if the object doesn't carry any source metadata
+func FromMetadata(meta map[string]string) (*Source, error) {
+	get := func(name string) string {
+		for k, v := range meta {
+			if strings.EqualFold(k, name) {
+				return strings.TrimSpace(v)
+			}
+		}
+		return ""
+	}
+
+	m := manifest{
+		ID:           get("source-id"),
+		Name:         get("source-name"),
+		Description:  get("source-description"),
+		BreachDate:   get("source-breach-date"),
+		AcquiredDate: get("source-acquired-date"),
+	}
+	if tags := get("source-tags"); tags != "" {
+		m.Tags = strings.Split(tags, ",")
+	}
+
+	return m.toSource()
+}
+
+func Get(ctx context.Context, cli util.DynamoDBAPI, tableName, sourceID string) (*Source, error) {
+	if cli == nil {
+		return nil, errors.New("passed dynamodb client was nil")
+	}
+
+	res, err := cli.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key:       map[string]types.AttributeValue{"sourceId": &types.AttributeValueMemberS{Value: sourceID}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get source [%s]: %s", sourceID, err)
+	}
+	if len(res.Item) == 0 {
+		return nil, nil
+	}
+
+	src := &Source{}
+	if unmarshErr := attributevalue.UnmarshalMap(res.Item, src); unmarshErr != nil {
+		return nil, fmt.Errorf("failed to unmarshal source [%s]: %s", sourceID, unmarshErr)
+	}
+	return src, nil
+}
+
+// stores src; if the source is already known, we only fill in what the stored record is missing
+// (a later dump may only carry a name in its metadata and we don't want to lose the description, etc.)
+//
+// returns the source as stored
+func Save(ctx context.Context, cli util.DynamoDBAPI, tableName string, src *Source) (*Source, error) {
+	if src == nil || src.ID == "" {
+		return nil, credparser.ErrBadParameter
+	}
+
+	existing, getErr := Get(ctx, cli, tableName, src.ID)
+	if getErr != nil {
+		return nil, getErr
+	}
+
+	toStore := src
+	if existing != nil {
+		if existing.Description == "" {
+			existing.Description = src.Description
+		}
+		if existing.BreachDate == nil {
+			existing.BreachDate = src.BreachDate
+		}
+		if existing.AcquiredDate == nil {
+			existing.AcquiredDate = src.AcquiredDate
+		}
+		for _, tag := range src.Tags {
+			found := false
+			for _, have := range existing.Tags {
+				if have == tag {
+					found = true
+					break
+				}
+			}
+			if !found {
+				existing.Tags = append(existing.Tags, tag)
+			}
+		}
+		toStore = existing
+	}
+	if toStore.CreatedAt.IsZero() {
+		toStore.CreatedAt = time.Now().UTC()
+	}
+
+	item, marshErr := attributevalue.MarshalMap(toStore)
+	if marshErr != nil {
+		return nil, fmt.Errorf("failed to marshal source [%s]: %s", src.ID, marshErr)
+	}
+
+	if _, putErr := cli.PutItem(ctx, &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(tableName),
+	}); putErr != nil {
+		return nil, fmt.Errorf("failed to store source [%s]: %s", src.ID, putErr)
+	}
+
+	return toStore, nil
+}
+
+// the source catalog is small; scanning it is fine
+func List(ctx context.Context, cli util.DynamoDBAPI, tableName string) ([]*Source, error) {
+	if cli == nil {
+		return nil, errors.New("passed dynamodb client was nil")
+	}
+
+	var ret []*Source
+	paginator := dynamodb.NewScanPaginator(cli, &dynamodb.ScanInput{TableName: aws.String(tableName)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan sources: %s", err)
+		}
+
+		var pageSrcs []*Source
+		if unmarshErr := attributevalue.UnmarshalListOfMaps(page.Items, &pageSrcs); unmarshErr != nil {
+			return nil, fmt.Errorf("failed to unmarshal sources: %s", unmarshErr)
+		}
+		ret = append(ret, pageSrcs...)
+	}
+
+	return ret, nil
+}
+
+func CredKey(domain, user string) string {
+	return domain + "#" + user
+}
+
+// records that cred appeared in sourceID
+func Link(ctx context.Context, cli util.DynamoDBAPI, tableName, sourceID string, cred *credparser.CredentialInfo) error {
+	if cli == nil {
+		return errors.New("passed dynamodb client was nil")
+	}
+	if sourceID == "" || cred == nil {
+		return credparser.ErrBadParameter
+	}
+
+	item, marshErr := attributevalue.MarshalMap(SourceCredential{
+		SourceID: sourceID,
+		CredKey:  CredKey(cred.Domain, cred.User),
+		Domain:   cred.Domain,
+		User:     cred.User,
+		LinkedAt: time.Now().UTC(),
+	})
+	if marshErr != nil {
+		return fmt.Errorf("failed to marshal source link: %s", marshErr)
+	}
+
+	if _, putErr := cli.PutItem(ctx, &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(tableName),
+	}); putErr != nil {
+		return fmt.Errorf("failed to link [%s] to source [%s]: %s", cred.Email, sourceID, putErr)
+	}
+	return nil
+}
+
+// removes the link between sourceID and the credential stored under domain/user (if there is one)
+func Unlink(ctx context.Context, cli util.DynamoDBAPI, tableName, sourceID, domain, user string) error {
+	if cli == nil {
+		return errors.New("passed dynamodb client was nil")
+	}
+
+	if _, err := cli.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"sourceId": &types.AttributeValueMemberS{Value: sourceID},
+			"credKey":  &types.AttributeValueMemberS{Value: CredKey(domain, user)},
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to unlink [%s@%s] from source [%s]: %s", user, domain, sourceID, err)
+	}
+	return nil
+}
+
+// returns the credential keys linked to sourceID
+func ListLinks(ctx context.Context, cli util.DynamoDBAPI, tableName, sourceID string) ([]*SourceCredential, error) {
+	if cli == nil {
+		return nil, errors.New("passed dynamodb client was nil")
+	}
+
+	expr, exprErr := expression.NewBuilder().WithKeyCondition(expression.Key("sourceId").Equal(expression.Value(sourceID))).Build()
+	if exprErr != nil {
+		return nil, fmt.Errorf("failed to build query expression: %s", exprErr)
+	}
+
+	var ret []*SourceCredential
+	paginator := dynamodb.NewQueryPaginator(cli, &dynamodb.QueryInput{
+		TableName:                 aws.String(tableName),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query source links for [%s]: %s", sourceID, err)
+		}
+
+		var pageLinks []*SourceCredential
+		if unmarshErr := attributevalue.UnmarshalListOfMaps(page.Items, &pageLinks); unmarshErr != nil {
+			return nil, fmt.Errorf("failed to unmarshal source links: %s", unmarshErr)
+		}
+		ret = append(ret, pageLinks...)
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,90 @@
+package sources
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Sources_Resolve(t *testing.T) {
+	testSet := []struct {
+		Name       string
+		Manifest   string
+		Metadata   map[string]string
+		ExpectID   string
+		ExpectTags []string
+		ExpectDate string
+		ExpectErr  bool
+	}{
+		{
+			Name:       "Manifest With Dates",
+			Manifest:   `{"name":"Acme Corp 2023 Leak","description":"forum dump","breachDate":"2023-06-01","acquiredDate":"2024-02-10T00:00:00Z","tags":["forum"," combo "]}`,
+			ExpectID:   "acme-corp-2023-leak",
+			ExpectTags: []string{"forum", "combo"},
+			ExpectDate: "2023-06-01",
+		},
+		{
+			Name:      "Manifest Bad Date",
+			Manifest:  `{"name":"bad","breachDate":"last tuesday"}`,
+			ExpectErr: true,
+		},
+		{
+			Name:       "Metadata",
+			Metadata:   map[string]string{"Source-Name": "Some Breach", "source-id": "custom-id", "source-tags": "a,b", "source-breach-date": "2022-01-31"},
+			ExpectID:   "custom-id",
+			ExpectTags: []string{"a", "b"},
+			ExpectDate: "2022-01-31",
+		},
+		{
+			Name:       "Name Without Slug",
+			Manifest:   `{"name":"Утечка","breachDate":"2023-01-01"}`,
+			ExpectID:   Slug("Утечка"),
+			ExpectDate: "2023-01-01",
+		},
+		{
+			Name:      "Blank Name",
+			Manifest:  `{"name":"  ","id":" "}`,
+			ExpectErr: true,
+		},
+		{
+			Name:      "Metadata Without Source",
+			Metadata:  map[string]string{"unrelated": "value"},
+			ExpectErr: true,
+		},
+	}
+	if id := Slug("Утечка"); !strings.HasPrefix(id, "source-") || len(id) != len("source-")+12 || Slug("!!!") == Slug("???") {
+		t.Errorf("expected names without a slug to get a hashed id, got [%s]", id)
+	}
+
+	for _, curTest := range testSet {
+		t.Run(curTest.Name, func(t *testing.T) {
+			var src *Source
+			var err error
+			if curTest.Manifest != "" {
+				src, err = ParseManifest(strings.NewReader(curTest.Manifest))
+			} else {
+				src, err = FromMetadata(curTest.Metadata)
+			}
+
+			if curTest.ExpectErr {
+				if err == nil {
+					t.Fatalf("expected an error, got source %+v", src)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if src.ID != curTest.ExpectID {
+				t.Errorf("source id [%s] does not match expected [%s]", src.ID, curTest.ExpectID)
+			}
+			if strings.Join(src.Tags, ",") != strings.Join(curTest.ExpectTags, ",") {
+				t.Errorf("source tags %v do not match expected %v", src.Tags, curTest.ExpectTags)
+			}
+			if src.BreachDate == nil || src.BreachDate.Format(time.DateOnly) != curTest.ExpectDate {
+				t.Errorf("breach date %v does not match expected %s", src.BreachDate, curTest.ExpectDate)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package tenants
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// which tenant (a customer or business unit) each email domain belongs to. tenants only exist in the
+// configuration; the tables have no notion of them. a domain belongs to at most one tenant, and subdomains
+// go with their parent unless they're listed themselves
+type Directory struct {
+	byDomain map[string]string   // lowercased domain => tenant
+	domains  map[string][]string // tenant => its domains, sorted
+}
+
+// reads "acme=acme.com|acme.co.uk,globex=globex.com" (tenant=domains, | between domains); nil (and no
+// error) if there are none
+func Parse(raw string) (*Directory, error) {
+	dir := &Directory{byDomain: map[string]string{}, domains: map[string][]string{}}
+
+	var errs []error
+	for _, pair := range strings.Split(raw, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		tenant, domains, found := strings.Cut(pair, "=")
+		tenant = strings.TrimSpace(tenant)
+		if !found || tenant == "" {
+			errs = append(errs, fmt.Errorf("tenant [%s] must be tenant=domain|domain...", pair))
+			continue
+		}
+
+		for _, domain := range strings.Split(domains, "|") {
+			if domain = strings.ToLower(strings.TrimSpace(domain)); domain == "" {
+				continue
+			}
+			if owner, taken := dir.byDomain[domain]; taken && owner != tenant {
+				errs = append(errs, fmt.Errorf("domain [%s] is in both tenant [%s] and [%s]", domain, owner, tenant))
+				continue
+			}
+			dir.byDomain[domain] = tenant
+			dir.domains[tenant] = append(dir.domains[tenant], domain)
+		}
+		if len(dir.domains[tenant]) == 0 {
+			errs = append(errs, fmt.Errorf("tenant [%s] has no domains", tenant))
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	if len(dir.domains) == 0 {
+		return nil, nil
+	}
+	for _, domains := range dir.domains {
+		sort.Strings(domains)
+	}
+	return dir, nil
+}
+
+// the tenant domain belongs to (by itself or its closest listed parent); empty if none. nil-safe
+func (d *Directory) Of(domain string) string {
+	if d == nil {
+		return ""
+	}
+	for domain = strings.ToLower(strings.TrimSpace(domain)); domain != ""; {
+		if tenant, found := d.byDomain[domain]; found {
+			return tenant
+		}
+		_, parent, found := strings.Cut(domain, ".")
+		if !found {
+			break
+		}
+		domain = parent
+	}
+	return ""
+}
+
+// whether tenant is configured at all
+func (d *Directory) Has(tenant string) bool {
+	return d != nil && len(d.domains[tenant]) > 0
+}
+
+// tenant's domains, sorted
+func (d *Directory) Domains(tenant string) []string {
+	if d == nil {
+		return nil
+	}
+	return d.domains[tenant]
+}
+
+// every tenant, sorted
+func (d *Directory) Names() []string {
+	if d == nil {
+		return nil
+	}
+	ret := make([]string, 0, len(d.domains))
+	for tenant := range d.domains {
+		ret = append(ret, tenant)
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,50 @@
+package tenants
+
+import (
+	"slices"
+	"testing"
+)
+
+func Test_Directory(t *testing.T) {
+	dir, err := Parse(" acme = Acme.com|acme.co.uk , globex=globex.com|eu.acme.com,,")
+	if err != nil || dir == nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	for domain, expect := range map[string]string{
+		"acme.com":         "acme",
+		"ACME.co.uk":       "acme",
+		"mail.acme.com":    "acme",   // a subdomain goes with its parent
+		"eu.acme.com":      "globex", // unless it's listed itself
+		"mail.eu.acme.com": "globex",
+		"globex.com":       "globex",
+		"notacme.com":      "",
+		"com":              "",
+		"example.org":      "",
+		"":                 "",
+	} {
+		if got := dir.Of(domain); got != expect {
+			t.Errorf("expected [%s] for [%s], got [%s]", expect, domain, got)
+		}
+	}
+
+	if !slices.Equal(dir.Names(), []string{"acme", "globex"}) || !slices.Equal(dir.Domains("acme"), []string{"acme.co.uk", "acme.com"}) {
+		t.Errorf("unexpected tenants %v / %v", dir.Names(), dir.Domains("acme"))
+	}
+	if !dir.Has("acme") || dir.Has("initech") {
+		t.Errorf("unexpected Has")
+	}
+
+	if none, err := Parse(" , "); none != nil || err != nil {
+		t.Errorf("expected no directory, got %v (%v)", none, err)
+	}
+	if (*Directory)(nil).Of("acme.com") != "" || (*Directory)(nil).Has("acme") {
+		t.Errorf("expected a nil directory to have no tenants")
+	}
+
+	for _, bad := range []string{"acme.com", "=acme.com", "acme=", "acme=a.com,globex=A.com"} {
+		if _, err := Parse(bad); err == nil {
+			t.Errorf("expected [%s] to be refused", bad)
+		}
+	}
+}
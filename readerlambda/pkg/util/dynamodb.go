@@ -4,19 +4,192 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log"
+	"sort"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
+// the dynamodb calls we make; satisfied by *dynamodb.Client and by awsfake.DynamoDB for tests/local runs
+type DynamoDBAPI interface {
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+	Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+	Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error)
+	BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error)
+	DescribeTable(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error)
+	CreateTable(ctx context.Context, params *dynamodb.CreateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error)
+	UpdateTable(ctx context.Context, params *dynamodb.UpdateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTableOutput, error)
+	UpdateTimeToLive(ctx context.Context, params *dynamodb.UpdateTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTimeToLiveOutput, error)
+	UpdateContinuousBackups(ctx context.Context, params *dynamodb.UpdateContinuousBackupsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateContinuousBackupsOutput, error)
+	DescribeTimeToLive(ctx context.Context, params *dynamodb.DescribeTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTimeToLiveOutput, error)
+	DescribeContinuousBackups(ctx context.Context, params *dynamodb.DescribeContinuousBackupsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeContinuousBackupsOutput, error)
+}
+
 type DymamoSchema interface {
 	GetAttrDefs() []types.AttributeDefinition
 	GetKeySchema() []types.KeySchemaElement
 }
 
-// checks that tableName exists in our dynamodb instance; sets it up if it does not
-func EnsureDynamoDBTable(ctx context.Context, cli *dynamodb.Client, tableName string, schemaDef DymamoSchema) error {
+const (
+	DEFAULT_READ_CAPACITY  = 10
+	DEFAULT_WRITE_CAPACITY = 10
+	DEFAULT_TABLE_WAIT     = 2 * time.Minute
+	DEFAULT_TABLE_POLL     = 2 * time.Second
+)
+
+// how a table is created when EnsureDynamoDBTable doesn't find it; of this only missing indexes, TTL and
+// point-in-time recovery are applied to a table that already exists (they're only ever turned on). the JSON fields are the account-wide bits that can come from the config file, the rest
+// are per table and set in code
+type TableOptions struct {
+	OnDemand      bool  `json:"onDemand,omitempty"` // pay per request instead of provisioned throughput
+	ReadCapacity  int64 `json:"readCapacity,omitempty"`
+	WriteCapacity int64 `json:"writeCapacity,omitempty"`
+
+	// server side encryption with a KMS key (the AWS managed one unless a key is given); off means
+	// dynamodb's default encryption with an AWS owned key
+	SSE         bool   `json:"sse,omitempty"`
+	SSEKMSKeyID string `json:"sseKmsKeyId,omitempty"`
+
+	PointInTimeRecovery bool              `json:"pointInTimeRecovery,omitempty"`
+	Tags                map[string]string `json:"tags,omitempty"`
+
+	// global secondary indexes and the definitions of any key attributes they use that the table's own
+	// key doesn't; provisioned indexes get the table's throughput if they don't set their own
+	Indexes       []types.GlobalSecondaryIndex `json:"-"`
+	IndexAttrDefs []types.AttributeDefinition  `json:"-"`
+	TTLAttribute  string                       `json:"-"` // epoch seconds attribute dynamodb expires items by
+	Wait          time.Duration                `json:"-"` // how long to wait for the table to become ACTIVE
+	Poll          time.Duration                `json:"-"` // how often to check while waiting
+}
+
+// the original behaviour: 10/10 provisioned throughput, nothing else
+func DefaultTableOptions() *TableOptions {
+	return &TableOptions{ReadCapacity: DEFAULT_READ_CAPACITY, WriteCapacity: DEFAULT_WRITE_CAPACITY}
+}
+
+// a copy of opts (the defaults if nil) with the given per table settings; handy for sharing one set of
+// account-wide options across tables
+func (opts *TableOptions) WithIndexes(indexes []types.GlobalSecondaryIndex, attrDefs ...types.AttributeDefinition) *TableOptions {
+	ret := opts.clone()
+	ret.Indexes = indexes
+	ret.IndexAttrDefs = attrDefs
+	return ret
+}
+
+func (opts *TableOptions) WithTTL(attribute string) *TableOptions {
+	ret := opts.clone()
+	ret.TTLAttribute = attribute
+	return ret
+}
+
+func (opts *TableOptions) clone() *TableOptions {
+	if opts == nil {
+		return DefaultTableOptions()
+	}
+	ret := *opts
+	return &ret
+}
+
+func (opts *TableOptions) Validate() error {
+	if opts == nil {
+		return nil
+	}
+	if opts.ReadCapacity < 0 || opts.WriteCapacity < 0 {
+		return errors.New("table read/write capacity can't be negative")
+	}
+	if opts.OnDemand && (opts.ReadCapacity > 0 || opts.WriteCapacity > 0) {
+		return errors.New("table read/write capacity doesn't apply to on-demand tables")
+	}
+	if opts.SSEKMSKeyID != "" && !opts.SSE {
+		return errors.New("a table SSE KMS key was given without enabling SSE")
+	}
+	return nil
+}
+
+func (opts *TableOptions) createInput(tableName string, schemaDef DymamoSchema) *dynamodb.CreateTableInput {
+	input := &dynamodb.CreateTableInput{
+		AttributeDefinitions: mergeAttrDefs(schemaDef.GetAttrDefs(), opts.IndexAttrDefs),
+		KeySchema:            schemaDef.GetKeySchema(),
+		TableName:            aws.String(tableName),
+	}
+
+	var throughput *types.ProvisionedThroughput
+	if opts.OnDemand {
+		input.BillingMode = types.BillingModePayPerRequest
+	} else {
+		read, write := opts.ReadCapacity, opts.WriteCapacity
+		if read == 0 {
+			read = DEFAULT_READ_CAPACITY
+		}
+		if write == 0 {
+			write = DEFAULT_WRITE_CAPACITY
+		}
+		throughput = &types.ProvisionedThroughput{ReadCapacityUnits: aws.Int64(read), WriteCapacityUnits: aws.Int64(write)}
+		input.BillingMode = types.BillingModeProvisioned
+		input.ProvisionedThroughput = throughput
+	}
+
+	for _, gsi := range opts.Indexes {
+		if gsi.Projection == nil {
+			gsi.Projection = &types.Projection{ProjectionType: types.ProjectionTypeAll}
+		}
+		if throughput != nil && gsi.ProvisionedThroughput == nil {
+			gsi.ProvisionedThroughput = throughput
+		}
+		input.GlobalSecondaryIndexes = append(input.GlobalSecondaryIndexes, gsi)
+	}
+
+	if opts.SSE {
+		input.SSESpecification = &types.SSESpecification{Enabled: aws.Bool(true), SSEType: types.SSETypeKms}
+		if opts.SSEKMSKeyID != "" {
+			input.SSESpecification.KMSMasterKeyId = aws.String(opts.SSEKMSKeyID)
+		}
+	}
+
+	// sorted so the request is the same every time
+	keys := make([]string, 0, len(opts.Tags))
+	for key := range opts.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		input.Tags = append(input.Tags, types.Tag{Key: aws.String(key), Value: aws.String(opts.Tags[key])})
+	}
+
+	return input
+}
+
+// schema attributes first; index attributes only if the schema doesn't already define them
+func mergeAttrDefs(schema, extra []types.AttributeDefinition) []types.AttributeDefinition {
+	ret := append([]types.AttributeDefinition{}, schema...)
+	for _, def := range extra {
+		dup := false
+		for _, have := range ret {
+			if aws.ToString(have.AttributeName) == aws.ToString(def.AttributeName) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			ret = append(ret, def)
+		}
+	}
+	return ret
+}
+
+// checks that tableName exists in our dynamodb instance; sets it up (per opts; nil for the defaults) if it
+// does not and waits until it's ACTIVE either way, so the caller can use it straight away
+//
+// several lambdas starting at once will all try to create a missing table; whoever loses the race just
+// waits for the winner's table. the TTL/point-in-time recovery settings are checked every time, so a table
+// made before they were asked for gets them too, and failing to check or turn them on is an error whether
+// the table is new or not
+func EnsureDynamoDBTable(ctx context.Context, cli DynamoDBAPI, tableName string, schemaDef DymamoSchema, opts *TableOptions) error {
 	if cli == nil {
 		return errors.New("passed dynamodb client was nil")
 	}
@@ -25,29 +198,164 @@ func EnsureDynamoDBTable(ctx context.Context, cli *dynamodb.Client, tableName st
 		return errors.New("nil schema definition passed")
 	}
 
+	if opts == nil {
+		opts = DefaultTableOptions()
+	}
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
 	// look for the table in the dynamodb instance
-	if _, err := cli.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+	desc, err := cli.DescribeTable(ctx, &dynamodb.DescribeTableInput{
 		TableName: aws.String(tableName),
-	}); err != nil {
-		var notFoundEx *types.ResourceNotFoundException
-		if errors.As(err, &notFoundEx) {
-			// not found, create it
-			if _, createErr := cli.CreateTable(ctx, &dynamodb.CreateTableInput{
-				AttributeDefinitions: schemaDef.GetAttrDefs(),
-				KeySchema:            schemaDef.GetKeySchema(),
-				TableName:            aws.String(tableName),
-				ProvisionedThroughput: &types.ProvisionedThroughput{
-					ReadCapacityUnits:  aws.Int64(10),
-					WriteCapacityUnits: aws.Int64(10),
+	})
+	if err == nil {
+		if desc.Table == nil || desc.Table.TableStatus != types.TableStatusActive {
+			// still being created (or updated) by someone else
+			if err := waitForTable(ctx, cli, tableName, opts); err != nil {
+				return err
+			}
+		}
+		addIndexes(ctx, cli, tableName, desc.Table, schemaDef, opts)
+		return applySettings(ctx, cli, tableName, opts)
+	}
+
+	var notFoundEx *types.ResourceNotFoundException
+	if !errors.As(err, &notFoundEx) {
+		// something else bad happened
+		return fmt.Errorf("failed to validate table [%s] exists in dynamodb: %s", tableName, err)
+	}
+
+	// not found, create it
+	if _, createErr := cli.CreateTable(ctx, opts.createInput(tableName, schemaDef)); createErr != nil {
+		var inUseEx *types.ResourceInUseException
+		if errors.As(createErr, &inUseEx) {
+			// someone beat us to it
+			if err := waitForTable(ctx, cli, tableName, opts); err != nil {
+				return err
+			}
+			return applySettings(ctx, cli, tableName, opts)
+		}
+		return fmt.Errorf("failed to create dynamodb table: %s", createErr)
+	}
+
+	if err := waitForTable(ctx, cli, tableName, opts); err != nil {
+		return err
+	}
+	return applySettings(ctx, cli, tableName, opts)
+}
+
+// turns on TTL and point-in-time recovery per opts if they aren't already; these can only be set once the
+// table exists. neither is ever turned off here, and a table already expiring items by some other attribute
+// is left alone with a warning (dynamodb only allows one, and changing it is a decision for a person)
+func applySettings(ctx context.Context, cli DynamoDBAPI, tableName string, opts *TableOptions) error {
+	if opts.TTLAttribute != "" {
+		ttl, descErr := cli.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: aws.String(tableName)})
+		if descErr != nil {
+			return fmt.Errorf("failed to check TTL on table [%s]: %s", tableName, descErr)
+		}
+
+		var status types.TimeToLiveStatus
+		var attr string
+		if ttl.TimeToLiveDescription != nil {
+			status, attr = ttl.TimeToLiveDescription.TimeToLiveStatus, aws.ToString(ttl.TimeToLiveDescription.AttributeName)
+		}
+		switch {
+		case (status == types.TimeToLiveStatusEnabled || status == types.TimeToLiveStatusEnabling) && attr == opts.TTLAttribute:
+		case status == types.TimeToLiveStatusEnabled || status == types.TimeToLiveStatusEnabling:
+			log.Printf("WARNING: table [%s] expires items by [%s], not [%s]; leaving it alone", tableName, attr, opts.TTLAttribute)
+		case status == types.TimeToLiveStatusDisabling:
+			log.Printf("WARNING: TTL on table [%s] is still being turned off; it'll be turned on by a later ensure", tableName)
+		default:
+			if _, ttlErr := cli.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+				TableName: aws.String(tableName),
+				TimeToLiveSpecification: &types.TimeToLiveSpecification{
+					AttributeName: aws.String(opts.TTLAttribute),
+					Enabled:       aws.Bool(true),
 				},
-			}); createErr != nil {
-				return fmt.Errorf("failed to create dynamodb table: %s", createErr)
+			}); ttlErr != nil {
+				return fmt.Errorf("failed to enable TTL on table [%s]: %s", tableName, ttlErr)
 			}
+			log.Printf("enabled TTL on table [%s] by [%s]", tableName, opts.TTLAttribute)
+		}
+	}
+
+	if opts.PointInTimeRecovery {
+		backups, descErr := cli.DescribeContinuousBackups(ctx, &dynamodb.DescribeContinuousBackupsInput{TableName: aws.String(tableName)})
+		if descErr != nil {
+			return fmt.Errorf("failed to check point-in-time recovery on table [%s]: %s", tableName, descErr)
+		}
+		if desc := backups.ContinuousBackupsDescription; desc == nil || desc.PointInTimeRecoveryDescription == nil ||
+			desc.PointInTimeRecoveryDescription.PointInTimeRecoveryStatus != types.PointInTimeRecoveryStatusEnabled {
+			if _, pitrErr := cli.UpdateContinuousBackups(ctx, &dynamodb.UpdateContinuousBackupsInput{
+				TableName: aws.String(tableName),
+				PointInTimeRecoverySpecification: &types.PointInTimeRecoverySpecification{
+					PointInTimeRecoveryEnabled: aws.Bool(true),
+				},
+			}); pitrErr != nil {
+				return fmt.Errorf("failed to enable point-in-time recovery on table [%s]: %s", tableName, pitrErr)
+			}
+			log.Printf("enabled point-in-time recovery on table [%s]", tableName)
+		}
+	}
+
+	return nil
+}
+
+// creates the indexes in opts that a table made before them doesn't have. dynamodb backfills them in the
+// background (queries on one fail until it's ACTIVE) and only builds one at a time, so any others are left
+// for a later ensure; failures are only logged, as the table itself is fine
+func addIndexes(ctx context.Context, cli DynamoDBAPI, tableName string, desc *types.TableDescription, schemaDef DymamoSchema, opts *TableOptions) {
+	if desc == nil {
+		return
+	}
+	have := map[string]bool{}
+	for _, gsi := range desc.GlobalSecondaryIndexes {
+		have[aws.ToString(gsi.IndexName)] = true
+		if gsi.IndexStatus == types.IndexStatusCreating {
+			return // one's already building
+		}
+	}
+
+	create := opts.createInput(tableName, schemaDef)
+	for _, gsi := range create.GlobalSecondaryIndexes {
+		if have[aws.ToString(gsi.IndexName)] {
+			continue
+		}
+		update := &types.CreateGlobalSecondaryIndexAction{
+			IndexName:             gsi.IndexName,
+			KeySchema:             gsi.KeySchema,
+			Projection:            gsi.Projection,
+			ProvisionedThroughput: gsi.ProvisionedThroughput,
+		}
+		if _, err := cli.UpdateTable(ctx, &dynamodb.UpdateTableInput{
+			TableName:                   aws.String(tableName),
+			AttributeDefinitions:        create.AttributeDefinitions,
+			GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{{Create: update}},
+		}); err != nil {
+			log.Printf("WARNING: failed to add index [%s] to table [%s]: %s", aws.ToString(gsi.IndexName), tableName, err)
 		} else {
-			// something else bad happened
-			return fmt.Errorf("failed to validate table [%s] exists in dynamodb: %s", tableName, err)
+			log.Printf("adding index [%s] to table [%s]; dynamodb builds it in the background", aws.ToString(gsi.IndexName), tableName)
 		}
+		return
 	}
+}
 
+func waitForTable(ctx context.Context, cli DynamoDBAPI, tableName string, opts *TableOptions) error {
+	maxWait, poll := opts.Wait, opts.Poll
+	if maxWait <= 0 {
+		maxWait = DEFAULT_TABLE_WAIT
+	}
+	if poll <= 0 {
+		poll = DEFAULT_TABLE_POLL
+	}
+
+	waiter := dynamodb.NewTableExistsWaiter(cli, func(o *dynamodb.TableExistsWaiterOptions) {
+		o.MinDelay = poll
+		o.MaxDelay = max(poll, 4*poll)
+	})
+	if err := waiter.Wait(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(tableName)}, maxWait); err != nil {
+		return fmt.Errorf("table [%s] didn't become active: %s", tableName, err)
+	}
 	return nil
 }
@@ -0,0 +1,243 @@
+package util_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/newodahs/readerlambda/pkg/awsfake"
+	"github.com/newodahs/readerlambda/pkg/jobs"
+	"github.com/newodahs/readerlambda/pkg/util"
+)
+
+func describe(t *testing.T, cli *awsfake.DynamoDB, tableName string) *types.TableDescription {
+	t.Helper()
+
+	out, err := cli.DescribeTable(context.Background(), &dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+	if err != nil {
+		t.Fatalf("failed to describe [%s]: %s", tableName, err)
+	}
+	return out.Table
+}
+
+func Test_EnsureDynamoDBTable_Defaults(t *testing.T) {
+	cli := awsfake.NewDynamoDB()
+	ctx := context.Background()
+
+	if err := util.EnsureDynamoDBTable(ctx, cli, "jobsTest", jobs.Job{}, nil); err != nil {
+		t.Fatalf("failed to ensure table: %s", err)
+	}
+	// already there; nothing to do
+	if err := util.EnsureDynamoDBTable(ctx, cli, "jobsTest", jobs.Job{}, nil); err != nil {
+		t.Fatalf("failed to ensure existing table: %s", err)
+	}
+
+	desc := describe(t, cli, "jobsTest")
+	if desc.BillingModeSummary == nil || desc.BillingModeSummary.BillingMode != types.BillingModeProvisioned {
+		t.Errorf("expected a provisioned table, got %+v", desc.BillingModeSummary)
+	}
+	if desc.ProvisionedThroughput == nil || aws.ToInt64(desc.ProvisionedThroughput.ReadCapacityUnits) != util.DEFAULT_READ_CAPACITY ||
+		aws.ToInt64(desc.ProvisionedThroughput.WriteCapacityUnits) != util.DEFAULT_WRITE_CAPACITY {
+		t.Errorf("unexpected throughput: %+v", desc.ProvisionedThroughput)
+	}
+	if ttl, pitr, _ := cli.TableSettings("jobsTest"); ttl != "" || pitr {
+		t.Errorf("expected no TTL/PITR, got [%s]/%v", ttl, pitr)
+	}
+}
+
+func Test_EnsureDynamoDBTable_Options(t *testing.T) {
+	cli := awsfake.NewDynamoDB()
+
+	opts := (&util.TableOptions{
+		OnDemand:            true,
+		SSE:                 true,
+		SSEKMSKeyID:         "alias/creds",
+		PointInTimeRecovery: true,
+		Tags:                map[string]string{"project": "creds", "env": "test"},
+	}).WithIndexes([]types.GlobalSecondaryIndex{{
+		IndexName: aws.String("byStatus"),
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("status"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("jobId"), KeyType: types.KeyTypeRange},
+		},
+	}}, types.AttributeDefinition{AttributeName: aws.String("status"), AttributeType: types.ScalarAttributeTypeS},
+		types.AttributeDefinition{AttributeName: aws.String("jobId"), AttributeType: types.ScalarAttributeTypeS}, // already in the schema
+	).WithTTL("expiresAt")
+
+	if err := util.EnsureDynamoDBTable(context.Background(), cli, "jobsTest", jobs.Job{}, opts); err != nil {
+		t.Fatalf("failed to ensure table: %s", err)
+	}
+
+	desc := describe(t, cli, "jobsTest")
+	if desc.BillingModeSummary == nil || desc.BillingModeSummary.BillingMode != types.BillingModePayPerRequest || desc.ProvisionedThroughput != nil {
+		t.Errorf("expected an on-demand table, got %+v/%+v", desc.BillingModeSummary, desc.ProvisionedThroughput)
+	}
+	if len(desc.GlobalSecondaryIndexes) != 1 || aws.ToString(desc.GlobalSecondaryIndexes[0].IndexName) != "byStatus" ||
+		desc.GlobalSecondaryIndexes[0].Projection == nil || desc.GlobalSecondaryIndexes[0].Projection.ProjectionType != types.ProjectionTypeAll {
+		t.Errorf("unexpected indexes: %+v", desc.GlobalSecondaryIndexes)
+	}
+	if len(desc.AttributeDefinitions) != len(jobs.Job{}.GetAttrDefs())+1 {
+		t.Errorf("expected index attributes merged into the schema's, got %d definitions", len(desc.AttributeDefinitions))
+	}
+	if desc.SSEDescription == nil || desc.SSEDescription.Status != types.SSEStatusEnabled || aws.ToString(desc.SSEDescription.KMSMasterKeyArn) != "alias/creds" {
+		t.Errorf("unexpected SSE: %+v", desc.SSEDescription)
+	}
+
+	ttl, pitr, tags := cli.TableSettings("jobsTest")
+	if ttl != "expiresAt" || !pitr {
+		t.Errorf("expected TTL on expiresAt and PITR, got [%s]/%v", ttl, pitr)
+	}
+	if len(tags) != 2 || tags["project"] != "creds" || tags["env"] != "test" {
+		t.Errorf("unexpected tags: %v", tags)
+	}
+
+	// WithIndexes/WithTTL copy, so shared options aren't touched
+	shared := &util.TableOptions{OnDemand: true}
+	if perTable := shared.WithTTL("expiresAt"); shared.TTLAttribute != "" || !perTable.OnDemand {
+		t.Errorf("unexpected options: %+v/%+v", shared, perTable)
+	}
+}
+
+// a table made before TTL/PITR were asked for picks them up on a later ensure
+func Test_EnsureDynamoDBTable_ReconcilesSettings(t *testing.T) {
+	cli := awsfake.NewDynamoDB()
+	ctx := context.Background()
+
+	if err := util.EnsureDynamoDBTable(ctx, cli, "jobsTest", jobs.Job{}, nil); err != nil {
+		t.Fatalf("failed to ensure table: %s", err)
+	}
+
+	opts := (&util.TableOptions{PointInTimeRecovery: true}).WithTTL("expiresAt")
+	for i := 0; i < 2; i++ { // the second time there's nothing left to do
+		if err := util.EnsureDynamoDBTable(ctx, cli, "jobsTest", jobs.Job{}, opts); err != nil {
+			t.Fatalf("failed to ensure existing table (pass %d): %s", i, err)
+		}
+		if ttl, pitr, _ := cli.TableSettings("jobsTest"); ttl != "expiresAt" || !pitr {
+			t.Errorf("expected TTL on expiresAt and PITR (pass %d), got [%s]/%v", i, ttl, pitr)
+		}
+	}
+
+	// expiring by something else is left as it is (and isn't fatal; the table is usable)
+	if err := util.EnsureDynamoDBTable(ctx, cli, "jobsTest", jobs.Job{}, opts.WithTTL("purgeAt")); err != nil {
+		t.Fatalf("failed to ensure table with another TTL attribute: %s", err)
+	}
+	if ttl, _, _ := cli.TableSettings("jobsTest"); ttl != "expiresAt" {
+		t.Errorf("expected TTL left on expiresAt, got [%s]", ttl)
+	}
+}
+
+// a dynamodb that won't change backups, e.g. for want of dynamodb:UpdateContinuousBackups
+type noBackupsDynamoDB struct {
+	*awsfake.DynamoDB
+}
+
+func (f noBackupsDynamoDB) UpdateContinuousBackups(ctx context.Context, params *dynamodb.UpdateContinuousBackupsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateContinuousBackupsOutput, error) {
+	return nil, errors.New("access denied")
+}
+
+// failing to turn a setting on is an error for an existing table just as it is for a new one
+func Test_EnsureDynamoDBTable_SettingsFailure(t *testing.T) {
+	cli := awsfake.NewDynamoDB()
+	ctx := context.Background()
+	opts := &util.TableOptions{PointInTimeRecovery: true}
+
+	if err := util.EnsureDynamoDBTable(ctx, noBackupsDynamoDB{cli}, "newTest", jobs.Job{}, opts); err == nil || !strings.Contains(err.Error(), "point-in-time recovery") {
+		t.Errorf("expected new table to fail turning on PITR, got %v", err)
+	}
+
+	if err := util.EnsureDynamoDBTable(ctx, cli, "existingTest", jobs.Job{}, nil); err != nil {
+		t.Fatalf("failed to ensure table: %s", err)
+	}
+	if err := util.EnsureDynamoDBTable(ctx, noBackupsDynamoDB{cli}, "existingTest", jobs.Job{}, opts); err == nil || !strings.Contains(err.Error(), "point-in-time recovery") {
+		t.Errorf("expected existing table to fail turning on PITR, got %v", err)
+	}
+}
+
+func Test_EnsureDynamoDBTable_WaitsForActive(t *testing.T) {
+	cli := awsfake.NewDynamoDB()
+	cli.CreatingFor = 3
+
+	opts := util.DefaultTableOptions()
+	opts.Poll = time.Millisecond
+	opts.Wait = 5 * time.Second
+	if err := util.EnsureDynamoDBTable(context.Background(), cli, "jobsTest", jobs.Job{}, opts); err != nil {
+		t.Fatalf("failed to ensure table: %s", err)
+	}
+	if status := describe(t, cli, "jobsTest").TableStatus; status != types.TableStatusActive {
+		t.Errorf("expected the table to be active once ensured, got %s", status)
+	}
+
+	// never becomes active in time
+	cli.CreatingFor = 1000
+	opts.Wait = 50 * time.Millisecond
+	if err := util.EnsureDynamoDBTable(context.Background(), cli, "slowTest", jobs.Job{}, opts); err == nil {
+		t.Errorf("expected an error waiting on a table that stays CREATING")
+	}
+}
+
+// several lambdas cold starting at once; the losers of the CreateTable race shouldn't fail
+func Test_EnsureDynamoDBTable_Concurrent(t *testing.T) {
+	cli := awsfake.NewDynamoDB()
+	cli.CreatingFor = 5
+
+	opts := util.DefaultTableOptions()
+	opts.Poll = time.Millisecond
+
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = util.EnsureDynamoDBTable(context.Background(), cli, "jobsTest", jobs.Job{}, opts)
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("caller %d failed: %s", i, err)
+		}
+	}
+	if tables := cli.Tables(); len(tables) != 1 {
+		t.Errorf("expected one table, got %v", tables)
+	}
+}
+
+func Test_TableOptions_Validate(t *testing.T) {
+	testSet := []struct {
+		Name      string
+		Opts      *util.TableOptions
+		ExpectErr bool
+	}{
+		{Name: "Nil", Opts: nil},
+		{Name: "Defaults", Opts: util.DefaultTableOptions()},
+		{Name: "OnDemand", Opts: &util.TableOptions{OnDemand: true}},
+		{Name: "OnDemandWithCapacity", Opts: &util.TableOptions{OnDemand: true, ReadCapacity: 5}, ExpectErr: true},
+		{Name: "NegativeCapacity", Opts: &util.TableOptions{WriteCapacity: -1}, ExpectErr: true},
+		{Name: "KeyWithoutSSE", Opts: &util.TableOptions{SSEKMSKeyID: "alias/creds"}, ExpectErr: true},
+	}
+
+	for _, test := range testSet {
+		t.Run(test.Name, func(t *testing.T) {
+			if err := test.Opts.Validate(); (err != nil) != test.ExpectErr {
+				t.Errorf("unexpected error state: %v", err)
+			}
+		})
+	}
+
+	// and EnsureDynamoDBTable refuses to create anything with bad options
+	cli := awsfake.NewDynamoDB()
+	if err := util.EnsureDynamoDBTable(context.Background(), cli, "jobsTest", jobs.Job{}, &util.TableOptions{WriteCapacity: -1}); err == nil {
+		t.Errorf("expected bad options to be rejected")
+	}
+	if tables := cli.Tables(); len(tables) != 0 {
+		t.Errorf("expected no tables, got %v", tables)
+	}
+}
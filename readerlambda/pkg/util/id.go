@@ -0,0 +1,15 @@
+package util
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// random 128-bit hex identifier; good enough for job/record ids without pulling in a uuid package
+func NewID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err) // crypto/rand doesn't fail on any platform we deploy to
+	}
+	return hex.EncodeToString(buf)
+}
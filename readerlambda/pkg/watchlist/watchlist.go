@@ -0,0 +1,200 @@
+package watchlist
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/util"
+)
+
+const DYNDB_TABLE_WATCHLIST = `credentialWatchlist`
+
+// what a watch is on
+type Kind string
+
+const (
+	KIND_DOMAIN  Kind = "domain"
+	KIND_ADDRESS Kind = "address"
+)
+
+// someone (Owner; a tenant or team) wants to hear when Target turns up in an ingest. the same target can
+// be watched by several owners; each gets their own alerts
+type Entry struct {
+	Target    string    `json:"target" dynamodbav:"target"` // lowercased domain or address
+	Owner     string    `json:"owner" dynamodbav:"owner"`
+	Kind      Kind      `json:"kind" dynamodbav:"kind"`
+	Label     string    `json:"label,omitempty" dynamodbav:"label,omitempty"`
+	CreatedAt time.Time `json:"createdAt" dynamodbav:"createdAt"`
+}
+
+func (e Entry) GetAttrDefs() []types.AttributeDefinition {
+	return []types.AttributeDefinition{
+		{
+			AttributeName: aws.String("target"),
+			AttributeType: types.ScalarAttributeTypeS,
+		},
+		{
+			AttributeName: aws.String("owner"),
+			AttributeType: types.ScalarAttributeTypeS,
+		},
+	}
+}
+
+func (e Entry) GetKeySchema() []types.KeySchemaElement {
+	return []types.KeySchemaElement{
+		{
+			AttributeName: aws.String("target"),
+			KeyType:       types.KeyTypeHash,
+		},
+		{
+			AttributeName: aws.String("owner"),
+			KeyType:       types.KeyTypeRange,
+		},
+	}
+}
+
+// a watch on target (a domain, or an address if it has an @ in it) for owner
+func NewEntry(target, owner, label string) (*Entry, error) {
+	target = strings.ToLower(strings.TrimSpace(target))
+	owner = strings.TrimSpace(owner)
+	if owner == "" {
+		return nil, errors.New("a watch needs an owner")
+	}
+
+	kind := KIND_DOMAIN
+	if user, domain, found := strings.Cut(target, "@"); found {
+		if user == "" || domain == "" {
+			return nil, fmt.Errorf("[%s] is not an email address", target)
+		}
+		kind = KIND_ADDRESS
+	}
+	if target == "" || strings.ContainsAny(target, " \t/") {
+		return nil, fmt.Errorf("[%s] is not a domain or email address", target)
+	}
+	return &Entry{Target: target, Owner: owner, Kind: kind, Label: label, CreatedAt: time.Now().UTC()}, nil
+}
+
+// adds (or replaces) a watch
+func Save(ctx context.Context, cli util.DynamoDBAPI, tableName string, entry *Entry) error {
+	if cli == nil {
+		return errors.New("passed dynamodb client was nil")
+	}
+	item, err := attributevalue.MarshalMap(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal watch: %s", err)
+	}
+	if _, err := cli.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(tableName), Item: item}); err != nil {
+		return fmt.Errorf("failed to save watch on [%s] for [%s]: %s", entry.Target, entry.Owner, err)
+	}
+	return nil
+}
+
+// removes owner's watch on target; returns false if there wasn't one
+func Delete(ctx context.Context, cli util.DynamoDBAPI, tableName, target, owner string) (bool, error) {
+	if cli == nil {
+		return false, errors.New("passed dynamodb client was nil")
+	}
+	res, err := cli.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"target": &types.AttributeValueMemberS{Value: strings.ToLower(strings.TrimSpace(target))},
+			"owner":  &types.AttributeValueMemberS{Value: strings.TrimSpace(owner)},
+		},
+		ReturnValues: types.ReturnValueAllOld,
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to delete watch on [%s] for [%s]: %s", target, owner, err)
+	}
+	return len(res.Attributes) > 0, nil
+}
+
+// every owner's watch on target
+func ForTarget(ctx context.Context, cli util.DynamoDBAPI, tableName, target string) ([]*Entry, error) {
+	if cli == nil {
+		return nil, errors.New("passed dynamodb client was nil")
+	}
+
+	var ret []*Entry
+	paginator := dynamodb.NewQueryPaginator(cli, &dynamodb.QueryInput{
+		TableName:                 aws.String(tableName),
+		KeyConditionExpression:    aws.String("#t = :target"),
+		ExpressionAttributeNames:  map[string]string{"#t": "target"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":target": &types.AttributeValueMemberS{Value: strings.ToLower(strings.TrimSpace(target))}},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query watches on [%s]: %s", target, err)
+		}
+
+		var pageEntries []*Entry
+		if unmarshErr := attributevalue.UnmarshalListOfMaps(page.Items, &pageEntries); unmarshErr != nil {
+			return nil, fmt.Errorf("failed to unmarshal watches: %s", unmarshErr)
+		}
+		ret = append(ret, pageEntries...)
+	}
+	return ret, nil
+}
+
+// every watch; the list is small so scanning it is fine
+func List(ctx context.Context, cli util.DynamoDBAPI, tableName string) ([]*Entry, error) {
+	if cli == nil {
+		return nil, errors.New("passed dynamodb client was nil")
+	}
+
+	var ret []*Entry
+	paginator := dynamodb.NewScanPaginator(cli, &dynamodb.ScanInput{TableName: aws.String(tableName)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan watchlist: %s", err)
+		}
+
+		var pageEntries []*Entry
+		if unmarshErr := attributevalue.UnmarshalListOfMaps(page.Items, &pageEntries); unmarshErr != nil {
+			return nil, fmt.Errorf("failed to unmarshal watchlist: %s", unmarshErr)
+		}
+		ret = append(ret, pageEntries...)
+	}
+	return ret, nil
+}
+
+// the watchlist held in memory for matching credentials as they're ingested
+type Matcher struct {
+	byTarget map[string][]*Entry
+}
+
+func NewMatcher(entries []*Entry) *Matcher {
+	m := &Matcher{byTarget: map[string][]*Entry{}}
+	for _, entry := range entries {
+		m.byTarget[entry.Target] = append(m.byTarget[entry.Target], entry)
+	}
+	return m
+}
+
+// loads the whole watchlist; nil (and no error) if it's empty
+func Load(ctx context.Context, cli util.DynamoDBAPI, tableName string) (*Matcher, error) {
+	entries, err := List(ctx, cli, tableName)
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	return NewMatcher(entries), nil
+}
+
+// the watches cred falls under: those on its domain and those on its address. nil-safe
+func (m *Matcher) Match(cred *credparser.CredentialInfo) []*Entry {
+	if m == nil || cred == nil {
+		return nil
+	}
+	domain := strings.ToLower(cred.Domain)
+	ret := append([]*Entry{}, m.byTarget[domain]...)
+	return append(ret, m.byTarget[strings.ToLower(cred.User)+"@"+domain]...)
+}
@@ -0,0 +1,80 @@
+package watchlist
+
+import (
+	"context"
+	"testing"
+
+	"github.com/newodahs/readerlambda/pkg/awsfake"
+	"github.com/newodahs/readerlambda/pkg/credparser"
+	"github.com/newodahs/readerlambda/pkg/util"
+)
+
+func Test_NewEntry(t *testing.T) {
+	testSet := []struct {
+		Name      string
+		Target    string
+		Owner     string
+		Kind      Kind
+		ExpectErr bool
+	}{
+		{Name: "Domain", Target: " Example.COM ", Owner: "tenant", Kind: KIND_DOMAIN},
+		{Name: "Address", Target: "JSmith@example.com", Owner: "tenant", Kind: KIND_ADDRESS},
+		{Name: "NoOwner", Target: "example.com", ExpectErr: true},
+		{Name: "Empty", Target: " ", Owner: "tenant", ExpectErr: true},
+		{Name: "NoUser", Target: "@example.com", Owner: "tenant", ExpectErr: true},
+		{Name: "Path", Target: "example.com/x", Owner: "tenant", ExpectErr: true},
+	}
+
+	for _, test := range testSet {
+		t.Run(test.Name, func(t *testing.T) {
+			entry, err := NewEntry(test.Target, test.Owner, "")
+			if (err != nil) != test.ExpectErr {
+				t.Fatalf("unexpected error state: %v", err)
+			}
+			if err == nil && (entry.Kind != test.Kind || entry.Target == test.Target) {
+				t.Errorf("unexpected entry %+v", entry)
+			}
+		})
+	}
+}
+
+func Test_Watchlist(t *testing.T) {
+	const tableName = "watchTest"
+	ctx := context.Background()
+	cli := awsfake.NewDynamoDB()
+	if err := util.EnsureDynamoDBTable(ctx, cli, tableName, Entry{}, nil); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+
+	if none, err := Load(ctx, cli, tableName); none != nil || err != nil {
+		t.Errorf("expected nothing to match with an empty watchlist, got %v (%v)", none, err)
+	}
+
+	for _, watch := range [][2]string{{"example.com", "tenant-a"}, {"example.com", "tenant-b"}, {"boss@other.com", "tenant-a"}} {
+		entry, _ := NewEntry(watch[0], watch[1], "")
+		if err := Save(ctx, cli, tableName, entry); err != nil {
+			t.Fatalf("failed to save: %s", err)
+		}
+	}
+
+	matcher, err := Load(ctx, cli, tableName)
+	if err != nil {
+		t.Fatalf("failed to load: %s", err)
+	}
+	for ident, expect := range map[[2]string]int{{"EXAMPLE.com", "anyone"}: 2, {"other.com", "Boss"}: 1, {"other.com", "worker"}: 0} {
+		cred := &credparser.CredentialInfo{Domain: ident[0], User: ident[1]}
+		if got := len(matcher.Match(cred)); got != expect {
+			t.Errorf("expected %d matches for %v, got %d", expect, ident, got)
+		}
+	}
+
+	if found, err := Delete(ctx, cli, tableName, "Example.com", "tenant-b"); err != nil || !found {
+		t.Errorf("expected the watch to be deleted, got %t (%v)", found, err)
+	}
+	if found, _ := Delete(ctx, cli, tableName, "example.com", "tenant-b"); found {
+		t.Errorf("expected nothing left to delete")
+	}
+	if entries, _ := List(ctx, cli, tableName); len(entries) != 2 {
+		t.Errorf("expected 2 watches left, got %d", len(entries))
+	}
+}
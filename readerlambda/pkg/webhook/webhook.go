@@ -0,0 +1,437 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/newodahs/readerlambda/pkg/alerts"
+	"github.com/newodahs/readerlambda/pkg/util"
+)
+
+const DYNDB_TABLE_DELIVERIES = `webhookDeliveries`
+
+// the table's TTL attribute; only set on delivered items (see DELIVERED_RETENTION)
+const ATTR_EXPIRES_AT = "expiresAt"
+
+// what a webhook is about
+type Event string
+
+const (
+	EVENT_ALERT         Event = "alert"
+	EVENT_JOB_COMPLETED Event = "job.completed"
+)
+
+// headers on every request; receivers should check the signature (see Verify) and ignore ids they've
+// already seen, as a delivery can arrive more than once
+const (
+	HEADER_ID        = "X-Webhook-Id"
+	HEADER_EVENT     = "X-Webhook-Event"
+	HEADER_TIMESTAMP = "X-Webhook-Timestamp" // unix seconds
+	HEADER_SIGNATURE = "X-Webhook-Signature" // sha256=<hex HMAC-SHA256 of "<timestamp>.<body>">
+)
+
+const (
+	DEFAULT_MAX_ATTEMPTS = 8
+	DEFAULT_BASE_DELAY   = 30 * time.Second // doubled after each failed attempt
+	DEFAULT_MAX_DELAY    = time.Hour
+	DEFAULT_TIMEOUT      = 10 * time.Second
+
+	DELIVERED_RETENTION = 30 * 24 * time.Hour // delivered records are kept this long, then left to TTL
+	MIN_SECRET_LEN      = 16
+)
+
+type Status string
+
+const (
+	STATUS_PENDING   Status = "pending"   // waiting to be sent, or for a retry
+	STATUS_DELIVERED Status = "delivered" // the receiver took it (2xx)
+	STATUS_FAILED    Status = "failed"    // gave up; see the admin routes for redelivering it
+)
+
+// one webhook and how delivering it has gone; the body is fixed when it's created so every attempt sends
+// the same thing (only the timestamp and signature change)
+type Delivery struct {
+	ID          string     `json:"id" dynamodbav:"deliveryId"` // also the idempotency id
+	Event       Event      `json:"event" dynamodbav:"event"`
+	URL         string     `json:"url" dynamodbav:"url"`
+	Body        string     `json:"-" dynamodbav:"body"`
+	Status      Status     `json:"status" dynamodbav:"status"`
+	Attempts    int        `json:"attempts" dynamodbav:"attempts"`
+	LastError   string     `json:"lastError,omitempty" dynamodbav:"lastError,omitempty"`
+	NextAttempt *time.Time `json:"nextAttempt,omitempty" dynamodbav:"nextAttempt,omitempty,unixtime"`
+	CreatedAt   time.Time  `json:"createdAt" dynamodbav:"createdAt"`
+	DeliveredAt *time.Time `json:"deliveredAt,omitempty" dynamodbav:"deliveredAt,omitempty"`
+	ExpiresAt   *time.Time `json:"-" dynamodbav:"expiresAt,omitempty,unixtime"`
+}
+
+func (d Delivery) GetAttrDefs() []types.AttributeDefinition {
+	return []types.AttributeDefinition{
+		{
+			AttributeName: aws.String("deliveryId"),
+			AttributeType: types.ScalarAttributeTypeS,
+		},
+	}
+}
+
+func (d Delivery) GetKeySchema() []types.KeySchemaElement {
+	return []types.KeySchemaElement{
+		{
+			AttributeName: aws.String("deliveryId"),
+			KeyType:       types.KeyTypeHash,
+		},
+	}
+}
+
+// what's POSTed
+type Payload struct {
+	ID        string          `json:"id"`
+	Event     Event           `json:"event"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// the signature header value for body sent at timestamp
+func Sign(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// checks a received webhook: the signature has to match and the timestamp be within tolerance of now
+// (so a captured request can't be replayed later)
+func Verify(secret []byte, header http.Header, body []byte, now time.Time, tolerance time.Duration) error {
+	timestamp, err := strconv.ParseInt(header.Get(HEADER_TIMESTAMP), 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad %s header: %s", HEADER_TIMESTAMP, err)
+	}
+	if skew := now.Sub(time.Unix(timestamp, 0)); skew > tolerance || skew < -tolerance {
+		return fmt.Errorf("webhook timestamp is %s off", skew)
+	}
+	if !hmac.Equal([]byte(header.Get(HEADER_SIGNATURE)), []byte(Sign(secret, timestamp, body))) {
+		return errors.New("webhook signature doesn't match")
+	}
+	return nil
+}
+
+// sends signed webhooks to one URL: each is queued in the deliveries table (see Enqueue), and Retry sends
+// what's due, retrying the ones that fail with exponential backoff. nil-safe: a nil sender sends nothing
+type Sender struct {
+	DynDBCli    util.DynamoDBAPI
+	Table       string
+	URL         string
+	Secret      []byte
+	Client      *http.Client     // nil for one with DEFAULT_TIMEOUT
+	MaxAttempts int              // including the first
+	BaseDelay   time.Duration    // before the first retry; doubles each time after
+	MaxDelay    time.Duration    // longest wait between attempts
+	Now         func() time.Time // nil for time.Now
+}
+
+func NewSender(cli util.DynamoDBAPI, table, url string, secret []byte) *Sender {
+	return &Sender{
+		DynDBCli:    cli,
+		Table:       table,
+		URL:         url,
+		Secret:      secret,
+		Client:      &http.Client{Timeout: DEFAULT_TIMEOUT},
+		MaxAttempts: DEFAULT_MAX_ATTEMPTS,
+		BaseDelay:   DEFAULT_BASE_DELAY,
+		MaxDelay:    DEFAULT_MAX_DELAY,
+	}
+}
+
+func (s *Sender) now() time.Time {
+	if s.Now != nil {
+		return s.Now().UTC()
+	}
+	return time.Now().UTC()
+}
+
+// queues data as event: it's recorded as pending and due straight away, and the next Retry sends it. an
+// error means it couldn't be recorded, so won't be sent at all
+func (s *Sender) Enqueue(ctx context.Context, event Event, data any) (*Delivery, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s webhook: %s", event, err)
+	}
+	now := s.now()
+	d := &Delivery{ID: util.NewID(), Event: event, URL: s.URL, Status: STATUS_PENDING, CreatedAt: now, NextAttempt: &now}
+	body, err := json.Marshal(Payload{ID: d.ID, Event: event, CreatedAt: d.CreatedAt, Data: raw})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s webhook: %s", event, err)
+	}
+	d.Body = string(body)
+
+	if err := s.save(ctx, d, nil); err != nil {
+		return nil, fmt.Errorf("failed to queue %s webhook: %s", event, err)
+	}
+	return d, nil
+}
+
+// queues alerts as webhooks; see Enqueue
+func (s *Sender) Notify(ctx context.Context, alert *alerts.Alert) error {
+	_, err := s.Enqueue(ctx, EVENT_ALERT, alert)
+	return err
+}
+
+// makes one attempt and updates d to match; with retry a failure is scheduled for another go (until
+// MaxAttempts), without it it's failed straight away
+func (s *Sender) attempt(ctx context.Context, d *Delivery, retry bool) {
+	d.Attempts++
+	now := s.now()
+	err := s.post(ctx, d, now)
+	if err == nil {
+		d.Status, d.LastError, d.NextAttempt = STATUS_DELIVERED, "", nil
+		expires := now.Add(DELIVERED_RETENTION)
+		d.DeliveredAt, d.ExpiresAt = &now, &expires
+		return
+	}
+
+	d.LastError = err.Error()
+	maxAttempts := s.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DEFAULT_MAX_ATTEMPTS
+	}
+	if !retry || d.Attempts >= maxAttempts {
+		d.Status, d.NextAttempt = STATUS_FAILED, nil
+		return
+	}
+	next := now.Add(s.backoff(d.Attempts))
+	d.Status, d.NextAttempt = STATUS_PENDING, &next
+}
+
+// how long to wait after the given number of failed attempts
+func (s *Sender) backoff(attempts int) time.Duration {
+	base, maxDelay := s.BaseDelay, s.MaxDelay
+	if base <= 0 {
+		base = DEFAULT_BASE_DELAY
+	}
+	if maxDelay <= 0 {
+		maxDelay = DEFAULT_MAX_DELAY
+	}
+	delay := base
+	for i := 1; i < attempts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxDelay)
+}
+
+func (s *Sender) post(ctx context.Context, d *Delivery, now time.Time) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, strings.NewReader(d.Body))
+	if err != nil {
+		return fmt.Errorf("failed to build webhook request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HEADER_ID, d.ID)
+	req.Header.Set(HEADER_EVENT, string(d.Event))
+	req.Header.Set(HEADER_TIMESTAMP, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(HEADER_SIGNATURE, Sign(s.Secret, now.Unix(), []byte(d.Body)))
+
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: DEFAULT_TIMEOUT}
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to deliver: %s", err)
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body) // so the connection can be reused
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("receiver answered %s", res.Status)
+	}
+	return nil
+}
+
+// writes d; with prevAttempts only if nobody else has made an attempt since we read it
+func (s *Sender) save(ctx context.Context, d *Delivery, prevAttempts *int) error {
+	if s.DynDBCli == nil {
+		return errors.New("passed dynamodb client was nil")
+	}
+	item, err := attributevalue.MarshalMap(d)
+	if err != nil {
+		return fmt.Errorf("failed to marshal delivery: %s", err)
+	}
+	input := &dynamodb.PutItemInput{TableName: aws.String(s.Table), Item: item}
+	if prevAttempts != nil {
+		input.ConditionExpression = aws.String("#a = :a")
+		input.ExpressionAttributeNames = map[string]string{"#a": "attempts"}
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{":a": &types.AttributeValueMemberN{Value: strconv.Itoa(*prevAttempts)}}
+	}
+	if _, err := s.DynDBCli.PutItem(ctx, input); err != nil {
+		return fmt.Errorf("failed to save delivery [%s]: %w", d.ID, err)
+	}
+	return nil
+}
+
+// what a retry run did
+type RetryStats struct {
+	Due       int `json:"due"`
+	Delivered int `json:"delivered"`
+	Pending   int `json:"pending"` // failed again; scheduled for another go
+	Failed    int `json:"failed"`  // failed for the last time
+	Skipped   int `json:"skipped"` // another run got to it first, or it couldn't be saved
+}
+
+// sends every pending delivery that's due, new ones (see Enqueue) and retries alike; stops early (returning what it got through and ctx's error)
+// if ctx is done
+func (s *Sender) Retry(ctx context.Context) (RetryStats, error) {
+	var stats RetryStats
+	if s == nil {
+		return stats, nil
+	}
+	if s.DynDBCli == nil {
+		return stats, errors.New("passed dynamodb client was nil")
+	}
+
+	paginator := dynamodb.NewScanPaginator(s.DynDBCli, &dynamodb.ScanInput{
+		TableName:                aws.String(s.Table),
+		FilterExpression:         aws.String("#s = :pending AND #n <= :now"),
+		ExpressionAttributeNames: map[string]string{"#s": "status", "#n": "nextAttempt"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pending": &types.AttributeValueMemberS{Value: string(STATUS_PENDING)},
+			":now":     &types.AttributeValueMemberN{Value: strconv.FormatInt(s.now().Unix(), 10)},
+		},
+	})
+	for paginator.HasMorePages() {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return stats, fmt.Errorf("failed to scan deliveries: %s", err)
+		}
+
+		for _, item := range page.Items {
+			d := &Delivery{}
+			if err := attributevalue.UnmarshalMap(item, d); err != nil {
+				log.Printf("WARNING: failed to unmarshal delivery: %s", err)
+				stats.Skipped++
+				continue
+			}
+			stats.Due++
+
+			prev := d.Attempts
+			s.attempt(ctx, d, true)
+			if err := s.save(ctx, d, &prev); err != nil {
+				var condFailed *types.ConditionalCheckFailedException
+				if !errors.As(err, &condFailed) {
+					log.Printf("WARNING: %s", err)
+				}
+				stats.Skipped++
+				continue
+			}
+			switch d.Status {
+			case STATUS_DELIVERED:
+				stats.Delivered++
+			case STATUS_PENDING:
+				stats.Pending++
+			default:
+				stats.Failed++
+			}
+		}
+	}
+	return stats, nil
+}
+
+// sends a delivery again now, whatever its status, to the URL it was first sent to; one attempt, and if
+// that fails it's marked failed again rather than going back into the retry schedule. nil (and no error)
+// if there's no such delivery
+func (s *Sender) Redeliver(ctx context.Context, id string) (*Delivery, error) {
+	if s == nil {
+		return nil, errors.New("webhooks aren't configured")
+	}
+	d, err := Get(ctx, s.DynDBCli, s.Table, id)
+	if err != nil || d == nil {
+		return nil, err
+	}
+	prev := d.Attempts
+	s.attempt(ctx, d, false)
+	if err := s.save(ctx, d, &prev); err != nil {
+		return d, err
+	}
+	return d, nil
+}
+
+// a single delivery; nil (and no error) if there isn't one
+func Get(ctx context.Context, cli util.DynamoDBAPI, tableName, id string) (*Delivery, error) {
+	if cli == nil {
+		return nil, errors.New("passed dynamodb client was nil")
+	}
+	res, err := cli.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key:       map[string]types.AttributeValue{"deliveryId": &types.AttributeValueMemberS{Value: id}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get delivery [%s]: %s", id, err)
+	}
+	if len(res.Item) == 0 {
+		return nil, nil
+	}
+	d := &Delivery{}
+	if err := attributevalue.UnmarshalMap(res.Item, d); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal delivery [%s]: %s", id, err)
+	}
+	return d, nil
+}
+
+// deliveries with status, newest first; failed and pending ones are few, so scanning for them is fine
+func List(ctx context.Context, cli util.DynamoDBAPI, tableName string, status Status) ([]*Delivery, error) {
+	if cli == nil {
+		return nil, errors.New("passed dynamodb client was nil")
+	}
+
+	var ret []*Delivery
+	paginator := dynamodb.NewScanPaginator(cli, &dynamodb.ScanInput{
+		TableName:                 aws.String(tableName),
+		FilterExpression:          aws.String("#s = :s"),
+		ExpressionAttributeNames:  map[string]string{"#s": "status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":s": &types.AttributeValueMemberS{Value: string(status)}},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan deliveries: %s", err)
+		}
+		var pageDeliveries []*Delivery
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &pageDeliveries); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal deliveries: %s", err)
+		}
+		ret = append(ret, pageDeliveries...)
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].CreatedAt.After(ret[j].CreatedAt) })
+	return ret, nil
+}
+
+// reads a payload back out of a request body
+func ReadPayload(body []byte) (*Payload, error) {
+	p := &Payload{}
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(p); err != nil {
+		return nil, fmt.Errorf("failed to decode webhook payload: %s", err)
+	}
+	return p, nil
+}
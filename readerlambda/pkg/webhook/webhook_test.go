@@ -0,0 +1,191 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/newodahs/readerlambda/pkg/alerts"
+	"github.com/newodahs/readerlambda/pkg/awsfake"
+	"github.com/newodahs/readerlambda/pkg/util"
+)
+
+const testSecret = "0123456789abcdef0123"
+
+// a local receiver that checks signatures and answers with whatever status is set
+type receiver struct {
+	mu       sync.Mutex
+	status   int
+	received []*Payload
+	ids      []string
+	badSigs  int
+	now      func() time.Time
+}
+
+func (rcv *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+
+	body, _ := io.ReadAll(r.Body)
+	if err := Verify([]byte(testSecret), r.Header, body, rcv.now(), 5*time.Minute); err != nil {
+		rcv.badSigs++
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if rcv.status != http.StatusOK {
+		w.WriteHeader(rcv.status)
+		return
+	}
+	payload, err := ReadPayload(body)
+	if err != nil || payload.ID != r.Header.Get(HEADER_ID) || string(payload.Event) != r.Header.Get(HEADER_EVENT) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rcv.received = append(rcv.received, payload)
+	rcv.ids = append(rcv.ids, r.Header.Get(HEADER_ID))
+}
+
+func (rcv *receiver) setStatus(status int) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	rcv.status = status
+}
+
+func Test_Verify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"id":"x"}`)
+	header := http.Header{}
+	header.Set(HEADER_TIMESTAMP, "1700000000")
+	header.Set(HEADER_SIGNATURE, Sign([]byte(testSecret), now.Unix(), body))
+
+	testSet := []struct {
+		Name      string
+		Secret    string
+		Body      string
+		Now       time.Time
+		ExpectErr bool
+	}{
+		{Name: "Good", Secret: testSecret, Body: string(body), Now: now},
+		{Name: "WrongSecret", Secret: "not the secret at all", Body: string(body), Now: now, ExpectErr: true},
+		{Name: "Tampered", Secret: testSecret, Body: `{"id":"y"}`, Now: now, ExpectErr: true},
+		{Name: "Stale", Secret: testSecret, Body: string(body), Now: now.Add(time.Hour), ExpectErr: true},
+	}
+
+	for _, test := range testSet {
+		t.Run(test.Name, func(t *testing.T) {
+			err := Verify([]byte(test.Secret), header, []byte(test.Body), test.Now, 5*time.Minute)
+			if (err != nil) != test.ExpectErr {
+				t.Errorf("unexpected error state: %v", err)
+			}
+		})
+	}
+}
+
+func Test_Sender(t *testing.T) {
+	const tableName = "deliveryTest"
+	ctx := context.Background()
+	cli := awsfake.NewDynamoDB()
+	if err := util.EnsureDynamoDBTable(ctx, cli, tableName, Delivery{}, util.DefaultTableOptions().WithTTL(ATTR_EXPIRES_AT)); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+
+	clock := time.Now().UTC()
+	now := func() time.Time { return clock }
+	rcv := &receiver{status: http.StatusOK, now: now}
+	srv := httptest.NewServer(rcv)
+	defer srv.Close()
+
+	sender := NewSender(cli, tableName, srv.URL, []byte(testSecret))
+	sender.Now, sender.MaxAttempts, sender.BaseDelay, sender.MaxDelay = now, 4, time.Minute, 3*time.Minute
+
+	// queued, then delivered by the next retry run
+	alert := alerts.New(alerts.ALERT_KIND_WATCHLIST)
+	alert.Email = "j****h@example.com"
+	if err := sender.Notify(ctx, alert); err != nil {
+		t.Fatalf("failed to queue: %s", err)
+	}
+	if len(rcv.received) != 0 {
+		t.Fatalf("expected nothing sent before a retry run, got %+v", rcv.received)
+	}
+	if pending, _ := List(ctx, cli, tableName, STATUS_PENDING); len(pending) != 1 || pending[0].Attempts != 0 {
+		t.Fatalf("expected the alert to be queued, got %+v", pending)
+	}
+	if stats, err := sender.Retry(ctx); err != nil || stats.Due != 1 || stats.Delivered != 1 {
+		t.Fatalf("expected the queued alert to be delivered, got %+v (%v)", stats, err)
+	}
+	if len(rcv.received) != 1 || rcv.received[0].Event != EVENT_ALERT {
+		t.Fatalf("expected the alert to be received, got %+v", rcv.received)
+	}
+	got := &alerts.Alert{}
+	if err := json.Unmarshal(rcv.received[0].Data, got); err != nil || got.ID != alert.ID {
+		t.Errorf("expected the alert as the payload's data, got %+v (%v)", got, err)
+	}
+
+	// refused, then retried with backoff until it's given up on
+	rcv.setStatus(http.StatusServiceUnavailable)
+	d, err := sender.Enqueue(ctx, EVENT_JOB_COMPLETED, map[string]string{"jobId": "abc"})
+	if err != nil {
+		t.Fatalf("failed to queue: %s", err)
+	}
+	if stats, _ := sender.Retry(ctx); stats.Pending != 1 {
+		t.Fatalf("expected the refused delivery to be rescheduled, got %+v", stats)
+	}
+	if d, _ = Get(ctx, cli, tableName, d.ID); d == nil || d.Status != STATUS_PENDING || d.NextAttempt == nil || d.NextAttempt.Unix() != clock.Add(time.Minute).Unix() {
+		t.Fatalf("expected a retry in a minute, got %+v", d)
+	}
+
+	if stats, _ := sender.Retry(ctx); stats.Due != 0 {
+		t.Errorf("expected nothing due yet, got %+v", stats)
+	}
+	for attempt, wait := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		clock = clock.Add(wait)
+		stats, err := sender.Retry(ctx)
+		if err != nil || stats.Due != 1 {
+			t.Fatalf("expected a retry after %s, got %+v (%v)", wait, stats, err)
+		}
+		if last := attempt == 2; (last && stats.Failed != 1) || (!last && stats.Pending != 1) {
+			t.Errorf("unexpected retry stats on attempt %d: %+v", attempt+2, stats)
+		}
+	}
+	clock = clock.Add(time.Hour)
+	if stats, _ := sender.Retry(ctx); stats.Due != 0 {
+		t.Errorf("expected nothing left to retry, got %+v", stats)
+	}
+
+	failed, err := List(ctx, cli, tableName, STATUS_FAILED)
+	if err != nil || len(failed) != 1 || failed[0].ID != d.ID || failed[0].Attempts != 4 || failed[0].LastError == "" {
+		t.Fatalf("expected the job delivery to have failed after 4 attempts, got %+v (%v)", failed, err)
+	}
+
+	// redelivered by hand once the receiver is back, under the same id
+	rcv.setStatus(http.StatusOK)
+	redelivered, err := sender.Redeliver(ctx, d.ID)
+	if err != nil || redelivered.Status != STATUS_DELIVERED || redelivered.ExpiresAt == nil {
+		t.Fatalf("expected the redelivery to succeed, got %+v (%v)", redelivered, err)
+	}
+	if rcv.ids[len(rcv.ids)-1] != d.ID {
+		t.Errorf("expected the redelivery to keep its id")
+	}
+	if missing, err := sender.Redeliver(ctx, "nope"); missing != nil || err != nil {
+		t.Errorf("expected nothing for a missing delivery, got %+v (%v)", missing, err)
+	}
+	if failed, _ := List(ctx, cli, tableName, STATUS_FAILED); len(failed) != 0 {
+		t.Errorf("expected no failed deliveries left, got %d", len(failed))
+	}
+	if delivered, _ := List(ctx, cli, tableName, STATUS_DELIVERED); len(delivered) != 2 {
+		t.Errorf("expected 2 delivered, got %d", len(delivered))
+	}
+	if rcv.badSigs != 0 {
+		t.Errorf("expected every request to be signed properly, %d weren't", rcv.badSigs)
+	}
+
+	var nilSender *Sender
+	if d, err := nilSender.Enqueue(ctx, EVENT_ALERT, alert); d != nil || err != nil {
+		t.Errorf("expected a nil sender to send nothing")
+	}
+}